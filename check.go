@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/niftynei/glightning/glightning"
+	"github.com/niftynei/glightning/jrpc2"
+	"github.com/rsbondi/multifund/funder"
+)
+
+const FundCheckDescription = `Run the pre-flight checks of fund_multi and withdraw_multi without touching any peer
+{channels} is the fund_multi channel array, {destinations} the withdraw_multi destination array, either may be empty
+set {connect} when the channels are for connect_fund_multi, so peers need not be connected yet
+every problem found is listed with the index of the channel or destination, -1 for the whole batch`
+
+type MultiFundCheck struct {
+	Channels     []ChannelRequest       `json:"channels,omitempty"`
+	Destinations []MultiWithdrawRequest `json:"destinations,omitempty"`
+	Connect      bool                   `json:"connect,omitempty"`
+}
+
+type CheckResult struct {
+	Ok       bool              `json:"ok"`
+	Channels []*funder.Problem `json:"channels"`
+	Withdraw []*funder.Problem `json:"destinations"`
+}
+
+func (m *MultiFundCheck) Call() (jrpc2.Result, error) {
+	result := &CheckResult{Channels: make([]*funder.Problem, 0), Withdraw: make([]*funder.Problem, 0)}
+
+	if len(m.Channels) > 0 {
+		chans := make([]glightning.FundChannelStart, 0)
+		options := make(map[string]*funder.ChannelOptions)
+		for i, c := range m.Channels {
+			chans = append(chans, c.FundChannelStart)
+			options[c.Id] = &m.Channels[i].ChannelOptions
+		}
+		problems, err := checkProblems(fundr.PreflightFund(chans, options, !m.Connect))
+		if err != nil {
+			return nil, err
+		}
+		result.Channels = problems
+	}
+
+	if len(m.Destinations) > 0 {
+		problems, err := checkProblems(fundr.PreflightWithdraw(withdrawRecipients(&m.Destinations)))
+		if err != nil {
+			return nil, err
+		}
+		result.Withdraw = problems
+	}
+
+	result.Ok = len(result.Channels) == 0 && len(result.Withdraw) == 0
+	return result, nil
+}
+
+// checkProblems separates failed checks from errors running them
+func checkProblems(err error) ([]*funder.Problem, error) {
+	if err == nil {
+		return make([]*funder.Problem, 0), nil
+	}
+	if pf, ok := err.(*funder.PreflightError); ok {
+		return pf.Problems, nil
+	}
+	return nil, err
+}
+
+func (m *MultiFundCheck) Name() string {
+	return "multifund_check"
+}
+
+func (m *MultiFundCheck) New() interface{} {
+	return &MultiFundCheck{}
+}
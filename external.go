@@ -2,25 +2,58 @@ package main
 
 import (
 	"bytes"
-	"encoding/hex"
-	"log"
+	"errors"
+	"fmt"
 
+	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcutil"
 	"github.com/niftynei/glightning/glightning"
 	"github.com/niftynei/glightning/jrpc2"
+	"github.com/rsbondi/multifund/funder"
+	"github.com/rsbondi/multifund/logger"
 	"github.com/rsbondi/multifund/wallet"
 )
 
 const FundExternalDescription = `Use external wallet funding feature to provide addresses for external device for creating channels to fund multiple channels
-{channels} is an array of object{"id" string, "satoshi" int, "announce" bool}`
+{channels} is an array of object{"id" string, "satoshi" int, "announce" bool}
+{inputs} optional array of "txid:vout" the transaction will spend, fund_multi_complete rejects a transaction spending anything else`
 
 type MultiChannelExternal struct {
 	Channels []glightning.FundChannelStart `json:"channels"`
+	Inputs   []string                      `json:"inputs,omitempty"`
 }
 
 func (m *MultiChannelExternal) Call() (jrpc2.Result, error) {
-	return createMultiExt(&m.Channels)
+	if len(outputs) > 0 {
+		return nil, errors.New("channels are already waiting for a transaction, complete them with fund_multi_complete or cancel them with fund_multi_start_cancel")
+	}
+	inputs, err := parseInputs(m.Inputs)
+	if err != nil {
+		return nil, err
+	}
+	result, err := createMultiExt(&m.Channels)
+	if err != nil {
+		return nil, err
+	}
+	expectedInputs = inputs
+	return result, nil
+}
+
+// parseInputs reads txid:vout outpoints, nil when none are given so any input is accepted
+func parseInputs(inputs []string) ([]wire.OutPoint, error) {
+	if len(inputs) == 0 {
+		return nil, nil
+	}
+	points := make([]wire.OutPoint, 0)
+	for _, in := range inputs {
+		op, err := funder.ParseOutPoint(in)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, *op)
+	}
+	return points, nil
 }
 
 func (m *MultiChannelExternal) Name() string {
@@ -31,7 +64,12 @@ func (m *MultiChannelExternal) New() interface{} {
 	return &MultiChannelExternal{}
 }
 
-const FundExternalCompleteDescription = `Complete a request started with fund_multi_start by providing an externally created transaction`
+const FundExternalCompleteDescription = `Complete a request started with fund_multi_start by providing an externally created transaction
+{tx} is the signed transaction hex, it must be final, standard, fully signed and pay a fee rate between 1 sat/vbyte
+and 10 times the current estimate, checked with testmempoolaccept when bitcoind is available, otherwise against
+the spent outputs from the chain backend, the channels are left pending when it is rejected so a corrected
+transaction can be provided, they are cancelled only when fundchannel_complete or the broadcast fails,
+once completed or cancelled they must be started again with fund_multi_start`
 
 type MultiChannelExternalComplete struct {
 	Tx string `json:"tx"`
@@ -49,29 +87,90 @@ func (m *MultiChannelExternalComplete) New() interface{} {
 	return &MultiChannelExternalComplete{}
 }
 
-var outputs map[string]*wallet.Outputs
+type MultiChannelExternalCancel struct{}
+
+func (m *MultiChannelExternalCancel) Call() (jrpc2.Result, error) {
+	if len(outputs) == 0 {
+		return nil, errors.New("no channels are waiting for a transaction")
+	}
+	peers := make([]string, 0)
+	for _, o := range outputs {
+		peers = append(peers, o.Peer)
+	}
+	cancelMultiExt(outputs, nil)
+	clearExternal()
+	return struct {
+		Cancelled []string `json:"cancelled"`
+	}{peers}, nil
+}
+
+func (m *MultiChannelExternalCancel) Name() string {
+	return "fund_multi_start_cancel"
+}
+
+func (m *MultiChannelExternalCancel) New() interface{} {
+	return &MultiChannelExternalCancel{}
+}
+
+var outputs wallet.ChannelOutputs
+
+// inputs fund_multi_start was told the transaction will spend
+var expectedInputs []wire.OutPoint
+
+// clearExternal forgets the channels of fund_multi_start once they are completed or cancelled
+func clearExternal() {
+	outputs = nil
+	expectedInputs = nil
+}
 
 func completeMultiExt(raw string) (jrpc2.Result, error) {
-	b, err := hex.DecodeString(raw)
+	if len(outputs) == 0 {
+		return nil, errors.New("no channels are waiting for a transaction, start them with fund_multi_start")
+	}
+	wtx, err := funder.DecodeTx(raw)
+	if err != nil {
+		return nil, err
+	}
+	fee, err := fundr.ValidateTx(wtx)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	wtx.Serialize(&buf)
 	tx := wallet.Transaction{
-		Signed: b,
+		TxId:   wtx.TxHash().String(),
+		Signed: buf.Bytes(),
+	}
+	in := fee
+	for _, out := range wtx.TxOut {
+		if in, err = in.Add(wallet.Amount(out.Value)); err != nil {
+			return nil, err
+		}
+	}
+	if err := fundr.GuardTx(tx, in); err != nil {
+		return nil, err
+	}
+	// a transaction that does not fit the channels leaves them waiting for a corrected one
+	if _, err := funder.MatchOutputs(wtx, outputs, expectedInputs); err != nil {
+		return nil, err
 	}
-	wtx := wire.NewMsgTx(2)
-	r := bytes.NewReader(tx.Signed)
-	wtx.Deserialize(r)
-	tx.TxId = wtx.TxHash().String()
 
-	channels, err := fundr.CompleteChannels(tx, outputs)
+	channels, err := fundr.CompleteChannels(tx, outputs, expectedInputs)
 	if err != nil {
-		cancelMultiExt(outputs)
+		cancelMultiExt(outputs, nil)
+		clearExternal()
 		return nil, err
 	}
 
-	txid, err := fundr.Bitcoin.SendTx(tx.String())
+	txid, err := fundr.Broadcast(tx, in)
 	if err != nil {
-		cancelMultiExt(outputs)
+		cancelMultiExt(outputs, nil)
+		clearExternal()
 		return nil, err
 	}
+	fundr.RecordBatch(txid, tx.String(), funder.OutputChannels(outputs, channels), fee, nil)
+	fundr.RecordHistory(funder.HISTORY_EXTERNAL, tx.String(), nil, funder.OutputPeers(outputs), channels, nil, nil)
+	clearExternal()
 
 	return struct {
 		Tx       string   `json:"tx"`
@@ -85,22 +184,43 @@ func completeMultiExt(raw string) (jrpc2.Result, error) {
 }
 
 func createMultiExt(chans *[]glightning.FundChannelStart) (jrpc2.Result, error) {
-	outputs = make(map[string]*wallet.Outputs, 0)
+	if err := fundr.PreflightExternal(*chans, nil); err != nil {
+		return nil, err
+	}
+	outputs = make(wallet.ChannelOutputs, 0)
 	addresses := make([]string, 0)
 
 	for i, c := range *chans {
 		result, err := fundr.Lightning.StartFundChannel(c.Id, c.Amount, c.Announce, nil)
 		if err != nil {
-			log.Printf("fund start error: %s", err.Error())
+			logger.Warnf("fund start error: %s", err.Error())
+			cancelMultiExt(outputs, nil)
+			clearExternal()
 			return nil, err
 		}
-		addr, err := btcutil.DecodeAddress(result, fundr.BitcoinNet)
-		addr.ScriptAddress()
-
-		amt := int64(c.Amount) // difference in wire and glightning
-		outputs[c.Id] = &wallet.Outputs{Vout: uint16(i), Amount: amt, Script: addr.ScriptAddress()}
+		amt := wallet.Amount(c.Amount)
+		script, err := fundingScript(result)
+		if err != nil {
+			logger.Warnf("fund start address error: %s", err.Error())
+			cancelMultiExt(append(outputs, &wallet.Outputs{Peer: c.Id}), nil)
+			clearExternal()
+			return nil, err
+		}
+		outputs = append(outputs, &wallet.Outputs{Peer: c.Id, Vout: uint16(i), Amount: amt, Script: script})
 		addresses = append(addresses, result)
 	}
 
 	return addresses, nil
 }
+
+// fundingScript is the output script paying the address from fundchannel_start
+func fundingScript(address string) ([]byte, error) {
+	addr, err := btcutil.DecodeAddress(address, fundr.BitcoinNet)
+	if err != nil {
+		return nil, err
+	}
+	if !addr.IsForNet(fundr.BitcoinNet) {
+		return nil, fmt.Errorf("%s is not a %s address", address, fundr.BitcoinNet.Name)
+	}
+	return txscript.PayToAddrScript(addr)
+}
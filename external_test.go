@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/niftynei/glightning/glightning"
+	"github.com/rsbondi/multifund/funder"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+// startExternal runs fund_multi_start for peer1 and peer2 expecting the transaction to spend the first utxo
+func startExternal(t *testing.T, b *fakeBitcoind) []string {
+	req := &MultiChannelExternal{
+		Channels: []glightning.FundChannelStart{{Id: "peer1", Amount: 100000}, {Id: "peer2", Amount: 100000}},
+		Inputs:   []string{b.utxos[0].OutPoint.String()},
+	}
+	result, err := req.Call()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result.([]string)
+}
+
+// externalTx is what an external wallet would build, spending op to 100000 for each address
+//   with the rest less the fee back to the wallet
+func externalTx(b *fakeBitcoind, op wire.OutPoint, addresses []string, fee wallet.Amount) *wire.MsgTx {
+	wtx := wire.NewMsgTx(2)
+	wtx.AddTxIn(wire.NewTxIn(&op, nil, nil))
+	change := b.prevouts[op].Value - fee.Int64()
+	for _, a := range addresses {
+		addr, _ := btcutil.DecodeAddress(a, testNet)
+		script, _ := txscript.PayToAddrScript(addr)
+		wtx.AddTxOut(wire.NewTxOut(100000, script))
+		change -= 100000
+	}
+	wtx.AddTxOut(wire.NewTxOut(change, b.script()))
+	b.signTx(wtx)
+	return wtx
+}
+
+func rawTx(wtx *wire.MsgTx) string {
+	var buf bytes.Buffer
+	wtx.Serialize(&buf)
+	return hex.EncodeToString(buf.Bytes())
+}
+
+func TestFundExternal(t *testing.T) {
+	l, b := setup(t, []wallet.Amount{1000000, 500000}, "peer1", "peer2")
+	addresses := startExternal(t, b)
+	wtx := externalTx(b, b.utxos[0].OutPoint, addresses, 1000)
+
+	if _, err := (&MultiChannelExternalComplete{Tx: rawTx(wtx)}).Call(); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.broadcast) != 1 || b.broadcast[0] != rawTx(wtx) {
+		t.Fatalf("the external transaction should be broadcast as given, have %d", len(b.broadcast))
+	}
+	txid := wtx.TxHash().String()
+	for _, peer := range []string{"peer1", "peer2"} {
+		if l.completed[peer] != txid {
+			t.Errorf("%s should be completed with %s, have %s", peer, txid, l.completed[peer])
+		}
+	}
+	batches, _ := fundr.Batches()
+	if batch := batches.Get(txid); batch == nil || batch.Fee != 1000 {
+		t.Errorf("want batch recorded with a fee of 1000, have %+v", batch)
+	}
+
+	// the channels are done, the same transaction is not sent again
+	if _, err := (&MultiChannelExternalComplete{Tx: rawTx(wtx)}).Call(); err == nil || !strings.Contains(err.Error(), "no channels are waiting") {
+		t.Errorf("want error completing twice, have %v", err)
+	}
+	if len(b.broadcast) != 1 {
+		t.Errorf("want 1 transaction broadcast, have %d", len(b.broadcast))
+	}
+}
+
+func TestFundExternalNotStarted(t *testing.T) {
+	_, b := setup(t, []wallet.Amount{1000000}, "peer1")
+	wtx := externalTx(b, b.utxos[0].OutPoint, nil, 1000)
+	if _, err := (&MultiChannelExternalComplete{Tx: rawTx(wtx)}).Call(); err == nil || !strings.Contains(err.Error(), "no channels are waiting") {
+		t.Errorf("want error without fund_multi_start, have %v", err)
+	}
+	nothingSent(t, "not started", b)
+}
+
+func TestFundExternalFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		tx      func(b *fakeBitcoind, addresses []string) string
+		prepare func(l *fakeLightningd, b *fakeBitcoind)
+		want    string
+		pending int // channels left waiting for a corrected transaction
+	}{
+		{"decode", func(b *fakeBitcoind, addresses []string) string {
+			return "zz"
+		}, nil, "invalid hex", 2},
+		{"unsigned", func(b *fakeBitcoind, addresses []string) string {
+			wtx := externalTx(b, b.utxos[0].OutPoint, addresses, 1000)
+			wtx.TxIn[0].Witness = nil
+			return rawTx(wtx)
+		}, nil, "not signed", 2},
+		{"bad signature", func(b *fakeBitcoind, addresses []string) string {
+			wtx := externalTx(b, b.utxos[0].OutPoint, addresses, 1000)
+			wtx.TxOut[0].Value--
+			return rawTx(wtx)
+		}, nil, "mempool", 2},
+		{"fee", func(b *fakeBitcoind, addresses []string) string {
+			return rawTx(externalTx(b, b.utxos[0].OutPoint, addresses, 0))
+		}, nil, "below 1 sat/vbyte", 2},
+		{"missing output", func(b *fakeBitcoind, addresses []string) string {
+			return rawTx(externalTx(b, b.utxos[0].OutPoint, addresses[:1], 1000))
+		}, nil, "no output for peer2", 2},
+		{"unexpected input", func(b *fakeBitcoind, addresses []string) string {
+			return rawTx(externalTx(b, b.utxos[1].OutPoint, addresses, 1000))
+		}, nil, "unexpected input", 2},
+		{"fundchannel_complete", func(b *fakeBitcoind, addresses []string) string {
+			return rawTx(externalTx(b, b.utxos[0].OutPoint, addresses, 1000))
+		}, func(l *fakeLightningd, b *fakeBitcoind) {
+			l.fail["fundchannel_complete"] = "peer2"
+		}, "fundchannel_complete failed for peer2", 0},
+		{"broadcast", func(b *fakeBitcoind, addresses []string) string {
+			return rawTx(externalTx(b, b.utxos[0].OutPoint, addresses, 1000))
+		}, func(l *fakeLightningd, b *fakeBitcoind) {
+			b.fail = errors.New("bitcoind unavailable")
+		}, "bitcoind unavailable", 0},
+	}
+	for _, tt := range tests {
+		l, b := setup(t, []wallet.Amount{1000000, 500000}, "peer1", "peer2")
+		addresses := startExternal(t, b)
+		if tt.prepare != nil {
+			tt.prepare(l, b)
+		}
+		_, err := (&MultiChannelExternalComplete{Tx: tt.tx(b, addresses)}).Call()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: want error with %q, have %v", tt.name, tt.want, err)
+		}
+		nothingSent(t, tt.name, b)
+		if pending := l.pending(); len(pending) != tt.pending {
+			t.Errorf("%s: want %d channels waiting, have %v", tt.name, tt.pending, pending)
+		}
+	}
+}
+
+func TestFundExternalPending(t *testing.T) {
+	l, b := setup(t, []wallet.Amount{1000000, 500000}, "peer1", "peer2")
+	addresses := startExternal(t, b)
+
+	// the channels are waiting, starting again would forget them
+	req := &MultiChannelExternal{Channels: []glightning.FundChannelStart{{Id: "peer1", Amount: 100000}}}
+	if _, err := req.Call(); err == nil || !strings.Contains(err.Error(), "already waiting") {
+		t.Errorf("want error starting twice, have %v", err)
+	}
+	if len(l.cancelled) > 0 || len(outputs) != 2 {
+		t.Errorf("want the channels left waiting, have %v cancelled and %d outputs", l.cancelled, len(outputs))
+	}
+
+	// a corrected transaction still completes them
+	wrong := externalTx(b, b.utxos[0].OutPoint, addresses[:1], 1000)
+	if _, err := (&MultiChannelExternalComplete{Tx: rawTx(wrong)}).Call(); err == nil {
+		t.Fatal("want error for a missing output")
+	}
+	if _, err := (&MultiChannelExternalComplete{Tx: rawTx(externalTx(b, b.utxos[0].OutPoint, addresses, 1000))}).Call(); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.broadcast) != 1 || len(l.pending()) > 0 {
+		t.Errorf("want the corrected transaction sent, have %d broadcast and %v waiting", len(b.broadcast), l.pending())
+	}
+}
+
+func TestFundExternalCancel(t *testing.T) {
+	l, b := setup(t, []wallet.Amount{1000000}, "peer1", "peer2")
+	if _, err := (&MultiChannelExternalCancel{}).Call(); err == nil {
+		t.Error("want error with nothing to cancel")
+	}
+	startExternal(t, b)
+	if _, err := (&MultiChannelExternalCancel{}).Call(); err != nil {
+		t.Fatal(err)
+	}
+	if len(l.pending()) > 0 || len(outputs) > 0 {
+		t.Errorf("want nothing waiting, have %v", l.pending())
+	}
+	startExternal(t, b)
+}
+
+func TestFundExternalBadAddress(t *testing.T) {
+	l, _ := setup(t, nil, "peer1", "peer2")
+	l.mainnet = "peer2"
+	req := &MultiChannelExternal{
+		Channels: []glightning.FundChannelStart{{Id: "peer1", Amount: 100000}, {Id: "peer2", Amount: 100000}},
+	}
+	if _, err := req.Call(); err == nil {
+		t.Fatal("want error for an address on another network")
+	}
+	if pending := l.pending(); len(pending) > 0 || len(outputs) > 0 {
+		t.Errorf("want started channels cancelled, have %v waiting", pending)
+	}
+}
+
+func TestFundExternalPreflight(t *testing.T) {
+	l, _ := setup(t, nil, "peer1", "peer2")
+	req := &MultiChannelExternal{
+		Channels: []glightning.FundChannelStart{{Id: "peer1", Amount: 100000}, {Id: "peer3", Amount: 100000}, {Id: "peer2", Amount: 1000}},
+	}
+	_, err := req.Call()
+	problems, ok := err.(*funder.PreflightError)
+	if !ok || len(problems.Problems) != 2 {
+		t.Fatalf("want not connected and amount problems, have %v", err)
+	}
+	if len(l.started) > 0 {
+		t.Errorf("no channel should be started, have %v", l.started)
+	}
+
+	// the wallet is empty, the transaction comes from elsewhere
+	req.Channels = req.Channels[:1]
+	if _, err := req.Call(); err != nil {
+		t.Errorf("the balance should not be checked, have %v", err)
+	}
+}
@@ -2,23 +2,56 @@ package main
 
 import (
 	"bytes"
-	"log"
+	"fmt"
 
 	"github.com/btcsuite/btcd/wire"
 	"github.com/niftynei/glightning/glightning"
 	"github.com/niftynei/glightning/jrpc2"
+	"github.com/rsbondi/multifund/funder"
+	"github.com/rsbondi/multifund/logger"
 	"github.com/rsbondi/multifund/wallet"
 )
 
 const FundMultiDescription = `Use external wallet funding feature to build a transaction to fund multiple channels
-{channels} is an array of object{"id" string, "satoshi" int, "announce" bool}`
+{channels} is an array of object{"id" string, "satoshi" int, "announce" bool, "label" string}
+each channel also takes the fundchannel_start options "feerate", "push", "close_to", "mindepth", "reserve"
+and "channel_type", every channel is checked before any is started`
+
+const ConnectFundMultiDescription = `Connect peers and open multiple channels in a single transaction
+{channels} is an array of object{"id" string, "host" string, "port" int, "satoshi" int, "announce" bool, "label" string}
+{id} may be id@host:port, host and port are optional, peers without a host are looked up in gossip
+and each address is tried in multi-address-prefer order, the result reports how each peer was connected
+channels take the same fundchannel_start options as fund_multi`
+
+// ChannelRequest is a channel to fund with its fundchannel_start options and an optional label for the funding output
+type ChannelRequest struct {
+	glightning.FundChannelStart
+	funder.ChannelOptions
+	Label string `json:"label,omitempty"`
+}
 
 type MultiChannel struct {
-	Channels []glightning.FundChannelStart `json:"channels"`
+	Channels []ChannelRequest `json:"channels"`
 }
 
 func (m *MultiChannel) Call() (jrpc2.Result, error) {
-	return createMulti(&m.Channels)
+	chans := make([]glightning.FundChannelStart, 0)
+	labels := make(map[string]string)
+	options := make(map[string]*funder.ChannelOptions)
+	for i, c := range m.Channels {
+		chans = append(chans, c.FundChannelStart)
+		options[c.Id] = &m.Channels[i].ChannelOptions
+		if c.Label != "" {
+			labels[c.Id] = c.Label
+		}
+	}
+	log := logger.NewTrace()
+	result, err := createMulti(funder.HISTORY_FUND, &chans, options, labels, log)
+	if err != nil {
+		log.Warnf("fund_multi failed: %s", err.Error())
+		return nil, err
+	}
+	return result, nil
 }
 
 func (f *MultiChannel) Name() string {
@@ -36,6 +69,8 @@ type ConnectAndFundChannelRequest struct {
 	Amount   uint64  `json:"satoshi"`
 	FeeRate  string  `json:"feerate,omitempty"`
 	Announce bool    `json:"announce"`
+	funder.ChannelOptions
+	Label string `json:"label,omitempty"`
 }
 
 type MultiChannelWithConnect struct {
@@ -43,7 +78,13 @@ type MultiChannelWithConnect struct {
 }
 
 func (m *MultiChannelWithConnect) Call() (jrpc2.Result, error) {
-	return connectAndCreateMulti(&m.Channels)
+	log := logger.NewTrace()
+	result, err := connectAndCreateMulti(&m.Channels, log)
+	if err != nil {
+		log.Warnf("connect_fund_multi failed: %s", err.Error())
+		return nil, err
+	}
+	return result, nil
 }
 
 func (f *MultiChannelWithConnect) Name() string {
@@ -54,80 +95,181 @@ func (f *MultiChannelWithConnect) New() interface{} {
 	return &MultiChannelWithConnect{}
 }
 
-func connectAndCreateMulti(chans *[]ConnectAndFundChannelRequest) (jrpc2.Result, error) {
-	createChans := make([]glightning.FundChannelStart, 0)
+type FundResult struct {
+	Tx          string                  `json:"tx"`
+	Txid        string                  `json:"txid"`
+	Channels    []string                `json:"channels"`
+	Connections []*funder.ConnectResult `json:"connections,omitempty"`
+	Trace       string                  `json:"trace"` // on every log line of the call
+}
+
+// connectAndCreateMulti connects every peer before starting any channel, an id can be
+//   id@host:port, and peers without a host are found in gossip
+//   peers that fail are dropped instead of failing the batch when multi-on-failure is drop
+func connectAndCreateMulti(chans *[]ConnectAndFundChannelRequest, log *logger.Logger) (*FundResult, error) {
+	peers := make([]*funder.PeerAddress, 0)
 	for _, c := range *chans {
-		_, err := fundr.Lightning.Connect(c.Id, c.Host, uint(c.Port))
+		peer, err := funder.ParsePeer(c.Id)
 		if err != nil {
 			return nil, err
 		}
-		newone := glightning.FundChannelStart{
-			Id:       c.Id,
+		if c.Host != "" {
+			peer.Host = c.Host
+			peer.Port = uint(c.Port)
+		}
+		peers = append(peers, peer)
+	}
+
+	createChans := make([]glightning.FundChannelStart, 0)
+	options := make(map[string]*funder.ChannelOptions)
+	for i, c := range *chans {
+		createChans = append(createChans, glightning.FundChannelStart{
+			Id:       peers[i].Id,
 			Amount:   c.Amount,
 			FeeRate:  c.FeeRate,
 			Announce: c.Announce,
+		})
+		options[peers[i].Id] = &(*chans)[i].ChannelOptions
+	}
+	if err := fundr.PreflightFund(createChans, options, false); err != nil {
+		return nil, err
+	}
+
+	connections, err := fundr.ConnectPeers(peers)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range connections {
+		if c.Connected {
+			log.Debugf("connected %s", c.Id)
+		} else {
+			log.Warnf("unable to connect %s: %s", c.Id, c.Error)
 		}
-		createChans = append(createChans, newone)
 	}
 
-	return createMulti(&createChans)
+	connected := make([]glightning.FundChannelStart, 0)
+	labels := make(map[string]string)
+	for i, c := range *chans {
+		if !connections[i].Connected {
+			continue // dropped by the multi-on-failure policy
+		}
+		if c.Label != "" {
+			labels[peers[i].Id] = c.Label
+		}
+		connected = append(connected, createChans[i])
+	}
+
+	result, err := createMulti(funder.HISTORY_CONNECT_FUND, &connected, options, labels, log)
+	if err != nil {
+		return nil, err
+	}
+	result.Connections = connections
+	return result, nil
 }
 
-func createMulti(chans *[]glightning.FundChannelStart) (jrpc2.Result, error) {
-	info, err := fundr.GetChannelAddresses(chans)
+// createMulti funds the channels, kind is the command, options and labels are by peer
+//   log carries the trace id of the command, it is recorded with the batch
+func createMulti(kind string, chans *[]glightning.FundChannelStart, options map[string]*funder.ChannelOptions, labels map[string]string, log *logger.Logger) (*FundResult, error) {
+	log.Infof("%s of %d channels", kind, len(*chans))
+	if err := fundr.PreflightFund(*chans, options, true); err != nil {
+		return nil, err
+	}
+
+	if fundr.UseNative() && fundr.Capabilities.NativeFund() && fundr.NativeFundAllowed() && funder.NativeSupports(*chans, options) {
+		log.Debugf("funding with multifundchannel")
+		result, err := fundr.NativeFundMulti(chans, options)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("broadcast %s funding %d channels", result.Txid, len(result.Channels))
+		fundr.RecordBatch(result.Txid, result.Tx, result.Batch, 0, log)
+		fundr.RecordHistory(kind, result.Tx, nil, result.Peers, result.Channels, labels, log)
+		return &FundResult{Tx: result.Tx, Txid: result.Txid, Channels: result.Channels, Trace: log.Trace()}, nil
+	}
+
+	if fundr.DualFund {
+		v1, v2 := fundr.SplitDualFund(chans, options)
+		if len(v2) > 0 {
+			log.Debugf("dual funding %d of the channels", len(v2))
+			result, err := fundr.FundDual(v1, v2, options, log)
+			if err != nil {
+				return nil, err
+			}
+			log.Infof("broadcast %s funding %d channels", result.Txid, len(result.Channels))
+			fundr.RecordBatch(result.Txid, result.Tx, result.Batch, 0, log)
+			fundr.RecordHistory(kind, result.Tx, nil, nil, result.Channels, labels, log)
+			return &FundResult{Tx: result.Tx, Txid: result.Txid, Channels: result.Channels, Trace: log.Trace()}, nil
+		}
+	}
+
+	info, err := fundr.GetChannelAddresses(chans, options, log)
 	if err != nil {
-		cancelMulti(chans)
+		cancelMulti(chans, log)
 		return nil, err
 	}
+	for _, o := range info.Outputs {
+		log.Debugf("started channel with %s for %d sat", o.Peer, o.Amount)
+	}
 
 	tx, err := wallet.CreateTransaction(info.Recipients, info.Utxos, fundr.BitcoinNet)
 	if err != nil {
+		cancelMulti(chans, log)
 		return nil, err
 	}
 
 	fundr.Wally.Sign(&tx, info.Utxos)
 	wtx := wire.NewMsgTx(2)
 	r := bytes.NewReader(tx.Signed)
-	wtx.Deserialize(r)
+	if err := wtx.Deserialize(r); err != nil {
+		cancelMulti(chans, log)
+		return nil, fmt.Errorf("signed transaction does not decode: %s", err.Error())
+	}
 	tx.TxId = wtx.TxHash().String()
+	log.Debugf("signed %s spending %d inputs: %s", tx.TxId, len(info.Utxos), tx.String())
+
+	in, err := wallet.UtxoTotal(info.Utxos)
+	if err != nil {
+		cancelMultiExt(info.Outputs, log)
+		return nil, err
+	}
+	if err := fundr.GuardTx(tx, in); err != nil {
+		cancelMultiExt(info.Outputs, log)
+		return nil, err
+	}
 
-	channels, err := fundr.CompleteChannels(tx, info.Outputs)
+	channels, err := fundr.CompleteChannels(tx, info.Outputs, funder.OutPoints(info.Utxos))
 	if err != nil {
-		cancelMultiExt(info.Outputs)
+		cancelMultiExt(info.Outputs, log)
 		return nil, err
 	}
 
-	txid, err := fundr.Bitcoin.SendTx(tx.String())
+	txid, err := fundr.Broadcast(tx, in)
 	if err != nil {
-		cancelMultiExt(info.Outputs)
+		cancelMultiExt(info.Outputs, log)
 		return nil, err
 	}
+	fee := wallet.TxFee(wtx, info.Utxos)
+	log.Infof("broadcast %s funding %d channels, fee %d sat", txid, len(channels), fee)
+	fundr.RecordBatch(txid, tx.String(), funder.OutputChannels(info.Outputs, channels), fee, log)
+	fundr.RecordHistory(kind, tx.String(), info.Utxos, funder.OutputPeers(info.Outputs), channels, labels, log)
 
-	return struct {
-		Tx       string   `json:"tx"`
-		Txid     string   `json:"txid"`
-		Channels []string `json:"channels"`
-	}{
-		tx.String(),
-		txid,
-		channels,
-	}, nil
+	return &FundResult{Tx: tx.String(), Txid: txid, Channels: channels, Trace: log.Trace()}, nil
 }
 
-func cancelMulti(chans *[]glightning.FundChannelStart) {
+func cancelMulti(chans *[]glightning.FundChannelStart, log *logger.Logger) {
 	for _, ch := range *chans {
 		_, err := fundr.Lightning.CancelFundChannel(ch.Id)
 		if err != nil {
-			log.Printf("fundchannel_cancel error: %s", err.Error())
+			log.Warnf("fundchannel_cancel error: %s", err.Error())
 		}
 	}
 }
 
-func cancelMultiExt(outputs map[string]*wallet.Outputs) {
-	for k, _ := range outputs {
-		_, err := fundr.Lightning.CancelFundChannel(k)
+func cancelMultiExt(outputs wallet.ChannelOutputs, log *logger.Logger) {
+	for _, o := range outputs {
+		_, err := fundr.Lightning.CancelFundChannel(o.Peer)
 		if err != nil {
-			log.Printf("channel cancel error: %s", err.Error())
+			log.Warnf("channel cancel error: %s", err.Error())
 		}
 	}
 }
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/niftynei/glightning/glightning"
+	"github.com/niftynei/glightning/jrpc2"
+	"github.com/rsbondi/multifund/funder"
+	"github.com/rsbondi/multifund/logger"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+func fundRequest(peers ...string) *MultiChannel {
+	m := &MultiChannel{}
+	for _, p := range peers {
+		m.Channels = append(m.Channels, ChannelRequest{FundChannelStart: glightning.FundChannelStart{Id: p, Amount: 100000, Announce: true}})
+	}
+	return m
+}
+
+// starts are the fundchannel_start requests of the channels
+func starts(m *MultiChannel) []glightning.FundChannelStart {
+	chans := make([]glightning.FundChannelStart, 0)
+	for _, c := range m.Channels {
+		chans = append(chans, c.FundChannelStart)
+	}
+	return chans
+}
+
+func TestFundMulti(t *testing.T) {
+	l, b := setup(t, []wallet.Amount{1000000}, "peer1", "peer2")
+	req := fundRequest("peer1", "peer2")
+	req.Channels[0].Label = "alice"
+
+	result, err := req.Call()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fund := result.(*FundResult)
+	if len(b.broadcast) != 1 {
+		t.Fatalf("want 1 transaction broadcast, have %d", len(b.broadcast))
+	}
+	wtx := decodeHex(t, b.broadcast[0])
+	if fund.Txid != wtx.TxHash().String() {
+		t.Errorf("want txid %s, have %s", wtx.TxHash(), fund.Txid)
+	}
+	for _, peer := range []string{"peer1", "peer2"} {
+		if !pays(wtx, fundingAddress(peer), 100000) {
+			t.Errorf("no funding output for %s", peer)
+		}
+		if l.completed[peer] != fund.Txid {
+			t.Errorf("%s should be completed with %s, have %s", peer, fund.Txid, l.completed[peer])
+		}
+	}
+	if len(fund.Channels) != 2 || len(l.cancelled) > 0 {
+		t.Errorf("want 2 channels and none cancelled, have %v and %v", fund.Channels, l.cancelled)
+	}
+
+	batches, _ := fundr.Batches()
+	batch := batches.Get(fund.Txid)
+	if batch == nil || batch.Fee == 0 {
+		t.Fatalf("batch should be recorded with its fee, have %+v", batch)
+	}
+	for i, c := range batch.Channels {
+		if c.ChannelId != fund.Channels[i] || c.Peer != []string{"peer1", "peer2"}[i] {
+			t.Errorf("want channel %d of the batch recorded with its id %s, have %+v", i, fund.Channels[i], c)
+		}
+	}
+	history, _ := fundr.History().List(&funder.HistoryFilter{})
+	if len(history) != 1 || history[0].Type != funder.HISTORY_FUND {
+		t.Errorf("want 1 fund history entry, have %d", len(history))
+	}
+	if b.labels[fundingAddress("peer1")] != "alice" {
+		t.Errorf("funding output should be labelled in bitcoind, have %v", b.labels)
+	}
+}
+
+// TestFundMultiTrace checks every line of a call has its trace and the signed transaction
+//   is only logged at debug
+func TestFundMultiTrace(t *testing.T) {
+	for _, level := range []logger.Level{logger.DEFAULT_LEVEL, logger.LEVEL_DEBUG} {
+		_, b := setup(t, []wallet.Amount{1000000}, "peer1", "peer2")
+		lines := make([]string, 0)
+		logger.SetOutput(func(l logger.Level, line string) { lines = append(lines, line) }, level)
+		defer logger.SetOutput(nil, logger.DEFAULT_LEVEL)
+
+		result, err := fundRequest("peer1", "peer2").Call()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fund := result.(*FundResult)
+		if fund.Trace == "" {
+			t.Fatal("result should have the trace id")
+		}
+		logged := false
+		for _, line := range lines {
+			if !strings.HasPrefix(line, "["+fund.Trace+"] ") {
+				t.Errorf("%s: want trace %s, have %s", level, fund.Trace, line)
+			}
+			logged = logged || strings.Contains(line, b.broadcast[0])
+		}
+		if logged != (level == logger.LEVEL_DEBUG) {
+			t.Errorf("%s: signed transaction logged %v", level, logged)
+		}
+
+		batches, _ := fundr.Batches()
+		if batch := batches.Get(fund.Txid); batch == nil || batch.Trace != fund.Trace {
+			t.Errorf("batch should be recorded with trace %s, have %+v", fund.Trace, batch)
+		}
+	}
+}
+
+func TestFundMultiFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		peers   []string
+		prepare func(l *fakeLightningd, b *fakeBitcoind)
+		want    string
+	}{
+		{"not connected", []string{"peer1", "peer3"}, nil, "peer3 is not connected"},
+		{"balance", []string{"peer1", "peer2"}, func(l *fakeLightningd, b *fakeBitcoind) {
+			b.utxos = nil
+		}, "spendable"},
+		{"fundchannel_start", []string{"peer1", "peer2"}, func(l *fakeLightningd, b *fakeBitcoind) {
+			l.fail["fundchannel_start"] = "peer2"
+		}, "fundchannel_start failed for peer2"},
+		{"fee limit", []string{"peer1", "peer2"}, func(l *fakeLightningd, b *fakeBitcoind) {
+			fundr.Limits = &funder.BroadcastLimits{MaxFee: 100}
+		}, "above the limit of 100"},
+		{"fundchannel_complete", []string{"peer1", "peer2"}, func(l *fakeLightningd, b *fakeBitcoind) {
+			l.fail["fundchannel_complete"] = "peer2"
+		}, "fundchannel_complete failed for peer2"},
+		{"sign", []string{"peer1", "peer2"}, func(l *fakeLightningd, b *fakeBitcoind) {
+			b.unsigned = true
+		}, "does not decode"},
+		{"broadcast", []string{"peer1", "peer2"}, func(l *fakeLightningd, b *fakeBitcoind) {
+			b.fail = errors.New("bitcoind unavailable")
+		}, "bitcoind unavailable"},
+	}
+	for _, tt := range tests {
+		l, b := setup(t, []wallet.Amount{1000000}, "peer1", "peer2")
+		if tt.prepare != nil {
+			tt.prepare(l, b)
+		}
+		_, err := fundRequest(tt.peers...).Call()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: want error with %q, have %v", tt.name, tt.want, err)
+		}
+		nothingSent(t, tt.name, b)
+		if pending := l.pending(); len(pending) > 0 {
+			t.Errorf("%s: channels should be cancelled, %v are still waiting", tt.name, pending)
+		}
+	}
+}
+
+func TestProbeCapabilities(t *testing.T) {
+	l, _ := setup(t, nil)
+	l.commands = []string{"fundpsbt", "signpsbt", "sendpsbt"}
+	caps, err := funder.ProbeCapabilities(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caps.Version != "v0.10.0" || caps.NativeFund() || !caps.NativeWithdraw() {
+		t.Errorf("want withdraw only, have %+v", caps)
+	}
+	var none *funder.Capabilities
+	if none.NativeFund() || none.NativeWithdraw() {
+		t.Error("nothing is native before the capabilities are probed")
+	}
+}
+
+func TestNativeSupports(t *testing.T) {
+	chans := starts(fundRequest("peer1", "peer2"))
+	if !funder.NativeSupports(chans, nil) {
+		t.Error("plain channels should be supported")
+	}
+	if funder.NativeSupports(chans, map[string]*funder.ChannelOptions{"peer1": {ChannelType: []uint{12}}}) {
+		t.Error("a channel type is not supported")
+	}
+	chans[0].FeeRate = "normal"
+	if !funder.NativeSupports(chans, nil) {
+		t.Error("one fee rate should be supported")
+	}
+	chans[1].FeeRate = "urgent"
+	if funder.NativeSupports(chans, nil) {
+		t.Error("mixed fee rates are not supported")
+	}
+}
+
+func TestNativeFundMulti(t *testing.T) {
+	l, b := setupNative(t, []wallet.Amount{1000000}, "peer1", "peer2")
+	fundr.Broadcaster = wallet.NewLightningBroadcaster(l)
+	fundr.Limits = &funder.BroadcastLimits{}
+
+	req := fundRequest("peer1", "peer2")
+	req.Channels[0].FeeRate = "slow"
+	result, err := req.Call()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fund := result.(*FundResult)
+	if l.multifund == nil || len(l.multifund.Destinations) != 2 || l.multifund.FeeRate != "slow" {
+		t.Fatalf("want both channels funded with multifundchannel at the slow rate, have %+v", l.multifund)
+	}
+	if fund.Txid != "multifund" || len(fund.Channels) != 2 || len(b.broadcast) > 0 {
+		t.Errorf("lightningd should broadcast, have %+v and %d broadcast", fund, len(b.broadcast))
+	}
+	batches, _ := fundr.Batches()
+	if batch := batches.Get("multifund"); batch == nil || len(batch.Channels) != 2 || batch.Channels[0].ChannelId != fund.Channels[0] || batch.Channels[0].Amount != 100000 {
+		t.Errorf("want the batch recorded with the channel ids, have %+v", batch)
+	}
+
+	chans := starts(req)
+	chans[1].FeeRate = "urgent"
+	if _, err := fundr.NativeFundMulti(&chans, nil); err == nil || !strings.Contains(err.Error(), "one fee rate") {
+		t.Errorf("want mixed fee rates rejected, have %v", err)
+	}
+}
+
+// TestNativeFundFallback checks the plugin builds the funding whenever lightningd's would skip a check
+func TestNativeFundFallback(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(l *fakeLightningd, req *MultiChannel)
+	}{
+		{"broadcaster", func(l *fakeLightningd, req *MultiChannel) {
+			fundr.Limits = &funder.BroadcastLimits{}
+		}},
+		{"fee limit", func(l *fakeLightningd, req *MultiChannel) {
+			fundr.Broadcaster = wallet.NewLightningBroadcaster(l)
+			fundr.Limits = &funder.BroadcastLimits{MaxFeePercent: 10}
+		}},
+		{"fee rates", func(l *fakeLightningd, req *MultiChannel) {
+			fundr.Broadcaster = wallet.NewLightningBroadcaster(l)
+			fundr.Limits = &funder.BroadcastLimits{}
+			req.Channels[0].FeeRate = "slow"
+			req.Channels[1].FeeRate = "urgent"
+		}},
+	}
+	for _, tt := range tests {
+		l, _ := setupNative(t, []wallet.Amount{1000000}, "peer1", "peer2")
+		l.commands = []string{"multifundchannel"}
+		req := fundRequest("peer1", "peer2")
+		tt.prepare(l, req)
+		// the fallback reaches fundchannel_start, failing it shows which path was taken
+		l.fail["fundchannel_start"] = "peer2"
+		if _, err := req.Call(); err == nil || !strings.Contains(err.Error(), "fundchannel_start failed") {
+			t.Errorf("%s: want the plugin's funding, have %v", tt.name, err)
+		}
+		if l.multifund != nil {
+			t.Errorf("%s: multifundchannel should not be used", tt.name)
+		}
+	}
+}
+
+// TestFundDual funds peer1 with fundchannel_start and peer2, which supports dual funding, with
+//   openchannel_init, update and signed in the same transaction
+func TestFundDual(t *testing.T) {
+	l, b := setup(t, []wallet.Amount{1000000}, "peer1", "peer2")
+	fundr.DualFund = true
+	l.features["peer2"] = dualFeatures
+
+	result, err := fundRequest("peer1", "peer2").Call()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fund := result.(*FundResult)
+	if len(b.broadcast) != 1 {
+		t.Fatalf("want 1 transaction broadcast, have %d", len(b.broadcast))
+	}
+	wtx := decodeHex(t, b.broadcast[0])
+	if fund.Txid != wtx.TxHash().String() {
+		t.Errorf("want txid %s, have %s", wtx.TxHash(), fund.Txid)
+	}
+	if !pays(wtx, fundingAddress("peer1"), 100000) || !pays(wtx, fundingAddress("peer2"), 100000) {
+		t.Error("want funding outputs for both peers")
+	}
+	if l.completed["peer1"] != fund.Txid || l.started["peer2"] {
+		t.Errorf("peer1 should be completed with fundchannel_complete and peer2 never started, have %v", l.completed)
+	}
+	d := l.dual["dual-peer2"]
+	if d == nil || !d.signed || d.updates != 2 {
+		t.Errorf("want peer2 secured after 2 updates and signed, have %+v", d)
+	}
+	if len(fund.Channels) != 2 || len(l.cancelled) > 0 || len(l.aborted) > 0 {
+		t.Errorf("want 2 channels and none cancelled, have %v, %v and %v", fund.Channels, l.cancelled, l.aborted)
+	}
+	batches, _ := fundr.Batches()
+	if batch := batches.Get(fund.Txid); batch == nil || len(batch.Channels) != 2 ||
+		batch.Channels[0].ChannelId != "channel-peer1" || batch.Channels[1].ChannelId != "dual-peer2" {
+		t.Errorf("want the batch recorded with both channel ids, have %+v", batch)
+	}
+}
+
+// TestFundDualFallback checks channels needing fundchannel_start options stay on v1
+func TestFundDualFallback(t *testing.T) {
+	l, b := setup(t, []wallet.Amount{1000000}, "peer1", "peer2")
+	fundr.DualFund = true
+	l.features["peer1"] = dualFeatures
+	l.features["peer2"] = dualFeatures
+	req := fundRequest("peer1", "peer2")
+	req.Channels[1].Push = 1
+
+	if _, err := req.Call(); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.broadcast) != 1 || l.dual["dual-peer1"] == nil || l.dual["dual-peer2"] != nil || l.completed["peer2"] == "" {
+		t.Errorf("want peer1 dual funded and peer2 opened with fundchannel_start, have %v", l.completed)
+	}
+}
+
+func TestFundDualFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(l *fakeLightningd, b *fakeBitcoind)
+		want    string
+		signed  bool // failed after our signatures were shared
+	}{
+		{"openchannel_init", func(l *fakeLightningd, b *fakeBitcoind) {
+			l.fail["openchannel_init"] = "peer2"
+		}, "openchannel_init peer2", false},
+		{"disagreement", func(l *fakeLightningd, b *fakeBitcoind) {
+			l.disagree = "peer2"
+		}, "did not agree", false},
+		{"wrapped input", func(l *fakeLightningd, b *fakeBitcoind) {
+			addr, _ := btcutil.NewAddressScriptHashFromHash(make([]byte, 20), testNet)
+			b.utxos[0].Address = addr.EncodeAddress()
+		}, "not native segwit", false},
+		{"openchannel_signed", func(l *fakeLightningd, b *fakeBitcoind) {
+			l.fail["openchannel_signed"] = "peer2"
+		}, "openchannel_signed dual-peer2", true},
+		{"txid changed", func(l *fakeLightningd, b *fakeBitcoind) {
+			l.malleate = "peer2"
+		}, "does not match", true},
+		{"broadcast", func(l *fakeLightningd, b *fakeBitcoind) {
+			b.fail = errors.New("bitcoind unavailable")
+		}, "bitcoind unavailable", true},
+	}
+	for _, tt := range tests {
+		l, b := setup(t, []wallet.Amount{1000000}, "peer1", "peer2")
+		fundr.DualFund = true
+		l.features["peer2"] = dualFeatures
+		tt.prepare(l, b)
+
+		_, err := fundRequest("peer1", "peer2").Call()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: want error with %q, have %v", tt.name, tt.want, err)
+		}
+		nothingSent(t, tt.name, b)
+		if tt.signed {
+			// a peer holding our signatures can still broadcast, the channels must stay to see it confirm
+			if !strings.Contains(err.Error(), "may still confirm") || len(l.cancelled) > 0 || len(l.aborted) > 0 {
+				t.Errorf("%s: want nothing rolled back, have %v, %v and %v", tt.name, err, l.cancelled, l.aborted)
+			}
+			continue
+		}
+		// completed channels are cancelled too, the funding was never sent
+		if len(l.cancelled) != 1 || l.cancelled[0] != "peer1" {
+			t.Errorf("%s: want peer1 cancelled, have %v", tt.name, l.cancelled)
+		}
+		if tt.name != "openchannel_init" && (len(l.aborted) != 1 || l.aborted[0] != "dual-peer2") {
+			t.Errorf("%s: want the v2 open aborted, have %v", tt.name, l.aborted)
+		}
+	}
+}
+
+// TestNotifyBatch checks batch events reach lightningd as multifund_batch notifications with the channel ids
+func TestNotifyBatch(t *testing.T) {
+	saved := sendNotification
+	defer func() { sendNotification = saved }()
+	sent := make([]*BatchNotification, 0)
+	sendNotification = func(n jrpc2.Method) error {
+		sent = append(sent, n.(*BatchNotification))
+		return nil
+	}
+
+	b := &funder.Batch{Txid: "fundingtx", Channels: funder.OutputChannels(wallet.ChannelOutputs{{Peer: "peer1", Amount: 100000}}, []string{"c1"}), Trace: "3f9a01c2"}
+	notifyBatch(funder.BATCH_CONFIRMED, b)
+	notifyBatch(funder.BATCH_NORMAL, b)
+	if len(sent) != 2 || sent[0].Name() != BATCH_NOTIFICATION || sent[0].Event != funder.BATCH_CONFIRMED || sent[1].Event != funder.BATCH_NORMAL {
+		t.Fatalf("want a notification per event, have %+v", sent)
+	}
+	if n := sent[1]; n.Txid != "fundingtx" || n.Channels[0].ChannelId != "c1" || n.Trace != "3f9a01c2" {
+		t.Errorf("want the batch in the notification, have %+v", n)
+	}
+}
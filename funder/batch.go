@@ -0,0 +1,268 @@
+package funder
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/niftynei/glightning/glightning"
+	"github.com/rsbondi/multifund/logger"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+const BATCH_FILE = "multifund_batches.json"
+
+const CHANNELD_NORMAL = "CHANNELD_NORMAL"
+
+// batch events passed to the tracker's notify
+const (
+	BATCH_CONFIRMED = "funding_confirmed"
+	BATCH_NORMAL    = "channels_normal"
+)
+
+type BatchChannel struct {
+	Peer           string `json:"peer"`
+	Amount         uint64 `json:"satoshi"`
+	ChannelId      string `json:"channel_id,omitempty"`
+	ShortChannelId string `json:"short_channel_id,omitempty"`
+	State          string `json:"state,omitempty"`
+}
+
+// Batch is a broadcast funding transaction and the channels it opens
+type Batch struct {
+	Txid      string         `json:"txid"`
+	Tx        string         `json:"tx"`
+	Fee       wallet.Amount  `json:"fee,omitempty"`
+	Channels  []BatchChannel `json:"channels"`
+	Created   int64          `json:"created"`
+	Confirmed bool           `json:"confirmed"`
+	Normal    bool           `json:"normal"`          // every channel reached CHANNELD_NORMAL, tracking is done
+	Trace     string         `json:"trace,omitempty"` // id on the log lines of the command that funded it
+}
+
+// BatchStore persists every funding batch to the lightning directory, keyed by txid
+type BatchStore struct {
+	path    string
+	mu      sync.Mutex
+	batches map[string]*Batch
+}
+
+func NewBatchStore(dir string) (*BatchStore, error) {
+	s := &BatchStore{
+		path:    filepath.Join(dir, BATCH_FILE),
+		batches: make(map[string]*Batch),
+	}
+	if err := readStore(s.path, &s.batches); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *BatchStore) Get(txid string) *Batch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.batches[txid]
+}
+
+// List is oldest first
+func (s *BatchStore) List() []*Batch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*Batch, 0, len(s.batches))
+	for _, b := range s.batches {
+		list = append(list, b)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created < list[j].Created
+	})
+	return list
+}
+
+func (s *BatchStore) Put(b *Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches[b.Txid] = b
+	return writeStore(s.path, s.batches)
+}
+
+// Batches provides the funding history, loaded from the lightning dir on first use
+func (f *Funder) Batches() (*BatchStore, error) {
+	if f.batches == nil {
+		s, err := NewBatchStore(f.Lightningdir)
+		if err != nil {
+			return nil, err
+		}
+		f.batches = s
+	}
+	return f.batches, nil
+}
+
+// BatchChannels lists the peers and amounts of a funding request, ids are the channel ids in
+//   the same order once lightningd has them
+func BatchChannels(chans []glightning.FundChannelStart, ids []string) []BatchChannel {
+	channels := make([]BatchChannel, 0)
+	for _, c := range chans {
+		channels = append(channels, BatchChannel{Peer: c.Id, Amount: c.Amount})
+	}
+	return withChannelIds(channels, ids)
+}
+
+// OutputChannels lists the peers and amounts of started channels, ids are in the order of
+//   outputs as CompleteChannels returns them
+func OutputChannels(outputs wallet.ChannelOutputs, ids []string) []BatchChannel {
+	channels := make([]BatchChannel, 0)
+	for _, o := range outputs {
+		channels = append(channels, BatchChannel{Peer: o.Peer, Amount: uint64(o.Amount)})
+	}
+	return withChannelIds(channels, ids)
+}
+
+func withChannelIds(channels []BatchChannel, ids []string) []BatchChannel {
+	for i := range channels {
+		if i < len(ids) {
+			channels[i].ChannelId = ids[i]
+		}
+	}
+	return channels
+}
+
+// RecordBatch saves a broadcast funding transaction for status and tracking
+//   the funding is already done so failures are only logged
+//   the trace of log is kept with the batch so tracking lines can be matched to the command
+func (f *Funder) RecordBatch(txid, tx string, channels []BatchChannel, fee wallet.Amount, log *logger.Logger) {
+	batches, err := f.Batches()
+	if err != nil {
+		log.Errorf("unable to load batches: %s", err.Error())
+		return
+	}
+	err = batches.Put(&Batch{
+		Txid:     txid,
+		Tx:       tx,
+		Fee:      fee,
+		Channels: channels,
+		Created:  time.Now().Unix(),
+		Trace:    log.Trace(),
+	})
+	if err != nil {
+		log.Errorf("unable to record batch %s: %s", txid, err.Error())
+	}
+}
+
+type BatchStatus struct {
+	*Batch
+	Status *wallet.TxStatus `json:"status"`
+}
+
+// BatchStatus reports the transaction and channel states of one batch, or all when txid is empty
+func (f *Funder) BatchStatus(txid string) ([]*BatchStatus, error) {
+	batches, err := f.Batches()
+	if err != nil {
+		return nil, err
+	}
+	list := batches.List()
+	if txid != "" {
+		b := batches.Get(txid)
+		if b == nil {
+			return nil, errors.New("unknown batch " + txid)
+		}
+		list = []*Batch{b}
+	}
+
+	peers := ListPeersResult{}
+	if err := f.Lightning.Request(&ListPeersRequest{}, &peers); err != nil {
+		return nil, err
+	}
+
+	result := make([]*BatchStatus, 0)
+	for _, b := range list {
+		status, err := f.Chain.TxStatus(b.Txid)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, &BatchStatus{Batch: channelStates(b, &peers), Status: status})
+	}
+	return result, nil
+}
+
+// channelStates copies the batch with the channel states from listpeers, channels are found by
+//   the id recorded with the batch, or the funding txid for batches recorded without one
+func channelStates(b *Batch, peers *ListPeersResult) *Batch {
+	updated := *b
+	updated.Channels = make([]BatchChannel, len(b.Channels))
+	for i, c := range b.Channels {
+		for _, p := range peers.Peers {
+			if p.Id != c.Peer {
+				continue
+			}
+			for _, pc := range p.Channels {
+				if (c.ChannelId != "" && pc.ChannelId == c.ChannelId) || (c.ChannelId == "" && pc.FundingTxid == b.Txid) {
+					c.ChannelId = pc.ChannelId
+					c.ShortChannelId = pc.ShortChannelId
+					c.State = pc.State
+				}
+			}
+		}
+		updated.Channels[i] = c
+	}
+	return &updated
+}
+
+// TrackBatches checks unfinished batches every interval and calls notify once when
+//   the funding transaction confirms and once when every channel reaches CHANNELD_NORMAL
+func (f *Funder) TrackBatches(interval time.Duration, notify func(event string, b *Batch)) {
+	for range time.Tick(interval) {
+		batches, err := f.Batches()
+		if err != nil {
+			logger.Errorf("unable to load batches: %s", err.Error())
+			continue
+		}
+
+		pending := make([]*Batch, 0)
+		for _, b := range batches.List() {
+			if !b.Normal {
+				pending = append(pending, b)
+			}
+		}
+		if len(pending) == 0 {
+			continue
+		}
+
+		peers := ListPeersResult{}
+		if err := f.Lightning.Request(&ListPeersRequest{}, &peers); err != nil {
+			logger.Warnf("listpeers error: %s", err.Error())
+			continue
+		}
+
+		for _, b := range pending {
+			updated := f.trackBatch(b, &peers, notify)
+			if err := batches.Put(updated); err != nil {
+				logger.WithTrace(b.Trace).Errorf("unable to update batch %s: %s", b.Txid, err.Error())
+			}
+		}
+	}
+}
+
+func (f *Funder) trackBatch(b *Batch, peers *ListPeersResult, notify func(event string, b *Batch)) *Batch {
+	updated := channelStates(b, peers)
+	if !updated.Confirmed {
+		status, err := f.Chain.TxStatus(b.Txid)
+		if err != nil {
+			logger.WithTrace(b.Trace).Warnf("unable to get status of %s: %s", b.Txid, err.Error())
+		} else if status.Confirmations > 0 {
+			updated.Confirmed = true
+			notify(BATCH_CONFIRMED, updated)
+		}
+	}
+
+	normal := len(updated.Channels) > 0
+	for _, c := range updated.Channels {
+		normal = normal && c.State == CHANNELD_NORMAL
+	}
+	if normal {
+		updated.Normal = true
+		notify(BATCH_NORMAL, updated)
+	}
+	return updated
+}
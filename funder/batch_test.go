@@ -0,0 +1,94 @@
+package funder
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+type fakeChain struct {
+	confirmations uint32
+	prevouts      map[wire.OutPoint]*wire.TxOut
+}
+
+func (c *fakeChain) Broadcast(rawtx string) (string, error) {
+	return "", nil
+}
+
+func (c *fakeChain) EstimateFeeRate(target uint) (uint64, error) {
+	return 0, nil
+}
+
+func (c *fakeChain) TxStatus(txid string) (*wallet.TxStatus, error) {
+	return &wallet.TxStatus{Txid: txid, Found: true, Confirmations: c.confirmations}, nil
+}
+
+func (c *fakeChain) AddressUtxos(address string) ([]wallet.UTXO, error) {
+	return nil, nil
+}
+
+func (c *fakeChain) PrevOut(op wire.OutPoint) (*wire.TxOut, error) {
+	return c.prevouts[op], nil
+}
+
+func TestTrackBatch(t *testing.T) {
+	chain := &fakeChain{}
+	f := &Funder{Chain: chain}
+	batch := &Batch{
+		Txid:     "fundingtx",
+		Channels: []BatchChannel{{Peer: "peer1", Amount: 100000}, {Peer: "peer2", Amount: 200000}},
+	}
+	peers := &ListPeersResult{Peers: []PeerInfo{
+		{Id: "peer1", Channels: []PeerChannel{
+			{State: "ONCHAIN", FundingTxid: "oldtx"},
+			{State: "CHANNELD_AWAITING_LOCKIN", ChannelId: "c1", FundingTxid: "fundingtx"},
+		}},
+		{Id: "peer2", Channels: []PeerChannel{{State: "CHANNELD_AWAITING_LOCKIN", ChannelId: "c2", FundingTxid: "fundingtx"}}},
+	}}
+
+	events := make([]string, 0)
+	notify := func(event string, b *Batch) {
+		events = append(events, event)
+	}
+
+	batch = f.trackBatch(batch, peers, notify)
+	if len(events) != 0 || batch.Confirmed {
+		t.Fatalf("unconfirmed batch should not notify, have %v", events)
+	}
+	if batch.Channels[0].ChannelId != "c1" || batch.Channels[0].State != "CHANNELD_AWAITING_LOCKIN" {
+		t.Errorf("channel state not taken from the funding transaction's channel: %+v", batch.Channels[0])
+	}
+
+	chain.confirmations = 1
+	batch = f.trackBatch(batch, peers, notify)
+	if len(events) != 1 || events[0] != BATCH_CONFIRMED || !batch.Confirmed {
+		t.Fatalf("want %s, have %v", BATCH_CONFIRMED, events)
+	}
+
+	peers.Peers[0].Channels[1].State = CHANNELD_NORMAL
+	batch = f.trackBatch(batch, peers, notify)
+	if len(events) != 1 {
+		t.Fatalf("batch should wait for every channel, have %v", events)
+	}
+
+	peers.Peers[1].Channels[0].State = CHANNELD_NORMAL
+	batch = f.trackBatch(batch, peers, notify)
+	if len(events) != 2 || events[1] != BATCH_NORMAL || !batch.Normal {
+		t.Fatalf("want %s, have %v", BATCH_NORMAL, events)
+	}
+}
+
+// TestChannelStatesById checks a channel recorded with its id is found by it, even when listpeers
+//   shows a different funding txid such as after an RBF of a dual funded open
+func TestChannelStatesById(t *testing.T) {
+	batch := &Batch{Txid: "fundingtx", Channels: OutputChannels(wallet.ChannelOutputs{{Peer: "peer1", Amount: 100000}}, []string{"c1"})}
+	peers := &ListPeersResult{Peers: []PeerInfo{{Id: "peer1", Channels: []PeerChannel{
+		{State: "ONCHAIN", ChannelId: "c0", FundingTxid: "fundingtx"},
+		{State: "CHANNELD_AWAITING_LOCKIN", ChannelId: "c1", FundingTxid: "replacedtx"},
+	}}}}
+	updated := channelStates(batch, peers)
+	if c := updated.Channels[0]; c.ChannelId != "c1" || c.State != "CHANNELD_AWAITING_LOCKIN" {
+		t.Errorf("want the state of the recorded channel id, have %+v", c)
+	}
+}
@@ -0,0 +1,296 @@
+package funder
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEFAULT_PORT = 9735
+
+const DEFAULT_CONNECT_TIMEOUT = 30 * time.Second
+
+// address types from listnodes, tor matches both onion versions
+const (
+	ADDRESS_IPV4  = "ipv4"
+	ADDRESS_IPV6  = "ipv6"
+	ADDRESS_TOR   = "tor"
+	ADDRESS_TORV2 = "torv2"
+	ADDRESS_TORV3 = "torv3"
+)
+
+const DEFAULT_ADDRESS_PREFER = "ipv4,ipv6,tor"
+
+// PeerAddress is a peer to connect, Host is empty when the address comes from gossip
+type PeerAddress struct {
+	Id   string
+	Host string
+	Port uint
+}
+
+// ParsePeer accepts a node id, id@host or id@host:port, ipv6 hosts with a port are in brackets
+func ParsePeer(s string) (*PeerAddress, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), "@", 2)
+	p := &PeerAddress{Id: parts[0]}
+	if p.Id == "" {
+		return nil, fmt.Errorf("missing node id in %s", s)
+	}
+	if len(parts) == 1 {
+		return p, nil
+	}
+
+	host, port, err := net.SplitHostPort(parts[1])
+	if err != nil {
+		// no port
+		p.Host = strings.Trim(parts[1], "[]")
+		if p.Host == "" {
+			return nil, fmt.Errorf("missing host in %s", s)
+		}
+		return p, nil
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || host == "" {
+		return nil, fmt.Errorf("invalid address in %s", s)
+	}
+	p.Host = host
+	p.Port = uint(n)
+	return p, nil
+}
+
+// what a batch does when a peer can not be connected or its channel started
+const (
+	FAILURE_ABORT = "abort" // fail the whole batch
+	FAILURE_DROP  = "drop"  // continue without the failed peers
+)
+
+const DEFAULT_PARALLEL = 5
+
+// ConnectPolicy orders gossip addresses by type, bounds each connection attempt and
+//   decides how many peers are handled at once and what happens when some fail
+type ConnectPolicy struct {
+	Prefer    []string // address types in order, others are not tried
+	Timeout   time.Duration
+	Parallel  int
+	OnFailure string
+}
+
+type ConnectConfig struct {
+	Prefer    string // comma separated address types
+	Timeout   string
+	Parallel  int
+	OnFailure string
+}
+
+// NewConnectPolicy validates the connection options, empty values are defaults
+func NewConnectPolicy(cfg *ConnectConfig) (*ConnectPolicy, error) {
+	p := &ConnectPolicy{Timeout: DEFAULT_CONNECT_TIMEOUT, Parallel: cfg.Parallel, OnFailure: cfg.OnFailure}
+	prefer := cfg.Prefer
+	if prefer == "" {
+		prefer = DEFAULT_ADDRESS_PREFER
+	}
+	for _, t := range strings.Split(prefer, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		switch t {
+		case ADDRESS_IPV4, ADDRESS_IPV6, ADDRESS_TOR, ADDRESS_TORV2, ADDRESS_TORV3:
+			p.Prefer = append(p.Prefer, t)
+		default:
+			return nil, fmt.Errorf("unknown address type %s, use ipv4, ipv6 or tor", t)
+		}
+	}
+	if cfg.Timeout != "" {
+		d, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		p.Timeout = d
+	}
+	if p.Parallel <= 0 {
+		p.Parallel = DEFAULT_PARALLEL
+	}
+	switch p.OnFailure {
+	case "":
+		p.OnFailure = FAILURE_ABORT
+	case FAILURE_ABORT, FAILURE_DROP:
+	default:
+		return nil, fmt.Errorf("unknown failure policy %s, use abort or drop", p.OnFailure)
+	}
+	return p, nil
+}
+
+// serialPolicy starts channels one at a time and fails on the first error without a timeout
+var serialPolicy = &ConnectPolicy{Parallel: 1, OnFailure: FAILURE_ABORT}
+
+// forEach calls fn for every index with at most parallel calls running at once
+func forEach(n, parallel int, fn func(i int)) {
+	if parallel <= 0 {
+		parallel = 1
+	}
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func (p *ConnectPolicy) rank(kind string) int {
+	for i, t := range p.Prefer {
+		if t == kind || (t == ADDRESS_TOR && (kind == ADDRESS_TORV2 || kind == ADDRESS_TORV3)) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Order returns the addresses of preferred types, most preferred first and otherwise in gossip order
+func (p *ConnectPolicy) Order(addrs []NodeAddress) []NodeAddress {
+	ordered := make([]NodeAddress, 0)
+	for i := range p.Prefer {
+		for _, a := range addrs {
+			if p.rank(a.Type) == i {
+				ordered = append(ordered, a)
+			}
+		}
+	}
+	return ordered
+}
+
+type ConnectAttempt struct {
+	Address string `json:"address"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ConnectResult reports how a peer was reached, or every address tried when it was not
+type ConnectResult struct {
+	Id        string           `json:"id"`
+	Connected bool             `json:"connected"`
+	Address   string           `json:"address,omitempty"`
+	Attempts  []ConnectAttempt `json:"attempts,omitempty"`
+	Error     string           `json:"error,omitempty"`
+}
+
+// Connector is lightningd's connect
+type Connector func(id, host string, port uint) (string, error)
+
+// Connect tries the given host, or else the gossip addresses in policy order, until one succeeds
+//   with no address at all lightningd is left to find the peer itself
+func (p *ConnectPolicy) Connect(peer *PeerAddress, gossip []NodeAddress, connect Connector) *ConnectResult {
+	addrs := []NodeAddress{{Address: peer.Host, Port: peer.Port}}
+	if peer.Host == "" {
+		addrs = p.Order(gossip)
+		if len(addrs) == 0 {
+			addrs = []NodeAddress{{}}
+		}
+	}
+
+	result := &ConnectResult{Id: peer.Id, Attempts: make([]ConnectAttempt, 0)}
+	for _, a := range addrs {
+		port := a.Port
+		if a.Address != "" && port == 0 {
+			port = DEFAULT_PORT
+		}
+		attempt := ConnectAttempt{}
+		if a.Address != "" {
+			attempt.Address = net.JoinHostPort(a.Address, strconv.Itoa(int(port)))
+		}
+		err := p.connectTimeout(peer.Id, a.Address, port, connect)
+		if err == nil {
+			result.Connected = true
+			result.Address = attempt.Address
+			result.Attempts = append(result.Attempts, attempt)
+			return result
+		}
+		attempt.Error = err.Error()
+		result.Attempts = append(result.Attempts, attempt)
+	}
+	result.Error = fmt.Sprintf("unable to connect after %d attempts", len(result.Attempts))
+	return result
+}
+
+// connectTimeout gives up waiting after the timeout, the connect itself can not be cancelled
+func (p *ConnectPolicy) connectTimeout(id, host string, port uint, connect Connector) error {
+	if p.Timeout <= 0 {
+		_, err := connect(id, host, port)
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := connect(id, host, port)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(p.Timeout):
+		return errors.New("timed out after " + p.Timeout.String())
+	}
+}
+
+// ConnectPeers connects every peer that is not already connected, addresses missing a host are
+//   looked up in gossip, a result is returned for every peer in order
+//   the error summarizes failures, with the drop policy only when no peer connected
+func (f *Funder) ConnectPeers(peers []*PeerAddress) ([]*ConnectResult, error) {
+	policy := f.ConnectPolicy
+	if policy == nil {
+		policy, _ = NewConnectPolicy(&ConnectConfig{})
+	}
+
+	connected := ListPeersResult{}
+	if err := f.Lightning.Request(&ListPeersRequest{}, &connected); err != nil {
+		return nil, err
+	}
+	isConnected := make(map[string]bool)
+	for _, p := range connected.Peers {
+		isConnected[p.Id] = p.Connected
+	}
+
+	results := make([]*ConnectResult, len(peers))
+	forEach(len(peers), policy.Parallel, func(i int) {
+		peer := peers[i]
+		if isConnected[peer.Id] {
+			results[i] = &ConnectResult{Id: peer.Id, Connected: true}
+			return
+		}
+		gossip := make([]NodeAddress, 0)
+		if peer.Host == "" {
+			nodes := ListNodesResult{}
+			if err := f.Lightning.Request(&ListNodesRequest{Id: peer.Id}, &nodes); err != nil {
+				results[i] = &ConnectResult{Id: peer.Id, Error: "listnodes: " + err.Error()}
+				return
+			}
+			for _, n := range nodes.Nodes {
+				gossip = append(gossip, n.Addresses...)
+			}
+		}
+		results[i] = policy.Connect(peer, gossip, f.Lightning.Connect)
+	})
+	return results, policy.connectError(results)
+}
+
+func (p *ConnectPolicy) connectError(results []*ConnectResult) error {
+	failed := make([]string, 0)
+	for _, r := range results {
+		if r.Connected {
+			continue
+		}
+		reason := r.Error
+		if len(r.Attempts) > 0 {
+			reason = r.Attempts[len(r.Attempts)-1].Error
+		}
+		failed = append(failed, r.Id+": "+reason)
+	}
+	if len(failed) == 0 || (p.OnFailure == FAILURE_DROP && len(failed) < len(results)) {
+		return nil
+	}
+	return fmt.Errorf("unable to connect %d of %d peers: %s", len(failed), len(results), strings.Join(failed, "; "))
+}
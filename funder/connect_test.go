@@ -0,0 +1,199 @@
+package funder
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/niftynei/glightning/glightning"
+)
+
+func TestParsePeer(t *testing.T) {
+	tests := []struct {
+		in   string
+		want PeerAddress
+		err  bool
+	}{
+		{"02aa", PeerAddress{Id: "02aa"}, false},
+		{"02aa@10.0.0.1", PeerAddress{Id: "02aa", Host: "10.0.0.1"}, false},
+		{"02aa@10.0.0.1:9736", PeerAddress{Id: "02aa", Host: "10.0.0.1", Port: 9736}, false},
+		{"02aa@[::1]:9735", PeerAddress{Id: "02aa", Host: "::1", Port: 9735}, false},
+		{"02aa@host.onion", PeerAddress{Id: "02aa", Host: "host.onion"}, false},
+		{"@10.0.0.1", PeerAddress{}, true},
+		{"02aa@", PeerAddress{}, true},
+		{"02aa@10.0.0.1:port", PeerAddress{}, true},
+	}
+	for _, tt := range tests {
+		p, err := ParsePeer(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected error", tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.in, err.Error())
+			continue
+		}
+		if *p != tt.want {
+			t.Errorf("%s: want %+v, have %+v", tt.in, tt.want, *p)
+		}
+	}
+}
+
+func TestConnectPolicy(t *testing.T) {
+	if _, err := NewConnectPolicy(&ConnectConfig{Prefer: "ipv4,smoke"}); err == nil {
+		t.Error("expected unknown address type to fail")
+	}
+	if _, err := NewConnectPolicy(&ConnectConfig{OnFailure: "retry"}); err == nil {
+		t.Error("expected unknown failure policy to fail")
+	}
+	policy, err := NewConnectPolicy(&ConnectConfig{Prefer: "tor, ipv4", Timeout: "10ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gossip := []NodeAddress{
+		{Type: ADDRESS_IPV6, Address: "::1", Port: 9735},
+		{Type: ADDRESS_IPV4, Address: "10.0.0.1", Port: 9735},
+		{Type: ADDRESS_TORV3, Address: "abc.onion", Port: 9735},
+		{Type: ADDRESS_IPV4, Address: "10.0.0.2"},
+	}
+	ordered := policy.Order(gossip)
+	if len(ordered) != 3 || ordered[0].Address != "abc.onion" || ordered[1].Address != "10.0.0.1" || ordered[2].Address != "10.0.0.2" {
+		t.Fatalf("unexpected order %+v", ordered)
+	}
+
+	connect := func(id, host string, port uint) (string, error) {
+		switch host {
+		case "abc.onion":
+			return "", errors.New("tor not configured")
+		case "10.0.0.1":
+			time.Sleep(200 * time.Millisecond)
+		}
+		if port != DEFAULT_PORT {
+			return "", errors.New("wrong port")
+		}
+		return id, nil
+	}
+
+	r := policy.Connect(&PeerAddress{Id: "02aa"}, gossip, connect)
+	if !r.Connected || r.Address != "10.0.0.2:9735" || len(r.Attempts) != 3 {
+		t.Fatalf("unexpected result %+v", r)
+	}
+	if r.Attempts[0].Error != "tor not configured" || r.Attempts[1].Error == "" {
+		t.Errorf("expected failure and timeout recorded, have %+v", r.Attempts)
+	}
+
+	r = policy.Connect(&PeerAddress{Id: "02aa", Host: "abc.onion"}, gossip, connect)
+	if r.Connected || len(r.Attempts) != 1 || r.Error == "" {
+		t.Errorf("given host should be the only attempt, have %+v", r)
+	}
+}
+
+// slowLightning fails or delays fundchannel_start for some peers and tracks concurrency
+type slowLightning struct {
+	fakeLightning
+	fail    map[string]bool
+	delay   map[string]time.Duration
+	mu      sync.Mutex
+	running int
+	most    int
+}
+
+func (l *slowLightning) StartFundChannel(id string, amount uint64, announce bool, feerate *glightning.FeeRate) (string, error) {
+	l.mu.Lock()
+	l.running++
+	if l.running > l.most {
+		l.most = l.running
+	}
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.running--
+		l.mu.Unlock()
+	}()
+
+	time.Sleep(l.delay[id] + 5*time.Millisecond)
+	if l.fail[id] {
+		return "", errors.New("peer refused")
+	}
+	return l.fakeLightning.StartFundChannel(id, amount, announce, feerate)
+}
+
+func TestStartChannelsParallel(t *testing.T) {
+	chans := func() *[]glightning.FundChannelStart {
+		c := make([]glightning.FundChannelStart, 0)
+		for _, id := range []string{"p0", "p1", "p2", "p3", "p4", "p5"} {
+			c = append(c, glightning.FundChannelStart{Id: id, Amount: 100000, Announce: true})
+		}
+		return &c
+	}
+	newLightning := func() *slowLightning {
+		return &slowLightning{
+			fakeLightning: fakeLightning{completed: make(map[string]string)},
+			fail:          map[string]bool{"p1": true},
+			delay:         map[string]time.Duration{"p4": time.Second},
+		}
+	}
+
+	l := newLightning()
+	abort := &ConnectPolicy{Parallel: 3, Timeout: 200 * time.Millisecond, OnFailure: FAILURE_ABORT}
+	if _, _, _, err := startChannels(l, testNet, chans(), nil, abort, nil); err == nil {
+		t.Error("expected abort on a failed peer")
+	}
+	if l.most > 3 {
+		t.Errorf("no more than 3 should start at once, had %d", l.most)
+	}
+
+	l = newLightning()
+	drop := &ConnectPolicy{Parallel: 3, Timeout: 200 * time.Millisecond, OnFailure: FAILURE_DROP}
+	c := chans()
+	outputs, recipients, amt, err := startChannels(l, testNet, c, nil, drop, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*c) != 4 || len(outputs) != 4 || len(recipients) != 4 || amt != 400000 {
+		t.Fatalf("want 4 channels after dropping the failed and slow peers, have %d", len(*c))
+	}
+	for i, ch := range *c {
+		if ch.Id == "p1" || ch.Id == "p4" {
+			t.Errorf("%s should have been dropped", ch.Id)
+		}
+		if outputs[i].Peer != ch.Id || outputs[i].Vout != uint16(i) {
+			t.Errorf("%s output should be %d, have %s %d", ch.Id, i, outputs[i].Peer, outputs[i].Vout)
+		}
+	}
+
+	// the slow start completes after the timeout and is cancelled
+	time.Sleep(time.Second)
+	l.fakeLightning.mu.Lock()
+	cancelled := l.fakeLightning.cancelled
+	l.fakeLightning.mu.Unlock()
+	if len(cancelled) != 1 || cancelled[0] != "p4" {
+		t.Errorf("expected the late start to be cancelled, have %v", cancelled)
+	}
+
+	l = newLightning()
+	l.fail = map[string]bool{"p0": true, "p1": true, "p2": true, "p3": true, "p4": true, "p5": true}
+	if _, _, _, err := startChannels(l, testNet, chans(), nil, drop, nil); err == nil {
+		t.Error("expected an error when every peer fails")
+	}
+}
+
+func TestConnectError(t *testing.T) {
+	results := []*ConnectResult{
+		{Id: "p0", Connected: true},
+		{Id: "p1", Attempts: []ConnectAttempt{{Address: "10.0.0.1:9735", Error: "refused"}}},
+	}
+	if err := (&ConnectPolicy{OnFailure: FAILURE_ABORT}).connectError(results); err == nil {
+		t.Error("abort should fail with one peer unreachable")
+	}
+	if err := (&ConnectPolicy{OnFailure: FAILURE_DROP}).connectError(results); err != nil {
+		t.Errorf("drop should continue with the rest, have %s", err.Error())
+	}
+	if err := (&ConnectPolicy{OnFailure: FAILURE_DROP}).connectError(results[1:]); err == nil {
+		t.Error("drop should fail when no peer connected")
+	}
+}
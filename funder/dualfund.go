@@ -0,0 +1,379 @@
+package funder
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcutil/psbt"
+	"github.com/niftynei/glightning/glightning"
+	"github.com/rsbondi/multifund/logger"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+// option_dual_fund feature bits
+const (
+	DUAL_FUND_REQUIRED = 28
+	DUAL_FUND_OPTIONAL = 29
+)
+
+// max rounds of openchannel_update before giving up on peers agreeing on the transaction
+const DUAL_FUND_ROUNDS = 10
+
+type ListPeersRequest struct {
+	Id string `json:"id,omitempty"`
+}
+
+func (r *ListPeersRequest) Name() string {
+	return "listpeers"
+}
+
+type PeerChannel struct {
+	State          string `json:"state"`
+	ChannelId      string `json:"channel_id"`
+	ShortChannelId string `json:"short_channel_id"`
+	FundingTxid    string `json:"funding_txid"`
+}
+
+type PeerInfo struct {
+	Id        string        `json:"id"`
+	Connected bool          `json:"connected"`
+	Features  string        `json:"features"`
+	Channels  []PeerChannel `json:"channels"`
+}
+
+type ListPeersResult struct {
+	Peers []PeerInfo `json:"peers"`
+}
+
+type OpenChannelInit struct {
+	Id          string `json:"id"`
+	Amount      uint64 `json:"amount"`
+	InitialPsbt string `json:"initialpsbt"`
+	Announce    bool   `json:"announce"`
+}
+
+func (r *OpenChannelInit) Name() string {
+	return "openchannel_init"
+}
+
+type OpenChannelUpdate struct {
+	ChannelId string `json:"channel_id"`
+	Psbt      string `json:"psbt"`
+}
+
+func (r *OpenChannelUpdate) Name() string {
+	return "openchannel_update"
+}
+
+type OpenChannelResult struct {
+	ChannelId          string `json:"channel_id"`
+	Psbt               string `json:"psbt"`
+	CommitmentsSecured bool   `json:"commitments_secured"`
+}
+
+type OpenChannelSigned struct {
+	ChannelId  string `json:"channel_id"`
+	SignedPsbt string `json:"signed_psbt"`
+}
+
+func (r *OpenChannelSigned) Name() string {
+	return "openchannel_signed"
+}
+
+type OpenChannelSignedResult struct {
+	ChannelId string `json:"channel_id"`
+	Tx        string `json:"tx"`
+	Txid      string `json:"txid"`
+}
+
+type OpenChannelAbort struct {
+	ChannelId string `json:"channel_id"`
+}
+
+func (r *OpenChannelAbort) Name() string {
+	return "openchannel_abort"
+}
+
+type DualFundResult struct {
+	Tx       string         `json:"tx"`
+	Txid     string         `json:"txid"`
+	Channels []string       `json:"channels"`
+	Batch    []BatchChannel `json:"-"` // the channels with their ids, for RecordBatch
+}
+
+// SupportsDualFund checks the peer's init features for option_dual_fund
+func (f *Funder) SupportsDualFund(id string) bool {
+	if !f.DualFund {
+		return false
+	}
+	result := ListPeersResult{}
+	if err := f.Lightning.Request(&ListPeersRequest{Id: id}, &result); err != nil {
+		logger.Warnf("listpeers error: %s", err.Error())
+		return false
+	}
+	for _, p := range result.Peers {
+		if p.Id == id {
+			return hasFeature(p.Features, DUAL_FUND_REQUIRED) || hasFeature(p.Features, DUAL_FUND_OPTIONAL)
+		}
+	}
+	return false
+}
+
+// hasFeature checks a bit in a big endian hex feature string
+func hasFeature(features string, bit uint) bool {
+	b, err := hex.DecodeString(features)
+	if err != nil {
+		return false
+	}
+	i := len(b) - 1 - int(bit/8)
+	if i < 0 {
+		return false
+	}
+	return b[i]&(1<<(bit%8)) != 0
+}
+
+// SplitDualFund separates channels to peers that can use the v2 open protocol from the rest
+//   channels with fundchannel_start options stay on v1 so the options are applied
+func (f *Funder) SplitDualFund(chans *[]glightning.FundChannelStart, options map[string]*ChannelOptions) ([]glightning.FundChannelStart, []glightning.FundChannelStart) {
+	v1 := make([]glightning.FundChannelStart, 0)
+	v2 := make([]glightning.FundChannelStart, 0)
+	for _, c := range *chans {
+		if options[c.Id].empty() && f.SupportsDualFund(c.Id) {
+			v2 = append(v2, c)
+		} else {
+			v1 = append(v1, c)
+		}
+	}
+	return v1, v2
+}
+
+// FundDual funds v1 and v2 channels in a single transaction
+//   v1 channels are started first so their outputs are part of the initial PSBT, the v2
+//   peers then add their funding outputs and contributions through openchannel_init/update
+//   until every peer has secured commitments on the same transaction.  Our inputs are
+//   signed once and passed to each v2 peer, the signed copies returned are merged and broadcast
+func (f *Funder) FundDual(v1, v2 []glightning.FundChannelStart, options map[string]*ChannelOptions, log *logger.Logger) (*DualFundResult, error) {
+	v2amt, err := channelTotal(v2)
+	if err != nil {
+		return nil, err
+	}
+	outamt, err := channelTotal(append(v1[:len(v1):len(v1)], v2...))
+	if err != nil {
+		return nil, err
+	}
+
+	satsPerVbyte := f.SatsPerVbyte()
+	fee := wallet.Amount(satsPerVbyte * uint64(160+43*(len(v1)+len(v2))))
+
+	wally := f.Wallet()
+	change := wally.ChangeAddress()
+	utxos, err := wally.Utxos(outamt, fee)
+	if err != nil {
+		return nil, err
+	}
+	utxoamt, err := wallet.UtxoTotal(utxos)
+	if err != nil {
+		return nil, err
+	}
+	if utxoamt < outamt+fee {
+		return nil, errors.New("Insufficient funds, Need more coin")
+	}
+
+	// until our signatures are shared every failure cancels the v1 channels and aborts the v2 opens,
+	//   v1 channels can still be cancelled once completed as the funding was never sent.  Once any
+	//   v2 peer has our signatures it can broadcast, so nothing is rolled back after that
+	channelIds := make([]string, 0)
+	shared := false
+	defer func() {
+		if !shared {
+			cancelChannels(f.Lightning, v1, log)
+			f.abortDual(channelIds, log)
+		}
+	}()
+
+	outputs, recipients, recipamt, err := startChannels(f.Lightning, f.BitcoinNet, &v1, options, nil, log)
+	if err != nil {
+		return nil, err
+	}
+
+	// the v2 funding outputs are added by lightningd, so they are only accounted for in the fee and change
+	changeRecipient := &wallet.TxRecipient{Address: change}
+	vsize := wallet.InputFeeSats(utxos, f.BitcoinNet) + wallet.OutputFeeSats(append(recipients, changeRecipient), f.BitcoinNet) + uint64(43*len(v2)) + 11
+	fee = wallet.Amount(satsPerVbyte * vsize)
+	if amt, ok := wallet.Change(utxoamt, recipamt+v2amt, fee); ok { // no change if dust, save on tx fee
+		changeRecipient.Amount = amt
+		recipients = append(recipients, changeRecipient)
+	}
+
+	initial, err := wallet.CreateWalletPsbt(recipients, utxos, f.BitcoinNet)
+	if err != nil {
+		return nil, err
+	}
+
+	final, err := f.negotiateDual(initial, v2, &channelIds)
+	if err != nil {
+		return nil, err
+	}
+	// the v1 channels are completed with the unsigned txid
+	if err := nativeSegwitInputs(final); err != nil {
+		return nil, err
+	}
+
+	var unsigned bytes.Buffer
+	if err := final.UnsignedTx.Serialize(&unsigned); err != nil {
+		return nil, err
+	}
+	tx := wallet.Transaction{
+		TxId:     final.UnsignedTx.TxHash().String(),
+		Signed:   unsigned.Bytes(),
+		Unsigned: unsigned.Bytes(),
+	}
+
+	// the peers' inputs and outputs are included, the limits apply to the whole transaction
+	in, err := wallet.InputTotal(final)
+	if err == nil {
+		err = f.GuardTx(tx, in)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	channels, err := completeChannels(f.Lightning, tx, outputs, nil) // v2 peers add their own inputs
+	if err != nil {
+		return nil, err
+	}
+
+	tx.Signed = nil
+	wally.Sign(&tx, utxos)
+	if tx.Signed == nil {
+		return nil, errors.New("wallet was unable to sign")
+	}
+	if err := wallet.AddSignedInputs(final, tx.Signed, utxos); err != nil {
+		return nil, err
+	}
+	signedPsbt, err := final.B64Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	// from here the transaction may be broadcast by a peer, failures are reported not rolled back
+	shared = true
+	signedErr := func(err error) error {
+		log.Errorf("dual funding %s failed after signing: %s", tx.TxId, err.Error())
+		return fmt.Errorf("%s, our signatures were shared so %s may still confirm, watch it instead of funding again", err.Error(), tx.TxId)
+	}
+
+	signedTxs := make([][]byte, 0)
+	for _, cid := range channelIds {
+		result := OpenChannelSignedResult{}
+		if err := f.Lightning.Request(&OpenChannelSigned{ChannelId: cid, SignedPsbt: signedPsbt}, &result); err != nil {
+			return nil, signedErr(fmt.Errorf("openchannel_signed %s: %s", cid, err.Error()))
+		}
+		raw, err := hex.DecodeString(result.Tx)
+		if err != nil {
+			return nil, signedErr(err)
+		}
+		signedTxs = append(signedTxs, raw)
+		channels = append(channels, cid)
+	}
+
+	merged, err := wallet.MergeWitnesses(signedTxs)
+	if err != nil {
+		return nil, signedErr(err)
+	}
+	if merged.TxId != tx.TxId {
+		return nil, signedErr(fmt.Errorf("signed txid %s does not match %s the channels were completed with", merged.TxId, tx.TxId))
+	}
+
+	txid, err := f.Broadcast(merged, in)
+	if err != nil {
+		return nil, signedErr(err)
+	}
+
+	return &DualFundResult{
+		Tx:       merged.String(),
+		Txid:     txid,
+		Channels: channels,
+		Batch:    append(OutputChannels(outputs, channels), BatchChannels(v2, channelIds)...),
+	}, nil
+}
+
+// negotiateDual runs openchannel_init for each v2 peer then openchannel_update rounds with the
+//   merged PSBT until every peer has secured commitments on the same transaction
+func (f *Funder) negotiateDual(initial *psbt.Packet, v2 []glightning.FundChannelStart, channelIds *[]string) (*psbt.Packet, error) {
+	encoded, err := initial.B64Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	merged := initial
+	for _, c := range v2 {
+		result := OpenChannelResult{}
+		err := f.Lightning.Request(&OpenChannelInit{Id: c.Id, Amount: c.Amount, InitialPsbt: encoded, Announce: c.Announce}, &result)
+		if err != nil {
+			return nil, fmt.Errorf("openchannel_init %s: %s", c.Id, err.Error())
+		}
+		*channelIds = append(*channelIds, result.ChannelId)
+		if merged, err = mergeEncoded(merged, result.Psbt); err != nil {
+			return nil, err
+		}
+	}
+
+	for round := 0; round < DUAL_FUND_ROUNDS; round++ {
+		txid := merged.UnsignedTx.TxHash()
+		encoded, err := merged.B64Encode()
+		if err != nil {
+			return nil, err
+		}
+
+		secured := true
+		for _, cid := range *channelIds {
+			result := OpenChannelResult{}
+			if err := f.Lightning.Request(&OpenChannelUpdate{ChannelId: cid, Psbt: encoded}, &result); err != nil {
+				return nil, fmt.Errorf("openchannel_update %s: %s", cid, err.Error())
+			}
+			if merged, err = mergeEncoded(merged, result.Psbt); err != nil {
+				return nil, err
+			}
+			secured = secured && result.CommitmentsSecured
+		}
+
+		if merged.UnsignedTx.TxHash() == txid {
+			if secured {
+				return merged, nil
+			}
+			continue
+		}
+		if secured {
+			// a peer secured commitments for a transaction that has since changed
+			return nil, errors.New("dual funding peers did not agree on the funding transaction")
+		}
+	}
+	return nil, errors.New("dual funding negotiation did not complete")
+}
+
+func mergeEncoded(base *psbt.Packet, encoded string) (*psbt.Packet, error) {
+	update, err := wallet.DecodePsbt(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return wallet.MergePsbt(base, update)
+}
+
+func (f *Funder) abortDual(channelIds []string, log *logger.Logger) {
+	for _, cid := range channelIds {
+		if err := f.Lightning.Request(&OpenChannelAbort{ChannelId: cid}, &OpenChannelResult{}); err != nil {
+			log.Warnf("openchannel_abort error: %s", err.Error())
+		}
+	}
+}
+
+func cancelChannels(l ChannelFunder, chans []glightning.FundChannelStart, log *logger.Logger) {
+	for _, c := range chans {
+		if _, err := l.CancelFundChannel(c.Id); err != nil {
+			log.Warnf("fundchannel_cancel error: %s", err.Error())
+		}
+	}
+}
@@ -2,39 +2,134 @@ package funder
 
 import (
 	"bytes"
-	"encoding/hex"
 	"errors"
-	"log"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcutil"
 	"github.com/niftynei/glightning/glightning"
+	"github.com/niftynei/glightning/jrpc2"
+	"github.com/rsbondi/multifund/logger"
 	"github.com/rsbondi/multifund/wallet"
 )
 
 type Funder struct {
-	Lightning      *glightning.Lightning
-	Wallettype     int
-	Bitcoin        *wallet.BitcoinWallet // we always use this at least for broadcasting the tx
-	Internal       wallet.Wallet
-	Wally          wallet.Wallet
-	BitcoinNet     *chaincfg.Params
-	Lightningdir   string
-	internalWallet *wallet.InternalWallet
+	Lightning     Lightning
+	Wallettype    int
+	Bitcoin       Bitcoind // only set when bitcoind is used, for the wallet or chain backend
+	Chain         wallet.ChainBackend
+	Fees          wallet.FeeEstimator
+	Broadcaster   wallet.Broadcaster
+	Internal      wallet.Wallet
+	Wally         wallet.Wallet
+	BitcoinNet    *chaincfg.Params
+	Lightningdir  string
+	DualFund      bool // lightningd has experimental dual funding enabled
+	Native        bool // route through lightningd's own funding commands when available
+	Capabilities  *Capabilities
+	ConnectPolicy *ConnectPolicy   // address preference and timeout when connecting peers, defaults when nil
+	Limits        *BroadcastLimits // fee limits checked before broadcast, defaults when nil
+	sessions      *SessionStore
+	batches       *BatchStore
+	history       *HistoryStore
+	labels        *LabelStore
+	queue         *WithdrawQueue
+	schedule      *Schedule
+}
+
+// ChannelFunder is the part of the lightning RPC used to open channels
+type ChannelFunder interface {
+	StartFundChannel(id string, amount uint64, announce bool, feerate *glightning.FeeRate) (string, error)
+	CompleteFundChannel(peerId, txId string, txout uint16) (string, error)
+	CancelFundChannel(peerId string) (bool, error)
+	Request(m jrpc2.Method, resp interface{}) error
+}
+
+// Lightning is the lightningd rpc the funder uses, *glightning.Lightning in the plugin
+type Lightning interface {
+	ChannelFunder
+	Connect(peerId, host string, port uint) (string, error)
+	NewAddr() (string, error)
+	ListConfigs() (map[string]interface{}, error)
+}
+
+// Bitcoind is the bitcoind rpc the funder uses besides the chain backend, *wallet.BitcoinWallet in the plugin
+type Bitcoind interface {
+	wallet.Wallet
+	SetLabel(address, label string) error
+	TestMempoolAccept(rawtx string) (*wallet.MempoolAcceptResult, error)
 }
 
 type FundingInfo struct {
-	Outputs    map[string]*wallet.Outputs
+	Outputs    wallet.ChannelOutputs
 	Recipients []*wallet.TxRecipient
 	Utxos      []wallet.UTXO
 }
 
+// InternalWallet provides lightningd's own wallet, read from the lightning dir on first use
 func (f *Funder) InternalWallet() wallet.Wallet {
-	if f.internalWallet == nil {
-		f.internalWallet = wallet.NewInternalWallet(f.Lightning, f.BitcoinNet, f.Lightningdir)
+	if f.Internal == nil {
+		f.Internal = wallet.NewInternalWallet(f.Lightning, f.BitcoinNet, f.Lightningdir)
+	}
+	return f.Internal
+}
+
+// Wallet provides the wallet selected by the multi-wallet option
+func (f *Funder) Wallet() wallet.Wallet {
+	if f.Wally == nil {
+		switch f.Wallettype {
+		case wallet.WALLET_BITCOIN:
+			f.Wally = f.Bitcoin
+		case wallet.WALLET_INTERNAL:
+			f.Wally = f.InternalWallet()
+		}
+	}
+	return f.Wally
+}
+
+// SatsPerVbyte is the fee rate from the configured fee policy
+func (f *Funder) SatsPerVbyte() uint64 {
+	rate, err := f.Fees.SatsPerVbyte()
+	if err != nil {
+		logger.Warnf("fee estimate error, using %d sat/vbyte: %s", rate, err.Error())
 	}
-	return f.internalWallet
+	return rate
+}
+
+// EstimateSatsPerVbyte is the fee source's own estimate without the fallback or limits, for
+//   deciding whether fees are low enough to send now
+func (f *Funder) EstimateSatsPerVbyte() (uint64, error) {
+	estimator := f.Fees
+	if policy, ok := f.Fees.(*wallet.FeePolicy); ok {
+		estimator = policy.Estimator
+	}
+	if estimator == nil {
+		return 0, errors.New("no fee estimator")
+	}
+	rate, err := estimator.SatsPerVbyte()
+	if err != nil {
+		return 0, err
+	}
+	if rate == 0 {
+		return 0, errors.New("no fee estimate available")
+	}
+	return rate, nil
+}
+
+// Sessions provides the pending multisig funding sessions, loaded from the lightning dir on first use
+func (f *Funder) Sessions() (*SessionStore, error) {
+	if f.sessions == nil {
+		s, err := NewSessionStore(f.Lightningdir)
+		if err != nil {
+			return nil, err
+		}
+		f.sessions = s
+	}
+	return f.sessions, nil
 }
 
 // GetChannelAddresses provides funding information for creating a transaction
@@ -42,11 +137,10 @@ func (f *Funder) InternalWallet() wallet.Wallet {
 //   this opens the potential for a multi party channel opening, or use of an external
 //   manual wallet signing
 // returns a FundingInfo struct with state, recipients and utxos
-func (f *Funder) GetChannelAddresses(chans *[]glightning.FundChannelStart) (*FundingInfo, error) {
-	var recipients = make([]*wallet.TxRecipient, 0)
-	outputs := make(map[string]*wallet.Outputs, 0)
-	outamt := uint64(0)
-	rate := f.Bitcoin.EstimateSmartFee(100)
+//   options are the extra fundchannel_start options by peer, checked by PreflightFund
+func (f *Funder) GetChannelAddresses(chans *[]glightning.FundChannelStart, options map[string]*ChannelOptions, log *logger.Logger) (*FundingInfo, error) {
+
+	satsPerVbyte := f.SatsPerVbyte()
 	// fee calc, we know the output rate, type is known before we create the addresses
 	//   43 vbytes per channel
 	// we don't know how many utxos, and wee need some starting point to fetch them
@@ -55,69 +149,43 @@ func (f *Funder) GetChannelAddresses(chans *[]glightning.FundChannelStart) (*Fun
 	//   and we may not use change if we are within the dust buffer
 	//   this may need further consideration
 	bytesEstimate := uint64(160 + 43*len(*chans)) // this may change if we need mor utxos
-	feerate := rate.Result.(*wallet.EstimateSmartFeeResult).Feerate / 1000.0
-
-	var fee uint64
-	if feerate == 0.0 {
-		log.Println("unable to estimate fee rate, using default")
-		fee = 2 * bytesEstimate
-	} else {
-		fee = wallet.Satoshis(feerate) * bytesEstimate
-	}
-
-	recipamt := int64(0)
-	for _, c := range *chans {
-		outamt += uint64(c.Amount)
-	}
+	fee := wallet.Amount(satsPerVbyte * bytesEstimate)
 
-	if f.Wally == nil {
-		switch f.Wallettype {
-		case wallet.WALLET_BITCOIN:
-			f.Wally = f.Bitcoin
-		case wallet.WALLET_INTERNAL:
-			f.Wally = f.InternalWallet()
-		}
+	outamt, err := channelTotal(*chans)
+	if err != nil {
+		return nil, err
 	}
 
-	change := f.Wally.ChangeAddress()
-	utxos, err := f.Wally.Utxos(outamt, fee)
+	wally := f.Wallet()
+	change := wally.ChangeAddress()
+	utxos, err := wally.Utxos(outamt, fee)
 	if err != nil {
 		return nil, err
 	}
-	utxoamt := uint64(0)
-	for _, u := range utxos {
-		utxoamt += u.Amount
+	utxoamt, err := wallet.UtxoTotal(utxos)
+	if err != nil {
+		return nil, err
 	}
 
-	if outamt > utxoamt+fee {
+	if outamt+fee > utxoamt {
 		return nil, errors.New("Insufficient funds, Need more coin")
 	}
 
-	for i, c := range *chans {
-		result, err := f.Lightning.StartFundChannel(c.Id, c.Amount, c.Announce, glightning.NewFeeRate(0, 2000)) // TODO: check for feerate
-		if err != nil {
-			log.Printf("fund start error: %s", err.Error())
-			return nil, err
-		}
-		addr, err := btcutil.DecodeAddress(result, f.BitcoinNet)
-		addr.ScriptAddress()
-
-		amt := int64(c.Amount) // difference in wire and glightning
-		outputs[c.Id] = &wallet.Outputs{Vout: uint16(i), Amount: amt, Script: addr.ScriptAddress()}
-		recipamt += amt
-		recipients = append(recipients, &wallet.TxRecipient{Address: result, Amount: amt})
+	outputs, recipients, recipamt, err := startChannels(f.Lightning, f.BitcoinNet, chans, options, f.ConnectPolicy, log)
+	if err != nil {
+		return nil, err
 	}
 
-	if utxoamt-fee > wallet.DUST_LIMIT { // no change if dust, save on tx fee
-		recipients = append(recipients, &wallet.TxRecipient{Address: change, Amount: int64(utxoamt-fee) - recipamt})
+	if amt, ok := wallet.Change(utxoamt, recipamt, fee); ok { // no change if dust, save on tx fee
+		recipients = append(recipients, &wallet.TxRecipient{Address: change, Amount: amt})
 		// recalculate fee, for more accureate change amount
 		vsize := wallet.InputFeeSats(utxos, f.BitcoinNet) + wallet.OutputFeeSats(recipients, f.BitcoinNet) + 11
-		if feerate == 0.0 {
-			fee = 2 * vsize
+		fee = wallet.Amount(satsPerVbyte * vsize)
+		if amt, ok = wallet.Change(utxoamt, recipamt, fee); ok {
+			recipients[len(recipients)-1].Amount = amt
 		} else {
-			fee = wallet.Satoshis(feerate) * vsize
+			recipients = recipients[:len(recipients)-1] // the larger fee leaves only dust
 		}
-		recipients[len(recipients)-1].Amount = int64(utxoamt-fee) - recipamt
 	}
 	fundinfo := &FundingInfo{
 		Outputs:    outputs,
@@ -127,32 +195,141 @@ func (f *Funder) GetChannelAddresses(chans *[]glightning.FundChannelStart) (*Fun
 	return fundinfo, nil
 }
 
-func (f *Funder) CompleteChannels(tx wallet.Transaction, outputs map[string]*wallet.Outputs) ([]string, error) {
-	channels := make([]string, 0)
-	wtx := wire.NewMsgTx(2)
-	r := bytes.NewReader(tx.Signed)
-	wtx.Deserialize(r)
-
-	for k, o := range outputs {
-		vout := -1
-		for v, txout := range wtx.TxOut {
-			log.Printf("finding output index: %v %v %d", txout.PkScript[2:], o.Script, v)
-			if hex.EncodeToString(txout.PkScript[2:]) == hex.EncodeToString(o.Script) {
-				if o.Amount != txout.Value {
-					return nil, errors.New("Can not find output in transaction")
-				}
-				vout = v
+// startChannels calls fundchannel_start for each channel and provides the outputs
+// and recipients needed for the funding transaction along with their total amount
+//   channels are started in parallel as the policy allows, a nil policy starts them one by one
+//   with the drop policy failed channels are removed from chans, the error is only when none started
+func startChannels(l ChannelFunder, net *chaincfg.Params, chans *[]glightning.FundChannelStart, options map[string]*ChannelOptions, policy *ConnectPolicy, log *logger.Logger) (wallet.ChannelOutputs, []*wallet.TxRecipient, wallet.Amount, error) {
+	if id := DuplicatePeer(*chans); id != "" {
+		return nil, nil, 0, errors.New("only one channel per peer can be opened in a batch, " + id + " is repeated")
+	}
+	if policy == nil {
+		policy = serialPolicy
+	}
+	addrs := make([]string, len(*chans))
+	errs := make([]error, len(*chans))
+	if policy.Parallel <= 1 {
+		for i, c := range *chans {
+			if addrs[i], errs[i] = policy.startChannel(l, c, options[c.Id]); errs[i] != nil && policy.OnFailure == FAILURE_ABORT {
 				break
 			}
 		}
-		if vout == -1 {
-			return nil, errors.New("Can not find output in transaction")
+	} else {
+		forEach(len(*chans), policy.Parallel, func(i int) {
+			addrs[i], errs[i] = policy.startChannel(l, (*chans)[i], options[(*chans)[i].Id])
+		})
+	}
+
+	started := make([]glightning.FundChannelStart, 0)
+	startedAddrs := make([]string, 0)
+	failed := make([]string, 0)
+	for i, c := range *chans {
+		if errs[i] != nil {
+			log.Warnf("fund start error: %s %s", c.Id, errs[i].Error())
+			failed = append(failed, c.Id+": "+errs[i].Error())
+			continue
+		}
+		if addrs[i] == "" {
+			continue // not tried after an earlier failure
+		}
+		started = append(started, c)
+		startedAddrs = append(startedAddrs, addrs[i])
+	}
+	if len(failed) > 0 && (policy.OnFailure == FAILURE_ABORT || len(started) == 0) {
+		return nil, nil, 0, fmt.Errorf("unable to start %d of %d channels: %s", len(failed), len(*chans), strings.Join(failed, "; "))
+	}
+
+	recipients := make([]*wallet.TxRecipient, 0)
+	outputs := make(wallet.ChannelOutputs, 0)
+	recipamt := wallet.Amount(0)
+	for i, c := range started {
+		addr, err := btcutil.DecodeAddress(startedAddrs[i], net)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+
+		amt := wallet.Amount(c.Amount)
+		script, err := txscript.PayToAddrScript(addr)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		outputs = append(outputs, &wallet.Outputs{Peer: c.Id, Vout: uint16(i), Amount: amt, Script: script})
+		recipamt += amt
+		recipients = append(recipients, &wallet.TxRecipient{Address: startedAddrs[i], Amount: amt})
+	}
+	*chans = started
+	return outputs, recipients, recipamt, nil
+}
+
+// startChannel gives up waiting for fundchannel_start after the timeout, a start that
+//   completes later is cancelled so the peer is not left waiting for a funding transaction
+func (p *ConnectPolicy) startChannel(l ChannelFunder, c glightning.FundChannelStart, o *ChannelOptions) (string, error) {
+	if p.Timeout <= 0 {
+		return startFundChannel(l, c, o)
+	}
+	type started struct {
+		addr string
+		err  error
+	}
+	done := make(chan started)
+	abandoned := make(chan struct{})
+	go func() {
+		addr, err := startFundChannel(l, c, o)
+		select {
+		case done <- started{addr, err}:
+		case <-abandoned:
+			if err == nil {
+				l.CancelFundChannel(c.Id)
+			}
 		}
-		cid, err := f.Lightning.CompleteFundChannel(k, tx.TxId, uint16(vout))
+	}()
+	select {
+	case s := <-done:
+		return s.addr, s.err
+	case <-time.After(p.Timeout):
+		close(abandoned)
+		return "", errors.New("fundchannel_start timed out after " + p.Timeout.String())
+	}
+}
+
+// CompleteChannels completes every channel once the funding outputs are found in the transaction
+//   inputs are the outpoints the transaction may spend, nil when they are not known
+func (f *Funder) CompleteChannels(tx wallet.Transaction, outputs wallet.ChannelOutputs, inputs []wire.OutPoint) ([]string, error) {
+	return completeChannels(f.Lightning, tx, outputs, inputs)
+}
+
+// completeChannels matches each funding output before completing any channel
+func completeChannels(l ChannelFunder, tx wallet.Transaction, outputs wallet.ChannelOutputs, inputs []wire.OutPoint) ([]string, error) {
+	channels := make([]string, 0)
+	wtx := wire.NewMsgTx(2)
+	if err := wtx.Deserialize(bytes.NewReader(tx.Signed)); err != nil {
+		return nil, err
+	}
+
+	vouts, err := MatchOutputs(wtx, outputs, inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, o := range outputs {
+		cid, err := l.CompleteFundChannel(o.Peer, tx.TxId, uint16(vouts[i]))
 		if err != nil {
 			return nil, err
 		}
+		o.Vout = uint16(vouts[i])
 		channels = append(channels, cid)
 	}
 	return channels, nil
 }
+
+// channelTotal totals the channel amounts, failing rather than wrapping around
+func channelTotal(chans []glightning.FundChannelStart) (wallet.Amount, error) {
+	total := wallet.Amount(0)
+	for _, c := range chans {
+		var err error
+		if total, err = total.Add(wallet.Amount(c.Amount)); err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,67 @@
+package funder
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/niftynei/glightning/glightning"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+func TestStartChannelsDuplicatePeer(t *testing.T) {
+	l := &fakeLightning{completed: make(map[string]string)}
+	chans := []glightning.FundChannelStart{
+		{Id: "peer", Amount: 100000},
+		{Id: "other", Amount: 100000},
+		{Id: "peer", Amount: 200000},
+	}
+	if _, _, _, err := startChannels(l, testNet, &chans, nil, nil, nil); err == nil {
+		t.Fatal("expected a repeated peer to be rejected")
+	}
+	if len(l.completed) != 0 || len(l.requests) != 0 {
+		t.Error("no channel should be started")
+	}
+}
+
+func TestCompleteChannelsOnce(t *testing.T) {
+	l := &fakeLightning{completed: make(map[string]string)}
+	chans := []glightning.FundChannelStart{{Id: "a", Amount: 100000}, {Id: "b", Amount: 100000}}
+	outputs, recipients, _, err := startChannels(l, testNet, &chans, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := func(recipients []*wallet.TxRecipient) wallet.Transaction {
+		wtx := wire.NewMsgTx(2)
+		wtx.AddTxIn(wire.NewTxIn(&wire.OutPoint{}, nil, nil))
+		for _, r := range recipients {
+			addr, _ := btcutil.DecodeAddress(r.Address, testNet)
+			script := append([]byte{0x00, 0x20}, addr.ScriptAddress()...)
+			wtx.AddTxOut(wire.NewTxOut(r.Amount.Int64(), script))
+		}
+		var buf bytes.Buffer
+		wtx.Serialize(&buf)
+		return wallet.Transaction{TxId: wtx.TxHash().String(), Signed: buf.Bytes()}
+	}
+
+	// the same funding output twice, with b's missing, must not complete either channel
+	outputs[1].Script = outputs[0].Script
+	if _, err := completeChannels(l, signed(recipients[:1]), outputs, nil); err == nil {
+		t.Fatal("one transaction output should not complete two channels")
+	}
+	if len(l.completed) != 0 {
+		t.Errorf("no channel should be completed when an output is missing, have %v", l.completed)
+	}
+
+	outputs, recipients, _, _ = startChannels(l, testNet, &chans, nil, nil, nil)
+	reversed := []*wallet.TxRecipient{recipients[1], recipients[0]}
+	channels, err := completeChannels(l, signed(reversed), outputs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 2 || outputs[0].Peer != "a" || outputs[0].Vout != 1 || outputs[1].Vout != 0 {
+		t.Errorf("unexpected outputs %+v %+v", outputs[0], outputs[1])
+	}
+}
@@ -0,0 +1,81 @@
+package funder
+
+import (
+	"bytes"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+// default limits on the fee of a broadcast transaction, above either is taken to be a bug
+const (
+	DEFAULT_MAX_FEE         = 1000000 // satoshi
+	DEFAULT_MAX_FEE_PERCENT = 10      // of the amount sent
+)
+
+// an amount in the transaction is impossible
+const REJECT_AMOUNT = "amount"
+
+// BroadcastLimits bound the fee of every transaction the plugin broadcasts, 0 for no limit
+type BroadcastLimits struct {
+	MaxFee        uint64 // satoshi
+	MaxFeePercent uint64 // of the total of the outputs
+}
+
+// CheckTx is the last check before a transaction is sent, in is the total of the outputs it spends
+//   amounts must not be negative or overflow, outputs other than data must not be dust and the fee
+//   the inputs leave must be within the limits
+func (l *BroadcastLimits) CheckTx(wtx *wire.MsgTx, in wallet.Amount) error {
+	if in == 0 || in > wallet.MAX_SATOSHI {
+		return reject(REJECT_AMOUNT, "inputs total %d", in)
+	}
+	out := wallet.Amount(0)
+	for i, o := range wtx.TxOut {
+		if o.Value < 0 || o.Value > wallet.MAX_SATOSHI.Int64() {
+			return reject(REJECT_AMOUNT, "output %d of %d", i, o.Value)
+		}
+		var err error
+		if out, err = out.Add(wallet.Amount(o.Value)); err != nil {
+			return reject(REJECT_AMOUNT, "outputs total more than %d", uint64(wallet.MAX_SATOSHI))
+		}
+		if o.Value < wallet.DUST_LIMIT.Int64() && txscript.GetScriptClass(o.PkScript) != txscript.NullDataTy {
+			return reject(REJECT_AMOUNT, "output %d of %d is dust", i, o.Value)
+		}
+	}
+	if out > in {
+		return reject(REJECT_FEE, "outputs are %d more than inputs", out-in)
+	}
+
+	fee := uint64(in - out)
+	if l.MaxFee > 0 && fee > l.MaxFee {
+		return reject(REJECT_FEE, "fee of %d is above the limit of %d", fee, l.MaxFee)
+	}
+	if l.MaxFeePercent > 0 && fee*100 > l.MaxFeePercent*uint64(out) {
+		return reject(REJECT_FEE, "fee of %d is more than %d%% of the %d sent", fee, l.MaxFeePercent, out)
+	}
+	return nil
+}
+
+// GuardTx checks a signed transaction against the broadcast limits, defaults when none are set
+//   callers completing channels check before fundchannel_complete so nothing is completed with it
+func (f *Funder) GuardTx(tx wallet.Transaction, in wallet.Amount) error {
+	wtx := wire.NewMsgTx(2)
+	if err := wtx.Deserialize(bytes.NewReader(tx.Signed)); err != nil {
+		return reject(REJECT_DECODE, "invalid transaction: %s", err.Error())
+	}
+	limits := f.Limits
+	if limits == nil {
+		limits = &BroadcastLimits{DEFAULT_MAX_FEE, DEFAULT_MAX_FEE_PERCENT}
+	}
+	return limits.CheckTx(wtx, in)
+}
+
+// Broadcast sends a transaction once it passes GuardTx, every transaction the plugin
+//   builds or completes is sent through here
+func (f *Funder) Broadcast(tx wallet.Transaction, in wallet.Amount) (string, error) {
+	if err := f.GuardTx(tx, in); err != nil {
+		return "", err
+	}
+	return f.Broadcaster.Broadcast(tx.String())
+}
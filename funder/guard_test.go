@@ -0,0 +1,73 @@
+package funder
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+func TestCheckTx(t *testing.T) {
+	limits := &BroadcastLimits{MaxFee: 10000, MaxFeePercent: 10}
+	tx := func(values ...int64) *wire.MsgTx {
+		wtx := wire.NewMsgTx(2)
+		wtx.AddTxIn(wire.NewTxIn(&wire.OutPoint{}, nil, nil))
+		for i, v := range values {
+			wtx.AddTxOut(wire.NewTxOut(v, p2wsh(string(rune('a'+i)))))
+		}
+		return wtx
+	}
+	data := tx(100000)
+	data.AddTxOut(wire.NewTxOut(0, []byte{0x6a, 0x01, 0x00}))
+
+	tests := []struct {
+		name   string
+		wtx    *wire.MsgTx
+		in     wallet.Amount
+		reason string
+	}{
+		{"ok", tx(100000, 50000), 151000, ""},
+		{"data output", data, 101000, ""},
+		{"no limit", tx(100000), 100500, ""},
+		{"absolute fee", tx(1000000), 1020000, REJECT_FEE},
+		{"percent fee", tx(50000), 60000, REJECT_FEE},
+		{"outputs above inputs", tx(100000, 50000), 140000, REJECT_FEE},
+		{"negative output", tx(100000, -1), 101000, REJECT_AMOUNT},
+		{"wrapped change", tx(100000, int64(^uint64(0)>>1)), 101000, REJECT_AMOUNT},
+		{"outputs overflow", tx(wallet.MAX_SATOSHI.Int64(), wallet.MAX_SATOSHI.Int64()), wallet.MAX_SATOSHI, REJECT_AMOUNT},
+		{"dust", tx(100000, 545), 101000, REJECT_AMOUNT},
+		{"no inputs", tx(100000), 0, REJECT_AMOUNT},
+	}
+	for _, tt := range tests {
+		err := limits.CheckTx(tt.wtx, tt.in)
+		if tt.reason == "" && err != nil {
+			t.Errorf("%s: %s", tt.name, err.Error())
+		}
+		if tt.reason != "" && !rejected(err, tt.reason) {
+			t.Errorf("%s: want %s rejection, have %v", tt.name, tt.reason, err)
+		}
+	}
+
+	if err := (&BroadcastLimits{}).CheckTx(tx(1000000), 1500000); err != nil {
+		t.Errorf("0 should not limit the fee, have %v", err)
+	}
+}
+
+func TestBroadcastGuard(t *testing.T) {
+	wtx := wire.NewMsgTx(2)
+	wtx.AddTxIn(wire.NewTxIn(&wire.OutPoint{}, nil, nil))
+	wtx.AddTxOut(wire.NewTxOut(100000, p2wsh("a")))
+	var buf bytes.Buffer
+	wtx.Serialize(&buf)
+	tx := wallet.Transaction{TxId: wtx.TxHash().String(), Signed: buf.Bytes()}
+
+	f := &Funder{Broadcaster: &wallet.NoBroadcaster{}}
+	// the default limits apply when none are configured, 2000000 is above DEFAULT_MAX_FEE
+	if _, err := f.Broadcast(tx, 2100000); !rejected(err, REJECT_FEE) {
+		t.Errorf("want fee rejection, have %v", err)
+	}
+	if _, err := f.Broadcast(tx, 101000); err != nil {
+		t.Error(err)
+	}
+}
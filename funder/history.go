@@ -0,0 +1,274 @@
+package funder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/rsbondi/multifund/logger"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+const HISTORY_FILE = "multifund_history.jsonl"
+
+// history entry types, the command that made the transaction
+const (
+	HISTORY_FUND         = "fund_multi"
+	HISTORY_CONNECT_FUND = "connect_fund_multi"
+	HISTORY_WITHDRAW     = "withdraw_multi"
+	HISTORY_EXTERNAL     = "fund_multi_complete"
+	HISTORY_MULTISIG     = "fund_multi_sign"
+	HISTORY_JOIN         = "fund_multi_join"
+)
+
+const HISTORY_DATE_FORMAT = "2006-01-02"
+
+const HISTORY_CSV_HEADER = "time,type,txid,vout,address,satoshi,peer,fee,feerate"
+
+type HistoryInput struct {
+	Txid   string        `json:"txid"`
+	Vout   uint32        `json:"vout"`
+	Amount wallet.Amount `json:"satoshi,omitempty"` // unknown when lightningd or an external wallet selected the inputs
+}
+
+type HistoryOutput struct {
+	Vout    uint32        `json:"vout"`
+	Address string        `json:"address"`
+	Amount  wallet.Amount `json:"satoshi"`
+	Peer    string        `json:"peer,omitempty"`
+	Label   string        `json:"label,omitempty"`
+}
+
+// HistoryEntry is one transaction made through the plugin
+type HistoryEntry struct {
+	Type     string          `json:"type"`
+	Txid     string          `json:"txid"`
+	Time     int64           `json:"time"`
+	Inputs   []HistoryInput  `json:"inputs"`
+	Outputs  []HistoryOutput `json:"outputs"`
+	Fee      wallet.Amount   `json:"fee,omitempty"`
+	FeeRate  uint64          `json:"feerate,omitempty"` // sat/vbyte
+	Peers    []string        `json:"peers,omitempty"`
+	Channels []string        `json:"channels,omitempty"`
+}
+
+// NewHistoryEntry reads the inputs and outputs from the signed transaction
+//   the fee is only known when the utxos spent are known
+//   peers maps funding output index to peer id, labels are by peer id or address
+func NewHistoryEntry(kind, rawtx string, utxos []wallet.UTXO, peers map[uint32]string, channels []string, labels map[string]string, net *chaincfg.Params) (*HistoryEntry, error) {
+	b, err := hex.DecodeString(rawtx)
+	if err != nil {
+		return nil, err
+	}
+	wtx := wire.NewMsgTx(2)
+	if err := wtx.Deserialize(bytes.NewReader(b)); err != nil {
+		return nil, err
+	}
+
+	e := &HistoryEntry{
+		Type:     kind,
+		Txid:     wtx.TxHash().String(),
+		Time:     time.Now().Unix(),
+		Inputs:   make([]HistoryInput, 0),
+		Outputs:  make([]HistoryOutput, 0),
+		Peers:    make([]string, 0),
+		Channels: channels,
+	}
+
+	for _, in := range wtx.TxIn {
+		hin := HistoryInput{Txid: in.PreviousOutPoint.Hash.String(), Vout: in.PreviousOutPoint.Index}
+		for _, u := range utxos {
+			if u.OutPoint == in.PreviousOutPoint {
+				hin.Amount = u.Amount
+			}
+		}
+		e.Inputs = append(e.Inputs, hin)
+	}
+
+	for v, out := range wtx.TxOut {
+		o := HistoryOutput{Vout: uint32(v), Amount: wallet.Amount(out.Value), Peer: peers[uint32(v)]}
+		_, addrs, _, err := txscript.ExtractPkScriptAddrs(out.PkScript, net)
+		if err == nil && len(addrs) == 1 {
+			o.Address = addrs[0].EncodeAddress()
+		}
+		if o.Peer != "" {
+			e.Peers = append(e.Peers, o.Peer)
+			o.Label = labels[o.Peer]
+		} else {
+			o.Label = labels[o.Address]
+		}
+		e.Outputs = append(e.Outputs, o)
+	}
+
+	if len(utxos) > 0 {
+		e.Fee = wallet.TxFee(wtx, utxos)
+		e.FeeRate = uint64(e.Fee) / wallet.TxVsize(wtx)
+	}
+	return e, nil
+}
+
+// OutputPeers maps the funding output index to the peer, after the channels are completed
+func OutputPeers(outputs wallet.ChannelOutputs) map[uint32]string {
+	peers := make(map[uint32]string)
+	for _, o := range outputs {
+		peers[uint32(o.Vout)] = o.Peer
+	}
+	return peers
+}
+
+// HistoryStore appends entries as json lines to the lightning directory, it is never rewritten
+type HistoryStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewHistoryStore(dir string) *HistoryStore {
+	return &HistoryStore{path: filepath.Join(dir, HISTORY_FILE)}
+}
+
+func (s *HistoryStore) Append(e *HistoryEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// HistoryFilter selects entries by type and time, zero values match everything
+type HistoryFilter struct {
+	Type string
+	From int64
+	To   int64
+}
+
+func (h *HistoryFilter) match(e *HistoryEntry) bool {
+	if h.Type != "" && h.Type != e.Type {
+		return false
+	}
+	if h.From != 0 && e.Time < h.From {
+		return false
+	}
+	if h.To != 0 && e.Time > h.To {
+		return false
+	}
+	return true
+}
+
+func (s *HistoryStore) List(filter *HistoryFilter) ([]*HistoryEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make([]*HistoryEntry, 0)
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		e := &HistoryEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			return nil, err
+		}
+		if filter.match(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// ParseHistoryTime accepts unix seconds or a date, end of day when end is set
+func ParseHistoryTime(s string, end bool) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	t, err := time.Parse(HISTORY_DATE_FORMAT, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %s, use unix seconds or %s", s, HISTORY_DATE_FORMAT)
+	}
+	if end {
+		t = t.Add(24*time.Hour - time.Second)
+	}
+	return t.Unix(), nil
+}
+
+// History provides the transaction history in the lightning dir
+func (f *Funder) History() *HistoryStore {
+	if f.history == nil {
+		f.history = NewHistoryStore(f.Lightningdir)
+	}
+	return f.history
+}
+
+// RecordHistory adds a broadcast transaction to the history, output labels are
+//   also set in the bitcoind wallet when it is used
+//   the transaction is already broadcast so failures are only logged
+func (f *Funder) RecordHistory(kind, rawtx string, utxos []wallet.UTXO, peers map[uint32]string, channels []string, labels map[string]string, log *logger.Logger) {
+	e, err := NewHistoryEntry(kind, rawtx, utxos, peers, channels, labels, f.BitcoinNet)
+	if err == nil {
+		err = f.History().Append(e)
+	}
+	if err != nil {
+		log.Errorf("unable to record %s history: %s", kind, err.Error())
+		return
+	}
+	for _, o := range e.Outputs {
+		if o.Label != "" && o.Address != "" {
+			f.setWalletLabel(o.Address, o.Label, log)
+		}
+	}
+}
+
+// HistoryCSV has a row per output, the fee is repeated on each row of a transaction
+func HistoryCSV(entries []*HistoryEntry) (string, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(strings.Split(HISTORY_CSV_HEADER, ","))
+	for _, e := range entries {
+		for _, o := range e.Outputs {
+			w.Write([]string{
+				time.Unix(e.Time, 0).UTC().Format(time.RFC3339),
+				e.Type,
+				e.Txid,
+				strconv.Itoa(int(o.Vout)),
+				o.Address,
+				strconv.FormatUint(uint64(o.Amount), 10),
+				o.Peer,
+				strconv.FormatUint(uint64(e.Fee), 10),
+				strconv.FormatUint(e.FeeRate, 10),
+			})
+		}
+	}
+	w.Flush()
+	return buf.String(), w.Error()
+}
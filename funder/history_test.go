@@ -0,0 +1,121 @@
+package funder
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+func TestHistory(t *testing.T) {
+	w := &fakeWallet{"history"}
+	utxos, _ := w.Utxos(0, 0)
+	funding, _ := (&fakeLightning{}).StartFundChannel("peer1", 0, true, nil)
+
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(wire.NewTxIn(&utxos[0].OutPoint, nil, wire.TxWitness{[]byte{0x01}}))
+	for _, r := range []struct {
+		addr string
+		amt  int64
+	}{{funding, 300000}, {w.ChangeAddress(), 699000}} {
+		addr, err := btcutil.DecodeAddress(r.addr, testNet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pks, _ := txscript.PayToAddrScript(addr)
+		tx.AddTxOut(wire.NewTxOut(r.amt, pks))
+	}
+	var raw bytes.Buffer
+	tx.Serialize(&raw)
+
+	e, err := NewHistoryEntry(HISTORY_FUND, hex.EncodeToString(raw.Bytes()), utxos, map[uint32]string{0: "peer1"}, []string{"chan1"}, nil, testNet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Fee != 1000 {
+		t.Errorf("want fee 1000, have %d", e.Fee)
+	}
+	if e.FeeRate == 0 {
+		t.Error("fee rate not set")
+	}
+	if e.Outputs[0].Peer != "peer1" || e.Outputs[0].Address != funding || e.Outputs[1].Peer != "" {
+		t.Errorf("unexpected outputs %+v", e.Outputs)
+	}
+	if e.Inputs[0].Amount != 1000000 {
+		t.Errorf("want input amount 1000000, have %d", e.Inputs[0].Amount)
+	}
+
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewHistoryStore(dir)
+
+	e.Time = 1600000000
+	store.Append(e)
+	withdraw := *e
+	withdraw.Type = HISTORY_WITHDRAW
+	withdraw.Time = 1600100000
+	store.Append(&withdraw)
+
+	tests := []struct {
+		filter HistoryFilter
+		want   int
+	}{
+		{HistoryFilter{}, 2},
+		{HistoryFilter{Type: HISTORY_WITHDRAW}, 1},
+		{HistoryFilter{From: 1600050000}, 1},
+		{HistoryFilter{To: 1600050000}, 1},
+		{HistoryFilter{Type: HISTORY_FUND, From: 1600050000}, 0},
+	}
+	for _, tt := range tests {
+		entries, err := store.List(&tt.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != tt.want {
+			t.Errorf("filter %+v want %d entries, have %d", tt.filter, tt.want, len(entries))
+		}
+	}
+
+	csv, err := HistoryCSV([]*HistoryEntry{e})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(csv), "\n")
+	if len(lines) != 3 || lines[0] != HISTORY_CSV_HEADER {
+		t.Errorf("unexpected csv\n%s", csv)
+	}
+
+	labels := HistoryLabels([]*HistoryEntry{e})
+	if len(labels) != 4 {
+		t.Fatalf("want a label for the tx, input and 2 outputs, have %d", len(labels))
+	}
+	if labels[2].Ref != e.Txid+":0" || labels[2].Label != HISTORY_LABEL_CHANNEL+"peer1" {
+		t.Errorf("unexpected funding output label %+v", labels[2])
+	}
+}
+
+func TestParseHistoryTime(t *testing.T) {
+	from, err := ParseHistoryTime("2020-09-13", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, _ := ParseHistoryTime("2020-09-13", true)
+	if to-from != 24*60*60-1 {
+		t.Errorf("date should cover the whole day, from %d to %d", from, to)
+	}
+	if n, _ := ParseHistoryTime("1600000000", false); n != 1600000000 {
+		t.Errorf("want unix seconds, have %d", n)
+	}
+	if _, err := ParseHistoryTime("yesterday", false); err == nil {
+		t.Error("expected invalid time to fail")
+	}
+}
@@ -0,0 +1,212 @@
+package funder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rsbondi/multifund/logger"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+const LABEL_FILE = "multifund_labels.json"
+
+const HISTORY_LABEL_CHANNEL = "channel to "
+
+// BIP329 label types
+const (
+	LABEL_TX     = "tx"
+	LABEL_ADDR   = "addr"
+	LABEL_PUBKEY = "pubkey"
+	LABEL_INPUT  = "input"
+	LABEL_OUTPUT = "output"
+	LABEL_XPUB   = "xpub"
+)
+
+// Bip329Label is one line of a BIP329 wallet label export
+type Bip329Label struct {
+	Type  string `json:"type"`
+	Ref   string `json:"ref"`
+	Label string `json:"label"`
+}
+
+func (l *Bip329Label) key() string {
+	return l.Type + ":" + l.Ref
+}
+
+// HistoryLabels labels each transaction by type, labelled outputs and their addresses by label,
+//   other funding outputs by peer and inputs and remaining outputs by type
+func HistoryLabels(entries []*HistoryEntry) []*Bip329Label {
+	labels := make([]*Bip329Label, 0)
+	for _, e := range entries {
+		labels = append(labels, &Bip329Label{Type: LABEL_TX, Ref: e.Txid, Label: e.Type})
+		for _, in := range e.Inputs {
+			labels = append(labels, &Bip329Label{Type: LABEL_INPUT, Ref: fmt.Sprintf("%s:%d", in.Txid, in.Vout), Label: e.Type})
+		}
+		for _, o := range e.Outputs {
+			label := e.Type
+			switch {
+			case o.Label != "":
+				label = o.Label
+			case o.Peer != "":
+				label = HISTORY_LABEL_CHANNEL + o.Peer
+			}
+			labels = append(labels, &Bip329Label{Type: LABEL_OUTPUT, Ref: fmt.Sprintf("%s:%d", e.Txid, o.Vout), Label: label})
+			if o.Label != "" && o.Address != "" {
+				labels = append(labels, &Bip329Label{Type: LABEL_ADDR, Ref: o.Address, Label: o.Label})
+			}
+		}
+	}
+	return labels
+}
+
+// Bip329JSONL encodes labels one json object per line
+func Bip329JSONL(labels []*Bip329Label) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, l := range labels {
+		if err := enc.Encode(l); err != nil {
+			return "", err
+		}
+	}
+	return buf.String(), nil
+}
+
+// ParseBip329 reads json lines, blank lines are skipped and any invalid line fails the import
+func ParseBip329(r io.Reader) ([]*Bip329Label, error) {
+	labels := make([]*Bip329Label, 0)
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		l := &Bip329Label{}
+		if err := json.Unmarshal([]byte(text), l); err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err.Error())
+		}
+		switch l.Type {
+		case LABEL_TX, LABEL_ADDR, LABEL_PUBKEY, LABEL_INPUT, LABEL_OUTPUT, LABEL_XPUB:
+		default:
+			return nil, fmt.Errorf("line %d: unknown label type %s", line, l.Type)
+		}
+		if l.Ref == "" {
+			return nil, fmt.Errorf("line %d: missing ref", line)
+		}
+		labels = append(labels, l)
+	}
+	return labels, scanner.Err()
+}
+
+// LabelStore keeps imported labels in the lightning directory, keyed by type and ref
+type LabelStore struct {
+	path   string
+	mu     sync.Mutex
+	labels map[string]*Bip329Label
+}
+
+func NewLabelStore(dir string) (*LabelStore, error) {
+	s := &LabelStore{
+		path:   filepath.Join(dir, LABEL_FILE),
+		labels: make(map[string]*Bip329Label),
+	}
+	if err := readStore(s.path, &s.labels); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// List is sorted by type and ref
+func (s *LabelStore) List() []*Bip329Label {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*Bip329Label, 0, len(s.labels))
+	for _, l := range s.labels {
+		list = append(list, l)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].key() < list[j].key()
+	})
+	return list
+}
+
+// Put replaces any existing label with the same type and ref
+func (s *LabelStore) Put(labels []*Bip329Label) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, l := range labels {
+		s.labels[l.key()] = l
+	}
+	return writeStore(s.path, s.labels)
+}
+
+// Labels provides the imported labels, loaded from the lightning dir on first use
+func (f *Funder) Labels() (*LabelStore, error) {
+	if f.labels == nil {
+		s, err := NewLabelStore(f.Lightningdir)
+		if err != nil {
+			return nil, err
+		}
+		f.labels = s
+	}
+	return f.labels, nil
+}
+
+// ExportLabels is the history labels with imported labels taking precedence
+func (f *Funder) ExportLabels() ([]*Bip329Label, error) {
+	entries, err := f.History().List(&HistoryFilter{})
+	if err != nil {
+		return nil, err
+	}
+	store, err := f.Labels()
+	if err != nil {
+		return nil, err
+	}
+
+	imported := make(map[string]bool)
+	for _, l := range store.List() {
+		imported[l.key()] = true
+	}
+
+	labels := make([]*Bip329Label, 0)
+	for _, l := range HistoryLabels(entries) {
+		if !imported[l.key()] {
+			labels = append(labels, l)
+		}
+	}
+	return append(labels, store.List()...), nil
+}
+
+// ImportLabels stores the labels and sets address labels in the bitcoind wallet when it is used
+func (f *Funder) ImportLabels(labels []*Bip329Label) error {
+	store, err := f.Labels()
+	if err != nil {
+		return err
+	}
+	if err := store.Put(labels); err != nil {
+		return err
+	}
+	for _, l := range labels {
+		if l.Type == LABEL_ADDR {
+			f.setWalletLabel(l.Ref, l.Label, nil)
+		}
+	}
+	return nil
+}
+
+func (f *Funder) setWalletLabel(address, label string, log *logger.Logger) {
+	if f.Wallettype != wallet.WALLET_BITCOIN || f.Bitcoin == nil {
+		return
+	}
+	if err := f.Bitcoin.SetLabel(address, label); err != nil {
+		log.Warnf("setlabel %s error: %s", address, err.Error())
+	}
+}
@@ -0,0 +1,74 @@
+package funder
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseBip329(t *testing.T) {
+	labels, err := ParseBip329(strings.NewReader(`{"type":"tx","ref":"abcd","label":"rent"}
+
+{"type":"addr","ref":"bcrt1qaddr","label":"landlord"}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(labels) != 2 || labels[1].Label != "landlord" {
+		t.Errorf("unexpected labels %+v", labels)
+	}
+
+	for _, bad := range []string{
+		`{"type":"utxo","ref":"abcd","label":"x"}`,
+		`{"type":"tx","label":"x"}`,
+		`not json`,
+	} {
+		if _, err := ParseBip329(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected %s to fail", bad)
+		}
+	}
+}
+
+func TestExportLabels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "labels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := &Funder{Lightningdir: dir}
+	e := &HistoryEntry{
+		Type: HISTORY_WITHDRAW,
+		Txid: "abcd",
+		Outputs: []HistoryOutput{
+			{Vout: 0, Address: "bcrt1qpaid", Amount: 1000, Label: "invoice 42"},
+			{Vout: 1, Address: "bcrt1qchange", Amount: 2000},
+		},
+	}
+	if err := f.History().Append(e); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.ImportLabels([]*Bip329Label{{Type: LABEL_OUTPUT, Ref: "abcd:1", Label: "change"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	labels, err := f.ExportLabels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"tx:abcd":         HISTORY_WITHDRAW,
+		"output:abcd:0":   "invoice 42",
+		"addr:bcrt1qpaid": "invoice 42",
+		"output:abcd:1":   "change",
+	}
+	if len(labels) != len(want) {
+		t.Fatalf("want %d labels, have %d", len(want), len(labels))
+	}
+	for _, l := range labels {
+		if want[l.key()] != l.Label {
+			t.Errorf("%s want %s, have %s", l.key(), want[l.key()], l.Label)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package funder
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+// MatchOutputs finds the transaction output of each channel by its full scriptPubKey and amount
+//   every channel output must be in the transaction exactly once, inputs when not nil are the
+//   only outpoints the transaction may spend, all problems found are reported together
+func MatchOutputs(wtx *wire.MsgTx, outputs wallet.ChannelOutputs, inputs []wire.OutPoint) ([]int, error) {
+	problems := make([]string, 0)
+
+	if inputs != nil {
+		expected := make(map[wire.OutPoint]bool)
+		for _, in := range inputs {
+			expected[in] = true
+		}
+		for _, in := range wtx.TxIn {
+			if !expected[in.PreviousOutPoint] {
+				problems = append(problems, "unexpected input "+in.PreviousOutPoint.String())
+			}
+		}
+	}
+
+	vouts := make([]int, len(outputs))
+	for i, o := range outputs {
+		vouts[i] = -1
+		for j := 0; j < i; j++ {
+			if bytes.Equal(outputs[j].Script, o.Script) {
+				problems = append(problems, fmt.Sprintf("channels %s and %s have the same funding script", outputs[j].Peer, o.Peer))
+			}
+		}
+
+		found := 0
+		for v, txout := range wtx.TxOut {
+			if !bytes.Equal(txout.PkScript, o.Script) {
+				continue
+			}
+			found++
+			if txout.Value != o.Amount.Int64() {
+				problems = append(problems, fmt.Sprintf("output %d for %s pays %d, expected %d", v, o.Peer, txout.Value, o.Amount))
+				continue
+			}
+			vouts[i] = v
+		}
+		switch {
+		case found == 0:
+			problems = append(problems, fmt.Sprintf("no output for %s paying %d to %s", o.Peer, o.Amount, hex.EncodeToString(o.Script)))
+		case found > 1:
+			problems = append(problems, fmt.Sprintf("the output for %s appears %d times", o.Peer, found))
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, errors.New("transaction does not fund the channels: " + strings.Join(problems, "; "))
+	}
+	return vouts, nil
+}
+
+// OutPoints are the outpoints the utxos refer to
+func OutPoints(utxos []wallet.UTXO) []wire.OutPoint {
+	points := make([]wire.OutPoint, 0)
+	for _, u := range utxos {
+		points = append(points, u.OutPoint)
+	}
+	return points
+}
+
+// ParseOutPoint reads txid:vout
+func ParseOutPoint(s string) (*wire.OutPoint, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid outpoint %s, use txid:vout", s)
+	}
+	hash, err := chainhash.NewHashFromStr(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid txid in %s", s)
+	}
+	vout, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vout in %s", s)
+	}
+	return wire.NewOutPoint(hash, uint32(vout)), nil
+}
@@ -0,0 +1,130 @@
+package funder
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+func p2wsh(seed string) []byte {
+	h := sha256.Sum256([]byte(seed))
+	return append([]byte{0x00, 0x20}, h[:]...)
+}
+
+func TestMatchOutputs(t *testing.T) {
+	prev := wire.OutPoint{Hash: chainhash.HashH([]byte("prev")), Index: 1}
+	taproot := append([]byte{0x51, 0x20}, p2wsh("a")[2:]...) // same program, different script type
+
+	wtx := wire.NewMsgTx(2)
+	wtx.AddTxIn(wire.NewTxIn(&prev, nil, nil))
+	wtx.AddTxOut(wire.NewTxOut(1000, []byte{0x6a})) // too short for the old prefix strip
+	wtx.AddTxOut(wire.NewTxOut(100000, taproot))
+	wtx.AddTxOut(wire.NewTxOut(100000, p2wsh("b")))
+	wtx.AddTxOut(wire.NewTxOut(100000, p2wsh("a")))
+
+	outputs := wallet.ChannelOutputs{
+		{Peer: "a", Amount: 100000, Script: p2wsh("a")},
+		{Peer: "b", Amount: 100000, Script: p2wsh("b")},
+	}
+	vouts, err := MatchOutputs(wtx, outputs, []wire.OutPoint{prev})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vouts[0] != 3 || vouts[1] != 2 {
+		t.Errorf("want outputs 3 and 2, have %v", vouts)
+	}
+
+	tests := []struct {
+		name    string
+		outputs wallet.ChannelOutputs
+		inputs  []wire.OutPoint
+		want    string
+	}{
+		{"missing", wallet.ChannelOutputs{{Peer: "c", Amount: 100000, Script: p2wsh("c")}}, nil, "no output for c"},
+		{"amount", wallet.ChannelOutputs{{Peer: "a", Amount: 90000, Script: p2wsh("a")}}, nil, "pays 100000, expected 90000"},
+		{"same script", wallet.ChannelOutputs{outputs[0], {Peer: "c", Amount: 100000, Script: p2wsh("a")}}, nil, "same funding script"},
+		{"unexpected input", outputs, []wire.OutPoint{}, "unexpected input"},
+	}
+	for _, tt := range tests {
+		_, err := MatchOutputs(wtx, tt.outputs, tt.inputs)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: want error with %q, have %v", tt.name, tt.want, err)
+		}
+	}
+
+	wtx.AddTxOut(wire.NewTxOut(100000, p2wsh("b")))
+	if _, err := MatchOutputs(wtx, outputs, nil); err == nil || !strings.Contains(err.Error(), "appears 2 times") {
+		t.Errorf("want duplicated output error, have %v", err)
+	}
+}
+
+func FuzzMatchOutputs(f *testing.F) {
+	seed := wire.NewMsgTx(2)
+	seed.AddTxIn(wire.NewTxIn(&wire.OutPoint{Hash: chainhash.HashH([]byte("seed"))}, nil, nil))
+	seed.AddTxOut(wire.NewTxOut(100000, p2wsh("a")))
+	seed.AddTxOut(wire.NewTxOut(0, nil))
+	seed.AddTxOut(wire.NewTxOut(5000, []byte{0x00}))
+	var buf bytes.Buffer
+	seed.Serialize(&buf)
+	f.Add(buf.Bytes())
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		wtx := wire.NewMsgTx(2)
+		if err := wtx.Deserialize(bytes.NewReader(raw)); err != nil {
+			return
+		}
+
+		counts := make(map[string]int)
+		for _, out := range wtx.TxOut {
+			counts[string(out.PkScript)]++
+		}
+
+		// channels for every output with a unique script must match where they are
+		outputs := make(wallet.ChannelOutputs, 0)
+		want := make([]int, 0)
+		for v, out := range wtx.TxOut {
+			if counts[string(out.PkScript)] == 1 {
+				outputs = append(outputs, &wallet.Outputs{Peer: "peer", Amount: wallet.Amount(out.Value), Script: out.PkScript})
+				want = append(want, v)
+			}
+		}
+		inputs := make([]wire.OutPoint, 0)
+		for _, in := range wtx.TxIn {
+			inputs = append(inputs, in.PreviousOutPoint)
+		}
+		vouts, err := MatchOutputs(wtx, outputs, inputs)
+		if err != nil {
+			t.Fatalf("unique outputs should match: %s", err.Error())
+		}
+		for i := range want {
+			if vouts[i] != want[i] {
+				t.Fatalf("output %d matched %d", want[i], vouts[i])
+			}
+		}
+
+		// a repeated script is never matched
+		for _, out := range wtx.TxOut {
+			if counts[string(out.PkScript)] > 1 {
+				repeated := wallet.ChannelOutputs{{Peer: "peer", Amount: wallet.Amount(out.Value), Script: out.PkScript}}
+				if _, err := MatchOutputs(wtx, repeated, nil); err == nil {
+					t.Fatal("repeated output should not match")
+				}
+				break
+			}
+		}
+
+		// and a channel whose script is not in the transaction is reported missing
+		if counts[string(p2wsh("absent"))] == 0 {
+			absent := wallet.ChannelOutputs{{Peer: "absent", Amount: 1, Script: p2wsh("absent")}}
+			if _, err := MatchOutputs(wtx, absent, nil); err == nil {
+				t.Fatal("absent output should not match")
+			}
+		}
+	})
+}
@@ -0,0 +1,583 @@
+package funder
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil/psbt"
+	"github.com/niftynei/glightning/glightning"
+	"github.com/rsbondi/multifund/logger"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+// Multi party funding
+//   several nodes each contribute their own inputs, channel outputs and change to a
+//   single transaction.  One node runs a Coordinator over http, each node (including the
+//   coordinating one if it opens channels) joins as a Participant
+//
+//   POST /<token>/contribute  participant PSBT with its inputs and outputs
+//   GET  /<token>/psbt        the combined PSBT once every participant has contributed
+//   POST /<token>/sign        combined PSBT with the participant's inputs finalized
+//   GET  /<token>/status      progress, txid once broadcast
+//
+//   the token is random and part of the url handed to participants, requests without it are refused
+//
+//   the session fails once COORDINATOR_TIMEOUT passes or it is cancelled, nothing is broadcast after
+//   that.  Participants cancel their channels on failure up to posting their signatures, after
+//   that the coordinator may still broadcast so the channels are kept
+//
+//   participants complete their own channels against the combined txid before signing,
+//   so the coordinator only broadcasts once every channel is ready for the funding tx, every
+//   input must be native segwit so signing can not change the txid
+
+type PsbtMessage struct {
+	Psbt  string `json:"psbt,omitempty"`
+	Ready bool   `json:"ready"`
+}
+
+type StatusMessage struct {
+	Joined int    `json:"joined"`
+	Signed bool   `json:"signed"`
+	Txid   string `json:"txid,omitempty"`
+	Tx     string `json:"tx,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// how long participants have to join and sign, the same as a participant waits
+const COORDINATOR_TIMEOUT = time.Minute * 10
+
+type Coordinator struct {
+	Participants int
+	Broadcast    func(tx wallet.Transaction, in wallet.Amount) (string, error)
+	Token        string
+
+	mu            sync.Mutex
+	contributions []*psbt.Packet
+	combined      *psbt.Packet
+	tx            string
+	txid          string
+	err           error
+	done          chan struct{}
+}
+
+// NewCoordinator starts a session for participants, it fails if not broadcast within timeout
+func NewCoordinator(participants int, timeout time.Duration, broadcast func(tx wallet.Transaction, in wallet.Amount) (string, error)) *Coordinator {
+	token := make([]byte, 16)
+	rand.Read(token)
+	c := &Coordinator{
+		Participants:  participants,
+		Broadcast:     broadcast,
+		Token:         hex.EncodeToString(token),
+		contributions: make([]*psbt.Packet, 0),
+		done:          make(chan struct{}),
+	}
+	time.AfterFunc(timeout, func() {
+		c.Cancel(errors.New("multi party funding timed out"))
+	})
+	return c
+}
+
+// Cancel fails the session with err unless it is already broadcast or failed
+func (c *Coordinator) Cancel(err error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.txid != "" {
+		return fmt.Errorf("already broadcast %s", c.txid)
+	}
+	if c.err != nil {
+		return c.err
+	}
+	c.fail(err)
+	return nil
+}
+
+// Done is closed once the transaction is broadcast or the session fails
+func (c *Coordinator) Done() <-chan struct{} {
+	return c.done
+}
+
+// Url is where participants reach the coordinator listening on addr, host:port
+func (c *Coordinator) Url(addr string) string {
+	return fmt.Sprintf("http://%s/%s", addr, c.Token)
+}
+
+func (c *Coordinator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the first path element is the token, the rest the endpoint
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) != 2 || subtle.ConstantTimeCompare([]byte(parts[0]), []byte(c.Token)) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+	path := "/" + parts[1]
+
+	var result interface{}
+	var err error
+	switch {
+	case r.Method == http.MethodPost && path == "/contribute":
+		result, err = c.contribute(r)
+	case r.Method == http.MethodGet && path == "/psbt":
+		result, err = c.psbt()
+	case r.Method == http.MethodPost && path == "/sign":
+		result, err = c.sign(r)
+	case r.Method == http.MethodGet && path == "/status":
+		result = c.status()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		result = &StatusMessage{Error: err.Error()}
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func (c *Coordinator) contribute(r *http.Request) (interface{}, error) {
+	p, err := readPsbt(r)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.combined != nil {
+		return nil, errors.New("all participants have already joined")
+	}
+	c.contributions = append(c.contributions, p)
+	if len(c.contributions) == c.Participants {
+		c.combined, err = combineContributions(c.contributions)
+		if err != nil {
+			c.fail(err)
+			return nil, err
+		}
+	}
+	return c.statusLocked(), nil
+}
+
+func (c *Coordinator) psbt() (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.combined == nil {
+		return &PsbtMessage{Ready: false}, nil
+	}
+	encoded, err := c.combined.B64Encode()
+	if err != nil {
+		return nil, err
+	}
+	return &PsbtMessage{Psbt: encoded, Ready: true}, nil
+}
+
+func (c *Coordinator) sign(r *http.Request) (interface{}, error) {
+	p, err := readPsbt(r)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.combined == nil {
+		return nil, errors.New("transaction is not ready for signing")
+	}
+	if c.txid != "" {
+		return c.statusLocked(), nil
+	}
+	if err := wallet.CombinePsbt(c.combined, p); err != nil {
+		return nil, err
+	}
+	if !wallet.IsComplete(c.combined) {
+		return c.statusLocked(), nil
+	}
+
+	in, err := wallet.InputTotal(c.combined)
+	if err != nil {
+		c.fail(err)
+		return nil, err
+	}
+	tx, err := wallet.FinalizePsbt(c.combined)
+	if err != nil {
+		c.fail(err)
+		return nil, err
+	}
+	// the channels are completed with the unsigned txid, a signature script would change it
+	if completed := c.combined.UnsignedTx.TxHash().String(); tx.TxId != completed {
+		err := fmt.Errorf("signed txid %s does not match %s the channels were completed with", tx.TxId, completed)
+		c.fail(err)
+		return nil, err
+	}
+	txid, err := c.Broadcast(tx, in)
+	if err != nil {
+		c.fail(err)
+		return nil, err
+	}
+	c.txid = txid
+	c.tx = tx.String()
+	close(c.done)
+	return c.statusLocked(), nil
+}
+
+func (c *Coordinator) status() interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.statusLocked()
+}
+
+func (c *Coordinator) statusLocked() *StatusMessage {
+	s := &StatusMessage{
+		Joined: len(c.contributions),
+		Signed: c.combined != nil && wallet.IsComplete(c.combined),
+		Txid:   c.txid,
+		Tx:     c.tx,
+	}
+	if c.err != nil {
+		s.Error = c.err.Error()
+	}
+	return s
+}
+
+func (c *Coordinator) fail(err error) {
+	if c.err == nil {
+		c.err = err
+		close(c.done)
+	}
+}
+
+func readPsbt(r *http.Request) (*psbt.Packet, error) {
+	msg := PsbtMessage{}
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		return nil, err
+	}
+	return wallet.DecodePsbt(msg.Psbt)
+}
+
+// combineContributions appends every participant's inputs and outputs in join order
+func combineContributions(parts []*psbt.Packet) (*psbt.Packet, error) {
+	tx := wire.NewMsgTx(2)
+	inputs := make([]psbt.PInput, 0)
+	outputs := make([]psbt.POutput, 0)
+	seen := make(map[wire.OutPoint]bool)
+
+	for _, p := range parts {
+		for i, in := range p.UnsignedTx.TxIn {
+			if seen[in.PreviousOutPoint] {
+				return nil, fmt.Errorf("input %s contributed more than once", in.PreviousOutPoint.String())
+			}
+			seen[in.PreviousOutPoint] = true
+			tx.AddTxIn(wire.NewTxIn(&in.PreviousOutPoint, nil, nil))
+			inputs = append(inputs, p.Inputs[i])
+		}
+		for i, out := range p.UnsignedTx.TxOut {
+			tx.AddTxOut(wire.NewTxOut(out.Value, out.PkScript))
+			outputs = append(outputs, p.Outputs[i])
+		}
+	}
+
+	combined, err := psbt.NewFromUnsignedTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	combined.Inputs = inputs
+	combined.Outputs = outputs
+	return combined, nil
+}
+
+type MultiPartyResult struct {
+	Tx       string            `json:"tx,omitempty"`
+	Txid     string            `json:"txid"`
+	Channels []string          `json:"channels"`
+	Peers    map[uint32]string `json:"-"` // funding output index to peer
+	Utxos    []wallet.UTXO     `json:"-"` // ours
+	Batch    []BatchChannel    `json:"-"` // our channels with their ids, for RecordBatch
+}
+
+type Participant struct {
+	Lightning    ChannelFunder
+	Wallet       wallet.Wallet
+	Net          *chaincfg.Params
+	SatsPerVbyte uint64
+	Client       *http.Client
+	Poll         time.Duration
+	Timeout      time.Duration
+}
+
+// Participant provides a participant for joining a multi party funding with this node's wallet
+func (f *Funder) Participant() *Participant {
+	return &Participant{
+		Lightning:    f.Lightning,
+		Wallet:       f.Wallet(),
+		Net:          f.BitcoinNet,
+		SatsPerVbyte: f.SatsPerVbyte(),
+		Client:       &http.Client{Timeout: time.Second * 10},
+		Poll:         time.Second,
+		Timeout:      time.Minute * 10,
+	}
+}
+
+// Join contributes our channels to the coordinator at url and waits for the broadcast
+func (p *Participant) Join(url string, chans *[]glightning.FundChannelStart) (*MultiPartyResult, error) {
+	url = strings.TrimRight(url, "/")
+
+	contribution, outputs, utxos, err := p.contribution(chans)
+	if err != nil {
+		return nil, err
+	}
+
+	shared := false
+	result, err := p.join(url, contribution, outputs, utxos, &shared)
+	if err != nil {
+		// once the coordinator has our signatures it may still broadcast, the channels must stay
+		if !shared {
+			p.cancel(outputs)
+		}
+		return nil, err
+	}
+	result.Utxos = utxos
+	result.Peers = OutputPeers(outputs)
+	result.Batch = OutputChannels(outputs, result.Channels)
+	return result, nil
+}
+
+// join runs the session, shared is set once our signatures are posted
+func (p *Participant) join(url string, contribution *psbt.Packet, outputs wallet.ChannelOutputs, utxos []wallet.UTXO, shared *bool) (*MultiPartyResult, error) {
+	encoded, err := contribution.B64Encode()
+	if err != nil {
+		return nil, err
+	}
+	status := StatusMessage{}
+	if err := p.post(url+"/contribute", &PsbtMessage{Psbt: encoded}, &status); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(p.Timeout)
+	msg := PsbtMessage{}
+	for !msg.Ready {
+		if time.Now().After(deadline) {
+			return nil, errors.New("timed out waiting for other participants")
+		}
+		if err := p.get(url+"/psbt", &msg); err != nil {
+			return nil, err
+		}
+		if !msg.Ready {
+			time.Sleep(p.Poll)
+		}
+	}
+
+	combined, err := wallet.DecodePsbt(msg.Psbt)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyContribution(combined, contribution); err != nil {
+		return nil, err
+	}
+
+	var unsigned bytes.Buffer
+	if err := combined.UnsignedTx.Serialize(&unsigned); err != nil {
+		return nil, err
+	}
+	tx := wallet.Transaction{
+		TxId:     combined.UnsignedTx.TxHash().String(),
+		Signed:   unsigned.Bytes(),
+		Unsigned: unsigned.Bytes(),
+	}
+
+	channels, err := completeChannels(p.Lightning, tx, outputs, nil) // other participants add inputs, ours are checked by verifyContribution
+	if err != nil {
+		return nil, err
+	}
+
+	tx.Signed = nil
+	p.Wallet.Sign(&tx, utxos)
+	if tx.Signed == nil {
+		return nil, errors.New("wallet was unable to sign")
+	}
+	if err := wallet.AddSignedInputs(combined, tx.Signed, utxos); err != nil {
+		return nil, err
+	}
+	encoded, err = combined.B64Encode()
+	if err != nil {
+		return nil, err
+	}
+	// the coordinator may have our signatures even when the post fails
+	*shared = true
+	sharedErr := func(err error) error {
+		return fmt.Errorf("%s, our signatures were shared so %s may still confirm, watch it instead of funding again", err.Error(), tx.TxId)
+	}
+	if err := p.post(url+"/sign", &PsbtMessage{Psbt: encoded}, &status); err != nil {
+		return nil, sharedErr(err)
+	}
+
+	for status.Txid == "" {
+		if time.Now().After(deadline) {
+			return nil, sharedErr(errors.New("timed out waiting for other participants to sign"))
+		}
+		time.Sleep(p.Poll)
+		if err := p.get(url+"/status", &status); err != nil {
+			return nil, sharedErr(err)
+		}
+		if status.Error != "" {
+			return nil, sharedErr(errors.New(status.Error))
+		}
+	}
+	if status.Txid != tx.TxId {
+		return nil, fmt.Errorf("coordinator broadcast %s, the channels were completed with %s", status.Txid, tx.TxId)
+	}
+
+	return &MultiPartyResult{Tx: status.Tx, Txid: status.Txid, Channels: channels}, nil
+}
+
+// contribution selects our utxos, starts the channels and builds the PSBT with our part of the transaction
+func (p *Participant) contribution(chans *[]glightning.FundChannelStart) (*psbt.Packet, wallet.ChannelOutputs, []wallet.UTXO, error) {
+	outamt, err := channelTotal(*chans)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// the shared transaction overhead is small, each participant covers its own inputs and outputs
+	fee := wallet.Amount(p.SatsPerVbyte * uint64(120+43*len(*chans)))
+
+	change := p.Wallet.ChangeAddress()
+	utxos, err := p.Wallet.Utxos(outamt, fee)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	utxoamt, err := wallet.UtxoTotal(utxos)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if utxoamt < outamt+fee {
+		return nil, nil, nil, errors.New("Insufficient funds, Need more coin")
+	}
+
+	outputs, recipients, recipamt, err := startChannels(p.Lightning, p.Net, chans, nil, nil, nil)
+	if err != nil {
+		cancelChannels(p.Lightning, *chans, nil)
+		return nil, nil, nil, err
+	}
+
+	changeRecipient := &wallet.TxRecipient{Address: change}
+	vsize := wallet.InputFeeSats(utxos, p.Net) + wallet.OutputFeeSats(append(recipients, changeRecipient), p.Net) + 11
+	fee = wallet.Amount(p.SatsPerVbyte * vsize)
+	if amt, ok := wallet.Change(utxoamt, recipamt, fee); ok { // no change if dust, save on tx fee
+		changeRecipient.Amount = amt
+		recipients = append(recipients, changeRecipient)
+	}
+
+	contribution, err := wallet.CreateWalletPsbt(recipients, utxos, p.Net)
+	if err != nil {
+		p.cancel(outputs)
+		return nil, nil, nil, err
+	}
+	return contribution, outputs, utxos, nil
+}
+
+func (p *Participant) cancel(outputs wallet.ChannelOutputs) {
+	for _, o := range outputs {
+		if _, err := p.Lightning.CancelFundChannel(o.Peer); err != nil {
+			logger.Warnf("channel cancel error: %s", err.Error())
+		}
+	}
+}
+
+func (p *Participant) post(url string, body interface{}, result interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	res, err := p.Client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	return decodeResponse(res, result)
+}
+
+func (p *Participant) get(url string, result interface{}) error {
+	res, err := p.Client.Get(url)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(res, result)
+}
+
+func decodeResponse(res *http.Response, result interface{}) error {
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		status := StatusMessage{}
+		json.NewDecoder(res.Body).Decode(&status)
+		return fmt.Errorf("coordinator error: %s", status.Error)
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+// verifyContribution makes sure the coordinator kept all of our inputs and outputs and every
+//   input spends native segwit, so the txid the channels are completed with is final
+func verifyContribution(combined, ours *psbt.Packet) error {
+	if err := nativeSegwitInputs(combined); err != nil {
+		return err
+	}
+
+	for _, in := range ours.UnsignedTx.TxIn {
+		found := false
+		for _, cin := range combined.UnsignedTx.TxIn {
+			if cin.PreviousOutPoint == in.PreviousOutPoint {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("input %s missing from combined transaction", in.PreviousOutPoint.String())
+		}
+	}
+
+	used := make(map[int]bool)
+	for _, out := range ours.UnsignedTx.TxOut {
+		found := false
+		for v, cout := range combined.UnsignedTx.TxOut {
+			if !used[v] && cout.Value == out.Value && bytes.Equal(cout.PkScript, out.PkScript) {
+				used[v] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New("output missing from combined transaction")
+		}
+	}
+	return nil
+}
+
+// nativeSegwitInputs requires every input to spend P2WPKH or P2WSH, anything else is signed with
+//   a signature script and the txid channels are completed with before signing would change
+func nativeSegwitInputs(p *psbt.Packet) error {
+	for i, in := range p.Inputs {
+		if in.WitnessUtxo == nil {
+			return fmt.Errorf("input %d has no witness utxo", i)
+		}
+		switch txscript.GetScriptClass(in.WitnessUtxo.PkScript) {
+		case txscript.WitnessV0PubKeyHashTy, txscript.WitnessV0ScriptHashTy:
+		default:
+			return fmt.Errorf("input %d is not native segwit, signing it would change the txid", i)
+		}
+	}
+	return nil
+}
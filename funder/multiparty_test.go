@@ -0,0 +1,441 @@
+package funder
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/psbt"
+	"github.com/niftynei/glightning/glightning"
+	"github.com/niftynei/glightning/jrpc2"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+var testNet = &chaincfg.RegressionNetParams
+
+type fakeLightning struct {
+	mu        sync.Mutex
+	completed map[string]string
+	cancelled []string
+	requests  []*FundChannelStartRequest
+}
+
+func (l *fakeLightning) StartFundChannel(id string, amount uint64, announce bool, feerate *glightning.FeeRate) (string, error) {
+	h := sha256.Sum256([]byte(id))
+	addr, err := btcutil.NewAddressWitnessScriptHash(h[:], testNet)
+	if err != nil {
+		return "", err
+	}
+	return addr.EncodeAddress(), nil
+}
+
+func (l *fakeLightning) CompleteFundChannel(peerId, txId string, txout uint16) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.completed[peerId] = txId
+	return "channel-" + peerId, nil
+}
+
+func (l *fakeLightning) CancelFundChannel(peerId string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cancelled = append(l.cancelled, peerId)
+	return true, nil
+}
+
+// Request answers fundchannel_start with options the same as StartFundChannel and records it
+func (l *fakeLightning) Request(m jrpc2.Method, resp interface{}) error {
+	req, ok := m.(*FundChannelStartRequest)
+	if !ok {
+		return errors.New("unexpected request " + m.Name())
+	}
+	l.mu.Lock()
+	l.requests = append(l.requests, req)
+	l.mu.Unlock()
+	addr, err := l.StartFundChannel(req.Id, req.Amount, req.Announce, nil)
+	if err != nil {
+		return err
+	}
+	resp.(*FundChannelStartResult).FundingAddress = addr
+	return nil
+}
+
+// the rest of Lightning, for tests that need a Funder
+func (l *fakeLightning) Connect(peerId, host string, port uint) (string, error) {
+	return peerId, nil
+}
+
+func (l *fakeLightning) NewAddr() (string, error) {
+	return (&fakeWallet{"newaddr"}).ChangeAddress(), nil
+}
+
+func (l *fakeLightning) ListConfigs() (map[string]interface{}, error) {
+	return map[string]interface{}{"network": "regtest"}, nil
+}
+
+type fakeWallet struct {
+	seed string
+}
+
+func (w *fakeWallet) key(kind string) *btcec.PrivateKey {
+	h := sha256.Sum256([]byte(w.seed + kind))
+	key, _ := btcec.PrivKeyFromBytes(btcec.S256(), h[:])
+	return key
+}
+
+func (w *fakeWallet) address(kind string) string {
+	addr, _ := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(w.key(kind).PubKey().SerializeCompressed()), testNet)
+	return addr.EncodeAddress()
+}
+
+func (w *fakeWallet) Utxos(amt wallet.Amount, fee wallet.Amount) ([]wallet.UTXO, error) {
+	h := chainhash.HashH([]byte(w.seed))
+	return []wallet.UTXO{wallet.UTXO{Amount: 1000000, Address: w.address("utxo"), OutPoint: *wire.NewOutPoint(&h, 1)}}, nil
+}
+
+func (w *fakeWallet) ChangeAddress() string {
+	return w.address("change")
+}
+
+func (w *fakeWallet) Sign(tx *wallet.Transaction, utxos []wallet.UTXO) {
+	wtx := wire.NewMsgTx(2)
+	wtx.Deserialize(bytes.NewReader(tx.Unsigned))
+	hashes := txscript.NewTxSigHashes(wtx)
+	for i, in := range wtx.TxIn {
+		for _, u := range utxos {
+			if in.PreviousOutPoint == u.OutPoint {
+				addr, _ := btcutil.DecodeAddress(u.Address, testNet)
+				script, _ := txscript.PayToAddrScript(addr)
+				in.Witness, _ = txscript.WitnessSignature(wtx, hashes, i, int64(u.Amount), script, txscript.SigHashAll, w.key("utxo"), true)
+			}
+		}
+	}
+	var signed bytes.Buffer
+	wtx.Serialize(&signed)
+	tx.Signed = signed.Bytes()
+}
+
+func newTestParticipant(seed string, l *fakeLightning) *Participant {
+	return &Participant{
+		Lightning:    l,
+		Wallet:       &fakeWallet{seed},
+		Net:          testNet,
+		SatsPerVbyte: 2,
+		Client:       &http.Client{Timeout: time.Second},
+		Poll:         time.Millisecond * 10,
+		Timeout:      time.Second * 5,
+	}
+}
+
+func TestMultiPartyFunding(t *testing.T) {
+	var broadcast string
+	coord := NewCoordinator(2, COORDINATOR_TIMEOUT, func(tx wallet.Transaction, in wallet.Amount) (string, error) {
+		broadcast = tx.String()
+		return tx.TxId, nil
+	})
+	server := httptest.NewServer(coord)
+	defer server.Close()
+
+	nodes := []struct {
+		seed     string
+		channels []glightning.FundChannelStart
+	}{
+		{"alice", []glightning.FundChannelStart{{Id: "peer1", Amount: 100000}, {Id: "peer2", Amount: 200000}}},
+		{"bob", []glightning.FundChannelStart{{Id: "peer3", Amount: 300000}}},
+	}
+
+	results := make([]*MultiPartyResult, len(nodes))
+	errs := make([]error, len(nodes))
+	lightnings := make([]*fakeLightning, len(nodes))
+	var wg sync.WaitGroup
+	for i, n := range nodes {
+		lightnings[i] = &fakeLightning{completed: make(map[string]string)}
+		p := newTestParticipant(n.seed, lightnings[i])
+		chans := n.channels
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = p.Join(coord.Url(server.Listener.Addr().String()), &chans)
+		}(i)
+		time.Sleep(time.Millisecond * 50) // keep join order stable
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("participant %d failed: %s", i, err.Error())
+		}
+		if results[i].Txid != results[0].Txid {
+			t.Errorf("participant %d want txid %s, have %s", i, results[0].Txid, results[i].Txid)
+		}
+		if len(results[i].Channels) != len(nodes[i].channels) {
+			t.Errorf("participant %d want %d channels, have %d", i, len(nodes[i].channels), len(results[i].Channels))
+		}
+	}
+
+	if broadcast == "" {
+		t.Fatal("transaction was not broadcast")
+	}
+
+	// every channel is completed against the broadcast txid, before broadcast
+	for _, l := range lightnings {
+		for peer, txid := range l.completed {
+			if txid != results[0].Txid {
+				t.Errorf("%s completed against %s, broadcast %s", peer, txid, results[0].Txid)
+			}
+		}
+	}
+
+	b, err := hex.DecodeString(broadcast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wtx := wire.NewMsgTx(2)
+	if err := wtx.Deserialize(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	if len(wtx.TxIn) != 2 {
+		t.Errorf("want 2 inputs, have %d", len(wtx.TxIn))
+	}
+	for i, in := range wtx.TxIn {
+		if len(in.Witness) == 0 {
+			t.Errorf("input %d is not signed", i)
+		}
+	}
+}
+
+func TestMultiPartyDuplicateInput(t *testing.T) {
+	coord := NewCoordinator(2, COORDINATOR_TIMEOUT, func(tx wallet.Transaction, in wallet.Amount) (string, error) {
+		t.Error("should not broadcast")
+		return "", nil
+	})
+	server := httptest.NewServer(coord)
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	lightnings := make([]*fakeLightning, 2)
+	for i := range errs {
+		lightnings[i] = &fakeLightning{completed: make(map[string]string)}
+		p := newTestParticipant("same", lightnings[i]) // same utxo for both
+		chans := []glightning.FundChannelStart{{Id: "peer", Amount: 100000}}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = p.Join(coord.Url(server.Listener.Addr().String()), &chans)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err == nil {
+			t.Errorf("participant %d should fail on duplicate input", i)
+		}
+		if len(lightnings[i].cancelled) == 0 {
+			t.Errorf("participant %d did not cancel its channels", i)
+		}
+	}
+}
+
+// TestMultiPartyTimeout checks a session nobody completes fails, and participants that have not
+//   signed cancel their channels
+func TestMultiPartyTimeout(t *testing.T) {
+	coord := NewCoordinator(2, time.Millisecond*100, func(tx wallet.Transaction, in wallet.Amount) (string, error) {
+		t.Error("should not broadcast")
+		return "", nil
+	})
+	server := httptest.NewServer(coord)
+	defer server.Close()
+
+	l := &fakeLightning{completed: make(map[string]string)}
+	chans := []glightning.FundChannelStart{{Id: "peer", Amount: 100000}}
+	_, err := newTestParticipant("alice", l).Join(coord.Url(server.Listener.Addr().String()), &chans)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("want the session timed out, have %v", err)
+	}
+	if len(l.cancelled) != 1 {
+		t.Errorf("want the channel cancelled, have %v", l.cancelled)
+	}
+	select {
+	case <-coord.Done():
+	default:
+		t.Error("the session should be done")
+	}
+	if err := coord.Cancel(errors.New("cancelled")); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("want cancel to report the timeout, have %v", err)
+	}
+}
+
+func TestCoordinatorCancel(t *testing.T) {
+	coord := NewCoordinator(2, COORDINATOR_TIMEOUT, nil)
+	if err := coord.Cancel(errors.New("cancelled by the coordinator")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-coord.Done():
+	default:
+		t.Error("the session should be done")
+	}
+	if s := coord.status().(*StatusMessage); s.Error != "cancelled by the coordinator" {
+		t.Errorf("want the status to show the cancel, have %+v", s)
+	}
+}
+
+// TestMultiPartySignedNoCancel checks participants keep their channels once their signatures are
+//   posted, the coordinator could still broadcast
+func TestMultiPartySignedNoCancel(t *testing.T) {
+	coord := NewCoordinator(2, COORDINATOR_TIMEOUT, func(tx wallet.Transaction, in wallet.Amount) (string, error) {
+		return "", errors.New("bitcoind unavailable")
+	})
+	server := httptest.NewServer(coord)
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	lightnings := make([]*fakeLightning, 2)
+	for i, seed := range []string{"alice", "bob"} {
+		lightnings[i] = &fakeLightning{completed: make(map[string]string)}
+		p := newTestParticipant(seed, lightnings[i])
+		chans := []glightning.FundChannelStart{{Id: "peer" + seed, Amount: 100000}}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = p.Join(coord.Url(server.Listener.Addr().String()), &chans)
+		}(i)
+		time.Sleep(time.Millisecond * 50) // keep join order stable
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err == nil || !strings.Contains(err.Error(), "may still confirm") {
+			t.Errorf("participant %d want a warning to watch the tx, have %v", i, err)
+		}
+		if len(lightnings[i].cancelled) != 0 {
+			t.Errorf("participant %d cancelled after signing: %v", i, lightnings[i].cancelled)
+		}
+	}
+}
+
+func TestCoordinatorToken(t *testing.T) {
+	coord := NewCoordinator(2, COORDINATOR_TIMEOUT, nil)
+	server := httptest.NewServer(coord)
+	defer server.Close()
+	if len(coord.Token) != 32 || coord.Token == NewCoordinator(2, COORDINATOR_TIMEOUT, nil).Token {
+		t.Errorf("want a random token, have %s", coord.Token)
+	}
+
+	for _, url := range []string{server.URL + "/status", server.URL + "/" + strings.Repeat("0", 32) + "/status"} {
+		res, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: want not found without the token, have %d", url, res.StatusCode)
+		}
+	}
+	status := StatusMessage{}
+	if err := newTestParticipant("alice", nil).get(coord.Url(server.Listener.Addr().String())+"/status", &status); err != nil {
+		t.Errorf("want status with the token, have %v", err)
+	}
+}
+
+func TestVerifyContributionScripts(t *testing.T) {
+	w := &fakeWallet{"alice"}
+	utxos, _ := w.Utxos(0, 0)
+	ours, err := wallet.CreateWalletPsbt([]*wallet.TxRecipient{{Address: w.ChangeAddress(), Amount: 900000}}, utxos, testNet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyContribution(ours, ours); err != nil {
+		t.Fatal(err)
+	}
+
+	// a P2SH wrapped input is signed with a scriptSig, which changes the txid
+	wrapped, _ := txscript.NewScriptBuilder().AddOp(txscript.OP_HASH160).AddData(make([]byte, 20)).AddOp(txscript.OP_EQUAL).Script()
+	combined, _ := wallet.DecodePsbt(encode(t, ours))
+	combined.Inputs[0].WitnessUtxo = wire.NewTxOut(1000000, wrapped)
+	if err := verifyContribution(combined, ours); err == nil || !strings.Contains(err.Error(), "not native segwit") {
+		t.Errorf("want a wrapped input rejected, have %v", err)
+	}
+	combined.Inputs[0].WitnessUtxo = nil
+	if err := verifyContribution(combined, ours); err == nil || !strings.Contains(err.Error(), "no witness utxo") {
+		t.Errorf("want an input without a witness utxo rejected, have %v", err)
+	}
+}
+
+// TestCoordinatorTxidChanged checks final scripts that would change the txid the channels were
+//   completed with, or do not spend the input, are rejected and nothing is broadcast
+func TestCoordinatorTxidChanged(t *testing.T) {
+	var broadcast string
+	coord := NewCoordinator(1, COORDINATOR_TIMEOUT, func(tx wallet.Transaction, in wallet.Amount) (string, error) {
+		broadcast = tx.TxId
+		return tx.TxId, nil
+	})
+	server := httptest.NewServer(coord)
+	defer server.Close()
+	url := coord.Url(server.Listener.Addr().String())
+
+	w := &fakeWallet{"alice"}
+	utxos, _ := w.Utxos(0, 0)
+	contribution, err := wallet.CreateWalletPsbt([]*wallet.TxRecipient{{Address: w.ChangeAddress(), Amount: 900000}}, utxos, testNet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestParticipant("alice", nil)
+	status := StatusMessage{}
+	if err := p.post(url+"/contribute", &PsbtMessage{Psbt: encode(t, contribution)}, &status); err != nil {
+		t.Fatal(err)
+	}
+
+	var unsigned bytes.Buffer
+	contribution.UnsignedTx.Serialize(&unsigned)
+	tx := wallet.Transaction{TxId: contribution.UnsignedTx.TxHash().String(), Unsigned: unsigned.Bytes()}
+	w.Sign(&tx, utxos)
+	if err := wallet.AddSignedInputs(contribution, tx.Signed, utxos); err != nil {
+		t.Fatal(err)
+	}
+	signed := encode(t, contribution)
+
+	// a scriptSig on a native input changes the txid, a bare witness does not spend it
+	contribution.Inputs[0].FinalScriptSig = []byte{0x01, 0x00}
+	if err := p.post(url+"/sign", &PsbtMessage{Psbt: encode(t, contribution)}, &status); err == nil || !strings.Contains(err.Error(), "do not spend") {
+		t.Errorf("want a scriptSig rejected, have %v", err)
+	}
+	contribution.Inputs[0].FinalScriptSig = nil
+	contribution.Inputs[0].FinalScriptWitness = []byte{0x01, 0x01, 0x00}
+	if err := p.post(url+"/sign", &PsbtMessage{Psbt: encode(t, contribution)}, &status); err == nil || !strings.Contains(err.Error(), "do not spend") {
+		t.Errorf("want a bogus witness rejected, have %v", err)
+	}
+	if broadcast != "" {
+		t.Fatal("should not broadcast")
+	}
+
+	if err := p.post(url+"/sign", &PsbtMessage{Psbt: signed}, &status); err != nil {
+		t.Fatal(err)
+	}
+	if broadcast != tx.TxId || status.Txid != tx.TxId {
+		t.Errorf("want %s broadcast, have %s", tx.TxId, broadcast)
+	}
+}
+
+func encode(t *testing.T, p *psbt.Packet) string {
+	encoded, err := p.B64Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
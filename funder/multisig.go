@@ -0,0 +1,53 @@
+package funder
+
+import (
+	"errors"
+
+	"github.com/btcsuite/btcutil/psbt"
+	"github.com/niftynei/glightning/glightning"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+// GetMultisigFundingPsbt starts the channels and builds a PSBT spending the provided
+//   multisig inputs, the inputs are chosen by the signers so all of them are spent and
+//   any change goes back to the change address they provide
+// returns the PSBT to be passed around for signatures and the channel outputs to complete
+func (f *Funder) GetMultisigFundingPsbt(chans *[]glightning.FundChannelStart, utxos []wallet.MultisigUTXO, change string) (*psbt.Packet, wallet.ChannelOutputs, error) {
+	if len(utxos) == 0 {
+		return nil, nil, errors.New("no multisig inputs provided")
+	}
+
+	outamt, err := channelTotal(*chans)
+	if err != nil {
+		return nil, nil, err
+	}
+	inamt := wallet.Amount(0)
+	for _, u := range utxos {
+		if inamt, err = inamt.Add(u.Amount); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// channel outputs are P2WSH, the change is assumed to go back to the same kind of script
+	vsize := wallet.MultisigInputFeeSats(utxos) + uint64(43*(len(*chans)+1)) + 11
+	fee := wallet.Amount(f.SatsPerVbyte() * vsize)
+
+	if inamt < outamt+fee {
+		return nil, nil, errors.New("Insufficient funds, Need more coin")
+	}
+
+	outputs, recipients, _, err := startChannels(f.Lightning, f.BitcoinNet, chans, nil, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if amt, ok := wallet.Change(inamt, outamt, fee); ok { // no change if dust, save on tx fee
+		recipients = append(recipients, &wallet.TxRecipient{Address: change, Amount: amt})
+	}
+
+	p, err := wallet.CreatePsbt(recipients, utxos, f.BitcoinNet)
+	if err != nil {
+		return nil, outputs, err
+	}
+	return p, outputs, nil
+}
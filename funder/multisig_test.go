@@ -0,0 +1,159 @@
+package funder
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/psbt"
+	"github.com/niftynei/glightning/glightning"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+func multisigKey(seed byte) *btcec.PrivateKey {
+	key, _ := btcec.PrivKeyFromBytes(btcec.S256(), bytes.Repeat([]byte{seed}, 32))
+	return key
+}
+
+// multisigUtxo is a 2 of 3 output of the keys seeded 1, 2 and 3
+func multisigUtxo(t *testing.T) wallet.MultisigUTXO {
+	pubkeys := make([]*btcutil.AddressPubKey, 0)
+	for seed := byte(1); seed <= 3; seed++ {
+		pk, err := btcutil.NewAddressPubKey(multisigKey(seed).PubKey().SerializeCompressed(), testNet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubkeys = append(pubkeys, pk)
+	}
+	script, err := txscript.MultiSigScript(pubkeys, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wallet.MultisigUTXO{
+		UTXO:          wallet.UTXO{Amount: 1000000, OutPoint: *wire.NewOutPoint(&chainhash.Hash{9}, 0)},
+		WitnessScript: script,
+	}
+}
+
+// signedBy is a copy of the PSBT as a participant would return it, with their partial signatures
+func signedBy(t *testing.T, p *psbt.Packet, key *btcec.PrivateKey) *psbt.Packet {
+	encoded, _ := p.B64Encode()
+	signed, err := wallet.DecodePsbt(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := txscript.NewTxSigHashes(signed.UnsignedTx)
+	for i, in := range signed.Inputs {
+		sig, err := txscript.RawTxInWitnessSignature(signed.UnsignedTx, hashes, i, in.WitnessUtxo.Value, in.WitnessScript, txscript.SigHashAll, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed.Inputs[i].PartialSigs = []*psbt.PartialSig{{PubKey: key.PubKey().SerializeCompressed(), Signature: sig}}
+	}
+	return signed
+}
+
+func missing(t *testing.T, p *psbt.Packet) int {
+	m, err := wallet.MissingSignatures(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m[0]
+}
+
+func TestMultisigSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multisig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := &fakeLightning{completed: make(map[string]string)}
+	f := &Funder{Lightning: l, BitcoinNet: testNet, Fees: wallet.StaticFees(2), Lightningdir: dir}
+	chans := []glightning.FundChannelStart{{Id: "peer1", Amount: 300000}, {Id: "peer2", Amount: 200000}}
+	utxo := multisigUtxo(t)
+
+	// create
+	p, outputs, err := f.GetMultisigFundingPsbt(&chans, []wallet.MultisigUTXO{utxo}, (&fakeWallet{"multisig"}).ChangeAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 2 || len(p.UnsignedTx.TxOut) != 3 {
+		t.Fatalf("want 2 channel outputs and change, have %d and %d outputs", len(outputs), len(p.UnsignedTx.TxOut))
+	}
+	if missing(t, p) != 2 {
+		t.Errorf("want 2 signatures missing, have %d", missing(t, p))
+	}
+	encoded, _ := p.B64Encode()
+	id := p.UnsignedTx.TxHash().String()
+	sessions, _ := f.Sessions()
+	if err := sessions.Put(&Session{Id: id, Psbt: encoded, Outputs: outputs}); err != nil {
+		t.Fatal(err)
+	}
+
+	// sign, a signature counts once however often it is sent
+	for i := 0; i < 2; i++ {
+		if err := wallet.CombinePsbt(p, signedBy(t, p, multisigKey(1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if missing(t, p) != 1 {
+		t.Errorf("want 1 signature missing, have %d", missing(t, p))
+	}
+
+	// signatures from a key outside the script, or not over this transaction, are rejected
+	if err := wallet.CombinePsbt(p, signedBy(t, p, multisigKey(4))); err == nil || !strings.Contains(err.Error(), "not in the witness script") {
+		t.Errorf("want an outside key rejected, have %v", err)
+	}
+	forged := signedBy(t, p, multisigKey(2))
+	forged.Inputs[0].WitnessUtxo = wire.NewTxOut(1, p.Inputs[0].WitnessUtxo.PkScript)
+	if err := wallet.CombinePsbt(p, signedBy(t, forged, multisigKey(2))); err == nil || !strings.Contains(err.Error(), "invalid signature") {
+		t.Errorf("want a signature over another amount rejected, have %v", err)
+	}
+	bogus := *p.Inputs[0].PartialSigs[0]
+	bogus.PubKey = multisigKey(3).PubKey().SerializeCompressed()
+	p.Inputs[0].PartialSigs = append(p.Inputs[0].PartialSigs, &bogus)
+	if missing(t, p) != 1 {
+		t.Errorf("a signature under the wrong key should not count, have %d missing", missing(t, p))
+	}
+	p.Inputs[0].PartialSigs = p.Inputs[0].PartialSigs[:1]
+
+	// persist the partly signed PSBT, a restarted plugin picks up the session
+	encoded, _ = p.B64Encode()
+	if err := sessions.Put(&Session{Id: id, Psbt: encoded, Outputs: outputs}); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewSessionStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := reopened.Get(id)
+	if session == nil || len(session.Outputs) != 2 {
+		t.Fatalf("want the session with its outputs, have %+v", session)
+	}
+	p, err = wallet.DecodePsbt(session.Psbt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// threshold
+	if err := wallet.CombinePsbt(p, signedBy(t, p, multisigKey(3))); err != nil {
+		t.Fatal(err)
+	}
+	if missing(t, p) != 0 {
+		t.Errorf("want the threshold reached, have %d missing", missing(t, p))
+	}
+	if err := reopened.Remove(id); err != nil {
+		t.Fatal(err)
+	}
+	if reopened, _ = NewSessionStore(dir); reopened.Get(id) != nil {
+		t.Error("a removed session should not be loaded")
+	}
+}
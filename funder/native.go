@@ -0,0 +1,365 @@
+package funder
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/niftynei/glightning/glightning"
+	"github.com/rsbondi/multifund/logger"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+// Newer lightningd versions ship their own batch funding, when using the internal wallet
+//   fund_multi and withdraw_multi are routed through those so the plugin keeps working
+//   as lightningd's wallet evolves
+
+type Capabilities struct {
+	Version          string `json:"version"`
+	MultiFundChannel bool   `json:"multifundchannel"`
+	FundPsbt         bool   `json:"fundpsbt"`
+	UtxoPsbt         bool   `json:"utxopsbt"`
+	SignPsbt         bool   `json:"signpsbt"`
+	SendPsbt         bool   `json:"sendpsbt"`
+}
+
+// NativeFund is true when fund_multi can use multifundchannel
+func (c *Capabilities) NativeFund() bool {
+	return c != nil && c.MultiFundChannel
+}
+
+// NativeWithdraw is true when withdraw_multi can use fundpsbt and signpsbt, the plugin broadcasts
+func (c *Capabilities) NativeWithdraw() bool {
+	return c != nil && c.FundPsbt && c.SignPsbt
+}
+
+type GetInfoRequest struct{}
+
+func (r *GetInfoRequest) Name() string {
+	return "getinfo"
+}
+
+type GetInfoResult struct {
+	Id          string `json:"id"`
+	Version     string `json:"version"`
+	BlockHeight uint32 `json:"blockheight"`
+}
+
+type HelpRequest struct{}
+
+func (r *HelpRequest) Name() string {
+	return "help"
+}
+
+type HelpResult struct {
+	Help []struct {
+		Command string `json:"command"`
+	} `json:"help"`
+}
+
+// ProbeCapabilities asks lightningd for its version and which funding commands it provides
+func ProbeCapabilities(l ChannelFunder) (*Capabilities, error) {
+	info := GetInfoResult{}
+	if err := l.Request(&GetInfoRequest{}, &info); err != nil {
+		return nil, err
+	}
+
+	help := HelpResult{}
+	if err := l.Request(&HelpRequest{}, &help); err != nil {
+		return nil, err
+	}
+
+	caps := &Capabilities{Version: info.Version}
+	for _, h := range help.Help {
+		// command includes the usage, "multifundchannel destinations [feerate] ..."
+		fields := strings.Fields(h.Command)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "multifundchannel":
+			caps.MultiFundChannel = true
+		case "fundpsbt":
+			caps.FundPsbt = true
+		case "utxopsbt":
+			caps.UtxoPsbt = true
+		case "signpsbt":
+			caps.SignPsbt = true
+		case "sendpsbt":
+			caps.SendPsbt = true
+		}
+	}
+	return caps, nil
+}
+
+// UseNative is true when the internal wallet is selected and lightningd can do the job itself
+func (f *Funder) UseNative() bool {
+	return f.Native && f.Wallettype == wallet.WALLET_INTERNAL && f.Capabilities != nil
+}
+
+type MultiFundDestination struct {
+	Id       string         `json:"id"`
+	Amount   uint64         `json:"amount"`
+	Announce bool           `json:"announce"`
+	PushMsat uint64         `json:"push_msat,omitempty"`
+	CloseTo  string         `json:"close_to,omitempty"`
+	MinDepth *uint32        `json:"mindepth,omitempty"`
+	Reserve  *wallet.Amount `json:"reserve,omitempty"`
+}
+
+type MultiFundChannelRequest struct {
+	Destinations []MultiFundDestination `json:"destinations"`
+	FeeRate      string                 `json:"feerate,omitempty"`
+}
+
+func (r *MultiFundChannelRequest) Name() string {
+	return "multifundchannel"
+}
+
+type MultiFundChannelResult struct {
+	Tx         string `json:"tx"`
+	Txid       string `json:"txid"`
+	ChannelIds []struct {
+		Id        string `json:"id"`
+		Outnum    uint   `json:"outnum"`
+		ChannelId string `json:"channel_id"`
+	} `json:"channel_ids"`
+}
+
+type NativeResult struct {
+	Tx       string            `json:"tx"`
+	Txid     string            `json:"txid"`
+	Channels []string          `json:"channels,omitempty"`
+	Peers    map[uint32]string `json:"-"` // funding output index to peer
+	Batch    []BatchChannel    `json:"-"` // the channels with their ids, for RecordBatch
+}
+
+// NativeSupports is false when a channel needs an option multifundchannel does not take,
+//   or the channels ask for different fee rates where multifundchannel takes one
+func NativeSupports(chans []glightning.FundChannelStart, options map[string]*ChannelOptions) bool {
+	if _, err := nativeFeeRate(chans); err != nil {
+		return false
+	}
+	for _, o := range options {
+		if o != nil && len(o.ChannelType) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// nativeFeeRate is the one fee rate set on the channels, empty for lightningd's default
+func nativeFeeRate(chans []glightning.FundChannelStart) (string, error) {
+	feerate := ""
+	for _, c := range chans {
+		if c.FeeRate == "" {
+			continue
+		}
+		if feerate != "" && feerate != c.FeeRate {
+			return "", fmt.Errorf("multifundchannel takes one fee rate, have %s and %s", feerate, c.FeeRate)
+		}
+		feerate = c.FeeRate
+	}
+	return feerate, nil
+}
+
+// NativeFundAllowed is true when lightningd may broadcast the funding, multifundchannel signs and
+//   broadcasts in one call so the transaction can not be checked by GuardTx or sent by the
+//   configured broadcaster, it is only used with the lightning broadcaster and no fee limits
+func (f *Funder) NativeFundAllowed() bool {
+	if _, ok := f.Broadcaster.(*wallet.LightningBroadcaster); !ok {
+		return false
+	}
+	return f.Limits != nil && f.Limits.MaxFee == 0 && f.Limits.MaxFeePercent == 0
+}
+
+// NativeFundMulti opens all channels with lightningd's multifundchannel
+func (f *Funder) NativeFundMulti(chans *[]glightning.FundChannelStart, options map[string]*ChannelOptions) (*NativeResult, error) {
+	feerate, err := nativeFeeRate(*chans)
+	if err != nil {
+		return nil, err
+	}
+	req := &MultiFundChannelRequest{Destinations: make([]MultiFundDestination, 0), FeeRate: feerate}
+	for _, c := range *chans {
+		d := MultiFundDestination{Id: c.Id, Amount: c.Amount, Announce: c.Announce}
+		if o := options[c.Id]; o != nil {
+			d.PushMsat = o.Push.Msat()
+			d.CloseTo = o.CloseTo
+			d.MinDepth = o.MinDepth
+			d.Reserve = o.Reserve
+		}
+		req.Destinations = append(req.Destinations, d)
+	}
+
+	result := MultiFundChannelResult{}
+	if err := f.Lightning.Request(req, &result); err != nil {
+		return nil, err
+	}
+
+	channels := make([]string, 0)
+	peers := make(map[uint32]string)
+	batch := make([]BatchChannel, 0)
+	for _, c := range result.ChannelIds {
+		channels = append(channels, c.ChannelId)
+		peers[uint32(c.Outnum)] = c.Id
+		bc := BatchChannel{Peer: c.Id, ChannelId: c.ChannelId}
+		for _, ch := range *chans {
+			if ch.Id == c.Id {
+				bc.Amount = ch.Amount
+			}
+		}
+		batch = append(batch, bc)
+	}
+	return &NativeResult{Tx: result.Tx, Txid: result.Txid, Channels: channels, Peers: peers, Batch: batch}, nil
+}
+
+type FundPsbtRequest struct {
+	Satoshi     wallet.Amount `json:"satoshi"`
+	FeeRate     string        `json:"feerate"`
+	StartWeight uint64        `json:"startweight"`
+	Reserve     bool          `json:"reserve"`
+}
+
+func (r *FundPsbtRequest) Name() string {
+	return "fundpsbt"
+}
+
+type FundPsbtResult struct {
+	Psbt                 string `json:"psbt"`
+	FeeRatePerKw         uint64 `json:"feerate_per_kw"`
+	EstimatedFinalWeight uint64 `json:"estimated_final_weight"`
+	ExcessMsat           string `json:"excess_msat"`
+}
+
+type UnreserveInputsRequest struct {
+	Psbt string `json:"psbt"`
+}
+
+func (r *UnreserveInputsRequest) Name() string {
+	return "unreserveinputs"
+}
+
+type SignPsbtRequest struct {
+	Psbt string `json:"psbt"`
+}
+
+func (r *SignPsbtRequest) Name() string {
+	return "signpsbt"
+}
+
+type SignPsbtResult struct {
+	SignedPsbt string `json:"signed_psbt"`
+}
+
+// weight of a P2WPKH change output
+const CHANGE_WEIGHT = 4 * 31
+
+// NativeWithdraw pays all recipients with lightningd's fundpsbt and signpsbt, the signed
+//   transaction is sent with Broadcast like the plugin's own
+//   sending, if set, is called with the txid before the broadcast and an error stops it
+func (f *Funder) NativeWithdraw(recipients []*wallet.TxRecipient, feerate string, sending func(txid string) error, log *logger.Logger) (*NativeResult, error) {
+	total := wallet.Amount(0)
+	for _, r := range recipients {
+		if r.Amount == 0 {
+			return nil, fmt.Errorf("invalid amount for %s", r.Address)
+		}
+		var err error
+		if total, err = total.Add(r.Amount); err != nil {
+			return nil, err
+		}
+	}
+	if feerate == "" {
+		feerate = "normal"
+	}
+
+	// 42 weight for the transaction overhead, the outputs are added by us
+	startweight := uint64(42) + 4*wallet.OutputFeeSats(recipients, f.BitcoinNet)
+	funded := FundPsbtResult{}
+	err := f.Lightning.Request(&FundPsbtRequest{Satoshi: total, FeeRate: feerate, StartWeight: startweight, Reserve: true}, &funded)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := wallet.DecodePsbt(funded.Psbt)
+	if err != nil {
+		f.unreserve(funded.Psbt, log)
+		return nil, err
+	}
+
+	// excess is what is left over after paying the outputs and fee, pay it back to ourselves
+	excess, err := parseMsat(funded.ExcessMsat)
+	if err != nil {
+		f.unreserve(funded.Psbt, log)
+		return nil, err
+	}
+	changefee := wallet.Amount(funded.FeeRatePerKw * CHANGE_WEIGHT / 1000)
+	if excess > changefee+wallet.DUST_LIMIT {
+		change, err := f.Lightning.NewAddr()
+		if err != nil {
+			f.unreserve(funded.Psbt, log)
+			return nil, err
+		}
+		recipients = append(recipients, &wallet.TxRecipient{Address: change, Amount: excess - changefee})
+	}
+
+	if err := wallet.AddPsbtOutputs(p, recipients, f.BitcoinNet); err != nil {
+		f.unreserve(funded.Psbt, log)
+		return nil, err
+	}
+	encoded, err := p.B64Encode()
+	if err != nil {
+		f.unreserve(funded.Psbt, log)
+		return nil, err
+	}
+
+	signed := SignPsbtResult{}
+	if err := f.Lightning.Request(&SignPsbtRequest{Psbt: encoded}, &signed); err != nil {
+		f.unreserve(funded.Psbt, log)
+		return nil, err
+	}
+
+	sp, err := wallet.DecodePsbt(signed.SignedPsbt)
+	if err != nil {
+		f.unreserve(funded.Psbt, log)
+		return nil, err
+	}
+	in, err := wallet.InputTotal(sp)
+	if err != nil {
+		f.unreserve(funded.Psbt, log)
+		return nil, err
+	}
+	tx, err := wallet.FinalizePsbt(sp)
+	if err != nil {
+		f.unreserve(funded.Psbt, log)
+		return nil, err
+	}
+	log.Debugf("signed %s spending %d inputs: %s", tx.TxId, len(sp.Inputs), tx.String())
+
+	if sending != nil {
+		if err := sending(tx.TxId); err != nil {
+			f.unreserve(funded.Psbt, log)
+			return nil, err
+		}
+	}
+	txid, err := f.Broadcast(tx, in)
+	if err != nil {
+		f.unreserve(funded.Psbt, log)
+		return nil, err
+	}
+	return &NativeResult{Tx: tx.String(), Txid: txid}, nil
+}
+
+func (f *Funder) unreserve(encoded string, log *logger.Logger) {
+	if err := f.Lightning.Request(&UnreserveInputsRequest{Psbt: encoded}, &struct{}{}); err != nil {
+		log.Warnf("unreserveinputs error: %s", err.Error())
+	}
+}
+
+// parseMsat reads lightningd's "1234msat" amounts as satoshis, rounding down any part of a satoshi
+func parseMsat(msat string) (wallet.Amount, error) {
+	var amt uint64
+	if _, err := fmt.Sscanf(msat, "%dmsat", &amt); err != nil {
+		return 0, errors.New("invalid msat amount: " + msat)
+	}
+	return wallet.Amount(amt / 1000), nil
+}
@@ -0,0 +1,110 @@
+package funder
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/niftynei/glightning/glightning"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+// named feerates lightningd accepts in place of a number
+var feeRateNames = map[string]bool{
+	"urgent":  true,
+	"normal":  true,
+	"slow":    true,
+	"opening": true,
+	"minimum": true,
+}
+
+var feeRateValue = regexp.MustCompile(`^[0-9]+(perkw|perkb)?$`)
+
+// ChannelOptions are the fundchannel_start options beyond id, amount, feerate and announce
+//   mindepth and reserve are pointers as 0 is meaningful for zero conf and zero reserve channels
+//   push is given like any other amount and sent to lightningd as push_msat
+type ChannelOptions struct {
+	Push        wallet.Amount  `json:"push,omitempty"`
+	CloseTo     string         `json:"close_to,omitempty"` // upfront shutdown address
+	MinDepth    *uint32        `json:"mindepth,omitempty"`
+	Reserve     *wallet.Amount `json:"reserve,omitempty"`
+	ChannelType []uint         `json:"channel_type,omitempty"`
+}
+
+func (o *ChannelOptions) empty() bool {
+	return o == nil || (o.Push == 0 && o.CloseTo == "" && o.MinDepth == nil && o.Reserve == nil && len(o.ChannelType) == 0)
+}
+
+// ValidateChannel checks a channel and its options before anything is started
+func ValidateChannel(c *glightning.FundChannelStart, o *ChannelOptions, net *chaincfg.Params) error {
+	if c.FeeRate != "" && !feeRateNames[c.FeeRate] && !feeRateValue.MatchString(c.FeeRate) {
+		return fmt.Errorf("%s: invalid feerate %s, use a number with optional perkw or perkb, or urgent, normal, slow", c.Id, c.FeeRate)
+	}
+	if o == nil {
+		return nil
+	}
+	if o.Push > wallet.Amount(c.Amount) {
+		return fmt.Errorf("%s: push %s is more than the channel amount", c.Id, o.Push)
+	}
+	if o.Reserve != nil && *o.Reserve >= wallet.Amount(c.Amount) {
+		return fmt.Errorf("%s: reserve %s must be less than the channel amount", c.Id, *o.Reserve)
+	}
+	if o.CloseTo != "" {
+		addr, err := btcutil.DecodeAddress(o.CloseTo, net)
+		if err != nil || !addr.IsForNet(net) {
+			return fmt.Errorf("%s: close_to %s is not a %s address", c.Id, o.CloseTo, net.Name)
+		}
+	}
+	seen := make(map[uint]bool)
+	for _, bit := range o.ChannelType {
+		if seen[bit] {
+			return fmt.Errorf("%s: channel_type repeats feature bit %d", c.Id, bit)
+		}
+		seen[bit] = true
+	}
+	return nil
+}
+
+// FundChannelStartRequest is fundchannel_start with every option, glightning only sends the basic ones
+type FundChannelStartRequest struct {
+	Id          string         `json:"id"`
+	Amount      uint64         `json:"amount"`
+	FeeRate     string         `json:"feerate,omitempty"`
+	Announce    bool           `json:"announce"`
+	CloseTo     string         `json:"close_to,omitempty"`
+	PushMsat    uint64         `json:"push_msat,omitempty"`
+	MinDepth    *uint32        `json:"mindepth,omitempty"`
+	Reserve     *wallet.Amount `json:"reserve,omitempty"`
+	ChannelType []uint         `json:"channel_type,omitempty"`
+}
+
+func (r *FundChannelStartRequest) Name() string {
+	return "fundchannel_start"
+}
+
+type FundChannelStartResult struct {
+	FundingAddress string `json:"funding_address"`
+	ScriptPubkey   string `json:"scriptpubkey"`
+	CloseTo        string `json:"close_to,omitempty"`
+}
+
+// startFundChannel uses glightning's fundchannel_start unless a feerate or option has to be passed
+func startFundChannel(l ChannelFunder, c glightning.FundChannelStart, o *ChannelOptions) (string, error) {
+	if c.FeeRate == "" && o.empty() {
+		return l.StartFundChannel(c.Id, c.Amount, c.Announce, nil)
+	}
+	req := &FundChannelStartRequest{Id: c.Id, Amount: c.Amount, FeeRate: c.FeeRate, Announce: c.Announce}
+	if o != nil {
+		req.CloseTo = o.CloseTo
+		req.PushMsat = o.Push.Msat()
+		req.MinDepth = o.MinDepth
+		req.Reserve = o.Reserve
+		req.ChannelType = o.ChannelType
+	}
+	result := FundChannelStartResult{}
+	if err := l.Request(req, &result); err != nil {
+		return "", err
+	}
+	return result.FundingAddress, nil
+}
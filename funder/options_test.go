@@ -0,0 +1,74 @@
+package funder
+
+import (
+	"testing"
+
+	"github.com/niftynei/glightning/glightning"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+func TestValidateChannel(t *testing.T) {
+	closeTo := (&fakeWallet{seed: "close"}).address("close")
+	zero := wallet.Amount(0)
+	big := wallet.Amount(100000)
+	c := glightning.FundChannelStart{Id: "peer", Amount: 100000}
+
+	tests := []struct {
+		name    string
+		feerate string
+		o       *ChannelOptions
+		valid   bool
+	}{
+		{"none", "", nil, true},
+		{"named feerate", "urgent", nil, true},
+		{"perkw feerate", "253perkw", nil, true},
+		{"bad feerate", "fast", nil, false},
+		{"all options", "normal", &ChannelOptions{Push: 1, CloseTo: closeTo, Reserve: &zero, ChannelType: []uint{12, 22}}, true},
+		{"push too much", "", &ChannelOptions{Push: 100001}, false},
+		{"reserve too big", "", &ChannelOptions{Reserve: &big}, false},
+		{"close_to other net", "", &ChannelOptions{CloseTo: "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq"}, false},
+		{"close_to garbage", "", &ChannelOptions{CloseTo: "nope"}, false},
+		{"repeated channel_type", "", &ChannelOptions{ChannelType: []uint{12, 12}}, false},
+	}
+	for _, tt := range tests {
+		c.FeeRate = tt.feerate
+		err := ValidateChannel(&c, tt.o, testNet)
+		if tt.valid && err != nil {
+			t.Errorf("%s: %s", tt.name, err.Error())
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
+
+func TestStartChannelsOptions(t *testing.T) {
+	l := &fakeLightning{completed: make(map[string]string)}
+	depth := uint32(0)
+	chans := []glightning.FundChannelStart{
+		{Id: "plain", Amount: 100000, Announce: true},
+		{Id: "feerate", Amount: 100000, FeeRate: "slow"},
+		{Id: "zeroconf", Amount: 100000, Announce: true},
+	}
+	options := map[string]*ChannelOptions{
+		"plain":    &ChannelOptions{},
+		"zeroconf": &ChannelOptions{MinDepth: &depth, Push: 5, ChannelType: []uint{12, 46}},
+	}
+	outputs, _, _, err := startChannels(l, testNet, &chans, options, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 3 {
+		t.Fatalf("want 3 outputs, have %d", len(outputs))
+	}
+	if len(l.requests) != 2 {
+		t.Fatalf("only channels with a feerate or options need the full request, have %d", len(l.requests))
+	}
+	if l.requests[0].Id != "feerate" || l.requests[0].FeeRate != "slow" {
+		t.Errorf("feerate not passed, have %+v", l.requests[0])
+	}
+	z := l.requests[1]
+	if z.Id != "zeroconf" || z.MinDepth == nil || *z.MinDepth != 0 || z.PushMsat != 5000 || len(z.ChannelType) != 2 {
+		t.Errorf("options not passed, have %+v", z)
+	}
+}
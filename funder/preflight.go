@@ -0,0 +1,218 @@
+package funder
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/niftynei/glightning/glightning"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+// largest channel without option_support_large_channel, 2^24 - 1
+const MAX_CHANNEL_SIZE = 16777215
+
+// option_support_large_channel feature bits
+const (
+	WUMBO_REQUIRED = 18
+	WUMBO_OPTIONAL = 19
+)
+
+// channel states of an open that has not finished negotiating, a second open to the peer would fail
+var pendingOpenStates = map[string]bool{
+	"OPENINGD":            true,
+	"DUALOPEND_OPEN_INIT": true,
+}
+
+// pre-flight checks, reported with each problem
+const (
+	CHECK_DUPLICATE = "duplicate_peer"
+	CHECK_AMOUNT    = "amount"
+	CHECK_OPTIONS   = "options"
+	CHECK_CONNECTED = "connected"
+	CHECK_PENDING   = "pending_open"
+	CHECK_BALANCE   = "balance"
+	CHECK_ADDRESS   = "address"
+)
+
+// Problem is one failed check, index is the position of the channel or destination in the request
+//   and is -1 for checks on the whole batch
+type Problem struct {
+	Index   int    `json:"index"`
+	Id      string `json:"id,omitempty"`
+	Check   string `json:"check"`
+	Message string `json:"message"`
+}
+
+// PreflightError lists every problem found so all of them can be fixed at once
+type PreflightError struct {
+	Problems []*Problem `json:"problems"`
+}
+
+func (e *PreflightError) Error() string {
+	msgs := make([]string, 0)
+	for _, p := range e.Problems {
+		msgs = append(msgs, p.Message)
+	}
+	return fmt.Sprintf("batch failed %d pre-flight checks: %s", len(e.Problems), strings.Join(msgs, "; "))
+}
+
+func preflightError(problems []*Problem) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	return &PreflightError{Problems: problems}
+}
+
+// DuplicatePeer returns the first peer with more than one channel in the batch, lightningd only
+//   negotiates one channel open with a peer at a time so a batch can open one channel per peer
+func DuplicatePeer(chans []glightning.FundChannelStart) string {
+	seen := make(map[string]bool)
+	for _, c := range chans {
+		if seen[c.Id] {
+			return c.Id
+		}
+		seen[c.Id] = true
+	}
+	return ""
+}
+
+// CheckChannels checks each channel against the others and the peer state from listpeers
+//   the size limit is only known for peers in listpeers, others are checked once connected
+func CheckChannels(chans []glightning.FundChannelStart, options map[string]*ChannelOptions, peers *ListPeersResult, requireConnected bool, net *chaincfg.Params) []*Problem {
+	byId := make(map[string]*PeerInfo)
+	for i := range peers.Peers {
+		byId[peers.Peers[i].Id] = &peers.Peers[i]
+	}
+
+	problems := make([]*Problem, 0)
+	add := func(i int, id, check, format string, args ...interface{}) {
+		problems = append(problems, &Problem{Index: i, Id: id, Check: check, Message: fmt.Sprintf(format, args...)})
+	}
+
+	seen := make(map[string]int)
+	for i, c := range chans {
+		if first, ok := seen[c.Id]; ok {
+			add(i, c.Id, CHECK_DUPLICATE, "%s is also channel %d, only one channel per peer can be opened in a batch", c.Id, first)
+		} else {
+			seen[c.Id] = i
+		}
+
+		if c.Amount < MIN_CHANNEL_SIZE {
+			add(i, c.Id, CHECK_AMOUNT, "%s: %d is below the minimum channel size of %d", c.Id, c.Amount, MIN_CHANNEL_SIZE)
+		}
+		if err := ValidateChannel(&chans[i], options[c.Id], net); err != nil {
+			add(i, c.Id, CHECK_OPTIONS, "%s", err.Error())
+		}
+
+		p, ok := byId[c.Id]
+		if !ok || !p.Connected {
+			if requireConnected {
+				add(i, c.Id, CHECK_CONNECTED, "%s is not connected", c.Id)
+			}
+		} else if c.Amount > MAX_CHANNEL_SIZE && !hasFeature(p.Features, WUMBO_REQUIRED) && !hasFeature(p.Features, WUMBO_OPTIONAL) {
+			add(i, c.Id, CHECK_AMOUNT, "%s: %d is above %d and the peer does not support large channels", c.Id, c.Amount, MAX_CHANNEL_SIZE)
+		}
+		if ok {
+			for _, pc := range p.Channels {
+				if pendingOpenStates[pc.State] {
+					add(i, c.Id, CHECK_PENDING, "%s already has an open in progress", c.Id)
+					break
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// CheckBalance compares what the batch spends with what the wallet can spend
+func CheckBalance(total, fee, spendable wallet.Amount) *Problem {
+	if need, err := total.Add(fee); err == nil && need <= spendable {
+		return nil
+	}
+	return &Problem{Index: -1, Check: CHECK_BALANCE, Message: fmt.Sprintf("%d plus an estimated fee of %d is more than the %d spendable", total, fee, spendable)}
+}
+
+// CheckWithdrawals checks each destination is an address for the network and above dust
+func CheckWithdrawals(recipients []*wallet.TxRecipient, net *chaincfg.Params) []*Problem {
+	problems := make([]*Problem, 0)
+	for i, r := range recipients {
+		addr, err := btcutil.DecodeAddress(r.Address, net)
+		if err != nil || !addr.IsForNet(net) {
+			problems = append(problems, &Problem{Index: i, Check: CHECK_ADDRESS, Message: fmt.Sprintf("%s is not a %s address", r.Address, net.Name)})
+		}
+		if r.Amount <= wallet.DUST_LIMIT {
+			problems = append(problems, &Problem{Index: i, Check: CHECK_AMOUNT, Message: fmt.Sprintf("%d to %s is not above the dust limit of %d", r.Amount, r.Address, wallet.DUST_LIMIT)})
+		}
+	}
+	return problems
+}
+
+// spendable sums the utxos the wallet selects for the amount, the wallets give what they have when short
+func spendable(w wallet.Wallet, amt, fee wallet.Amount) wallet.Amount {
+	utxos, err := w.Utxos(amt, fee)
+	if err != nil {
+		return 0
+	}
+	total, err := wallet.UtxoTotal(utxos)
+	if err != nil {
+		return 0
+	}
+	return total
+}
+
+// PreflightFund checks a funding batch before any peer is touched, the error is a *PreflightError
+//   with every problem found, requireConnected is false when the peers are connected afterwards
+func (f *Funder) PreflightFund(chans []glightning.FundChannelStart, options map[string]*ChannelOptions, requireConnected bool) error {
+	problems, total, err := f.channelProblems(chans, options, requireConnected)
+	if err != nil {
+		return err
+	}
+	fee := wallet.Amount(f.SatsPerVbyte() * uint64(160+43*len(chans))) // same estimate as GetChannelAddresses
+	if p := CheckBalance(total, fee, spendable(f.Wallet(), total, fee)); p != nil {
+		problems = append(problems, p)
+	}
+	return preflightError(problems)
+}
+
+// PreflightExternal checks a batch funded from an external wallet, the same as PreflightFund
+//   without the balance of our wallet
+func (f *Funder) PreflightExternal(chans []glightning.FundChannelStart, options map[string]*ChannelOptions) error {
+	problems, _, err := f.channelProblems(chans, options, true)
+	if err != nil {
+		return err
+	}
+	return preflightError(problems)
+}
+
+// channelProblems checks the channels against the peers in listpeers and totals them
+func (f *Funder) channelProblems(chans []glightning.FundChannelStart, options map[string]*ChannelOptions, requireConnected bool) ([]*Problem, wallet.Amount, error) {
+	peers := ListPeersResult{}
+	if err := f.Lightning.Request(&ListPeersRequest{}, &peers); err != nil {
+		return nil, 0, err
+	}
+	total, err := channelTotal(chans)
+	if err != nil {
+		return nil, 0, err
+	}
+	return CheckChannels(chans, options, &peers, requireConnected, f.BitcoinNet), total, nil
+}
+
+// PreflightWithdraw checks the destinations and balance of a withdraw from the internal wallet
+func (f *Funder) PreflightWithdraw(recipients []*wallet.TxRecipient) error {
+	problems := CheckWithdrawals(recipients, f.BitcoinNet)
+
+	total := wallet.Amount(0)
+	for _, r := range recipients {
+		var err error
+		if total, err = total.Add(r.Amount); err != nil {
+			return err
+		}
+	}
+	fee := wallet.Amount(f.SatsPerVbyte() * uint64(160+70*len(recipients))) // same estimate as withdraw_multi
+	if p := CheckBalance(total, fee, spendable(f.InternalWallet(), total, fee)); p != nil {
+		problems = append(problems, p)
+	}
+	return preflightError(problems)
+}
@@ -0,0 +1,83 @@
+package funder
+
+import (
+	"testing"
+
+	"github.com/niftynei/glightning/glightning"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+func TestCheckChannels(t *testing.T) {
+	peers := &ListPeersResult{Peers: []PeerInfo{
+		{Id: "plain", Connected: true, Features: "00"},
+		{Id: "wumbo", Connected: true, Features: "080000"}, // bit 19
+		{Id: "opening", Connected: true, Channels: []PeerChannel{{State: "OPENINGD"}}},
+		{Id: "offline", Connected: false},
+	}}
+	chans := []glightning.FundChannelStart{
+		{Id: "plain", Amount: 100000},
+		{Id: "wumbo", Amount: 20000000},
+		{Id: "plain", Amount: 20000000},
+		{Id: "opening", Amount: 100000},
+		{Id: "offline", Amount: 100000},
+		{Id: "unknown", Amount: 1000, FeeRate: "fast"},
+	}
+
+	problems := CheckChannels(chans, nil, peers, true, testNet)
+	want := []struct {
+		index int
+		check string
+	}{
+		{2, CHECK_DUPLICATE},
+		{2, CHECK_AMOUNT},
+		{3, CHECK_PENDING},
+		{4, CHECK_CONNECTED},
+		{5, CHECK_AMOUNT},
+		{5, CHECK_OPTIONS},
+		{5, CHECK_CONNECTED},
+	}
+	if len(problems) != len(want) {
+		for _, p := range problems {
+			t.Log(p.Index, p.Check, p.Message)
+		}
+		t.Fatalf("want %d problems, have %d", len(want), len(problems))
+	}
+	for i, w := range want {
+		if problems[i].Index != w.index || problems[i].Check != w.check {
+			t.Errorf("problem %d: want %d %s, have %d %s", i, w.index, w.check, problems[i].Index, problems[i].Check)
+		}
+	}
+
+	// connect_fund_multi connects afterwards, unknown peers are not size checked yet
+	problems = CheckChannels(chans[4:5], nil, peers, false, testNet)
+	if len(problems) != 0 {
+		t.Errorf("unconnected peer should pass when it is connected later, have %v", problems[0].Message)
+	}
+}
+
+func TestCheckWithdrawals(t *testing.T) {
+	w := &fakeWallet{seed: "withdraw"}
+	recipients := []*wallet.TxRecipient{
+		{Address: w.address("a"), Amount: 50000},
+		{Address: "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq", Amount: 50000},
+		{Address: w.address("b"), Amount: 100},
+	}
+	problems := CheckWithdrawals(recipients, testNet)
+	if len(problems) != 2 || problems[0].Index != 1 || problems[0].Check != CHECK_ADDRESS || problems[1].Index != 2 || problems[1].Check != CHECK_AMOUNT {
+		t.Errorf("unexpected problems %+v", problems)
+	}
+
+	if p := CheckBalance(100000, 1000, 101000); p != nil {
+		t.Errorf("exact balance should pass, have %s", p.Message)
+	}
+	if p := CheckBalance(100000, 1000, 100999); p == nil || p.Index != -1 {
+		t.Error("expected a batch balance problem")
+	}
+	if p := CheckBalance(wallet.MAX_SATOSHI, 1, ^wallet.Amount(0)); p == nil {
+		t.Error("expected a balance problem when the total and fee overflow")
+	}
+	err := preflightError([]*Problem{{Index: -1, Check: CHECK_BALANCE, Message: "short"}})
+	if pf, ok := err.(*PreflightError); !ok || len(pf.Problems) != 1 {
+		t.Errorf("expected a PreflightError, have %v", err)
+	}
+}
@@ -0,0 +1,202 @@
+package funder
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rsbondi/multifund/wallet"
+)
+
+const QUEUE_FILE = "multifund_withdraw_queue.json"
+
+// queued withdraw status
+const (
+	QUEUE_QUEUED  = "queued"
+	QUEUE_SENDING = "sending"
+	QUEUE_SENT    = "sent"
+	QUEUE_FAILED  = "failed"
+)
+
+type QueuedWithdraw struct {
+	Id          string        `json:"id"`
+	Destination string        `json:"destination"`
+	Amount      wallet.Amount `json:"satoshi"`
+	Label       string        `json:"label,omitempty"`
+	Status      string        `json:"status"`
+	Created     int64         `json:"created"`
+	Sent        int64         `json:"sent,omitempty"`
+	Txid        string        `json:"txid,omitempty"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// WithdrawQueue persists withdraw requests to the lightning directory until they are sent in a batch
+type WithdrawQueue struct {
+	path  string
+	mu    sync.Mutex
+	items map[string]*QueuedWithdraw
+}
+
+func NewWithdrawQueue(dir string) (*WithdrawQueue, error) {
+	q := &WithdrawQueue{
+		path:  filepath.Join(dir, QUEUE_FILE),
+		items: make(map[string]*QueuedWithdraw),
+	}
+	if err := readStore(q.path, &q.items); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// WithdrawQueue provides the withdraw queue, loaded from the lightning dir on first use
+func (f *Funder) WithdrawQueue() (*WithdrawQueue, error) {
+	if f.queue == nil {
+		q, err := NewWithdrawQueue(f.Lightningdir)
+		if err != nil {
+			return nil, err
+		}
+		f.queue = q
+	}
+	return f.queue, nil
+}
+
+func (q *WithdrawQueue) Add(destination string, amount wallet.Amount, label string) (*QueuedWithdraw, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	w := &QueuedWithdraw{
+		Id:          hex.EncodeToString(id),
+		Destination: destination,
+		Amount:      amount,
+		Label:       label,
+		Status:      QUEUE_QUEUED,
+		Created:     time.Now().Unix(),
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items[w.Id] = w
+	return w, q.save()
+}
+
+// List is oldest first, all requests when status is empty
+func (q *WithdrawQueue) List(status string) []*QueuedWithdraw {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	list := make([]*QueuedWithdraw, 0)
+	for _, w := range q.items {
+		if status == "" || w.Status == status {
+			item := *w
+			list = append(list, &item)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Created == list[j].Created {
+			return list[i].Id < list[j].Id
+		}
+		return list[i].Created < list[j].Created
+	})
+	return list
+}
+
+// Remove deletes a request, sent requests are kept as a record
+func (q *WithdrawQueue) Remove(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	w, ok := q.items[id]
+	if !ok {
+		return fmt.Errorf("unknown queued withdraw %s", id)
+	}
+	if w.Status == QUEUE_SENT || w.Status == QUEUE_SENDING {
+		return errors.New("withdraw already sent in " + w.Txid)
+	}
+	delete(q.items, id)
+	return q.save()
+}
+
+// Sending records the txid of requests before it is broadcast, so a restart between the broadcast
+//   and Complete can look the transaction up instead of sending them again
+func (q *WithdrawQueue) Sending(ids []string, txid string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, id := range ids {
+		if w, ok := q.items[id]; ok {
+			w.Status = QUEUE_SENDING
+			w.Txid = txid
+		}
+	}
+	return q.save()
+}
+
+// Requeue puts sending requests whose transaction never reached the chain back in the queue
+func (q *WithdrawQueue) Requeue(ids []string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, id := range ids {
+		if w, ok := q.items[id]; ok {
+			w.Status = QUEUE_QUEUED
+			w.Txid = ""
+		}
+	}
+	return q.save()
+}
+
+// Complete records the result of sending requests, failed requests are not retried
+func (q *WithdrawQueue) Complete(ids []string, txid string, err error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now().Unix()
+	for _, id := range ids {
+		w, ok := q.items[id]
+		if !ok {
+			continue
+		}
+		if err != nil {
+			w.Status = QUEUE_FAILED
+			w.Error = err.Error()
+			continue
+		}
+		w.Status = QUEUE_SENT
+		w.Sent = now
+		w.Txid = txid
+		w.Error = ""
+	}
+	return q.save()
+}
+
+func (q *WithdrawQueue) save() error {
+	return writeStore(q.path, q.items)
+}
+
+// QueuePolicy decides when queued withdraws are sent, any condition met flushes the queue
+//   0 disables a condition
+type QueuePolicy struct {
+	Size       int           // number of queued requests
+	Interval   time.Duration // age of the oldest queued request
+	MaxFeeRate uint64        // sat/vbyte, send when fees are at or below
+}
+
+// Ready reports whether the pending requests should be sent now, satsPerVbyte is the estimate
+//   without fallback or limits, 0 when there is none so the fee rate never triggers on a guess
+func (p *QueuePolicy) Ready(pending []*QueuedWithdraw, satsPerVbyte uint64, now time.Time) bool {
+	if len(pending) == 0 {
+		return false
+	}
+	if p.Size > 0 && len(pending) >= p.Size {
+		return true
+	}
+	if p.Interval > 0 {
+		for _, w := range pending {
+			if now.Sub(time.Unix(w.Created, 0)) >= p.Interval {
+				return true
+			}
+		}
+	}
+	return p.MaxFeeRate > 0 && satsPerVbyte > 0 && satsPerVbyte <= p.MaxFeeRate
+}
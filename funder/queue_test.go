@@ -0,0 +1,94 @@
+package funder
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestQueuePolicy(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	pending := []*QueuedWithdraw{
+		{Id: "a", Created: now.Add(-2 * time.Hour).Unix()},
+		{Id: "b", Created: now.Unix()},
+	}
+	tests := []struct {
+		name    string
+		policy  QueuePolicy
+		pending []*QueuedWithdraw
+		rate    uint64
+		want    bool
+	}{
+		{"empty", QueuePolicy{Size: 1, MaxFeeRate: 100}, nil, 1, false},
+		{"size met", QueuePolicy{Size: 2}, pending, 10, true},
+		{"size not met", QueuePolicy{Size: 3}, pending, 10, false},
+		{"interval met", QueuePolicy{Interval: time.Hour}, pending, 10, true},
+		{"interval not met", QueuePolicy{Interval: 3 * time.Hour}, pending, 10, false},
+		{"fee at ceiling", QueuePolicy{MaxFeeRate: 5}, pending, 5, true},
+		{"fee above ceiling", QueuePolicy{MaxFeeRate: 5}, pending, 6, false},
+		{"no fee estimate", QueuePolicy{MaxFeeRate: 5}, pending, 0, false},
+		{"disabled", QueuePolicy{}, pending, 1, false},
+	}
+	for _, tt := range tests {
+		if have := tt.policy.Ready(tt.pending, tt.rate, now); have != tt.want {
+			t.Errorf("%s: want %v, have %v", tt.name, tt.want, have)
+		}
+	}
+}
+
+func TestWithdrawQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := NewWithdrawQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := q.Add("addr1", 10000, "alice")
+	b, _ := q.Add("addr2", 20000, "")
+	c, _ := q.Add("addr3", 30000, "")
+
+	if err := q.Remove(c.Id); err != nil {
+		t.Fatal(err)
+	}
+	q.Complete([]string{a.Id}, "txid", nil)
+	q.Complete([]string{b.Id}, "", errors.New("insufficient funds"))
+
+	// reload to check it persisted
+	q, err = NewWithdrawQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(q.List("")) != 2 || len(q.List(QUEUE_QUEUED)) != 0 {
+		t.Fatalf("unexpected queue %+v", q.List(""))
+	}
+	sent := q.List(QUEUE_SENT)
+	if len(sent) != 1 || sent[0].Txid != "txid" || sent[0].Label != "alice" {
+		t.Errorf("unexpected sent %+v", sent)
+	}
+	failed := q.List(QUEUE_FAILED)
+	if len(failed) != 1 || failed[0].Error != "insufficient funds" {
+		t.Errorf("unexpected failed %+v", failed)
+	}
+	if err := q.Remove(a.Id); err == nil {
+		t.Error("sent withdraw should not be removed")
+	}
+
+	d, _ := q.Add("addr4", 40000, "")
+	q.Sending([]string{d.Id}, "txid2")
+	if q, _ = NewWithdrawQueue(dir); len(q.List(QUEUE_SENDING)) != 1 || q.List(QUEUE_SENDING)[0].Txid != "txid2" {
+		t.Errorf("want the sending txid persisted, have %+v", q.List(QUEUE_SENDING))
+	}
+	if err := q.Remove(d.Id); err == nil {
+		t.Error("sending withdraw should not be removed")
+	}
+	q.Requeue([]string{d.Id})
+	if queued := q.List(QUEUE_QUEUED); len(queued) != 1 || queued[0].Txid != "" {
+		t.Errorf("want the withdraw queued again, have %+v", queued)
+	}
+}
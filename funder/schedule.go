@@ -0,0 +1,165 @@
+package funder
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const SCHEDULE_FILE = "multifund_schedule.json"
+
+// scheduled funding status
+const (
+	SCHEDULE_WAITING = "waiting"
+	SCHEDULE_DONE    = "done"
+	SCHEDULE_FAILED  = "failed"
+)
+
+// ScheduledChannel keeps the address of the peer so it can be reconnected before funding
+type ScheduledChannel struct {
+	Id       string `json:"id"`
+	Host     string `json:"host,omitempty"`
+	Port     uint   `json:"port,omitempty"`
+	Amount   uint64 `json:"satoshi"`
+	FeeRate  string `json:"feerate,omitempty"`
+	Announce bool   `json:"announce"`
+	ChannelOptions
+	Label string `json:"label,omitempty"`
+}
+
+// ScheduledFunding is a batch of channels opened once fees drop to MaxFeeRate or the deadline passes
+type ScheduledFunding struct {
+	Id         string             `json:"id"`
+	Channels   []ScheduledChannel `json:"channels"`
+	MaxFeeRate uint64             `json:"max_feerate"` // sat/vbyte
+	Deadline   int64              `json:"deadline,omitempty"`
+	Status     string             `json:"status"`
+	Created    int64              `json:"created"`
+	Executed   int64              `json:"executed,omitempty"`
+	Txid       string             `json:"txid,omitempty"`
+	Error      string             `json:"error,omitempty"`
+}
+
+// Ready reports whether the funding should run now, satsPerVbyte is the estimate without fallback
+//   or limits, 0 when there is none so only the deadline can trigger
+func (s *ScheduledFunding) Ready(satsPerVbyte uint64, now time.Time) bool {
+	if s.Status != SCHEDULE_WAITING {
+		return false
+	}
+	if s.Deadline != 0 && now.Unix() >= s.Deadline {
+		return true
+	}
+	return satsPerVbyte > 0 && satsPerVbyte <= s.MaxFeeRate
+}
+
+// Schedule persists scheduled fundings to the lightning directory
+type Schedule struct {
+	path     string
+	mu       sync.Mutex
+	fundings map[string]*ScheduledFunding
+}
+
+func NewSchedule(dir string) (*Schedule, error) {
+	s := &Schedule{
+		path:     filepath.Join(dir, SCHEDULE_FILE),
+		fundings: make(map[string]*ScheduledFunding),
+	}
+	if err := readStore(s.path, &s.fundings); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Schedule provides the scheduled fundings, loaded from the lightning dir on first use
+func (f *Funder) Schedule() (*Schedule, error) {
+	if f.schedule == nil {
+		s, err := NewSchedule(f.Lightningdir)
+		if err != nil {
+			return nil, err
+		}
+		f.schedule = s
+	}
+	return f.schedule, nil
+}
+
+func (s *Schedule) Add(channels []ScheduledChannel, maxFeeRate uint64, deadline int64) (*ScheduledFunding, error) {
+	if len(channels) == 0 {
+		return nil, errors.New("no channels to schedule")
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	sf := &ScheduledFunding{
+		Id:         hex.EncodeToString(id),
+		Channels:   channels,
+		MaxFeeRate: maxFeeRate,
+		Deadline:   deadline,
+		Status:     SCHEDULE_WAITING,
+		Created:    time.Now().Unix(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fundings[sf.Id] = sf
+	return sf, s.save()
+}
+
+// List is oldest first, all fundings when status is empty
+func (s *Schedule) List(status string) []*ScheduledFunding {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*ScheduledFunding, 0)
+	for _, sf := range s.fundings {
+		if status == "" || sf.Status == status {
+			item := *sf
+			list = append(list, &item)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Created == list[j].Created {
+			return list[i].Id < list[j].Id
+		}
+		return list[i].Created < list[j].Created
+	})
+	return list
+}
+
+// Remove cancels a waiting funding or clears a finished one
+func (s *Schedule) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.fundings[id]; !ok {
+		return fmt.Errorf("unknown scheduled funding %s", id)
+	}
+	delete(s.fundings, id)
+	return s.save()
+}
+
+// Complete records the result of running a funding, failed fundings are not retried
+func (s *Schedule) Complete(id, txid string, err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sf, ok := s.fundings[id]
+	if !ok {
+		return nil
+	}
+	sf.Executed = time.Now().Unix()
+	if err != nil {
+		sf.Status = SCHEDULE_FAILED
+		sf.Error = err.Error()
+	} else {
+		sf.Status = SCHEDULE_DONE
+		sf.Txid = txid
+	}
+	return s.save()
+}
+
+func (s *Schedule) save() error {
+	return writeStore(s.path, s.fundings)
+}
@@ -0,0 +1,96 @@
+package funder
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rsbondi/multifund/wallet"
+)
+
+func TestScheduledFundingReady(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	tests := []struct {
+		name string
+		sf   ScheduledFunding
+		rate uint64
+		want bool
+	}{
+		{"fee at ceiling", ScheduledFunding{Status: SCHEDULE_WAITING, MaxFeeRate: 5}, 5, true},
+		{"fee above ceiling", ScheduledFunding{Status: SCHEDULE_WAITING, MaxFeeRate: 5}, 6, false},
+		{"deadline passed", ScheduledFunding{Status: SCHEDULE_WAITING, MaxFeeRate: 5, Deadline: now.Unix()}, 50, true},
+		{"deadline ahead", ScheduledFunding{Status: SCHEDULE_WAITING, MaxFeeRate: 5, Deadline: now.Unix() + 1}, 50, false},
+		{"done", ScheduledFunding{Status: SCHEDULE_DONE, MaxFeeRate: 5}, 1, false},
+		{"no estimate", ScheduledFunding{Status: SCHEDULE_WAITING, MaxFeeRate: 5}, 0, false},
+		{"no estimate deadline passed", ScheduledFunding{Status: SCHEDULE_WAITING, MaxFeeRate: 5, Deadline: now.Unix()}, 0, true},
+	}
+	for _, tt := range tests {
+		if have := tt.sf.Ready(tt.rate, now); have != tt.want {
+			t.Errorf("%s: want %v, have %v", tt.name, tt.want, have)
+		}
+	}
+}
+
+type failingFees struct{}
+
+func (f failingFees) SatsPerVbyte() (uint64, error) {
+	return 0, errors.New("estimatesmartfee unavailable")
+}
+
+// TestEstimateSatsPerVbyte checks the fee triggers see the estimator's rate, never the fallback or limits
+func TestEstimateSatsPerVbyte(t *testing.T) {
+	tests := []struct {
+		name string
+		fees wallet.FeeEstimator
+		want uint64
+		err  bool
+	}{
+		{"static", wallet.StaticFees(3), 3, false},
+		{"policy limits", &wallet.FeePolicy{Estimator: wallet.StaticFees(3), Min: 10}, 3, false},
+		{"policy fallback", &wallet.FeePolicy{Estimator: failingFees{}, Fallback: 1}, 0, true},
+		{"no estimate", &wallet.FeePolicy{Estimator: wallet.StaticFees(0), Fallback: 1}, 0, true},
+		{"no estimator", &wallet.FeePolicy{Fallback: 1}, 0, true},
+	}
+	for _, tt := range tests {
+		rate, err := (&Funder{Fees: tt.fees}).EstimateSatsPerVbyte()
+		if rate != tt.want || (err != nil) != tt.err {
+			t.Errorf("%s: want %d error %v, have %d %v", tt.name, tt.want, tt.err, rate, err)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schedule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewSchedule(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add(nil, 5, 0); err == nil {
+		t.Error("expected empty schedule to fail")
+	}
+	chans := []ScheduledChannel{{Id: "peer1", Host: "127.0.0.1", Port: 9735, Amount: 100000}}
+	a, _ := s.Add(chans, 5, 0)
+	b, _ := s.Add(chans, 5, 0)
+	s.Complete(a.Id, "txid", nil)
+	s.Complete(b.Id, "", errors.New("peer offline"))
+
+	s, err = NewSchedule(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := s.List(SCHEDULE_DONE)
+	if len(done) != 1 || done[0].Txid != "txid" || done[0].Channels[0].Host != "127.0.0.1" {
+		t.Errorf("unexpected done %+v", done)
+	}
+	failed := s.List(SCHEDULE_FAILED)
+	if len(failed) != 1 || failed[0].Error != "peer offline" {
+		t.Errorf("unexpected failed %+v", failed)
+	}
+}
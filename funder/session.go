@@ -0,0 +1,83 @@
+package funder
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/rsbondi/multifund/wallet"
+)
+
+const SESSION_FILE = "multifund_sessions.json"
+
+// Session is a multisig funding waiting on signatures, keyed by the unsigned txid
+//   the PSBT holds every partial signature collected so far
+type Session struct {
+	Id      string                `json:"id"`
+	Psbt    string                `json:"psbt"`
+	Outputs wallet.ChannelOutputs `json:"outputs"`
+	Created int64                 `json:"created"`
+}
+
+// SessionStore persists pending sessions to the lightning directory so signing
+//   rounds survive a plugin restart
+type SessionStore struct {
+	path     string
+	mu       sync.Mutex
+	sessions map[string]*Session
+	update   sync.Mutex
+}
+
+func NewSessionStore(dir string) (*SessionStore, error) {
+	s := &SessionStore{
+		path:     filepath.Join(dir, SESSION_FILE),
+		sessions: make(map[string]*Session),
+	}
+	if err := readStore(s.path, &s.sessions); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Lock is held by a caller across reading, changing and putting back a session, so concurrent
+//   signing rounds do not overwrite each other's signatures
+func (s *SessionStore) Lock() {
+	s.update.Lock()
+}
+
+func (s *SessionStore) Unlock() {
+	s.update.Unlock()
+}
+
+func (s *SessionStore) Get(id string) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[id]
+}
+
+func (s *SessionStore) List() []*Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*Session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		list = append(list, sess)
+	}
+	return list
+}
+
+func (s *SessionStore) Put(sess *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[sess.Id] = sess
+	return s.save()
+}
+
+func (s *SessionStore) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return s.save()
+}
+
+func (s *SessionStore) save() error {
+	return writeStore(s.path, s.sessions)
+}
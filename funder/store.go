@@ -0,0 +1,32 @@
+package funder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+// readStore loads a json store from the lightning dir, a missing file is an empty store
+func readStore(path string, v interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// writeStore writes to a temp file first so a crash never leaves a truncated store
+func writeStore(path string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,226 @@
+package funder
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// smallest channel lightningd opens
+const MIN_CHANNEL_SIZE = 20000
+
+// nodes that have not announced within this are assumed offline
+const SUGGEST_MAX_AGE = 14 * 24 * time.Hour
+
+// score weights, capacity and centrality matter most then fee policy and uptime
+const (
+	SCORE_CAPACITY   = 0.35
+	SCORE_CENTRALITY = 0.35
+	SCORE_FEE        = 0.15
+	SCORE_UPTIME     = 0.15
+)
+
+type ListChannelsRequest struct{}
+
+func (r *ListChannelsRequest) Name() string {
+	return "listchannels"
+}
+
+type ChannelInfo struct {
+	Source          string `json:"source"`
+	Destination     string `json:"destination"`
+	ShortChannelId  string `json:"short_channel_id"`
+	Satoshis        uint64 `json:"satoshis"`
+	Active          bool   `json:"active"`
+	BaseFeeMsat     uint64 `json:"base_fee_millisatoshi"`
+	FeePerMillionth uint64 `json:"fee_per_millionth"`
+	LastUpdate      int64  `json:"last_update"`
+}
+
+type ListChannelsResult struct {
+	Channels []ChannelInfo `json:"channels"`
+}
+
+type ListNodesRequest struct {
+	Id string `json:"id,omitempty"`
+}
+
+func (r *ListNodesRequest) Name() string {
+	return "listnodes"
+}
+
+type NodeAddress struct {
+	Type    string `json:"type"`
+	Address string `json:"address"`
+	Port    uint   `json:"port"`
+}
+
+type NodeInfo struct {
+	NodeId        string        `json:"nodeid"`
+	Alias         string        `json:"alias"`
+	LastTimestamp int64         `json:"last_timestamp"`
+	Addresses     []NodeAddress `json:"addresses"`
+}
+
+type ListNodesResult struct {
+	Nodes []NodeInfo `json:"nodes"`
+}
+
+type Suggestion struct {
+	Id       string       `json:"id"`
+	Alias    string       `json:"alias,omitempty"`
+	Address  *NodeAddress `json:"address"`
+	Amount   uint64       `json:"satoshi"`
+	Score    float64      `json:"score"`
+	Capacity uint64       `json:"capacity"`
+	Channels int          `json:"channels"`
+	FeePpm   uint64       `json:"fee_ppm"`
+}
+
+// ScoreNodes ranks announced nodes from gossip, best first, excluding ourselves and existing peers
+//   capacity and channel count (centrality) are relative to the best node, fees score lower as
+//   the median ppm rises and uptime is the share of active channels, nodes not announced recently are skipped
+func ScoreNodes(self string, peers map[string]bool, nodes []NodeInfo, channels []ChannelInfo, now time.Time) []*Suggestion {
+	type stats struct {
+		capacity uint64
+		peers    map[string]bool
+		active   int
+		total    int
+		fees     []uint64
+	}
+	byNode := make(map[string]*stats)
+	for _, c := range channels {
+		s, ok := byNode[c.Source]
+		if !ok {
+			s = &stats{peers: make(map[string]bool)}
+			byNode[c.Source] = s
+		}
+		// each channel is listed once per direction, count it from the source side only
+		s.capacity += c.Satoshis
+		s.peers[c.Destination] = true
+		s.total++
+		if c.Active {
+			s.active++
+		}
+		s.fees = append(s.fees, c.FeePerMillionth)
+	}
+
+	suggestions := make([]*Suggestion, 0)
+	maxCapacity, maxChannels := uint64(1), 1
+	for _, n := range nodes {
+		s, ok := byNode[n.NodeId]
+		if !ok || n.NodeId == self || peers[n.NodeId] || len(n.Addresses) == 0 {
+			continue
+		}
+		if now.Sub(time.Unix(n.LastTimestamp, 0)) > SUGGEST_MAX_AGE {
+			continue
+		}
+		if s.capacity > maxCapacity {
+			maxCapacity = s.capacity
+		}
+		if len(s.peers) > maxChannels {
+			maxChannels = len(s.peers)
+		}
+		suggestions = append(suggestions, &Suggestion{
+			Id:       n.NodeId,
+			Alias:    n.Alias,
+			Address:  &n.Addresses[0],
+			Capacity: s.capacity,
+			Channels: len(s.peers),
+			FeePpm:   median(s.fees),
+			Score:    float64(s.active) / float64(s.total) * SCORE_UPTIME,
+		})
+	}
+
+	for _, s := range suggestions {
+		s.Score += float64(s.Capacity) / float64(maxCapacity) * SCORE_CAPACITY
+		s.Score += float64(s.Channels) / float64(maxChannels) * SCORE_CENTRALITY
+		s.Score += 1 / (1 + float64(s.FeePpm)/1000) * SCORE_FEE
+		s.Score = math.Round(s.Score*1000) / 1000
+	}
+
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		if suggestions[i].Score == suggestions[j].Score {
+			return suggestions[i].Id < suggestions[j].Id
+		}
+		return suggestions[i].Score > suggestions[j].Score
+	})
+	return suggestions
+}
+
+func median(values []uint64) uint64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]uint64{}, values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2]
+}
+
+// Allocate splits the budget across the best count nodes in proportion to their score
+//   every channel gets at least MIN_CHANNEL_SIZE, rounding is given to the best node
+func Allocate(suggestions []*Suggestion, budget uint64, count int) ([]*Suggestion, error) {
+	if count <= 0 {
+		return nil, errors.New("count must be positive")
+	}
+	if len(suggestions) < count {
+		count = len(suggestions)
+	}
+	if count == 0 {
+		return nil, errors.New("no suitable nodes found in gossip")
+	}
+	if budget < uint64(count)*MIN_CHANNEL_SIZE {
+		return nil, fmt.Errorf("budget of %d is too small for %d channels of at least %d", budget, count, MIN_CHANNEL_SIZE)
+	}
+
+	picked := suggestions[:count]
+	total := 0.0
+	for _, s := range picked {
+		total += s.Score
+	}
+
+	// the minimum is given to everyone and the rest shared by score
+	spare := budget - uint64(count)*MIN_CHANNEL_SIZE
+	allocated := uint64(0)
+	for _, s := range picked {
+		share := 1 / float64(count)
+		if total > 0 {
+			share = s.Score / total
+		}
+		s.Amount = MIN_CHANNEL_SIZE + uint64(float64(spare)*share)
+		allocated += s.Amount
+	}
+	picked[0].Amount += budget - allocated
+	return picked, nil
+}
+
+// Suggest scores the nodes known from gossip and allocates the budget across count of them
+func (f *Funder) Suggest(budget uint64, count int) ([]*Suggestion, error) {
+	info := GetInfoResult{}
+	if err := f.Lightning.Request(&GetInfoRequest{}, &info); err != nil {
+		return nil, err
+	}
+	peers := ListPeersResult{}
+	if err := f.Lightning.Request(&ListPeersRequest{}, &peers); err != nil {
+		return nil, err
+	}
+	nodes := ListNodesResult{}
+	if err := f.Lightning.Request(&ListNodesRequest{}, &nodes); err != nil {
+		return nil, err
+	}
+	channels := ListChannelsResult{}
+	if err := f.Lightning.Request(&ListChannelsRequest{}, &channels); err != nil {
+		return nil, err
+	}
+
+	existing := make(map[string]bool)
+	for _, p := range peers.Peers {
+		if len(p.Channels) > 0 {
+			existing[p.Id] = true
+		}
+	}
+
+	return Allocate(ScoreNodes(info.Id, existing, nodes.Nodes, channels.Channels, time.Now()), budget, count)
+}
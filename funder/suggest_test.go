@@ -0,0 +1,62 @@
+package funder
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSuggest(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	addr := []NodeAddress{{Type: "ipv4", Address: "10.0.0.1", Port: 9735}}
+	nodes := []NodeInfo{
+		{NodeId: "self", LastTimestamp: now.Unix(), Addresses: addr},
+		{NodeId: "hub", LastTimestamp: now.Unix(), Addresses: addr},
+		{NodeId: "small", LastTimestamp: now.Unix(), Addresses: addr},
+		{NodeId: "peer", LastTimestamp: now.Unix(), Addresses: addr},
+		{NodeId: "stale", LastTimestamp: now.Add(-30 * 24 * time.Hour).Unix(), Addresses: addr},
+		{NodeId: "private", LastTimestamp: now.Unix()},
+	}
+	channels := []ChannelInfo{
+		{Source: "hub", Destination: "a", Satoshis: 5000000, Active: true, FeePerMillionth: 1},
+		{Source: "hub", Destination: "b", Satoshis: 5000000, Active: true, FeePerMillionth: 1},
+		{Source: "hub", Destination: "c", Satoshis: 5000000, Active: true, FeePerMillionth: 1},
+		{Source: "small", Destination: "a", Satoshis: 100000, Active: false, FeePerMillionth: 5000},
+		{Source: "peer", Destination: "a", Satoshis: 9000000, Active: true},
+		{Source: "stale", Destination: "a", Satoshis: 9000000, Active: true},
+		{Source: "private", Destination: "a", Satoshis: 9000000, Active: true},
+		{Source: "self", Destination: "a", Satoshis: 9000000, Active: true},
+	}
+
+	scored := ScoreNodes("self", map[string]bool{"peer": true}, nodes, channels, now)
+	if len(scored) != 2 {
+		t.Fatalf("want hub and small only, have %d", len(scored))
+	}
+	if scored[0].Id != "hub" || scored[1].Id != "small" || scored[0].Score <= scored[1].Score {
+		t.Errorf("hub should rank first, have %s %v, %s %v", scored[0].Id, scored[0].Score, scored[1].Id, scored[1].Score)
+	}
+	if scored[0].Capacity != 15000000 || scored[0].Channels != 3 {
+		t.Errorf("unexpected hub stats %+v", scored[0])
+	}
+
+	picked, err := Allocate(scored, 1000000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := uint64(0)
+	for _, s := range picked {
+		if s.Amount < MIN_CHANNEL_SIZE {
+			t.Errorf("%s below minimum with %d", s.Id, s.Amount)
+		}
+		total += s.Amount
+	}
+	if total != 1000000 {
+		t.Errorf("want the whole budget allocated, have %d", total)
+	}
+	if picked[0].Amount <= picked[1].Amount {
+		t.Error("better node should get more of the budget")
+	}
+
+	if _, err := Allocate(scored, MIN_CHANNEL_SIZE, 2); err == nil {
+		t.Error("expected budget below the minimum to fail")
+	}
+}
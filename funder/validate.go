@@ -0,0 +1,248 @@
+package funder
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+// reasons a transaction built elsewhere is rejected
+const (
+	REJECT_DECODE      = "decode"
+	REJECT_UNSIGNED    = "unsigned"
+	REJECT_NOT_FINAL   = "not_final"
+	REJECT_NONSTANDARD = "nonstandard"
+	REJECT_INPUTS      = "missing_inputs"
+	REJECT_SCRIPT      = "script"
+	REJECT_MEMPOOL     = "mempool"
+	REJECT_FEE         = "fee"
+)
+
+// relay policy bitcoind applies by default
+const (
+	MAX_STANDARD_TX_WEIGHT = 400000
+	MIN_RELAY_FEERATE      = 1 // sat/vbyte
+)
+
+// locktimes below this are block heights, above are unix times
+const LOCKTIME_THRESHOLD = 500000000
+
+// a fee rate this many times the current estimate is taken to be a mistake
+const MAX_FEERATE_MULTIPLE = 10
+
+// TxRejection explains why a transaction was not used, no channel has been completed with it
+type TxRejection struct {
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+func (r *TxRejection) Error() string {
+	return fmt.Sprintf("transaction rejected (%s): %s", r.Reason, r.Message)
+}
+
+func reject(reason, format string, args ...interface{}) error {
+	return &TxRejection{Reason: reason, Message: fmt.Sprintf(format, args...)}
+}
+
+// DecodeTx reads a hex encoded transaction, nothing may follow it
+func DecodeTx(raw string) (*wire.MsgTx, error) {
+	b, err := hex.DecodeString(strings.TrimSpace(raw))
+	if err != nil {
+		return nil, reject(REJECT_DECODE, "invalid hex: %s", err.Error())
+	}
+	wtx := wire.NewMsgTx(2)
+	r := bytes.NewReader(b)
+	if err := wtx.Deserialize(r); err != nil {
+		return nil, reject(REJECT_DECODE, "invalid transaction: %s", err.Error())
+	}
+	if r.Len() > 0 {
+		return nil, reject(REJECT_DECODE, "%d bytes after the transaction", r.Len())
+	}
+	if len(wtx.TxIn) == 0 || len(wtx.TxOut) == 0 {
+		return nil, reject(REJECT_DECODE, "transaction has %d inputs and %d outputs", len(wtx.TxIn), len(wtx.TxOut))
+	}
+	return wtx, nil
+}
+
+// CheckSigned checks every input has a witness or signature script
+func CheckSigned(wtx *wire.MsgTx) error {
+	unsigned := make([]string, 0)
+	for i, in := range wtx.TxIn {
+		if len(in.Witness) == 0 && len(in.SignatureScript) == 0 {
+			unsigned = append(unsigned, fmt.Sprint(i))
+		}
+	}
+	if len(unsigned) > 0 {
+		return reject(REJECT_UNSIGNED, "inputs %s are not signed", strings.Join(unsigned, ", "))
+	}
+	return nil
+}
+
+// CheckFinal checks the transaction can be mined in the block after height
+//   time locks are compared with now rather than the median time past
+func CheckFinal(wtx *wire.MsgTx, height uint32, now time.Time) error {
+	if wtx.LockTime == 0 {
+		return nil
+	}
+	final := true
+	for _, in := range wtx.TxIn {
+		if in.Sequence != wire.MaxTxInSequenceNum {
+			final = false
+		}
+	}
+	switch {
+	case final:
+		return nil
+	case wtx.LockTime < LOCKTIME_THRESHOLD && wtx.LockTime <= height:
+		return nil
+	case wtx.LockTime >= LOCKTIME_THRESHOLD && int64(wtx.LockTime) < now.Unix():
+		return nil
+	}
+	return reject(REJECT_NOT_FINAL, "locktime %d has not been reached", wtx.LockTime)
+}
+
+// CheckStandard applies the relay policies that can be checked without the spent outputs
+func CheckStandard(wtx *wire.MsgTx) error {
+	if wtx.Version < 1 || wtx.Version > 2 {
+		return reject(REJECT_NONSTANDARD, "version %d", wtx.Version)
+	}
+	if w := wtx.SerializeSizeStripped()*3 + wtx.SerializeSize(); w > MAX_STANDARD_TX_WEIGHT {
+		return reject(REJECT_NONSTANDARD, "weight %d is above %d", w, MAX_STANDARD_TX_WEIGHT)
+	}
+	nulldata := 0
+	for i, out := range wtx.TxOut {
+		switch txscript.GetScriptClass(out.PkScript) {
+		case txscript.NonStandardTy:
+			return reject(REJECT_NONSTANDARD, "output %d has a nonstandard script", i)
+		case txscript.NullDataTy:
+			nulldata++
+		default:
+			if out.Value < wallet.DUST_LIMIT.Int64() {
+				return reject(REJECT_NONSTANDARD, "output %d of %d is dust", i, out.Value)
+			}
+		}
+	}
+	if nulldata > 1 {
+		return reject(REJECT_NONSTANDARD, "%d data outputs, only one is relayed", nulldata)
+	}
+	return nil
+}
+
+// CheckFeeRate checks the fee is between min and max sat/vbyte, max of 0 for no limit
+func CheckFeeRate(fee, vsize int64, min, max uint64) error {
+	if fee < 0 {
+		return reject(REJECT_FEE, "outputs are %d more than inputs", -fee)
+	}
+	if fee < int64(min)*vsize {
+		return reject(REJECT_FEE, "fee of %d for %d vbytes is below %d sat/vbyte", fee, vsize, min)
+	}
+	if max > 0 && fee > int64(max)*vsize {
+		return reject(REJECT_FEE, "fee of %d for %d vbytes is above %d sat/vbyte", fee, vsize, max)
+	}
+	return nil
+}
+
+// mempool is bitcoind's testmempoolaccept
+type mempool interface {
+	TestMempoolAccept(rawtx string) (*wallet.MempoolAcceptResult, error)
+}
+
+// VerifyInputs runs each input's scripts against the output it spends and returns the fee
+func VerifyInputs(wtx *wire.MsgTx, chain wallet.ChainBackend) (int64, error) {
+	hashes := txscript.NewTxSigHashes(wtx)
+	in := int64(0)
+	missing := make([]string, 0)
+	for i, txin := range wtx.TxIn {
+		prev, err := chain.PrevOut(txin.PreviousOutPoint)
+		if err != nil {
+			return 0, err
+		}
+		if prev == nil {
+			missing = append(missing, txin.PreviousOutPoint.String())
+			continue
+		}
+		engine, err := txscript.NewEngine(prev.PkScript, wtx, i, txscript.StandardVerifyFlags, nil, hashes, prev.Value)
+		if err == nil {
+			err = engine.Execute()
+		}
+		if err != nil {
+			return 0, reject(REJECT_SCRIPT, "input %d: %s", i, err.Error())
+		}
+		in += prev.Value
+	}
+	if len(missing) > 0 {
+		return 0, reject(REJECT_INPUTS, "%s not found or already spent", strings.Join(missing, ", "))
+	}
+
+	out := int64(0)
+	for _, txout := range wtx.TxOut {
+		out += txout.Value
+	}
+	return in - out, nil
+}
+
+// validateTx uses testmempoolaccept when bitcoind is available, otherwise the spent outputs from the chain backend
+//   the fee comes from the chain backend when bitcoind is too old to report it
+func validateTx(wtx *wire.MsgTx, height uint32, pool mempool, chain wallet.ChainBackend, maxRate uint64) (wallet.Amount, error) {
+	if err := CheckSigned(wtx); err != nil {
+		return 0, err
+	}
+	if err := CheckFinal(wtx, height, time.Now()); err != nil {
+		return 0, err
+	}
+	if err := CheckStandard(wtx); err != nil {
+		return 0, err
+	}
+
+	fee := int64(-1)
+	if pool != nil {
+		var buf bytes.Buffer
+		if err := wtx.Serialize(&buf); err != nil {
+			return 0, err
+		}
+		result, err := pool.TestMempoolAccept(hex.EncodeToString(buf.Bytes()))
+		if err != nil {
+			return 0, err
+		}
+		if !result.Allowed {
+			return 0, reject(REJECT_MEMPOOL, "%s", result.RejectReason)
+		}
+		if result.Fees != nil {
+			base, err := wallet.BtcAmount(result.Fees.Base)
+			if err != nil {
+				return 0, err
+			}
+			fee = base.Int64()
+		}
+	}
+	if fee < 0 {
+		var err error
+		if fee, err = VerifyInputs(wtx, chain); err != nil {
+			return 0, err
+		}
+	}
+	if err := CheckFeeRate(fee, int64(wallet.TxVsize(wtx)), MIN_RELAY_FEERATE, maxRate); err != nil {
+		return 0, err
+	}
+	return wallet.Amount(fee), nil
+}
+
+// ValidateTx checks a signed transaction built elsewhere can be broadcast before any channel is completed with it
+//   and provides its fee, the error is a *TxRejection when the transaction is the problem
+func (f *Funder) ValidateTx(wtx *wire.MsgTx) (wallet.Amount, error) {
+	info := GetInfoResult{}
+	if err := f.Lightning.Request(&GetInfoRequest{}, &info); err != nil {
+		return 0, err
+	}
+	var pool mempool
+	if f.Bitcoin != nil {
+		pool = f.Bitcoin
+	}
+	return validateTx(wtx, info.BlockHeight, pool, f.Chain, f.SatsPerVbyte()*MAX_FEERATE_MULTIPLE)
+}
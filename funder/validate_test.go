@@ -0,0 +1,160 @@
+package funder
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+type fakeMempool struct {
+	result *wallet.MempoolAcceptResult
+}
+
+func (m *fakeMempool) TestMempoolAccept(rawtx string) (*wallet.MempoolAcceptResult, error) {
+	return m.result, nil
+}
+
+// signedTx spends a p2wpkh output of in sat to a p2wsh output of out sat
+func signedTx(t *testing.T, in, out int64) (*wire.MsgTx, *fakeChain) {
+	key, _ := btcec.PrivKeyFromBytes(btcec.S256(), bytes.Repeat([]byte{1}, 32))
+	addr, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(key.PubKey().SerializeCompressed()), testNet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkScript, _ := txscript.PayToAddrScript(addr)
+	prev := wire.OutPoint{Hash: chainhash.HashH([]byte("funding")), Index: 0}
+
+	wtx := wire.NewMsgTx(2)
+	wtx.AddTxIn(wire.NewTxIn(&prev, nil, nil))
+	wtx.AddTxOut(wire.NewTxOut(out, p2wsh("channel")))
+	wtx.TxIn[0].Witness, err = txscript.WitnessSignature(wtx, txscript.NewTxSigHashes(wtx), 0, in, pkScript, txscript.SigHashAll, key, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wtx, &fakeChain{prevouts: map[wire.OutPoint]*wire.TxOut{prev: wire.NewTxOut(in, pkScript)}}
+}
+
+func rejected(err error, reason string) bool {
+	r, ok := err.(*TxRejection)
+	return ok && r.Reason == reason
+}
+
+func TestDecodeTx(t *testing.T) {
+	wtx, _ := signedTx(t, 200000, 199000)
+	var buf bytes.Buffer
+	wtx.Serialize(&buf)
+	raw := hex.EncodeToString(buf.Bytes())
+
+	if _, err := DecodeTx(raw); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{"zz", raw[:len(raw)-2], raw + "00", ""} {
+		if _, err := DecodeTx(bad); !rejected(err, REJECT_DECODE) {
+			t.Errorf("want decode rejection, have %v", err)
+		}
+	}
+}
+
+func TestValidateTx(t *testing.T) {
+	wtx, chain := signedTx(t, 200000, 199000)
+	fee, err := validateTx(wtx, 100, nil, chain, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fee != 1000 {
+		t.Errorf("want fee of 1000, have %d", fee)
+	}
+
+	// fee of 1000 for 113 vbytes
+	if _, err := validateTx(wtx, 100, nil, chain, 5); !rejected(err, REJECT_FEE) {
+		t.Errorf("want fee rejection, have %v", err)
+	}
+
+	wtx.TxOut[0].Value = 199500 // no longer matches the signature
+	if _, err := validateTx(wtx, 100, nil, chain, 20); !rejected(err, REJECT_SCRIPT) {
+		t.Errorf("want script rejection, have %v", err)
+	}
+
+	wtx, _ = signedTx(t, 200000, 199000)
+	if _, err := validateTx(wtx, 100, nil, &fakeChain{}, 20); !rejected(err, REJECT_INPUTS) {
+		t.Errorf("want missing inputs rejection, have %v", err)
+	}
+
+	wtx.LockTime = 101
+	wtx.TxIn[0].Sequence = 0
+	if _, err := validateTx(wtx, 100, nil, chain, 20); !rejected(err, REJECT_NOT_FINAL) {
+		t.Errorf("want not final rejection, have %v", err)
+	}
+
+	wtx, _ = signedTx(t, 200000, 199000)
+	wtx.TxIn[0].Witness = nil
+	if _, err := validateTx(wtx, 100, nil, chain, 20); !rejected(err, REJECT_UNSIGNED) {
+		t.Errorf("want unsigned rejection, have %v", err)
+	}
+
+	wtx, _ = signedTx(t, 200000, 199000)
+	pool := &fakeMempool{&wallet.MempoolAcceptResult{Allowed: false, RejectReason: "non-BIP68-final"}}
+	if _, err := validateTx(wtx, 100, pool, chain, 20); !rejected(err, REJECT_MEMPOOL) || !strings.Contains(err.Error(), "non-BIP68-final") {
+		t.Errorf("want mempool rejection, have %v", err)
+	}
+
+	// the fee from testmempoolaccept is used without looking up inputs
+	pool.result = &wallet.MempoolAcceptResult{Allowed: true}
+	pool.result.Fees = &struct {
+		Base json.Number `json:"base"`
+	}{"0.00001000"}
+	if _, err := validateTx(wtx, 100, pool, &fakeChain{}, 20); err != nil {
+		t.Errorf("accepted transaction should be valid, have %v", err)
+	}
+}
+
+func TestCheckStandard(t *testing.T) {
+	wtx, _ := signedTx(t, 200000, 199000)
+	wtx.AddTxOut(wire.NewTxOut(500, p2wsh("dust")))
+	if err := CheckStandard(wtx); !rejected(err, REJECT_NONSTANDARD) {
+		t.Errorf("want dust rejection, have %v", err)
+	}
+
+	wtx.TxOut[1] = wire.NewTxOut(1000, []byte{0x00, 0x01, 0x02})
+	if err := CheckStandard(wtx); !rejected(err, REJECT_NONSTANDARD) {
+		t.Errorf("want nonstandard script rejection, have %v", err)
+	}
+}
+
+func TestCheckFinal(t *testing.T) {
+	wtx, _ := signedTx(t, 200000, 199000)
+	now := time.Unix(1600000000, 0)
+	wtx.TxIn[0].Sequence = 0
+	tests := []struct {
+		locktime uint32
+		final    bool
+	}{
+		{0, true},
+		{100, true},
+		{101, false},
+		{1599999999, true},
+		{1600000001, false},
+	}
+	for _, tt := range tests {
+		wtx.LockTime = tt.locktime
+		if err := CheckFinal(wtx, 100, now); (err == nil) != tt.final {
+			t.Errorf("locktime %d: want final %v, have %v", tt.locktime, tt.final, err)
+		}
+	}
+
+	wtx.LockTime = 101
+	wtx.TxIn[0].Sequence = wire.MaxTxInSequenceNum
+	if err := CheckFinal(wtx, 100, now); err != nil {
+		t.Errorf("final sequences disable the locktime, have %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/niftynei/glightning/jrpc2"
+	"github.com/rsbondi/multifund/funder"
+)
+
+const MultiFundHistoryDescription = `List transactions made by the plugin, optionally exported for bookkeeping
+{type} filters by command, fund_multi, connect_fund_multi, withdraw_multi, fund_multi_complete or fund_multi_sign
+{from} and {to} are unix seconds or YYYY-MM-DD, inclusive
+{format} is json (default), csv or bip329
+{file} writes the export to a file instead of returning it`
+
+const (
+	HISTORY_JSON   = "json"
+	HISTORY_CSV    = "csv"
+	HISTORY_BIP329 = "bip329"
+)
+
+type MultiFundHistory struct {
+	Type   string `json:"type,omitempty"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+	Format string `json:"format,omitempty"`
+	File   string `json:"file,omitempty"`
+}
+
+func (m *MultiFundHistory) Call() (jrpc2.Result, error) {
+	return history(m)
+}
+
+func (m *MultiFundHistory) Name() string {
+	return "multifund_history"
+}
+
+func (m *MultiFundHistory) New() interface{} {
+	return &MultiFundHistory{}
+}
+
+func history(m *MultiFundHistory) (jrpc2.Result, error) {
+	from, err := funder.ParseHistoryTime(m.From, false)
+	if err != nil {
+		return nil, err
+	}
+	to, err := funder.ParseHistoryTime(m.To, true)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := fundr.History().List(&funder.HistoryFilter{Type: m.Type, From: from, To: to})
+	if err != nil {
+		return nil, err
+	}
+
+	var export string
+	switch m.Format {
+	case "", HISTORY_JSON:
+		if m.File == "" {
+			return struct {
+				History []*funder.HistoryEntry `json:"history"`
+			}{entries}, nil
+		}
+		b, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		export = string(b)
+	case HISTORY_CSV:
+		export, err = funder.HistoryCSV(entries)
+	case HISTORY_BIP329:
+		export, err = funder.Bip329JSONL(funder.HistoryLabels(entries))
+	default:
+		return nil, fmt.Errorf("unknown format %s, use json, csv or bip329", m.Format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if m.File != "" {
+		if err := ioutil.WriteFile(m.File, []byte(export), 0600); err != nil {
+			return nil, err
+		}
+		return struct {
+			File    string `json:"file"`
+			Entries int    `json:"entries"`
+		}{m.File, len(entries)}, nil
+	}
+
+	return struct {
+		Format  string `json:"format"`
+		Entries int    `json:"entries"`
+		Export  string `json:"export"`
+	}{m.Format, len(entries), export}, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/niftynei/glightning/jrpc2"
+	"github.com/rsbondi/multifund/funder"
+)
+
+const LabelsExportDescription = `Export BIP329 labels as json lines, labels from the transaction history and imported labels
+{file} writes the labels to a file instead of returning them`
+
+const LabelsImportDescription = `Import BIP329 labels, json lines from {file} or the {labels} string
+imported labels replace history labels for the same type and ref on export
+addr labels are also set in bitcoind when using the bitcoin wallet`
+
+type MultiFundLabelsExport struct {
+	File string `json:"file,omitempty"`
+}
+
+func (m *MultiFundLabelsExport) Call() (jrpc2.Result, error) {
+	labels, err := fundr.ExportLabels()
+	if err != nil {
+		return nil, err
+	}
+	export, err := funder.Bip329JSONL(labels)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.File != "" {
+		if err := ioutil.WriteFile(m.File, []byte(export), 0600); err != nil {
+			return nil, err
+		}
+		return struct {
+			File   string `json:"file"`
+			Labels int    `json:"labels"`
+		}{m.File, len(labels)}, nil
+	}
+
+	return struct {
+		Labels int    `json:"labels"`
+		Export string `json:"export"`
+	}{len(labels), export}, nil
+}
+
+func (m *MultiFundLabelsExport) Name() string {
+	return "multifund_labels_export"
+}
+
+func (m *MultiFundLabelsExport) New() interface{} {
+	return &MultiFundLabelsExport{}
+}
+
+type MultiFundLabelsImport struct {
+	File   string `json:"file,omitempty"`
+	Labels string `json:"labels,omitempty"`
+}
+
+func (m *MultiFundLabelsImport) Call() (jrpc2.Result, error) {
+	var r io.Reader
+	switch {
+	case m.File != "":
+		f, err := os.Open(m.File)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	case m.Labels != "":
+		r = strings.NewReader(m.Labels)
+	default:
+		return nil, errors.New("file or labels required")
+	}
+
+	labels, err := funder.ParseBip329(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := fundr.ImportLabels(labels); err != nil {
+		return nil, err
+	}
+
+	return struct {
+		Imported int `json:"imported"`
+	}{len(labels)}, nil
+}
+
+func (m *MultiFundLabelsImport) Name() string {
+	return "multifund_labels_import"
+}
+
+func (m *MultiFundLabelsImport) New() interface{} {
+	return &MultiFundLabelsImport{}
+}
@@ -0,0 +1,138 @@
+package logger
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// Level is how important a line is, lines below the configured level are dropped
+type Level int
+
+const (
+	LEVEL_DEBUG Level = iota
+	LEVEL_INFO
+	LEVEL_WARN
+	LEVEL_ERROR
+)
+
+// the level unless set with the multi-log-level option, sensitive data such as raw signed
+//   transactions is only logged at debug
+const DEFAULT_LEVEL = LEVEL_INFO
+
+var levelNames = map[string]Level{
+	"debug":   LEVEL_DEBUG,
+	"info":    LEVEL_INFO,
+	"warn":    LEVEL_WARN,
+	"unusual": LEVEL_WARN, // lightningd's names are accepted too
+	"error":   LEVEL_ERROR,
+	"broken":  LEVEL_ERROR,
+}
+
+func (l Level) String() string {
+	switch l {
+	case LEVEL_DEBUG:
+		return "debug"
+	case LEVEL_INFO:
+		return "info"
+	case LEVEL_WARN:
+		return "warn"
+	}
+	return "error"
+}
+
+// ParseLevel reads debug, info, warn or error
+func ParseLevel(s string) (Level, error) {
+	level, ok := levelNames[strings.ToLower(strings.TrimSpace(s))]
+	if !ok {
+		return 0, fmt.Errorf("invalid log level %s, use debug, info, warn or error", s)
+	}
+	return level, nil
+}
+
+// Sink writes a line, lightningd's log notification in the plugin
+type Sink func(level Level, line string)
+
+var (
+	mu    sync.RWMutex
+	sink  Sink = stderrSink
+	level      = DEFAULT_LEVEL
+)
+
+// stderrSink is used until the plugin is initialized and in tests
+func stderrSink(l Level, line string) {
+	log.Printf("%s %s", l, line)
+}
+
+// SetOutput sends every line at or above min to s, nil restores the default stderr output
+func SetOutput(s Sink, min Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	if s == nil {
+		s = stderrSink
+	}
+	sink = s
+	level = min
+}
+
+// Enabled is true when lines at l are written, to skip building expensive debug output
+func Enabled(l Level) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return l >= level
+}
+
+// Logger tags every line with a trace id, a nil Logger logs without one
+type Logger struct {
+	trace string
+}
+
+// NewTrace starts a logger with a new random trace id, one per command or batch
+func NewTrace() *Logger {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return &Logger{trace: hex.EncodeToString(b)}
+}
+
+// WithTrace continues logging under an existing trace id, such as one recorded with a batch
+func WithTrace(trace string) *Logger {
+	return &Logger{trace: trace}
+}
+
+// Trace is the id added to each line, empty for a nil Logger
+func (l *Logger) Trace() string {
+	if l == nil {
+		return ""
+	}
+	return l.trace
+}
+
+func (l *Logger) write(lvl Level, format string, args ...interface{}) {
+	mu.RLock()
+	s, min := sink, level
+	mu.RUnlock()
+	if lvl < min {
+		return
+	}
+	line := fmt.Sprintf(format, args...)
+	if trace := l.Trace(); trace != "" {
+		line = "[" + trace + "] " + line
+	}
+	s(lvl, line)
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) { l.write(LEVEL_DEBUG, format, args...) }
+func (l *Logger) Infof(format string, args ...interface{})  { l.write(LEVEL_INFO, format, args...) }
+func (l *Logger) Warnf(format string, args ...interface{})  { l.write(LEVEL_WARN, format, args...) }
+func (l *Logger) Errorf(format string, args ...interface{}) { l.write(LEVEL_ERROR, format, args...) }
+
+// lines not part of any command, such as startup and background tracking
+var untraced *Logger
+
+func Debugf(format string, args ...interface{}) { untraced.write(LEVEL_DEBUG, format, args...) }
+func Infof(format string, args ...interface{})  { untraced.write(LEVEL_INFO, format, args...) }
+func Warnf(format string, args ...interface{})  { untraced.write(LEVEL_WARN, format, args...) }
+func Errorf(format string, args ...interface{}) { untraced.write(LEVEL_ERROR, format, args...) }
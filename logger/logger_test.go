@@ -0,0 +1,71 @@
+package logger
+
+import (
+	"strings"
+	"testing"
+)
+
+type line struct {
+	level Level
+	text  string
+}
+
+// capture collects lines at or above min until the test ends
+func capture(t *testing.T, min Level) *[]line {
+	lines := make([]line, 0)
+	SetOutput(func(l Level, text string) { lines = append(lines, line{l, text}) }, min)
+	t.Cleanup(func() { SetOutput(nil, DEFAULT_LEVEL) })
+	return &lines
+}
+
+func TestParseLevel(t *testing.T) {
+	for s, want := range map[string]Level{"debug": LEVEL_DEBUG, "INFO": LEVEL_INFO, "unusual": LEVEL_WARN, " broken ": LEVEL_ERROR} {
+		if l, err := ParseLevel(s); err != nil || l != want {
+			t.Errorf("%s: want %s, have %s %v", s, want, l, err)
+		}
+	}
+	if _, err := ParseLevel("trace"); err == nil {
+		t.Error("want error for an unknown level")
+	}
+}
+
+func TestLevels(t *testing.T) {
+	lines := capture(t, DEFAULT_LEVEL)
+	Debugf("raw tx %s", "0200...")
+	Infof("started")
+	Errorf("failed")
+	if len(*lines) != 2 || (*lines)[0].text != "started" || (*lines)[1].level != LEVEL_ERROR {
+		t.Errorf("debug lines should be dropped at the default level, have %v", *lines)
+	}
+	if Enabled(LEVEL_DEBUG) || !Enabled(LEVEL_WARN) {
+		t.Error("only info and above should be enabled by default")
+	}
+
+	lines = capture(t, LEVEL_DEBUG)
+	Debugf("raw tx")
+	if len(*lines) != 1 {
+		t.Errorf("want debug line, have %v", *lines)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	lines := capture(t, LEVEL_INFO)
+	a, b := NewTrace(), NewTrace()
+	if len(a.Trace()) != 8 || a.Trace() == b.Trace() {
+		t.Errorf("want distinct trace ids, have %s %s", a.Trace(), b.Trace())
+	}
+	a.Infof("channel %d started", 1)
+	WithTrace(a.Trace()).Warnf("confirmed")
+	var none *Logger
+	none.Infof("untraced")
+
+	if (*lines)[0].text != "["+a.Trace()+"] channel 1 started" {
+		t.Errorf("want trace prefix, have %s", (*lines)[0].text)
+	}
+	if !strings.HasPrefix((*lines)[1].text, "["+a.Trace()+"]") {
+		t.Errorf("want the same trace, have %s", (*lines)[1].text)
+	}
+	if (*lines)[2].text != "untraced" {
+		t.Errorf("nil logger should not add a trace, have %s", (*lines)[2].text)
+	}
+}
@@ -4,10 +4,13 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/niftynei/glightning/glightning"
 	"github.com/rsbondi/multifund/funder"
+	"github.com/rsbondi/multifund/logger"
 	"github.com/rsbondi/multifund/wallet"
 )
 
@@ -15,15 +18,19 @@ const VERSION = "0.0.1-WIP"
 
 var plugin *glightning.Plugin
 
+var lightning *glightning.Lightning
+
 var fundr *funder.Funder
 
 func main() {
 	plugin = glightning.NewPlugin(onInit)
 	fundr = &funder.Funder{}
-	fundr.Lightning = glightning.NewLightning()
+	lightning = glightning.NewLightning()
+	fundr.Lightning = lightning
 
 	registerOptions(plugin)
 	registerMethods(plugin)
+	plugin.RegisterNotification(BATCH_NOTIFICATION)
 
 	err := plugin.Start(os.Stdin, os.Stdout)
 	if err != nil {
@@ -32,7 +39,12 @@ func main() {
 }
 
 func onInit(plugin *glightning.Plugin, options map[string]string, config *glightning.Config) {
-	log.Printf("versiion: %s initialized for wallet type %s", VERSION, options["multi-wallet"])
+	level, err := logger.ParseLevel(options["multi-log-level"])
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger.SetOutput(pluginLog, level)
+	logger.Infof("version %s initialized for wallet type %s", VERSION, options["multi-wallet"])
 	fundr.Lightningdir = config.LightningDir
 	options["rpc-file"] = fmt.Sprintf("%s/%s", config.LightningDir, config.RpcFile)
 	switch options["multi-wallet"] {
@@ -41,14 +53,30 @@ func onInit(plugin *glightning.Plugin, options map[string]string, config *glight
 	default:
 		fundr.Wallettype = wallet.WALLET_INTERNAL
 	}
-	fundr.Lightning.StartUp(config.RpcFile, config.LightningDir)
+	lightning.StartUp(config.RpcFile, config.LightningDir)
 
 	cfg, err := fundr.Lightning.ListConfigs()
 
 	if err != nil {
 		log.Fatal(err)
 	}
-	fundr.Bitcoin = wallet.NewBitcoinWallet(cfg)
+	if dual, ok := cfg["experimental-dual-fund"].(bool); ok {
+		fundr.DualFund = dual
+	}
+
+	// lightningd broadcasts what it builds, which would bypass any other multi-broadcast
+	fundr.Native = options["multi-native"] != "off"
+	if fundr.Native && options["multi-broadcast"] != wallet.BROADCAST_LIGHTNING {
+		logger.Infof("multi-native is off, lightningd can not broadcast with multi-broadcast=%s", options["multi-broadcast"])
+		fundr.Native = false
+	}
+	caps, err := funder.ProbeCapabilities(fundr.Lightning)
+	if err != nil {
+		logger.Warnf("unable to probe lightningd capabilities: %s", err.Error())
+	} else {
+		fundr.Capabilities = caps
+		logger.Infof("lightningd %s, multifundchannel: %v, fundpsbt: %v", caps.Version, caps.NativeFund(), caps.NativeWithdraw())
+	}
 
 	switch cfg["network"] {
 	case "bitcoin":
@@ -61,10 +89,128 @@ func onInit(plugin *glightning.Plugin, options map[string]string, config *glight
 		fundr.BitcoinNet = &chaincfg.TestNet3Params
 	}
 
+	// bitcoind is only needed when something is configured to use it
+	var bitcoin *wallet.BitcoinWallet
+	if fundr.Wallettype == wallet.WALLET_BITCOIN || options["multi-chain-backend"] == wallet.CHAIN_BITCOIN || options["multi-broadcast"] == wallet.BROADCAST_BITCOIN {
+		bitcoin = wallet.NewBitcoinWallet(cfg)
+		fundr.Bitcoin = bitcoin
+	}
+	fundr.Chain, err = wallet.NewChainBackend(&wallet.ChainConfig{
+		Backend:        options["multi-chain-backend"],
+		EsploraUrl:     options["multi-esplora-url"],
+		ElectrumServer: options["multi-electrum-server"],
+		ElectrumTLS:    options["multi-electrum-tls"] == "true",
+		Net:            fundr.BitcoinNet,
+	}, bitcoin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	feeSource := options["multi-fee-source"]
+	if feeSource == "auto" {
+		if fundr.Wallettype == wallet.WALLET_INTERNAL {
+			feeSource = wallet.FEE_LIGHTNING
+		} else {
+			feeSource = wallet.FEE_BITCOIN
+		}
+	}
+	fundr.Fees, err = wallet.NewFeePolicy(&wallet.FeeConfig{
+		Source:   feeSource,
+		Target:   uint(uintOption(options, "multi-fee-target")),
+		Mode:     options["multi-fee-mode"],
+		Fallback: uintOption(options, "multi-fee-fallback"),
+		Min:      uintOption(options, "multi-fee-min"),
+		Max:      uintOption(options, "multi-fee-max"),
+	}, fundr.Chain, bitcoin, fundr.Lightning)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fundr.Broadcaster, err = wallet.NewBroadcaster(options["multi-broadcast"], fundr.Chain, bitcoin, fundr.Lightning, options["multi-esplora-url"])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fundr.Limits = &funder.BroadcastLimits{
+		MaxFee:        uintOption(options, "multi-max-fee"),
+		MaxFeePercent: uintOption(options, "multi-max-fee-percent"),
+	}
+	if fundr.Native && !fundr.NativeFundAllowed() {
+		logger.Infof("multifundchannel is not used while multi-max-fee or multi-max-fee-percent is set, it broadcasts before the fee can be checked")
+	}
+
+	fundr.ConnectPolicy, err = funder.NewConnectPolicy(&funder.ConnectConfig{
+		Prefer:    options["multi-address-prefer"],
+		Timeout:   options["multi-connect-timeout"],
+		Parallel:  int(uintOption(options, "multi-parallel")),
+		OnFailure: options["multi-on-failure"],
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	go fundr.TrackBatches(time.Minute, notifyBatch)
+
+	queuePolicy.Size = int(uintOption(options, "multi-queue-size"))
+	queuePolicy.MaxFeeRate = uintOption(options, "multi-queue-feerate")
+	if options["multi-queue-interval"] != "" {
+		if queuePolicy.Interval, err = time.ParseDuration(options["multi-queue-interval"]); err != nil {
+			log.Fatalf("invalid multi-queue-interval: %s", err.Error())
+		}
+	}
+	go runWithdrawQueue(time.Minute)
+	go runFundSchedule(time.Minute)
+
+}
+
+// pluginLog writes to lightningd's log, levels below lightningd's log-level are also dropped there
+func pluginLog(level logger.Level, line string) {
+	switch level {
+	case logger.LEVEL_DEBUG:
+		plugin.Log(line, glightning.Debug)
+	case logger.LEVEL_INFO:
+		plugin.Log(line, glightning.Info)
+	case logger.LEVEL_WARN:
+		plugin.Log(line, glightning.Unusual)
+	default:
+		plugin.Log(line, glightning.Broken)
+	}
+}
+
+// uintOption reads a numeric option, numbers are passed as strings
+func uintOption(options map[string]string, name string) uint64 {
+	if options[name] == "" {
+		return 0
+	}
+	n, err := strconv.ParseUint(options[name], 10, 64)
+	if err != nil {
+		log.Fatalf("invalid %s: %s", name, options[name])
+	}
+	return n
 }
 
 func registerOptions(p *glightning.Plugin) {
 	p.RegisterOption(glightning.NewOption("multi-wallet", "Wallet to use for multi-channel open - internal or bitcoin", "internal"))
+	p.RegisterOption(glightning.NewOption("multi-chain-backend", "Chain data source for fee estimation and utxo lookup - bitcoin, esplora or electrum", "bitcoin"))
+	p.RegisterOption(glightning.NewOption("multi-fee-source", "Fee rate source - auto, lightning, bitcoin, chain or static, auto uses lightning for the internal wallet and bitcoin otherwise", "auto"))
+	p.RegisterOption(glightning.NewOption("multi-fee-target", "Confirmation target in blocks for bitcoin and chain fee sources", "6"))
+	p.RegisterOption(glightning.NewOption("multi-fee-mode", "estimatesmartfee mode for the bitcoin fee source - CONSERVATIVE or ECONOMICAL", "CONSERVATIVE"))
+	p.RegisterOption(glightning.NewOption("multi-fee-fallback", "Fee rate in sat/vbyte when no estimate is available, also the static rate", "2"))
+	p.RegisterOption(glightning.NewOption("multi-fee-min", "Minimum fee rate in sat/vbyte, 0 for no limit", "1"))
+	p.RegisterOption(glightning.NewOption("multi-fee-max", "Maximum fee rate in sat/vbyte, 0 for no limit", "0"))
+	p.RegisterOption(glightning.NewOption("multi-max-fee", "Largest fee in satoshi of any transaction the plugin broadcasts, 0 for no limit", "1000000"))
+	p.RegisterOption(glightning.NewOption("multi-max-fee-percent", "Largest fee of any transaction the plugin broadcasts as a percentage of its outputs, 0 for no limit", "10"))
+	p.RegisterOption(glightning.NewOption("multi-queue-size", "Send queued withdraws when this many are queued, 0 to disable", "50"))
+	p.RegisterOption(glightning.NewOption("multi-queue-interval", "Send queued withdraws when the oldest is this old, ex. 6h, empty to disable", "24h"))
+	p.RegisterOption(glightning.NewOption("multi-queue-feerate", "Send queued withdraws when the fee rate is at or below this sat/vbyte, 0 to disable", "0"))
+	p.RegisterOption(glightning.NewOption("multi-broadcast", "Where to broadcast transactions - chain, bitcoin, lightning, esplora or none", "chain"))
+	p.RegisterOption(glightning.NewOption("multi-esplora-url", "Esplora API url used by the esplora backend or broadcaster, ex. https://blockstream.info/api", ""))
+	p.RegisterOption(glightning.NewOption("multi-electrum-server", "Electrum server host:port used by multi-chain-backend=electrum", ""))
+	p.RegisterOption(glightning.NewOption("multi-electrum-tls", "Connect to the electrum server with tls - true or false", "false"))
+	p.RegisterOption(glightning.NewOption("multi-address-prefer", "Address types to try in order when connecting peers from gossip - ipv4, ipv6 and tor, comma separated", funder.DEFAULT_ADDRESS_PREFER))
+	p.RegisterOption(glightning.NewOption("multi-connect-timeout", "How long to wait for each connection attempt and fundchannel_start, ex. 30s, 0 to wait indefinitely", "30s"))
+	p.RegisterOption(glightning.NewOption("multi-parallel", "Number of peers connected and channels started at once", "5"))
+	p.RegisterOption(glightning.NewOption("multi-on-failure", "When a peer can not be connected or its channel started - abort the batch or drop the peer and continue", funder.FAILURE_ABORT))
+	p.RegisterOption(glightning.NewOption("multi-log-level", "Least important log lines to write - debug, info, warn or error, raw transactions are only logged at debug", "info"))
+	p.RegisterOption(glightning.NewOption("multi-native", "Use lightningd's multifundchannel and fundpsbt with the internal wallet when available and multi-broadcast=lightning, multifundchannel also needs multi-max-fee and multi-max-fee-percent at 0 - auto or off", "auto"))
 }
 
 // fund_multi [{"id":"0265b6...", "satoshi": 20000, "announce":true}, {id, satoshi, announce}...]
@@ -74,11 +220,11 @@ func registerMethods(p *glightning.Plugin) {
 	p.RegisterMethod(multi)
 
 	multic := glightning.NewRpcMethod(&MultiChannelWithConnect{}, `Connects peers and opens multiple channels in single transaction`)
-	multic.LongDesc = "{peers} consist of {id, host, port, satoshi, announce}"
+	multic.LongDesc = ConnectFundMultiDescription
 	p.RegisterMethod(multic)
 
 	multiw := glightning.NewRpcMethod(&MultiWithdraw{}, `Batch withdraw funds to multiple destinations`)
-	multiw.LongDesc = `{destinations} consist of an array of{"destination": ADDRESS, "satoshi": n}`
+	multiw.LongDesc = WithdrawMultiDescription
 	p.RegisterMethod(multiw)
 
 	multix := glightning.NewRpcMethod(&MultiChannelExternal{}, `Get addresses for external transaction creation`)
@@ -86,6 +232,78 @@ func registerMethods(p *glightning.Plugin) {
 	p.RegisterMethod(multix)
 
 	multixc := glightning.NewRpcMethod(&MultiChannelExternalComplete{}, `Complete funding and send transaction`)
-	multixc.LongDesc = FundExternalDescription
+	multixc.LongDesc = FundExternalCompleteDescription
 	p.RegisterMethod(multixc)
+
+	multixx := glightning.NewRpcMethod(&MultiChannelExternalCancel{}, `Cancel the channels waiting for an external transaction`)
+	multixx.LongDesc = "cancels the channels of fund_multi_start so they can be started again"
+	p.RegisterMethod(multixx)
+
+	status := glightning.NewRpcMethod(&MultiFundStatus{}, `Show funding transaction and channel states`)
+	status.LongDesc = MultiFundStatusDescription
+	p.RegisterMethod(status)
+
+	hist := glightning.NewRpcMethod(&MultiFundHistory{}, `List and export transactions made by the plugin`)
+	hist.LongDesc = MultiFundHistoryDescription
+	p.RegisterMethod(hist)
+
+	lexport := glightning.NewRpcMethod(&MultiFundLabelsExport{}, `Export BIP329 wallet labels`)
+	lexport.LongDesc = LabelsExportDescription
+	p.RegisterMethod(lexport)
+
+	limport := glightning.NewRpcMethod(&MultiFundLabelsImport{}, `Import BIP329 wallet labels`)
+	limport.LongDesc = LabelsImportDescription
+	p.RegisterMethod(limport)
+
+	queue := glightning.NewRpcMethod(&WithdrawQueue{}, `Queue a withdraw to be batched`)
+	queue.LongDesc = WithdrawQueueDescription
+	p.RegisterMethod(queue)
+
+	queuel := glightning.NewRpcMethod(&WithdrawQueueList{}, `List queued withdraws and their status`)
+	queuel.LongDesc = "{status} optionally filters by queued, sent or failed"
+	p.RegisterMethod(queuel)
+
+	queuer := glightning.NewRpcMethod(&WithdrawQueueRemove{}, `Remove a queued withdraw`)
+	queuer.LongDesc = "{id} of a queued or failed withdraw"
+	p.RegisterMethod(queuer)
+
+	sched := glightning.NewRpcMethod(&MultiChannelSchedule{}, `Schedule opening multiple channels when fees are low`)
+	sched.LongDesc = FundScheduleDescription
+	p.RegisterMethod(sched)
+
+	schedl := glightning.NewRpcMethod(&MultiChannelScheduleList{}, `List scheduled channel openings`)
+	schedl.LongDesc = "{status} optionally filters by waiting, done or failed"
+	p.RegisterMethod(schedl)
+
+	schedc := glightning.NewRpcMethod(&MultiChannelScheduleCancel{}, `Cancel a scheduled channel opening`)
+	schedc.LongDesc = "{id} of the scheduled funding, finished fundings are cleared"
+	p.RegisterMethod(schedc)
+
+	suggest := glightning.NewRpcMethod(&MultiChannelSuggest{}, `Suggest peers and amounts for a batch of channels`)
+	suggest.LongDesc = FundSuggestDescription
+	p.RegisterMethod(suggest)
+
+	check := glightning.NewRpcMethod(&MultiFundCheck{}, `Check a funding batch or withdraw before running it`)
+	check.LongDesc = FundCheckDescription
+	p.RegisterMethod(check)
+
+	multis := glightning.NewRpcMethod(&MultiChannelMultisig{}, `Get a PSBT funding multiple channels from multisig inputs`)
+	multis.LongDesc = FundMultisigDescription
+	p.RegisterMethod(multis)
+
+	multiss := glightning.NewRpcMethod(&MultiChannelMultisigSign{}, `Add multisig signatures, complete funding and send transaction when the threshold is met`)
+	multiss.LongDesc = FundMultisigSignDescription
+	p.RegisterMethod(multiss)
+
+	multico := glightning.NewRpcMethod(&MultiPartyCoordinate{}, `Coordinate a channel funding transaction shared by several nodes`)
+	multico.LongDesc = FundCoordinateDescription
+	p.RegisterMethod(multico)
+
+	multicc := glightning.NewRpcMethod(&MultiPartyCoordinateCancel{}, `Cancel the multi party funding this node coordinates`)
+	multicc.LongDesc = FundCoordinateCancelDescription
+	p.RegisterMethod(multicc)
+
+	multij := glightning.NewRpcMethod(&MultiPartyJoin{}, `Join a shared channel funding transaction`)
+	multij.LongDesc = FundJoinDescription
+	p.RegisterMethod(multij)
 }
@@ -0,0 +1,614 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/niftynei/glightning/glightning"
+	"github.com/niftynei/glightning/jrpc2"
+	"github.com/rsbondi/multifund/funder"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+var testNet = &chaincfg.RegressionNetParams
+
+// fakeLightningd keeps the channel state lightningd would, fail makes a command fail for a peer
+type fakeLightningd struct {
+	mu        sync.Mutex
+	peers     map[string]bool // connected
+	started   map[string]bool
+	completed map[string]string
+	cancelled []string
+	fail      map[string]string // command to the peer it fails for
+	mainnet   string            // peer given a mainnet funding address
+	height    uint32
+
+	// lightningd's own wallet and batch commands, used with the internal wallet
+	wallet     *fakeBitcoind
+	commands   []string // listed by help
+	multifund  *funder.MultiFundChannelRequest
+	reserved   bool
+	unreserved int
+
+	// v2 opens, peers with features set to dualFeatures take part
+	features map[string]string
+	dual     map[string]*fakeDual // by channel id
+	aborted  []string
+	disagree string // peer that changes the transaction after securing commitments
+	malleate string // peer that returns its signed transaction with a signature script added
+}
+
+// option_dual_fund optional
+const dualFeatures = "20000000"
+
+// fakeDual is a v2 open, the peer adds its funding output and secures commitments once it
+//   sees the same transaction twice
+type fakeDual struct {
+	peer    string
+	amount  uint64
+	last    chainhash.Hash
+	updates int
+	signed  bool
+}
+
+func newFakeLightningd(peers ...string) *fakeLightningd {
+	l := &fakeLightningd{
+		peers:     make(map[string]bool),
+		started:   make(map[string]bool),
+		completed: make(map[string]string),
+		fail:      make(map[string]string),
+		height:    100,
+		features:  make(map[string]string),
+		dual:      make(map[string]*fakeDual),
+	}
+	for _, p := range peers {
+		l.peers[p] = true
+	}
+	return l
+}
+
+func (l *fakeLightningd) failing(command, peer string) error {
+	if l.fail[command] == peer {
+		return errors.New(command + " failed for " + peer)
+	}
+	return nil
+}
+
+// fundingAddress is the p2wsh address lightningd would give for the peer's channel
+func fundingAddress(peer string) string {
+	h := sha256.Sum256([]byte(peer))
+	addr, _ := btcutil.NewAddressWitnessScriptHash(h[:], testNet)
+	return addr.EncodeAddress()
+}
+
+func (l *fakeLightningd) StartFundChannel(id string, amount uint64, announce bool, feerate *glightning.FeeRate) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.failing("fundchannel_start", id); err != nil {
+		return "", err
+	}
+	if !l.peers[id] {
+		return "", errors.New("unknown peer " + id)
+	}
+	if l.started[id] {
+		return "", errors.New("already funding channel with " + id)
+	}
+	l.started[id] = true
+	if id == l.mainnet {
+		h := sha256.Sum256([]byte(id))
+		addr, _ := btcutil.NewAddressWitnessScriptHash(h[:], &chaincfg.MainNetParams)
+		return addr.EncodeAddress(), nil
+	}
+	return fundingAddress(id), nil
+}
+
+func (l *fakeLightningd) CompleteFundChannel(peerId, txId string, txout uint16) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.failing("fundchannel_complete", peerId); err != nil {
+		return "", err
+	}
+	if !l.started[peerId] {
+		return "", errors.New("no channel funding started with " + peerId)
+	}
+	l.completed[peerId] = txId
+	return "channel-" + peerId, nil
+}
+
+func (l *fakeLightningd) CancelFundChannel(peerId string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cancelled = append(l.cancelled, peerId)
+	if !l.started[peerId] || l.completed[peerId] != "" {
+		return false, errors.New("no channel funding to cancel with " + peerId)
+	}
+	delete(l.started, peerId)
+	return true, nil
+}
+
+func (l *fakeLightningd) Connect(peerId, host string, port uint) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.failing("connect", peerId); err != nil {
+		return "", err
+	}
+	l.peers[peerId] = true
+	return peerId, nil
+}
+
+func (l *fakeLightningd) NewAddr() (string, error) {
+	return fundingAddress("newaddr"), nil
+}
+
+func (l *fakeLightningd) ListConfigs() (map[string]interface{}, error) {
+	return map[string]interface{}{"network": "regtest"}, nil
+}
+
+func (l *fakeLightningd) Request(m jrpc2.Method, resp interface{}) error {
+	switch req := m.(type) {
+	case *funder.ListPeersRequest:
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		result := resp.(*funder.ListPeersResult)
+		for id, connected := range l.peers {
+			if req.Id == "" || req.Id == id {
+				result.Peers = append(result.Peers, funder.PeerInfo{Id: id, Connected: connected, Features: l.features[id]})
+			}
+		}
+		return nil
+	case *funder.GetInfoRequest:
+		resp.(*funder.GetInfoResult).BlockHeight = l.height
+		resp.(*funder.GetInfoResult).Version = "v0.10.0"
+		return nil
+	case *funder.HelpRequest:
+		result := resp.(*funder.HelpResult)
+		for _, c := range l.commands {
+			result.Help = append(result.Help, struct {
+				Command string `json:"command"`
+			}{c + " [args]"})
+		}
+		return nil
+	case *funder.FundChannelStartRequest:
+		addr, err := l.StartFundChannel(req.Id, req.Amount, req.Announce, nil)
+		if err != nil {
+			return err
+		}
+		resp.(*funder.FundChannelStartResult).FundingAddress = addr
+		return nil
+	case *funder.MultiFundChannelRequest:
+		return l.multiFundChannel(req, resp.(*funder.MultiFundChannelResult))
+	case *funder.FundPsbtRequest:
+		return l.fundPsbt(req, resp.(*funder.FundPsbtResult))
+	case *funder.SignPsbtRequest:
+		return l.signPsbt(req, resp.(*funder.SignPsbtResult))
+	case *funder.OpenChannelInit:
+		return l.openChannelInit(req, resp.(*funder.OpenChannelResult))
+	case *funder.OpenChannelUpdate:
+		return l.openChannelUpdate(req, resp.(*funder.OpenChannelResult))
+	case *funder.OpenChannelSigned:
+		return l.openChannelSigned(req, resp.(*funder.OpenChannelSignedResult))
+	case *funder.OpenChannelAbort:
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.aborted = append(l.aborted, req.ChannelId)
+		return nil
+	case *funder.UnreserveInputsRequest:
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.reserved = false
+		l.unreserved++
+		return nil
+	}
+	return errors.New("unexpected request " + m.Name())
+}
+
+func (l *fakeLightningd) openChannelInit(req *funder.OpenChannelInit, result *funder.OpenChannelResult) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.failing("openchannel_init", req.Id); err != nil {
+		return err
+	}
+	if l.features[req.Id] != dualFeatures {
+		return errors.New(req.Id + " does not support dual funding")
+	}
+	p, err := wallet.DecodePsbt(req.InitialPsbt)
+	if err != nil {
+		return err
+	}
+	if err := wallet.AddPsbtOutputs(p, []*wallet.TxRecipient{{Address: fundingAddress(req.Id), Amount: wallet.Amount(req.Amount)}}, testNet); err != nil {
+		return err
+	}
+	result.ChannelId = "dual-" + req.Id
+	result.Psbt, err = p.B64Encode()
+	l.dual[result.ChannelId] = &fakeDual{peer: req.Id, amount: req.Amount}
+	return err
+}
+
+func (l *fakeLightningd) openChannelUpdate(req *funder.OpenChannelUpdate, result *funder.OpenChannelResult) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	d := l.dual[req.ChannelId]
+	if d == nil {
+		return errors.New("unknown channel " + req.ChannelId)
+	}
+	if err := l.failing("openchannel_update", d.peer); err != nil {
+		return err
+	}
+	p, err := wallet.DecodePsbt(req.Psbt)
+	if err != nil {
+		return err
+	}
+	if !pays(p.UnsignedTx, fundingAddress(d.peer), wallet.Amount(d.amount)) {
+		return errors.New("funding output missing for " + d.peer)
+	}
+	d.updates++
+	txid := p.UnsignedTx.TxHash()
+	result.CommitmentsSecured = txid == d.last
+	d.last = txid
+	if l.disagree == d.peer {
+		// secured, then adds another output anyway
+		wallet.AddPsbtOutputs(p, []*wallet.TxRecipient{{Address: fundingAddress("extra"), Amount: 10000}}, testNet)
+		result.CommitmentsSecured = true
+	}
+	result.ChannelId = req.ChannelId
+	result.Psbt, err = p.B64Encode()
+	return err
+}
+
+// openChannelSigned returns the transaction with our signatures, the peer adds none as it has no inputs
+func (l *fakeLightningd) openChannelSigned(req *funder.OpenChannelSigned, result *funder.OpenChannelSignedResult) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	d := l.dual[req.ChannelId]
+	if d == nil {
+		return errors.New("unknown channel " + req.ChannelId)
+	}
+	if err := l.failing("openchannel_signed", d.peer); err != nil {
+		return err
+	}
+	p, err := wallet.DecodePsbt(req.SignedPsbt)
+	if err != nil {
+		return err
+	}
+	if p.UnsignedTx.TxHash() != d.last {
+		return errors.New("signed transaction does not match the secured commitments")
+	}
+	tx, err := wallet.FinalizePsbt(p)
+	if err != nil {
+		return err
+	}
+	if l.malleate == d.peer {
+		wtx := wire.NewMsgTx(2)
+		wtx.Deserialize(bytes.NewReader(tx.Signed))
+		wtx.TxIn[0].SignatureScript = []byte{0x00}
+		var signed bytes.Buffer
+		wtx.Serialize(&signed)
+		tx = wallet.Transaction{TxId: wtx.TxHash().String(), Signed: signed.Bytes()}
+	}
+	d.signed = true
+	result.ChannelId = req.ChannelId
+	result.Tx = tx.String()
+	result.Txid = tx.TxId
+	return nil
+}
+
+// multiFundChannel opens every channel and broadcasts, which the plugin can not see
+func (l *fakeLightningd) multiFundChannel(req *funder.MultiFundChannelRequest, result *funder.MultiFundChannelResult) error {
+	l.mu.Lock()
+	l.multifund = req
+	l.mu.Unlock()
+	for i, d := range req.Destinations {
+		if _, err := l.StartFundChannel(d.Id, d.Amount, d.Announce, nil); err != nil {
+			return err
+		}
+		channel, _ := l.CompleteFundChannel(d.Id, "multifund", uint16(i))
+		result.ChannelIds = append(result.ChannelIds, struct {
+			Id        string `json:"id"`
+			Outnum    uint   `json:"outnum"`
+			ChannelId string `json:"channel_id"`
+		}{d.Id, uint(i), channel})
+	}
+	result.Tx = "02000000"
+	result.Txid = "multifund"
+	return nil
+}
+
+// fee rate of fundpsbt, 8 sat/vbyte
+const fakeFeeRatePerKw = 2000
+
+// fundPsbt spends every wallet output, the excess is what is left after the amount and fee
+func (l *fakeLightningd) fundPsbt(req *funder.FundPsbtRequest, result *funder.FundPsbtResult) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	p, err := wallet.CreateWalletPsbt(nil, l.wallet.utxos, testNet)
+	if err != nil {
+		return err
+	}
+	total, _ := wallet.UtxoTotal(l.wallet.utxos)
+	weight := req.StartWeight + uint64(272*len(l.wallet.utxos))
+	fee := wallet.Amount(fakeFeeRatePerKw * weight / 1000)
+	if total < req.Satoshi+fee {
+		return errors.New("Could not afford")
+	}
+	if result.Psbt, err = p.B64Encode(); err != nil {
+		return err
+	}
+	l.reserved = req.Reserve
+	result.FeeRatePerKw = fakeFeeRatePerKw
+	result.EstimatedFinalWeight = weight
+	result.ExcessMsat = fmt.Sprintf("%dmsat", uint64(total-req.Satoshi-fee)*1000)
+	return nil
+}
+
+func (l *fakeLightningd) signPsbt(req *funder.SignPsbtRequest, result *funder.SignPsbtResult) error {
+	p, err := wallet.DecodePsbt(req.Psbt)
+	if err != nil {
+		return err
+	}
+	wtx := p.UnsignedTx.Copy()
+	l.wallet.signTx(wtx)
+	var signed bytes.Buffer
+	wtx.Serialize(&signed)
+	if err := wallet.AddSignedInputs(p, signed.Bytes(), l.wallet.utxos); err != nil {
+		return err
+	}
+	result.SignedPsbt, err = p.B64Encode()
+	return err
+}
+
+// fakeBitcoind is a single key wallet and the chain its outputs are on, every transaction
+//   it signs or accepts is checked against the outputs it spends
+type fakeBitcoind struct {
+	mu        sync.Mutex
+	key       *btcec.PrivateKey
+	utxos     []wallet.UTXO
+	prevouts  map[wire.OutPoint]*wire.TxOut
+	broadcast []string
+	labels    map[string]string
+	fail      error // broadcast fails
+	unsigned  bool  // Sign gives nothing back, as when the node cannot be reached
+}
+
+func newFakeBitcoind(amounts ...wallet.Amount) *fakeBitcoind {
+	key, _ := btcec.PrivKeyFromBytes(btcec.S256(), bytes.Repeat([]byte{7}, 32))
+	b := &fakeBitcoind{
+		key:      key,
+		prevouts: make(map[wire.OutPoint]*wire.TxOut),
+		labels:   make(map[string]string),
+	}
+	for i, amt := range amounts {
+		b.fund(uint32(i), amt)
+	}
+	return b
+}
+
+// fund adds an unspent output of amt paying to the wallet
+func (b *fakeBitcoind) fund(i uint32, amt wallet.Amount) wire.OutPoint {
+	op := *wire.NewOutPoint(&chainhash.Hash{byte(i + 1)}, i)
+	b.utxos = append(b.utxos, wallet.UTXO{Amount: amt, Address: b.address(), OutPoint: op})
+	b.prevouts[op] = wire.NewTxOut(amt.Int64(), b.script())
+	return op
+}
+
+func (b *fakeBitcoind) address() string {
+	addr, _ := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(b.key.PubKey().SerializeCompressed()), testNet)
+	return addr.EncodeAddress()
+}
+
+func (b *fakeBitcoind) script() []byte {
+	addr, _ := btcutil.DecodeAddress(b.address(), testNet)
+	script, _ := txscript.PayToAddrScript(addr)
+	return script
+}
+
+// Utxos gives every output, the wallets give what they have when short
+func (b *fakeBitcoind) Utxos(amt wallet.Amount, fee wallet.Amount) ([]wallet.UTXO, error) {
+	return b.utxos, nil
+}
+
+func (b *fakeBitcoind) ChangeAddress() string {
+	return b.address()
+}
+
+func (b *fakeBitcoind) Sign(tx *wallet.Transaction, utxos []wallet.UTXO) {
+	if b.unsigned {
+		return
+	}
+	wtx := wire.NewMsgTx(2)
+	wtx.Deserialize(bytes.NewReader(tx.Unsigned))
+	b.signTx(wtx)
+	var signed bytes.Buffer
+	wtx.Serialize(&signed)
+	tx.Signed = signed.Bytes()
+}
+
+func (b *fakeBitcoind) signTx(wtx *wire.MsgTx) {
+	hashes := txscript.NewTxSigHashes(wtx)
+	for i, in := range wtx.TxIn {
+		prev, ok := b.prevouts[in.PreviousOutPoint]
+		if !ok {
+			continue
+		}
+		in.Witness, _ = txscript.WitnessSignature(wtx, hashes, i, prev.Value, prev.PkScript, txscript.SigHashAll, b.key, true)
+	}
+}
+
+func (b *fakeBitcoind) SetLabel(address, label string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.labels[address] = label
+	return nil
+}
+
+// TestMempoolAccept runs the input scripts, which is as much of bitcoind's checks as the tests need
+func (b *fakeBitcoind) TestMempoolAccept(rawtx string) (*wallet.MempoolAcceptResult, error) {
+	wtx, err := funder.DecodeTx(rawtx)
+	if err != nil {
+		return nil, err
+	}
+	result := &wallet.MempoolAcceptResult{Txid: wtx.TxHash().String()}
+	fee, err := funder.VerifyInputs(wtx, b)
+	if err != nil {
+		result.RejectReason = err.Error()
+		return result, nil
+	}
+	if fee < 0 {
+		result.RejectReason = "bad-txns-in-belowout"
+		return result, nil
+	}
+	result.Allowed = true
+	result.Fees = &struct {
+		Base json.Number `json:"base"`
+	}{json.Number(wallet.Amount(fee).Btc())}
+	return result, nil
+}
+
+func (b *fakeBitcoind) Broadcast(rawtx string) (string, error) {
+	if b.fail != nil {
+		return "", b.fail
+	}
+	wtx, err := funder.DecodeTx(rawtx)
+	if err != nil {
+		return "", err
+	}
+	if _, err := funder.VerifyInputs(wtx, b); err != nil {
+		return "", err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.broadcast = append(b.broadcast, rawtx)
+	return wtx.TxHash().String(), nil
+}
+
+func (b *fakeBitcoind) EstimateFeeRate(target uint) (uint64, error) {
+	return 0, nil
+}
+
+// TxStatus finds the transactions broadcast through the fake, unconfirmed
+func (b *fakeBitcoind) TxStatus(txid string) (*wallet.TxStatus, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, raw := range b.broadcast {
+		if wtx, err := funder.DecodeTx(raw); err == nil && wtx.TxHash().String() == txid {
+			return &wallet.TxStatus{Txid: txid, Found: true}, nil
+		}
+	}
+	return &wallet.TxStatus{Txid: txid}, nil
+}
+
+func (b *fakeBitcoind) AddressUtxos(address string) ([]wallet.UTXO, error) {
+	return nil, nil
+}
+
+func (b *fakeBitcoind) PrevOut(op wire.OutPoint) (*wire.TxOut, error) {
+	return b.prevouts[op], nil
+}
+
+// setup points the plugin at the fakes with the bitcoind wallet selected, connected are the peers
+//   lightningd is connected to
+func setup(t *testing.T, amounts []wallet.Amount, connected ...string) (*fakeLightningd, *fakeBitcoind) {
+	dir, err := ioutil.TempDir("", "multifund")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	l := newFakeLightningd(connected...)
+	b := newFakeBitcoind(amounts...)
+	fundr = &funder.Funder{
+		Lightning:    l,
+		Wallettype:   wallet.WALLET_BITCOIN,
+		Bitcoin:      b,
+		Chain:        b,
+		Fees:         wallet.StaticFees(2),
+		Broadcaster:  b,
+		Internal:     b,
+		BitcoinNet:   testNet,
+		Lightningdir: dir,
+	}
+	outputs = nil
+	expectedInputs = nil
+	return l, b
+}
+
+// setupNative selects the internal wallet with lightningd providing its batch commands,
+//   lightningd's wallet is the fake bitcoind so its broadcasts are checked the same way
+func setupNative(t *testing.T, amounts []wallet.Amount, connected ...string) (*fakeLightningd, *fakeBitcoind) {
+	l, b := setup(t, amounts, connected...)
+	l.wallet = b
+	l.commands = []string{"multifundchannel", "fundpsbt", "signpsbt", "sendpsbt"}
+	caps, err := funder.ProbeCapabilities(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fundr.Wallettype = wallet.WALLET_INTERNAL
+	fundr.Native = true
+	fundr.Capabilities = caps
+	return l, b
+}
+
+func decodeHex(t *testing.T, raw string) *wire.MsgTx {
+	b, err := hex.DecodeString(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wtx := wire.NewMsgTx(2)
+	if err := wtx.Deserialize(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	return wtx
+}
+
+// pays is true when the transaction has an output of amt to the address
+func pays(wtx *wire.MsgTx, address string, amt wallet.Amount) bool {
+	addr, _ := btcutil.DecodeAddress(address, testNet)
+	script, _ := txscript.PayToAddrScript(addr)
+	for _, out := range wtx.TxOut {
+		if bytes.Equal(out.PkScript, script) && out.Value == amt.Int64() {
+			return true
+		}
+	}
+	return false
+}
+
+// pending are the peers with a channel started and neither completed nor cancelled
+func (l *fakeLightningd) pending() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	peers := make([]string, 0)
+	for id := range l.started {
+		if l.completed[id] == "" {
+			peers = append(peers, id)
+		}
+	}
+	return peers
+}
+
+// nothingSent checks a failed call left nothing broadcast or recorded
+func nothingSent(t *testing.T, name string, b *fakeBitcoind) {
+	t.Helper()
+	if len(b.broadcast) > 0 {
+		t.Errorf("%s: nothing should be broadcast, have %d", name, len(b.broadcast))
+	}
+	batches, err := fundr.Batches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches.List()) > 0 {
+		t.Errorf("%s: nothing should be recorded, have %d batches", name, len(batches.List()))
+	}
+}
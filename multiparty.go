@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/niftynei/glightning/glightning"
+	"github.com/niftynei/glightning/jrpc2"
+	"github.com/rsbondi/multifund/funder"
+	"github.com/rsbondi/multifund/logger"
+)
+
+const FundCoordinateDescription = `Coordinate a transaction funding channels from several nodes
+{participants} is the number of nodes that will join, including this one if it opens channels
+{listen} is the host:port to accept participants on, defaults to 127.0.0.1:9737
+returns the url participants pass to fund_multi_join, it includes a random token so keep it private to them
+the session fails if not broadcast within 10 minutes, or when cancelled with fund_multi_coordinate_cancel`
+
+const FundCoordinateCancelDescription = `Cancel the multi party funding in progress and stop accepting participants
+fails if the transaction was already broadcast`
+
+const FundJoinDescription = `Join a multi party funding, contributing inputs and channels from this node
+{url} is the url returned by fund_multi_coordinate
+{channels} is an array of object{"id" string, "satoshi" int, "announce" bool}`
+
+type MultiPartyCoordinate struct {
+	Participants int    `json:"participants"`
+	Listen       string `json:"listen,omitempty"`
+}
+
+func (m *MultiPartyCoordinate) Call() (jrpc2.Result, error) {
+	return coordinateMulti(m.Participants, m.Listen)
+}
+
+func (m *MultiPartyCoordinate) Name() string {
+	return "fund_multi_coordinate"
+}
+
+func (m *MultiPartyCoordinate) New() interface{} {
+	return &MultiPartyCoordinate{}
+}
+
+type MultiPartyJoin struct {
+	Url      string                        `json:"url"`
+	Channels []glightning.FundChannelStart `json:"channels"`
+}
+
+func (m *MultiPartyJoin) Call() (jrpc2.Result, error) {
+	result, err := fundr.Participant().Join(m.Url, &m.Channels)
+	if err != nil {
+		return nil, err
+	}
+	fundr.RecordHistory(funder.HISTORY_JOIN, result.Tx, result.Utxos, result.Peers, result.Channels, nil, nil)
+	fundr.RecordBatch(result.Txid, result.Tx, result.Batch, 0, nil)
+	return result, nil
+}
+
+func (m *MultiPartyJoin) Name() string {
+	return "fund_multi_join"
+}
+
+func (m *MultiPartyJoin) New() interface{} {
+	return &MultiPartyJoin{}
+}
+
+type MultiPartyCoordinateCancel struct{}
+
+func (m *MultiPartyCoordinateCancel) Call() (jrpc2.Result, error) {
+	return cancelCoordinate()
+}
+
+func (m *MultiPartyCoordinateCancel) Name() string {
+	return "fund_multi_coordinate_cancel"
+}
+
+func (m *MultiPartyCoordinateCancel) New() interface{} {
+	return &MultiPartyCoordinateCancel{}
+}
+
+// the session in progress, RPC calls run concurrently so access is under coordinatorMu
+var (
+	coordinatorMu     sync.Mutex
+	coordinator       *funder.Coordinator
+	coordinatorServer *http.Server
+)
+
+func coordinateMulti(participants int, listen string) (jrpc2.Result, error) {
+	if participants < 2 {
+		return nil, errors.New("at least 2 participants required")
+	}
+	coordinatorMu.Lock()
+	defer coordinatorMu.Unlock()
+	if coordinator != nil {
+		select {
+		case <-coordinator.Done():
+		default:
+			return nil, errors.New("a multi party funding is already in progress")
+		}
+	}
+	if listen == "" {
+		listen = "127.0.0.1:9737"
+	}
+
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+
+	c := funder.NewCoordinator(participants, funder.COORDINATOR_TIMEOUT, fundr.Broadcast)
+	server := &http.Server{Handler: c}
+	go server.Serve(l)
+	go func() {
+		<-c.Done()
+		// give participants a chance to see the final status
+		time.Sleep(time.Minute)
+		closeCoordinator(server)
+	}()
+	coordinator, coordinatorServer = c, server
+
+	return struct {
+		Url string `json:"url"`
+	}{
+		c.Url(l.Addr().String()),
+	}, nil
+}
+
+func cancelCoordinate() (jrpc2.Result, error) {
+	coordinatorMu.Lock()
+	c, server := coordinator, coordinatorServer
+	coordinatorMu.Unlock()
+	if c == nil {
+		return nil, errors.New("no multi party funding in progress")
+	}
+	if err := c.Cancel(errors.New("cancelled by the coordinator")); err != nil {
+		return nil, err
+	}
+	closeCoordinator(server)
+	return struct {
+		Cancelled bool `json:"cancelled"`
+	}{true}, nil
+}
+
+func closeCoordinator(server *http.Server) {
+	if err := server.Close(); err != nil {
+		logger.Warnf("coordinator shutdown error: %s", err.Error())
+	}
+}
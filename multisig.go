@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/niftynei/glightning/glightning"
+	"github.com/niftynei/glightning/jrpc2"
+	"github.com/rsbondi/multifund/funder"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+const FundMultisigDescription = `Start funding multiple channels from P2WSH multisig inputs, returns a PSBT to be signed by the participants
+{channels} is an array of object{"id" string, "satoshi" int, "announce" bool}
+{inputs} is an array of object{"txid" string, "vout" int, "satoshi" int, "witness_script" hex}
+{change} is the address for any change, usually the multisig itself`
+
+const FundMultisigSignDescription = `Add partial signatures to a session started with fund_multi_psbt
+{psbt} is the PSBT, base64 or hex, signed by one or more participants
+once every input reaches its threshold the channels are completed and the transaction is broadcast`
+
+type MultisigInput struct {
+	Txid          string        `json:"txid"`
+	Vout          uint32        `json:"vout"`
+	Amount        wallet.Amount `json:"satoshi"`
+	WitnessScript string        `json:"witness_script"`
+}
+
+type MultiChannelMultisig struct {
+	Channels []glightning.FundChannelStart `json:"channels"`
+	Inputs   []MultisigInput               `json:"inputs"`
+	Change   string                        `json:"change"`
+}
+
+func (m *MultiChannelMultisig) Call() (jrpc2.Result, error) {
+	return createMultisig(&m.Channels, m.Inputs, m.Change)
+}
+
+func (m *MultiChannelMultisig) Name() string {
+	return "fund_multi_psbt"
+}
+
+func (m *MultiChannelMultisig) New() interface{} {
+	return &MultiChannelMultisig{}
+}
+
+type MultiChannelMultisigSign struct {
+	Psbt string `json:"psbt"`
+}
+
+func (m *MultiChannelMultisigSign) Call() (jrpc2.Result, error) {
+	return signMultisig(m.Psbt)
+}
+
+func (m *MultiChannelMultisigSign) Name() string {
+	return "fund_multi_sign"
+}
+
+func (m *MultiChannelMultisigSign) New() interface{} {
+	return &MultiChannelMultisigSign{}
+}
+
+type multisigStatus struct {
+	Session  string   `json:"session"`
+	Psbt     string   `json:"psbt,omitempty"`
+	Missing  []int    `json:"signatures_missing,omitempty"`
+	Tx       string   `json:"tx,omitempty"`
+	Txid     string   `json:"txid,omitempty"`
+	Channels []string `json:"channels,omitempty"`
+}
+
+func createMultisig(chans *[]glightning.FundChannelStart, inputs []MultisigInput, change string) (jrpc2.Result, error) {
+	if change == "" {
+		return nil, errors.New("change address required")
+	}
+
+	utxos := make([]wallet.MultisigUTXO, 0)
+	for _, in := range inputs {
+		h, err := chainhash.NewHashFromStr(in.Txid)
+		if err != nil {
+			return nil, err
+		}
+		script, err := hex.DecodeString(in.WitnessScript)
+		if err != nil {
+			return nil, fmt.Errorf("invalid witness script for %s:%d: %s", in.Txid, in.Vout, err.Error())
+		}
+		utxos = append(utxos, wallet.MultisigUTXO{
+			UTXO:          wallet.UTXO{Amount: in.Amount, OutPoint: *wire.NewOutPoint(h, in.Vout)},
+			WitnessScript: script,
+		})
+	}
+
+	sessions, err := fundr.Sessions()
+	if err != nil {
+		return nil, err
+	}
+
+	p, outputs, err := fundr.GetMultisigFundingPsbt(chans, utxos, change)
+	if err != nil {
+		cancelMulti(chans, nil)
+		return nil, err
+	}
+
+	encoded, err := p.B64Encode()
+	if err != nil {
+		cancelMulti(chans, nil)
+		return nil, err
+	}
+
+	missing, err := wallet.MissingSignatures(p)
+	if err != nil {
+		cancelMulti(chans, nil)
+		return nil, err
+	}
+
+	id := p.UnsignedTx.TxHash().String()
+	err = sessions.Put(&funder.Session{
+		Id:      id,
+		Psbt:    encoded,
+		Outputs: outputs,
+		Created: time.Now().Unix(),
+	})
+	if err != nil {
+		cancelMulti(chans, nil)
+		return nil, err
+	}
+
+	return &multisigStatus{
+		Session: id,
+		Psbt:    encoded,
+		Missing: missing,
+	}, nil
+}
+
+func signMultisig(signed string) (jrpc2.Result, error) {
+	sessions, err := fundr.Sessions()
+	if err != nil {
+		return nil, err
+	}
+
+	incoming, err := wallet.DecodePsbt(signed)
+	if err != nil {
+		return nil, err
+	}
+
+	id := incoming.UnsignedTx.TxHash().String()
+	sessions.Lock()
+	defer sessions.Unlock()
+	session := sessions.Get(id)
+	if session == nil {
+		return nil, fmt.Errorf("no pending session for %s", id)
+	}
+
+	p, err := wallet.DecodePsbt(session.Psbt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := wallet.CombinePsbt(p, incoming); err != nil {
+		return nil, err
+	}
+
+	missing, err := wallet.MissingSignatures(p)
+	if err != nil {
+		return nil, err
+	}
+
+	complete := true
+	for _, m := range missing {
+		if m > 0 {
+			complete = false
+			break
+		}
+	}
+
+	if !complete {
+		encoded, err := p.B64Encode()
+		if err != nil {
+			return nil, err
+		}
+		session.Psbt = encoded
+		if err := sessions.Put(session); err != nil {
+			return nil, err
+		}
+		return &multisigStatus{
+			Session: id,
+			Psbt:    encoded,
+			Missing: missing,
+		}, nil
+	}
+
+	in, err := wallet.InputTotal(p)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := wallet.FinalizePsbt(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := fundr.GuardTx(tx, in); err != nil {
+		cancelMultiExt(session.Outputs, nil)
+		sessions.Remove(id)
+		return nil, err
+	}
+
+	channels, err := fundr.CompleteChannels(tx, session.Outputs, nil)
+	if err != nil {
+		cancelMultiExt(session.Outputs, nil)
+		sessions.Remove(id)
+		return nil, err
+	}
+
+	txid, err := fundr.Broadcast(tx, in)
+	if err != nil {
+		cancelMultiExt(session.Outputs, nil)
+		sessions.Remove(id)
+		return nil, err
+	}
+
+	fundr.RecordBatch(txid, tx.String(), funder.OutputChannels(session.Outputs, channels), 0, nil)
+	fundr.RecordHistory(funder.HISTORY_MULTISIG, tx.String(), nil, funder.OutputPeers(session.Outputs), channels, nil, nil)
+
+	if err := sessions.Remove(id); err != nil {
+		return nil, err
+	}
+
+	return &multisigStatus{
+		Session:  id,
+		Tx:       tx.String(),
+		Txid:     txid,
+		Channels: channels,
+	}, nil
+}
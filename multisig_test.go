@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"sync"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/psbt"
+	"github.com/niftynei/glightning/glightning"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+func multisigKey(seed byte) *btcec.PrivateKey {
+	key, _ := btcec.PrivKeyFromBytes(btcec.S256(), bytes.Repeat([]byte{seed}, 32))
+	return key
+}
+
+// multisigInput is a 2 of 3 output of the keys seeded 1, 2 and 3, known to the fake bitcoind
+func multisigInput(t *testing.T, b *fakeBitcoind) MultisigInput {
+	pubkeys := make([]*btcutil.AddressPubKey, 0)
+	for seed := byte(1); seed <= 3; seed++ {
+		pk, err := btcutil.NewAddressPubKey(multisigKey(seed).PubKey().SerializeCompressed(), testNet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubkeys = append(pubkeys, pk)
+	}
+	script, err := txscript.MultiSigScript(pubkeys, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utxo := wallet.MultisigUTXO{WitnessScript: script}
+	pkScript, err := utxo.PkScript(testNet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := *wire.NewOutPoint(&chainhash.Hash{9}, 0)
+	b.prevouts[op] = wire.NewTxOut(1000000, pkScript)
+	return MultisigInput{Txid: op.Hash.String(), Vout: op.Index, Amount: 1000000, WitnessScript: hex.EncodeToString(script)}
+}
+
+// signPsbt adds the partial signatures of key, as a participant would return the PSBT
+func signPsbt(t *testing.T, encoded string, key *btcec.PrivateKey) string {
+	p, err := wallet.DecodePsbt(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := txscript.NewTxSigHashes(p.UnsignedTx)
+	for i, in := range p.Inputs {
+		sig, err := txscript.RawTxInWitnessSignature(p.UnsignedTx, hashes, i, in.WitnessUtxo.Value, in.WitnessScript, txscript.SigHashAll, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Inputs[i].PartialSigs = []*psbt.PartialSig{{PubKey: key.PubKey().SerializeCompressed(), Signature: sig}}
+	}
+	signed, err := p.B64Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// TestFundMultisigConcurrentSign checks signatures sent at the same time are all kept, the
+//   threshold is reached and the transaction broadcast once
+func TestFundMultisigConcurrentSign(t *testing.T) {
+	l, b := setup(t, nil, "peer1", "peer2")
+	chans := []glightning.FundChannelStart{{Id: "peer1", Amount: 300000}, {Id: "peer2", Amount: 200000}}
+	result, err := createMultisig(&chans, []MultisigInput{multisigInput(t, b)}, b.address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := result.(*multisigStatus)
+
+	var wg sync.WaitGroup
+	results := make([]*multisigStatus, 2)
+	errs := make([]error, 2)
+	for i := range results {
+		signed := signPsbt(t, status.Psbt, multisigKey(byte(i+1)))
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r, err := signMultisig(signed)
+			if err == nil {
+				results[i] = r.(*multisigStatus)
+			}
+			errs[i] = err
+		}(i)
+	}
+	wg.Wait()
+
+	txids := 0
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("sign %d: %s", i, err.Error())
+		}
+		if results[i].Txid != "" {
+			txids++
+		}
+	}
+	if txids != 1 || len(b.broadcast) != 1 {
+		t.Fatalf("want one broadcast, have %d results with a txid and %d broadcast", txids, len(b.broadcast))
+	}
+	if len(l.pending()) != 0 {
+		t.Errorf("want every channel completed, have %v pending", l.pending())
+	}
+	sessions, _ := fundr.Sessions()
+	if len(sessions.List()) != 0 {
+		t.Error("the session should be removed once broadcast")
+	}
+}
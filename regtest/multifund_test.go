@@ -0,0 +1,266 @@
+//go:build regtest
+// +build regtest
+
+// Package regtest runs the plugin in lightningd against a local regtest bitcoind
+//   go test -tags regtest ./regtest
+// the binaries are found on the path or set with BITCOIND, BITCOIN_CLI and LIGHTNINGD
+package regtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/rsbondi/multifund/wallet"
+)
+
+const CHANNEL_NORMAL = "CHANNELD_NORMAL"
+
+// blocks mined after a funding so every channel is locked in
+const FUNDING_DEPTH = 6
+
+var (
+	baseDir  string
+	plugin   string
+	bitcoind *bitcoinNode
+	alice    *lightningNode // the node funding every channel
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(run(m))
+}
+
+// run sets up bitcoind and the funding node, the directory is kept when a test fails
+func run(m *testing.M) int {
+	if bin := missingBinary(); bin != "" {
+		fmt.Printf("skipping regtest suite, %s not found\n", bin)
+		return 0
+	}
+	var err error
+	if baseDir, err = ioutil.TempDir("", "multifund-regtest"); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	code := setupAndRun(m)
+	if code == 0 {
+		os.RemoveAll(baseDir)
+	} else {
+		fmt.Printf("node directories and logs are in %s\n", baseDir)
+	}
+	return code
+}
+
+func setupAndRun(m *testing.M) int {
+	plugin = filepath.Join(baseDir, "multifund")
+	build := exec.Command("go", "build", "-o", plugin, "..")
+	if out, err := build.CombinedOutput(); err != nil {
+		fmt.Printf("unable to build the plugin: %s\n%s", err.Error(), out)
+		return 1
+	}
+
+	var err error
+	if bitcoind, err = startBitcoind(filepath.Join(baseDir, "bitcoin")); err != nil {
+		fmt.Printf("unable to start bitcoind: %s\n", err.Error())
+		return 1
+	}
+	defer bitcoind.stop()
+	if err := bitcoind.mine(101); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	// the plugin builds the transactions itself unless MULTIFUND_NATIVE=auto, lightningd then broadcasts
+	native := os.Getenv("MULTIFUND_NATIVE")
+	if native == "" {
+		native = "off"
+	}
+	args := []string{"--multi-wallet=internal", "--multi-native=" + native}
+	if native != "off" {
+		args = append(args, "--multi-broadcast=lightning")
+	}
+	if alice, err = startLightningd(baseDir, "alice", plugin, bitcoind, args...); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer alice.stop()
+	for _, btc := range []string{"0.5", "0.5"} {
+		if err := alice.fund(bitcoind, btc); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+	return m.Run()
+}
+
+// newPeer starts a node to open a channel with, stopped when the test ends
+func newPeer(t *testing.T, name string) *lightningNode {
+	n, err := startLightningd(baseDir, name, plugin, bitcoind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.stop)
+	return n
+}
+
+func connectPeers(t *testing.T, peers ...*lightningNode) {
+	for _, p := range peers {
+		if err := alice.connect(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// confirm mines the funding transaction and waits for every channel to be usable
+func confirm(t *testing.T, txid string, peers ...*lightningNode) {
+	if err := bitcoind.rpc("getmempoolentry", []interface{}{txid}, nil); err != nil {
+		t.Fatalf("funding transaction %s is not in the mempool: %s", txid, err.Error())
+	}
+	if err := bitcoind.mine(FUNDING_DEPTH); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range append(peers, alice) {
+		if err := n.sync(bitcoind); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := alice.waitState(CHANNEL_NORMAL, peers...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type fundResult struct {
+	Tx          string   `json:"tx"`
+	Txid        string   `json:"txid"`
+	Channels    []string `json:"channels"`
+	Connections []struct {
+		Id        string `json:"id"`
+		Connected bool   `json:"connected"`
+		Error     string `json:"error"`
+	} `json:"connections"`
+}
+
+func channel(n *lightningNode, sat uint64) map[string]interface{} {
+	return map[string]interface{}{"id": n.id, "satoshi": sat, "announce": true}
+}
+
+func TestFundMulti(t *testing.T) {
+	bob, carol := newPeer(t, "bob"), newPeer(t, "carol")
+	connectPeers(t, bob, carol)
+
+	result := fundResult{}
+	err := alice.rpc("fund_multi", map[string]interface{}{
+		"channels": []map[string]interface{}{channel(bob, 100000), channel(carol, 200000)},
+	}, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Channels) != 2 {
+		t.Errorf("want 2 channels, have %v", result.Channels)
+	}
+	confirm(t, result.Txid, bob, carol)
+}
+
+func TestConnectFundMulti(t *testing.T) {
+	dave, erin := newPeer(t, "dave"), newPeer(t, "erin")
+
+	result := fundResult{}
+	err := alice.rpc("connect_fund_multi", map[string]interface{}{
+		"channels": []map[string]interface{}{
+			{"id": dave.id + "@127.0.0.1:" + strconv.Itoa(dave.port), "satoshi": 100000, "announce": true},
+			{"id": erin.id, "host": "127.0.0.1", "port": erin.port, "satoshi": 100000, "announce": true},
+		},
+	}, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range result.Connections {
+		if !c.Connected {
+			t.Errorf("%s should be connected: %s", c.Id, c.Error)
+		}
+	}
+	confirm(t, result.Txid, dave, erin)
+}
+
+func TestFundExternal(t *testing.T) {
+	frank, grace := newPeer(t, "frank"), newPeer(t, "grace")
+	connectPeers(t, frank, grace)
+
+	addresses := make([]string, 0)
+	err := alice.rpc("fund_multi_start", map[string]interface{}{
+		"channels": []map[string]interface{}{channel(frank, 100000), channel(grace, 100000)},
+	}, &addresses)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// bitcoind is the external wallet
+	outputs := make([]map[string]json.Number, 0)
+	for _, a := range addresses {
+		outputs = append(outputs, map[string]json.Number{a: json.Number(wallet.Amount(100000).Btc())})
+	}
+	funded := struct {
+		Psbt string `json:"psbt"`
+	}{}
+	if err := bitcoind.rpc("walletcreatefundedpsbt", []interface{}{[]interface{}{}, outputs}, &funded); err != nil {
+		t.Fatal(err)
+	}
+	if err := bitcoind.rpc("walletprocesspsbt", []interface{}{funded.Psbt}, &funded); err != nil {
+		t.Fatal(err)
+	}
+	final := struct {
+		Hex      string `json:"hex"`
+		Complete bool   `json:"complete"`
+	}{}
+	if err := bitcoind.rpc("finalizepsbt", []interface{}{funded.Psbt}, &final); err != nil || !final.Complete {
+		t.Fatalf("unable to sign the funding transaction: %v", err)
+	}
+
+	result := fundResult{}
+	if err := alice.rpc("fund_multi_complete", map[string]interface{}{"tx": final.Hex}, &result); err != nil {
+		t.Fatal(err)
+	}
+	confirm(t, result.Txid, frank, grace)
+}
+
+func TestWithdrawMulti(t *testing.T) {
+	first, err := bitcoind.newAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := bitcoind.newAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := struct {
+		Txid string `json:"txid"`
+	}{}
+	err = alice.rpc("withdraw_multi", map[string]interface{}{
+		"destinations": []map[string]interface{}{
+			{"destination": first, "satoshi": 50000},
+			{"destination": second, "satoshi": "0.0007btc"},
+		},
+	}, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bitcoind.mine(1); err != nil {
+		t.Fatal(err)
+	}
+
+	for addr, want := range map[string]wallet.Amount{first: 50000, second: 70000} {
+		var received json.Number
+		if err := bitcoind.rpc("getreceivedbyaddress", []interface{}{addr, 1}, &received); err != nil {
+			t.Fatal(err)
+		}
+		if amt, err := wallet.BtcAmount(received); err != nil || amt != want {
+			t.Errorf("%s should receive %s, have %s btc", addr, want, received)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+//go:build regtest
+// +build regtest
+
+package regtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	RPC_USER     = "multifund"
+	RPC_PASSWORD = "multifund"
+)
+
+// how long to wait for a node to start, sync or reach a channel state
+const WAIT_TIMEOUT = 60 * time.Second
+
+// binaries, set the environment to test another release
+var (
+	bitcoindBin   = binary("BITCOIND", "bitcoind")
+	bitcoinCliBin = binary("BITCOIN_CLI", "bitcoin-cli")
+	lightningdBin = binary("LIGHTNINGD", "lightningd")
+)
+
+func binary(env, name string) string {
+	if path := os.Getenv(env); path != "" {
+		return path
+	}
+	return name
+}
+
+// missingBinary is the first binary that can not be found, empty when all are available
+func missingBinary() string {
+	for _, bin := range []string{bitcoindBin, bitcoinCliBin, lightningdBin, "go"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			return bin
+		}
+	}
+	return ""
+}
+
+// freePort asks the os for a port nothing is listening on
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// waitFor polls until done is true or returns an error, the last error is reported on timeout
+func waitFor(what string, done func() (bool, error)) error {
+	deadline := time.Now().Add(WAIT_TIMEOUT)
+	var last error
+	for time.Now().Before(deadline) {
+		ok, err := done()
+		if ok {
+			return nil
+		}
+		last = err
+		time.Sleep(250 * time.Millisecond)
+	}
+	if last != nil {
+		return fmt.Errorf("timed out waiting for %s: %s", what, last.Error())
+	}
+	return fmt.Errorf("timed out waiting for %s", what)
+}
+
+// stopProcess waits for a process asked to stop, killing it when it does not
+func stopProcess(cmd *exec.Cmd) {
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		<-done
+	}
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+}
+
+func (r *rpcResponse) decode(method string, result interface{}) error {
+	if r.Error != nil {
+		return fmt.Errorf("%s: %s (%d)", method, r.Error.Message, r.Error.Code)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(r.Result, result)
+}
+
+// bitcoinNode is a regtest bitcoind with a wallet for funding and mining
+type bitcoinNode struct {
+	dir  string
+	port int
+	cmd  *exec.Cmd
+}
+
+func startBitcoind(dir string) (*bitcoinNode, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	rpcport, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	p2pport, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	b := &bitcoinNode{dir: dir, port: rpcport}
+	b.cmd = exec.Command(bitcoindBin,
+		"-regtest",
+		"-datadir="+dir,
+		"-server",
+		"-txindex",
+		"-fallbackfee=0.00001",
+		"-rpcuser="+RPC_USER,
+		"-rpcpassword="+RPC_PASSWORD,
+		"-rpcport="+strconv.Itoa(rpcport),
+		"-port="+strconv.Itoa(p2pport),
+	)
+	if err := b.cmd.Start(); err != nil {
+		return nil, err
+	}
+	err = waitFor("bitcoind", func() (bool, error) {
+		err := b.rpc("getblockchaininfo", nil, nil)
+		return err == nil, err
+	})
+	if err != nil {
+		b.stop()
+		return nil, err
+	}
+	// releases since 0.21 start without a wallet
+	wallets := make([]string, 0)
+	if err := b.rpc("listwallets", nil, &wallets); err == nil && len(wallets) == 0 {
+		if err := b.rpc("createwallet", []interface{}{"multifund"}, nil); err != nil {
+			b.stop()
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func (b *bitcoinNode) rpc(method string, params []interface{}, result interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	body, err := json.Marshal(map[string]interface{}{"jsonrpc": "1.0", "id": method, "method": method, "params": params})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://127.0.0.1:%d", b.port), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(RPC_USER, RPC_PASSWORD)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	resp := rpcResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return fmt.Errorf("%s: %s", method, res.Status)
+	}
+	return resp.decode(method, result)
+}
+
+func (b *bitcoinNode) stop() {
+	b.rpc("stop", nil, nil)
+	stopProcess(b.cmd)
+}
+
+func (b *bitcoinNode) newAddress() (string, error) {
+	addr := ""
+	err := b.rpc("getnewaddress", nil, &addr)
+	return addr, err
+}
+
+func (b *bitcoinNode) height() (uint32, error) {
+	var height uint32
+	err := b.rpc("getblockcount", nil, &height)
+	return height, err
+}
+
+// mine generates blocks to the wallet
+func (b *bitcoinNode) mine(blocks int) error {
+	addr, err := b.newAddress()
+	if err != nil {
+		return err
+	}
+	return b.rpc("generatetoaddress", []interface{}{blocks, addr}, nil)
+}
+
+// send pays btc, a decimal string, to the address and returns the txid
+func (b *bitcoinNode) send(address, btc string) (string, error) {
+	txid := ""
+	err := b.rpc("sendtoaddress", []interface{}{address, json.Number(btc)}, &txid)
+	return txid, err
+}
+
+// lightningNode is a regtest lightningd with the plugin loaded
+type lightningNode struct {
+	name string
+	dir  string
+	port int
+	id   string
+	cmd  *exec.Cmd
+}
+
+// startLightningd starts a node using bitcoind for its chain, options are added to the command line
+func startLightningd(dir, name, plugin string, bitcoind *bitcoinNode, options ...string) (*lightningNode, error) {
+	n := &lightningNode{name: name, dir: filepath.Join(dir, name)}
+	if err := os.MkdirAll(n.dir, 0700); err != nil {
+		return nil, err
+	}
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	n.port = port
+	args := []string{
+		"--lightning-dir=" + n.dir,
+		"--network=regtest",
+		"--bitcoin-cli=" + bitcoinCliBin,
+		"--bitcoin-datadir=" + bitcoind.dir,
+		"--bitcoin-rpcuser=" + RPC_USER,
+		"--bitcoin-rpcpassword=" + RPC_PASSWORD,
+		"--bitcoin-rpcport=" + strconv.Itoa(bitcoind.port),
+		"--addr=127.0.0.1:" + strconv.Itoa(port),
+		"--log-level=debug",
+		"--log-file=" + filepath.Join(n.dir, "log"),
+		"--plugin=" + plugin,
+	}
+	n.cmd = exec.Command(lightningdBin, append(args, options...)...)
+	if err := n.cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	info := struct {
+		Id string `json:"id"`
+	}{}
+	err = waitFor(name+" to start", func() (bool, error) {
+		err := n.rpc("getinfo", nil, &info)
+		return err == nil, err
+	})
+	if err != nil {
+		n.stop()
+		return nil, fmt.Errorf("%s, see %s: %s", name, filepath.Join(n.dir, "log"), err.Error())
+	}
+	n.id = info.Id
+	return n, nil
+}
+
+// rpc calls lightningd over its unix socket, params are by name
+func (n *lightningNode) rpc(method string, params map[string]interface{}, result interface{}) error {
+	if params == nil {
+		params = map[string]interface{}{}
+	}
+	conn, err := net.Dial("unix", filepath.Join(n.dir, "regtest", "lightning-rpc"))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	req := map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": method, "params": params}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return err
+	}
+	resp := rpcResponse{}
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return err
+	}
+	return resp.decode(method, result)
+}
+
+func (n *lightningNode) stop() {
+	n.rpc("stop", nil, nil)
+	stopProcess(n.cmd)
+}
+
+func (n *lightningNode) connect(peer *lightningNode) error {
+	return n.rpc("connect", map[string]interface{}{"id": peer.id, "host": "127.0.0.1", "port": peer.port}, nil)
+}
+
+// sync waits for the node to reach bitcoind's height
+func (n *lightningNode) sync(b *bitcoinNode) error {
+	return waitFor(n.name+" to sync", func() (bool, error) {
+		height, err := b.height()
+		if err != nil {
+			return false, err
+		}
+		info := struct {
+			BlockHeight uint32 `json:"blockheight"`
+		}{}
+		if err := n.rpc("getinfo", nil, &info); err != nil {
+			return false, err
+		}
+		return info.BlockHeight == height, nil
+	})
+}
+
+// fund sends btc from bitcoind to the node's wallet and waits for the node to see it confirmed
+func (n *lightningNode) fund(b *bitcoinNode, btc string) error {
+	addr := struct {
+		Bech32 string `json:"bech32"`
+	}{}
+	if err := n.rpc("newaddr", map[string]interface{}{"addresstype": "bech32"}, &addr); err != nil {
+		return err
+	}
+	if _, err := b.send(addr.Bech32, btc); err != nil {
+		return err
+	}
+	if err := b.mine(1); err != nil {
+		return err
+	}
+	return waitFor(n.name+" funds", func() (bool, error) {
+		funds := struct {
+			Outputs []struct {
+				Address string `json:"address"`
+				Status  string `json:"status"`
+			} `json:"outputs"`
+		}{}
+		if err := n.rpc("listfunds", nil, &funds); err != nil {
+			return false, err
+		}
+		for _, o := range funds.Outputs {
+			if o.Address == addr.Bech32 && o.Status == "confirmed" {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+}
+
+type channelInfo struct {
+	PeerId string `json:"peer_id"`
+	State  string `json:"state"`
+}
+
+// channelStates are the states of the channels with the peer, from listpeerchannels when lightningd
+//   has it, otherwise from listpeers
+func (n *lightningNode) channelStates(peer string) ([]string, error) {
+	channels := struct {
+		Channels []channelInfo `json:"channels"`
+	}{}
+	err := n.rpc("listpeerchannels", map[string]interface{}{"id": peer}, &channels)
+	if err != nil {
+		peers := struct {
+			Peers []struct {
+				Channels []channelInfo `json:"channels"`
+			} `json:"peers"`
+		}{}
+		if err := n.rpc("listpeers", map[string]interface{}{"id": peer}, &peers); err != nil {
+			return nil, err
+		}
+		for _, p := range peers.Peers {
+			channels.Channels = append(channels.Channels, p.Channels...)
+		}
+	}
+	states := make([]string, 0)
+	for _, c := range channels.Channels {
+		states = append(states, c.State)
+	}
+	return states, nil
+}
+
+// waitState waits until the node has a channel with each peer in the state
+func (n *lightningNode) waitState(state string, peers ...*lightningNode) error {
+	for _, p := range peers {
+		var have []string
+		err := waitFor(fmt.Sprintf("%s channel with %s to be %s", n.name, p.name, state), func() (bool, error) {
+			var err error
+			if have, err = n.channelStates(p.id); err != nil {
+				return false, err
+			}
+			for _, s := range have {
+				if s == state {
+					return true, nil
+				}
+			}
+			return false, errors.New(fmt.Sprint(have))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/niftynei/glightning/jrpc2"
+	"github.com/rsbondi/multifund/funder"
+	"github.com/rsbondi/multifund/logger"
+)
+
+const FundScheduleDescription = `Schedule opening multiple channels in a single transaction once fees are low
+{channels} is an array of object{"id" string, "host" string, "port" int, "satoshi" int, "announce" bool, "label" string}
+{feerate} is the most to pay in sat/vbyte, the channels are opened when the estimate is at or below it
+{deadline} opens the channels regardless of fees, unix seconds or a duration from now, ex. 48h
+peers are reconnected right before the channels are opened`
+
+// held while a scheduled funding runs so it is not removed mid funding
+var scheduleMu sync.Mutex
+
+type MultiChannelSchedule struct {
+	Channels []ConnectAndFundChannelRequest `json:"channels"`
+	FeeRate  uint64                         `json:"feerate"`
+	Deadline string                         `json:"deadline,omitempty"`
+}
+
+func (m *MultiChannelSchedule) Call() (jrpc2.Result, error) {
+	if m.FeeRate == 0 && m.Deadline == "" {
+		return nil, fmt.Errorf("feerate or deadline required")
+	}
+	deadline, err := parseDeadline(m.Deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	channels := make([]funder.ScheduledChannel, 0)
+	for _, c := range m.Channels {
+		channels = append(channels, funder.ScheduledChannel{
+			Id:             c.Id,
+			Host:           c.Host,
+			Port:           uint(c.Port),
+			Amount:         c.Amount,
+			FeeRate:        c.FeeRate,
+			Announce:       c.Announce,
+			ChannelOptions: c.ChannelOptions,
+			Label:          c.Label,
+		})
+	}
+
+	schedule, err := fundr.Schedule()
+	if err != nil {
+		return nil, err
+	}
+	return schedule.Add(channels, m.FeeRate, deadline)
+}
+
+func (m *MultiChannelSchedule) Name() string {
+	return "fund_multi_schedule"
+}
+
+func (m *MultiChannelSchedule) New() interface{} {
+	return &MultiChannelSchedule{}
+}
+
+// parseDeadline accepts unix seconds or a duration from now
+func parseDeadline(deadline string) (int64, error) {
+	if deadline == "" {
+		return 0, nil
+	}
+	if n, err := strconv.ParseInt(deadline, 10, 64); err == nil {
+		return n, nil
+	}
+	d, err := time.ParseDuration(deadline)
+	if err != nil {
+		return 0, fmt.Errorf("invalid deadline %s, use unix seconds or a duration", deadline)
+	}
+	return time.Now().Add(d).Unix(), nil
+}
+
+type MultiChannelScheduleList struct {
+	Status string `json:"status,omitempty"`
+}
+
+func (m *MultiChannelScheduleList) Call() (jrpc2.Result, error) {
+	schedule, err := fundr.Schedule()
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		Scheduled []*funder.ScheduledFunding `json:"scheduled"`
+	}{schedule.List(m.Status)}, nil
+}
+
+func (m *MultiChannelScheduleList) Name() string {
+	return "fund_multi_schedule_list"
+}
+
+func (m *MultiChannelScheduleList) New() interface{} {
+	return &MultiChannelScheduleList{}
+}
+
+type MultiChannelScheduleCancel struct {
+	Id string `json:"id"`
+}
+
+func (m *MultiChannelScheduleCancel) Call() (jrpc2.Result, error) {
+	schedule, err := fundr.Schedule()
+	if err != nil {
+		return nil, err
+	}
+	scheduleMu.Lock()
+	defer scheduleMu.Unlock()
+	if err := schedule.Remove(m.Id); err != nil {
+		return nil, err
+	}
+	return struct {
+		Removed string `json:"removed"`
+	}{m.Id}, nil
+}
+
+func (m *MultiChannelScheduleCancel) Name() string {
+	return "fund_multi_schedule_cancel"
+}
+
+func (m *MultiChannelScheduleCancel) New() interface{} {
+	return &MultiChannelScheduleCancel{}
+}
+
+// runFundSchedule checks scheduled fundings every interval against the current fee rate
+func runFundSchedule(interval time.Duration) {
+	for range time.Tick(interval) {
+		runScheduled()
+	}
+}
+
+func runScheduled() {
+	scheduleMu.Lock()
+	defer scheduleMu.Unlock()
+
+	schedule, err := fundr.Schedule()
+	if err != nil {
+		logger.Errorf("unable to load fund schedule: %s", err.Error())
+		return
+	}
+	waiting := schedule.List(funder.SCHEDULE_WAITING)
+	if len(waiting) == 0 {
+		return
+	}
+
+	rate, err := fundr.EstimateSatsPerVbyte()
+	if err != nil {
+		logger.Warnf("no fee estimate, only fundings past their deadline run: %s", err.Error())
+	}
+	now := time.Now()
+	for _, sf := range waiting {
+		if !sf.Ready(rate, now) {
+			continue
+		}
+
+		chans := make([]ConnectAndFundChannelRequest, 0)
+		for _, c := range sf.Channels {
+			chans = append(chans, ConnectAndFundChannelRequest{
+				Id:             c.Id,
+				Host:           c.Host,
+				Port:           float64(c.Port),
+				Amount:         c.Amount,
+				FeeRate:        c.FeeRate,
+				Announce:       c.Announce,
+				ChannelOptions: c.ChannelOptions,
+				Label:          c.Label,
+			})
+		}
+
+		txid := ""
+		log := logger.NewTrace()
+		result, err := connectAndCreateMulti(&chans, log)
+		if err != nil {
+			log.Warnf("scheduled funding %s failed: %s", sf.Id, err.Error())
+		} else {
+			txid = result.Txid
+			log.Infof("scheduled funding %s opened %d channels in %s at %d sat/vbyte", sf.Id, len(chans), txid, rate)
+		}
+		if err := schedule.Complete(sf.Id, txid, err); err != nil {
+			log.Errorf("unable to update fund schedule: %s", err.Error())
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/niftynei/glightning/jrpc2"
+	"github.com/rsbondi/multifund/funder"
+	"github.com/rsbondi/multifund/logger"
+)
+
+const MultiFundStatusDescription = `Show the state of funding batches, all batches or the one for {txid}
+includes mempool or confirmation state of the transaction and the state of each channel from listpeers`
+
+type MultiFundStatus struct {
+	Txid string `json:"txid,omitempty"`
+}
+
+func (m *MultiFundStatus) Call() (jrpc2.Result, error) {
+	batches, err := fundr.BatchStatus(m.Txid)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		Batches []*funder.BatchStatus `json:"batches"`
+	}{batches}, nil
+}
+
+func (m *MultiFundStatus) Name() string {
+	return "multifund_status"
+}
+
+func (m *MultiFundStatus) New() interface{} {
+	return &MultiFundStatus{}
+}
+
+// custom notification topic, declared to lightningd so other plugins can subscribe
+const BATCH_NOTIFICATION = "multifund_batch"
+
+// BatchNotification is sent to plugins subscribed to multifund_batch on each batch event
+type BatchNotification struct {
+	Event    string                `json:"event"`
+	Txid     string                `json:"txid"`
+	Channels []funder.BatchChannel `json:"channels"`
+	Trace    string                `json:"trace,omitempty"`
+}
+
+func (n *BatchNotification) Name() string {
+	return BATCH_NOTIFICATION
+}
+
+// sendNotification hands a notification to lightningd, tests replace it
+var sendNotification = func(n jrpc2.Method) error {
+	return plugin.Notify(n)
+}
+
+// notifyBatch sends the batch event to subscribed plugins and logs it under the trace of the
+//   command that funded the batch
+func notifyBatch(event string, b *funder.Batch) {
+	log := logger.WithTrace(b.Trace)
+	switch event {
+	case funder.BATCH_CONFIRMED:
+		log.Infof("funding transaction %s confirmed for %d channels", b.Txid, len(b.Channels))
+	case funder.BATCH_NORMAL:
+		log.Infof("all %d channels funded by %s are CHANNELD_NORMAL", len(b.Channels), b.Txid)
+	}
+	if err := sendNotification(&BatchNotification{Event: event, Txid: b.Txid, Channels: b.Channels, Trace: b.Trace}); err != nil {
+		log.Warnf("unable to send %s notification for %s: %s", event, b.Txid, err.Error())
+	}
+}
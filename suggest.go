@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/niftynei/glightning/jrpc2"
+	"github.com/rsbondi/multifund/funder"
+	"github.com/rsbondi/multifund/logger"
+)
+
+const FundSuggestDescription = `Suggest peers for a batch of channels from gossip, scored by capacity, centrality, fees and uptime
+{budget} is the total satoshi to spread across {count} channels, in proportion to the score
+existing peers are excluded, set {execute} to connect and open the channels with connect_fund_multi`
+
+type MultiChannelSuggest struct {
+	Budget  uint64 `json:"budget"`
+	Count   int    `json:"count"`
+	Execute bool   `json:"execute,omitempty"`
+}
+
+func (m *MultiChannelSuggest) Call() (jrpc2.Result, error) {
+	suggestions, err := fundr.Suggest(m.Budget, m.Count)
+	if err != nil {
+		return nil, err
+	}
+	if !m.Execute {
+		return struct {
+			Suggestions []*funder.Suggestion `json:"suggestions"`
+		}{suggestions}, nil
+	}
+
+	chans := make([]ConnectAndFundChannelRequest, 0)
+	for _, s := range suggestions {
+		chans = append(chans, ConnectAndFundChannelRequest{
+			Id:       s.Id,
+			Amount:   s.Amount,
+			Announce: true,
+		})
+	}
+	log := logger.NewTrace()
+	result, err := connectAndCreateMulti(&chans, log)
+	if err != nil {
+		log.Warnf("fund_multi_suggest failed: %s", err.Error())
+		return nil, err
+	}
+	return struct {
+		Suggestions []*funder.Suggestion `json:"suggestions"`
+		*FundResult
+	}{suggestions, result}, nil
+}
+
+func (m *MultiChannelSuggest) Name() string {
+	return "fund_multi_suggest"
+}
+
+func (m *MultiChannelSuggest) New() interface{} {
+	return &MultiChannelSuggest{}
+}
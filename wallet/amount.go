@@ -0,0 +1,163 @@
+package wallet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+const SATOSHI_PER_BTC = 100000000
+
+// Amount is a whole number of satoshi, on chain amounts are never fractional so keeping
+//   them as integers avoids the rounding of converting BTC floats
+type Amount uint64
+
+// the most satoshi there can ever be, any amount above is an overflow
+const MAX_SATOSHI = Amount(21000000 * SATOSHI_PER_BTC)
+
+var ErrAmountOverflow = errors.New("amount is more than 21 million bitcoin")
+
+var satPerBtc = big.NewRat(SATOSHI_PER_BTC, 1)
+
+// ParseAmount reads an amount the way lightningd does, 100000sat, 1000msat, 0.01btc
+//   or a bare number of satoshi, msat must be whole satoshi
+func ParseAmount(s string) (Amount, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	switch {
+	case strings.HasSuffix(s, "msat"):
+		msat, err := strconv.ParseUint(strings.TrimSuffix(s, "msat"), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid amount %s", s)
+		}
+		if msat%1000 != 0 {
+			return 0, fmt.Errorf("%s is not a whole satoshi", s)
+		}
+		return checkAmount(msat / 1000)
+	case strings.HasSuffix(s, "btc"):
+		return ParseBtc(strings.TrimSuffix(s, "btc"))
+	}
+	sat, err := strconv.ParseUint(strings.TrimSuffix(s, "sat"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %s, use sat, msat or btc", s)
+	}
+	return checkAmount(sat)
+}
+
+// ParseBtc converts a decimal BTC value exactly, as bitcoind and electrum provide them
+func ParseBtc(s string) (Amount, error) {
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok || strings.Contains(s, "/") {
+		return 0, fmt.Errorf("invalid btc amount %s", s)
+	}
+	if r.Sign() < 0 {
+		return 0, fmt.Errorf("negative btc amount %s", s)
+	}
+	r.Mul(r, satPerBtc)
+	if !r.IsInt() {
+		return 0, fmt.Errorf("%s btc is not a whole satoshi", s)
+	}
+	if !r.Num().IsUint64() {
+		return 0, ErrAmountOverflow
+	}
+	return checkAmount(r.Num().Uint64())
+}
+
+// BtcAmount is ParseBtc for a number read from json
+func BtcAmount(n json.Number) (Amount, error) {
+	return ParseBtc(n.String())
+}
+
+func checkAmount(sat uint64) (Amount, error) {
+	if Amount(sat) > MAX_SATOSHI {
+		return 0, ErrAmountOverflow
+	}
+	return Amount(sat), nil
+}
+
+// Add fails rather than wrap around or pass the supply limit
+func (a Amount) Add(b Amount) (Amount, error) {
+	if a > MAX_SATOSHI || b > MAX_SATOSHI-a {
+		return 0, ErrAmountOverflow
+	}
+	return a + b, nil
+}
+
+// Sub fails rather than wrap around when b is more than a
+func (a Amount) Sub(b Amount) (Amount, error) {
+	if b > a {
+		return 0, fmt.Errorf("%s is more than %s", b, a)
+	}
+	return a - b, nil
+}
+
+// Mul is for fee rates times sizes
+func (a Amount) Mul(n uint64) (Amount, error) {
+	if n != 0 && a > MAX_SATOSHI/Amount(n) {
+		return 0, ErrAmountOverflow
+	}
+	return a * Amount(n), nil
+}
+
+// Sum adds the amounts with the same checks as Add
+func Sum(amounts ...Amount) (Amount, error) {
+	total := Amount(0)
+	for _, a := range amounts {
+		var err error
+		if total, err = total.Add(a); err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+// Int64 is the amount as used by wire.TxOut
+func (a Amount) Int64() int64 {
+	return int64(a)
+}
+
+func (a Amount) Msat() uint64 {
+	return uint64(a) * 1000
+}
+
+// Btc formats the amount with 8 decimals as bitcoind does
+func (a Amount) Btc() string {
+	return fmt.Sprintf("%d.%08d", a/SATOSHI_PER_BTC, a%SATOSHI_PER_BTC)
+}
+
+func (a Amount) String() string {
+	return fmt.Sprintf("%dsat", uint64(a))
+}
+
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.FormatUint(uint64(a), 10)), nil
+}
+
+// UnmarshalJSON takes a number of satoshi or a string ParseAmount accepts
+func (a *Amount) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		amt, err := ParseAmount(s)
+		if err != nil {
+			return err
+		}
+		*a = amt
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return err
+	}
+	sat, err := strconv.ParseUint(n.String(), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid amount %s, satoshi must be a whole number", n)
+	}
+	amt, err := checkAmount(sat)
+	if err != nil {
+		return err
+	}
+	*a = amt
+	return nil
+}
@@ -0,0 +1,110 @@
+package wallet
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Amount
+		ok   bool
+	}{
+		{"100000", 100000, true},
+		{"100000sat", 100000, true},
+		{"1000msat", 1, true},
+		{"1500msat", 0, false}, // not a whole satoshi
+		{"0.01btc", 1000000, true},
+		{"0.29btc", 29000000, true},
+		{"0.123456789btc", 0, false},
+		{"21000000btc", MAX_SATOSHI, true},
+		{"21000000.00000001btc", 0, false},
+		{"2100000000000001sat", 0, false},
+		{"-1btc", 0, false},
+		{"1/2btc", 0, false},
+		{"-100sat", 0, false},
+		{"1.5sat", 0, false},
+		{"", 0, false},
+		{"sat", 0, false},
+	}
+	for _, tt := range tests {
+		amt, err := ParseAmount(tt.in)
+		if (err == nil) != tt.ok || amt != tt.want {
+			t.Errorf("%s: want %d %v, have %d %v", tt.in, tt.want, tt.ok, amt, err)
+		}
+	}
+}
+
+func TestBtcAmount(t *testing.T) {
+	// each of these is off by one satoshi when multiplied as a float
+	tests := []struct {
+		btc  string
+		want Amount
+	}{
+		{"0.29", 29000000},
+		{"0.57", 57000000},
+		{"1.15", 115000000},
+		{"0.00000001", 1},
+		{"20999999.99999999", MAX_SATOSHI - 1},
+	}
+	for _, tt := range tests {
+		amt, err := BtcAmount(json.Number(tt.btc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if amt != tt.want {
+			t.Errorf("%s btc: want %d, have %d", tt.btc, tt.want, amt)
+		}
+	}
+
+	for amt, want := range map[Amount]string{1: "0.00000001", 29000000: "0.29000000", MAX_SATOSHI: "21000000.00000000"} {
+		if amt.Btc() != want {
+			t.Errorf("%d: want %s, have %s", amt, want, amt.Btc())
+		}
+	}
+}
+
+func TestAmountArithmetic(t *testing.T) {
+	if _, err := MAX_SATOSHI.Add(1); err != ErrAmountOverflow {
+		t.Errorf("want overflow adding to the supply, have %v", err)
+	}
+	if _, err := Amount(^uint64(0)).Add(0); err != ErrAmountOverflow {
+		t.Errorf("want overflow for an amount above the supply, have %v", err)
+	}
+	if _, err := Amount(1).Sub(2); err == nil {
+		t.Error("want error subtracting more than the amount")
+	}
+	if _, err := Amount(1000000).Mul(1 << 40); err != ErrAmountOverflow {
+		t.Errorf("want overflow multiplying, have %v", err)
+	}
+	if a, err := Amount(250).Mul(4); err != nil || a != 1000 {
+		t.Errorf("want 1000, have %d %v", a, err)
+	}
+	if _, err := Sum(MAX_SATOSHI, 1); err != ErrAmountOverflow {
+		t.Errorf("want overflow summing, have %v", err)
+	}
+}
+
+func TestAmountJSON(t *testing.T) {
+	var amounts []Amount
+	if err := json.Unmarshal([]byte(`[100000, "100000sat", "100000000msat", "0.001btc"]`), &amounts); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range amounts {
+		if a != 100000 {
+			t.Errorf("want 100000, have %d", a)
+		}
+	}
+	b, _ := json.Marshal(amounts[0])
+	if string(b) != "100000" {
+		t.Errorf("amounts are written as satoshi, have %s", b)
+	}
+
+	for _, bad := range []string{`1.5`, `-1`, `"1btc2"`, `2100000000000001`, `true`} {
+		var a Amount
+		if err := json.Unmarshal([]byte(bad), &a); err == nil {
+			t.Errorf("%s: want error, have %d", bad, a)
+		}
+	}
+}
@@ -18,6 +18,7 @@ import (
 
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
+	"github.com/rsbondi/multifund/logger"
 )
 
 type BitcoinWallet struct {
@@ -115,13 +116,22 @@ func netmatch(line string, exp string, setme *string) {
 }
 
 type bitcoinUtxo struct {
-	Txid          string  `json:"txid"`
-	Vout          uint32  `json:"vout"`
-	Amount        float64 `json:"amount"`
-	Address       string  `json:"address"`
-	ScriptPubKey  string  `json:"scriptPubKey"`
-	RedeemScript  string  `json:"redeemScript"`
-	Confirmations uint    `json:"confirmations"`
+	Txid          string      `json:"txid"`
+	Vout          uint32      `json:"vout"`
+	Amount        json.Number `json:"amount"`
+	Address       string      `json:"address"`
+	ScriptPubKey  string      `json:"scriptPubKey"`
+	RedeemScript  string      `json:"redeemScript"`
+	Confirmations uint        `json:"confirmations"`
+}
+
+// sats is the exact amount, listunspent never gives an invalid one so 0 is only a precaution
+func (u *bitcoinUtxo) sats() Amount {
+	amt, err := BtcAmount(u.Amount)
+	if err != nil {
+		logger.Errorf("invalid utxo amount %s: %s", u.Amount, err.Error())
+	}
+	return amt
 }
 
 type empty struct{}
@@ -138,10 +148,10 @@ func makeResult(r interface{}) RpcResult {
 type ByAmount []bitcoinUtxo
 
 func (a ByAmount) Len() int           { return len(a) }
-func (a ByAmount) Less(i, j int) bool { return a[i].Amount < a[j].Amount }
+func (a ByAmount) Less(i, j int) bool { return a[i].sats() < a[j].sats() }
 func (a ByAmount) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 
-func (b *BitcoinWallet) Utxos(amt uint64, fee uint64) ([]UTXO, error) {
+func (b *BitcoinWallet) Utxos(amt Amount, fee Amount) ([]UTXO, error) {
 	minconf := uint(3)
 	unspent := make([]bitcoinUtxo, 0)
 	result := makeResult(&unspent)
@@ -149,18 +159,18 @@ func (b *BitcoinWallet) Utxos(amt uint64, fee uint64) ([]UTXO, error) {
 	sort.Sort(ByAmount(unspent))
 	candidates := make([]*bitcoinUtxo, 0)
 	for _, u := range unspent {
-		sats := Satoshis(u.Amount)
+		sats := u.sats()
 
 		// best case, but least likely, no change needed
 		if sats >= amt+fee && sats <= amt+fee+DUST_LIMIT && u.Confirmations > minconf {
 			txid, err := hex.DecodeString(u.Txid)
 			if err != nil {
-				log.Printf("unable to decode txid %s\n", err)
+				logger.Errorf("unable to decode txid %s", err)
 
 			}
 			h, _ := chainhash.NewHash(reverseBytes(txid))
 			o := wire.NewOutPoint(h, u.Vout)
-			utxos := []UTXO{UTXO{Satoshis(u.Amount), u.Address, *o}}
+			utxos := []UTXO{UTXO{u.sats(), u.Address, *o}}
 			return utxos, nil
 		}
 		if sats > amt+fee+DUST_LIMIT && u.Confirmations > minconf {
@@ -170,10 +180,10 @@ func (b *BitcoinWallet) Utxos(amt uint64, fee uint64) ([]UTXO, error) {
 	}
 	if len(candidates) == 0 {
 		// unspent is sorted so grabbing the largest first should give us the least input count to tx
-		sats := uint64(0)
+		sats := Amount(0)
 		for i := len(unspent) - 1; i >= 0; i-- {
 			u := unspent[i]
-			sats += Satoshis(u.Amount)
+			sats += u.sats()
 			candidates = append(candidates, &unspent[i])
 			if sats > amt+fee+DUST_LIMIT && u.Confirmations > minconf {
 				break
@@ -188,24 +198,24 @@ func (b *BitcoinWallet) Utxos(amt uint64, fee uint64) ([]UTXO, error) {
 	for _, c := range candidates {
 		txid, err := hex.DecodeString(c.Txid)
 		if err != nil {
-			log.Printf("unable to decode txid %s\n", err)
+			logger.Errorf("unable to decode txid %s", err)
 
 		}
 		h, err := chainhash.NewHash(reverseBytes(txid))
 		if err != nil {
-			log.Printf("unable to create hash from txid %s\n", err)
+			logger.Errorf("unable to create hash from txid %s", err)
 			return nil, err
 		}
 
 		o := wire.NewOutPoint(h, c.Vout)
 
-		utxos = append(utxos, UTXO{Satoshis(c.Amount), c.Address, *o})
+		utxos = append(utxos, UTXO{c.sats(), c.Address, *o})
 	}
 	return utxos, nil
 }
 
 type EstimateSmartFeeResult struct {
-	Feerate float64 `json:"feerate"`
+	Feerate json.Number `json:"feerate"`
 }
 
 func (b *BitcoinWallet) EstimateSmartFee(target uint) RpcResult {
@@ -284,7 +294,7 @@ func (b *BitcoinWallet) Sign(tx *Transaction, utxos []UTXO) {
 
 	signed, err := hex.DecodeString(raw.Hex)
 	if err != nil {
-		log.Printf("error signing tx: %s", err.Error())
+		logger.Errorf("error signing tx: %s", err.Error())
 
 		return
 	}
@@ -299,12 +309,156 @@ type BitcoinSendResult struct {
 func (b *BitcoinWallet) SendTx(rawtx string) (string, error) {
 	bs := ""
 	result := makeResult(&bs)
-	b.RpcPost("sendrawtransaction", []string{rawtx}, &result)
+	err := b.RpcPost("sendrawtransaction", []string{rawtx}, &result)
+	if err != nil {
+		logger.Errorf("Transaction Send Error: %s", err.Error())
+		return "", err
+	}
 	if result.Error != nil {
-		log.Printf("Transaction Send Error: %s", result.Error.Message)
+		logger.Errorf("Transaction Send Error: %s", result.Error.Message)
 		return "", errors.New(result.Error.Message)
 	}
 
 	return bs, nil
 
 }
+
+// EstimateFeeRate converts estimatesmartfee's BTC/kvbyte to satoshis
+func (b *BitcoinWallet) EstimateFeeRate(target uint) (uint64, error) {
+	fee := EstimateSmartFeeResult{}
+	result := makeResult(&fee)
+	if err := b.RpcPost("estimatesmartfee", []uint{target}, &result); err != nil {
+		return 0, err
+	}
+	return satsPerKvb(fee.Feerate)
+}
+
+type bitcoinTx struct {
+	Txid          string `json:"txid"`
+	Confirmations uint32 `json:"confirmations"`
+	BlockHash     string `json:"blockhash"`
+}
+
+// TxStatus uses getrawtransaction, transactions not in the mempool or wallet need -txindex
+func (b *BitcoinWallet) TxStatus(txid string) (*TxStatus, error) {
+	tx := bitcoinTx{}
+	result := makeResult(&tx)
+	if err := b.RpcPost("getrawtransaction", []interface{}{txid, true}, &result); err != nil {
+		return nil, err
+	}
+	if result.Error != nil {
+		return &TxStatus{Txid: txid}, nil
+	}
+	return &TxStatus{
+		Txid:          txid,
+		Found:         true,
+		Confirmations: tx.Confirmations,
+		BlockHash:     tx.BlockHash,
+	}, nil
+}
+
+type scanUtxo struct {
+	Txid   string      `json:"txid"`
+	Vout   uint32      `json:"vout"`
+	Amount json.Number `json:"amount"`
+}
+
+type scanResult struct {
+	Unspents []scanUtxo `json:"unspents"`
+}
+
+// AddressUtxos scans the utxo set so the address does not need to be in the bitcoind wallet
+func (b *BitcoinWallet) AddressUtxos(address string) ([]UTXO, error) {
+	scan := scanResult{}
+	result := makeResult(&scan)
+	if err := b.RpcPost("scantxoutset", []interface{}{"start", []string{"addr(" + address + ")"}}, &result); err != nil {
+		return nil, err
+	}
+	if result.Error != nil {
+		return nil, errors.New(result.Error.Message)
+	}
+
+	utxos := make([]UTXO, 0)
+	for _, u := range scan.Unspents {
+		h, err := chainhash.NewHashFromStr(u.Txid)
+		if err != nil {
+			return nil, err
+		}
+		amt, err := BtcAmount(u.Amount)
+		if err != nil {
+			return nil, err
+		}
+		utxos = append(utxos, UTXO{amt, address, *wire.NewOutPoint(h, u.Vout)})
+	}
+	return utxos, nil
+}
+
+type bitcoinTxOut struct {
+	Value        json.Number `json:"value"`
+	ScriptPubKey struct {
+		Hex string `json:"hex"`
+	} `json:"scriptPubKey"`
+}
+
+// PrevOut uses gettxout, which only knows unspent outputs, an input spending anything else is invalid anyway
+func (b *BitcoinWallet) PrevOut(op wire.OutPoint) (*wire.TxOut, error) {
+	var out *bitcoinTxOut
+	result := makeResult(&out)
+	if err := b.RpcPost("gettxout", []interface{}{op.Hash.String(), op.Index, true}, &result); err != nil {
+		return nil, err
+	}
+	if result.Error != nil {
+		return nil, errors.New(result.Error.Message)
+	}
+	if out == nil {
+		return nil, nil
+	}
+	script, err := hex.DecodeString(out.ScriptPubKey.Hex)
+	if err != nil {
+		return nil, err
+	}
+	value, err := BtcAmount(out.Value)
+	if err != nil {
+		return nil, err
+	}
+	return wire.NewTxOut(value.Int64(), script), nil
+}
+
+type MempoolAcceptResult struct {
+	Txid         string `json:"txid"`
+	Allowed      bool   `json:"allowed"`
+	RejectReason string `json:"reject-reason"`
+	Vsize        int64  `json:"vsize"`
+	Fees         *struct {
+		Base json.Number `json:"base"`
+	} `json:"fees"`
+}
+
+// TestMempoolAccept asks bitcoind whether it would accept the transaction without broadcasting it
+//   vsize and fees are only provided by bitcoind 0.21 and later, and only when allowed
+func (b *BitcoinWallet) TestMempoolAccept(rawtx string) (*MempoolAcceptResult, error) {
+	accept := make([]MempoolAcceptResult, 0)
+	result := makeResult(&accept)
+	if err := b.RpcPost("testmempoolaccept", []interface{}{[]string{rawtx}}, &result); err != nil {
+		return nil, err
+	}
+	if result.Error != nil {
+		return nil, errors.New(result.Error.Message)
+	}
+	if len(accept) != 1 {
+		return nil, errors.New("unexpected testmempoolaccept result")
+	}
+	return &accept[0], nil
+}
+
+// SetLabel labels an address in the bitcoind wallet
+func (b *BitcoinWallet) SetLabel(address, label string) error {
+	result := makeResult(nil)
+	if err := b.RpcPost("setlabel", []string{address, label}, &result); err != nil {
+		return err
+	}
+	if result.Error != nil {
+		return errors.New(result.Error.Message)
+	}
+	return nil
+}
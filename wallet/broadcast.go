@@ -0,0 +1,146 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil/psbt"
+)
+
+const (
+	BROADCAST_CHAIN     = "chain"
+	BROADCAST_BITCOIN   = "bitcoin"
+	BROADCAST_LIGHTNING = "lightning"
+	BROADCAST_ESPLORA   = "esplora"
+	BROADCAST_NONE      = "none"
+)
+
+// Broadcaster sends signed transactions to the network
+type Broadcaster interface {
+
+	// Broadcast takes a hex encoded signed transaction and returns its txid
+	Broadcast(rawtx string) (string, error)
+}
+
+func (b *BitcoinWallet) Broadcast(rawtx string) (string, error) {
+	return b.SendTx(rawtx)
+}
+
+// LightningBroadcaster hands the transaction to lightningd's sendpsbt, so lightningd's
+//   own bitcoin backend is used and no separate bitcoind access is needed
+type LightningBroadcaster struct {
+	lightning Lightning
+}
+
+func NewLightningBroadcaster(l Lightning) *LightningBroadcaster {
+	return &LightningBroadcaster{lightning: l}
+}
+
+type SendPsbtRequest struct {
+	Psbt string `json:"psbt"`
+}
+
+func (r *SendPsbtRequest) Name() string {
+	return "sendpsbt"
+}
+
+type SendPsbtResult struct {
+	Tx   string `json:"tx"`
+	Txid string `json:"txid"`
+}
+
+func (l *LightningBroadcaster) Broadcast(rawtx string) (string, error) {
+	raw, err := hex.DecodeString(rawtx)
+	if err != nil {
+		return "", err
+	}
+	p, err := PsbtFromSigned(raw)
+	if err != nil {
+		return "", err
+	}
+	encoded, err := p.B64Encode()
+	if err != nil {
+		return "", err
+	}
+
+	result := SendPsbtResult{}
+	if err := l.lightning.Request(&SendPsbtRequest{Psbt: encoded}, &result); err != nil {
+		return "", err
+	}
+	return result.Txid, nil
+}
+
+// PsbtFromSigned wraps a fully signed transaction in a finalized PSBT
+func PsbtFromSigned(raw []byte) (*psbt.Packet, error) {
+	wtx := wire.NewMsgTx(2)
+	if err := wtx.Deserialize(bytes.NewReader(raw)); err != nil {
+		return nil, err
+	}
+
+	unsigned := wtx.Copy()
+	for _, in := range unsigned.TxIn {
+		in.SignatureScript = nil
+		in.Witness = nil
+	}
+	p, err := psbt.NewFromUnsignedTx(unsigned)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, in := range wtx.TxIn {
+		if len(in.Witness) == 0 && len(in.SignatureScript) == 0 {
+			return nil, fmt.Errorf("input %d is not signed", i)
+		}
+		p.Inputs[i].FinalScriptSig = in.SignatureScript
+		if len(in.Witness) > 0 {
+			var w bytes.Buffer
+			if err := writeWitness(&w, in.Witness); err != nil {
+				return nil, err
+			}
+			p.Inputs[i].FinalScriptWitness = w.Bytes()
+		}
+	}
+	return p, nil
+}
+
+// NoBroadcaster never sends the transaction, commands return it for the caller to broadcast
+type NoBroadcaster struct{}
+
+func (n *NoBroadcaster) Broadcast(rawtx string) (string, error) {
+	raw, err := hex.DecodeString(rawtx)
+	if err != nil {
+		return "", err
+	}
+	wtx := wire.NewMsgTx(2)
+	if err := wtx.Deserialize(bytes.NewReader(raw)); err != nil {
+		return "", err
+	}
+	return wtx.TxHash().String(), nil
+}
+
+// NewBroadcaster provides the broadcaster for the multi-broadcast option, by default
+//   transactions go through the chain backend
+func NewBroadcaster(kind string, chain ChainBackend, bitcoin *BitcoinWallet, l Lightning, esploraUrl string) (Broadcaster, error) {
+	switch kind {
+	case "", BROADCAST_CHAIN:
+		return chain, nil
+	case BROADCAST_BITCOIN:
+		if bitcoin == nil {
+			return nil, errors.New("bitcoin broadcast requires bitcoind rpc access")
+		}
+		return bitcoin, nil
+	case BROADCAST_LIGHTNING:
+		return NewLightningBroadcaster(l), nil
+	case BROADCAST_ESPLORA:
+		if esploraUrl == "" {
+			return nil, errors.New("esplora broadcast requires multi-esplora-url")
+		}
+		return NewEsplora(esploraUrl, nil), nil
+	case BROADCAST_NONE:
+		return &NoBroadcaster{}, nil
+	}
+	return nil, fmt.Errorf("unknown broadcaster %s", kind)
+}
@@ -0,0 +1,97 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func signedTestTx() *wire.MsgTx {
+	h := chainhash.HashH([]byte("prev"))
+	tx := wire.NewMsgTx(2)
+	in := wire.NewTxIn(wire.NewOutPoint(&h, 0), nil, wire.TxWitness{[]byte{0x01}, []byte{0x02}})
+	tx.AddTxIn(in)
+	tx.AddTxOut(wire.NewTxOut(1000, []byte{0x00, 0x14}))
+	return tx
+}
+
+func TestEsploraBroadcast(t *testing.T) {
+	tx := signedTestTx()
+	var raw bytes.Buffer
+	tx.Serialize(&raw)
+	rawtx := hex.EncodeToString(raw.Bytes())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/tx" {
+			http.NotFound(w, r)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != rawtx {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("sendrawtransaction RPC error: TX decode failed"))
+			return
+		}
+		w.Write([]byte(tx.TxHash().String()))
+	}))
+	defer server.Close()
+
+	b := NewEsplora(server.URL+"/api/", nil)
+	txid, err := b.Broadcast(rawtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txid != tx.TxHash().String() {
+		t.Errorf("want txid %s, have %s", tx.TxHash().String(), txid)
+	}
+
+	_, err = b.Broadcast("00")
+	if err == nil {
+		t.Error("expected rejected transaction to return an error")
+	}
+}
+
+func TestNoBroadcast(t *testing.T) {
+	tx := signedTestTx()
+	var raw bytes.Buffer
+	tx.Serialize(&raw)
+
+	txid, err := (&NoBroadcaster{}).Broadcast(hex.EncodeToString(raw.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txid != tx.TxHash().String() {
+		t.Errorf("want txid %s, have %s", tx.TxHash().String(), txid)
+	}
+}
+
+func TestPsbtFromSigned(t *testing.T) {
+	tx := signedTestTx()
+	var raw bytes.Buffer
+	tx.Serialize(&raw)
+
+	p, err := PsbtFromSigned(raw.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.UnsignedTx.TxHash() != tx.TxHash() {
+		t.Error("PSBT does not match the signed transaction")
+	}
+	if !IsComplete(p) {
+		t.Error("PSBT inputs should be final")
+	}
+
+	unsigned := tx.Copy()
+	unsigned.TxIn[0].Witness = nil
+	raw.Reset()
+	unsigned.Serialize(&raw)
+	if _, err := PsbtFromSigned(raw.Bytes()); err == nil {
+		t.Error("expected unsigned input to be rejected")
+	}
+}
@@ -0,0 +1,90 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	CHAIN_BITCOIN  = "bitcoin"
+	CHAIN_ESPLORA  = "esplora"
+	CHAIN_ELECTRUM = "electrum"
+)
+
+// ChainBackend is the view of the blockchain used for fees, broadcasting and tracking transactions
+type ChainBackend interface {
+	Broadcaster
+
+	// EstimateFeeRate provides satoshis per kvbyte to confirm within target blocks
+	//   0 when the backend has no estimate
+	EstimateFeeRate(target uint) (uint64, error)
+
+	// TxStatus reports whether a transaction is known and how many confirmations it has
+	TxStatus(txid string) (*TxStatus, error)
+
+	// AddressUtxos lists the unspent outputs paying to an address
+	AddressUtxos(address string) ([]UTXO, error)
+
+	// PrevOut provides the output an input spends, for checking transactions built elsewhere
+	//   nil when the output is not known or already spent
+	PrevOut(op wire.OutPoint) (*wire.TxOut, error)
+}
+
+type TxStatus struct {
+	Txid          string `json:"txid"`
+	Found         bool   `json:"found"`
+	Confirmations uint32 `json:"confirmations"`
+	BlockHeight   uint32 `json:"block_height,omitempty"`
+	BlockHash     string `json:"block_hash,omitempty"`
+}
+
+type ChainConfig struct {
+	Backend        string
+	EsploraUrl     string
+	ElectrumServer string
+	ElectrumTLS    bool
+	Net            *chaincfg.Params
+}
+
+// NewChainBackend provides the backend for the multi-chain-backend option
+func NewChainBackend(cfg *ChainConfig, bitcoin *BitcoinWallet) (ChainBackend, error) {
+	switch cfg.Backend {
+	case "", CHAIN_BITCOIN:
+		if bitcoin == nil {
+			return nil, errors.New("bitcoin chain backend requires bitcoind rpc access")
+		}
+		return bitcoin, nil
+	case CHAIN_ESPLORA:
+		if cfg.EsploraUrl == "" {
+			return nil, errors.New("esplora chain backend requires multi-esplora-url")
+		}
+		return NewEsplora(cfg.EsploraUrl, cfg.Net), nil
+	case CHAIN_ELECTRUM:
+		if cfg.ElectrumServer == "" {
+			return nil, errors.New("electrum chain backend requires multi-electrum-server")
+		}
+		return NewElectrum(cfg.ElectrumServer, cfg.ElectrumTLS, cfg.Net), nil
+	}
+	return nil, fmt.Errorf("unknown chain backend %s", cfg.Backend)
+}
+
+// rawTxOut is output vout of a hex encoded transaction
+func rawTxOut(raw string, vout uint32) (*wire.TxOut, error) {
+	b, err := hex.DecodeString(raw)
+	if err != nil {
+		return nil, err
+	}
+	wtx := wire.NewMsgTx(2)
+	if err := wtx.Deserialize(bytes.NewReader(b)); err != nil {
+		return nil, err
+	}
+	if int(vout) >= len(wtx.TxOut) {
+		return nil, fmt.Errorf("transaction %s has no output %d", wtx.TxHash().String(), vout)
+	}
+	return wtx.TxOut[vout], nil
+}
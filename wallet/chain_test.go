@@ -0,0 +1,189 @@
+package wallet
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// prevTx has two outputs of 1000 and 2000 sat
+func prevTx() (*wire.MsgTx, string) {
+	wtx := wire.NewMsgTx(2)
+	wtx.AddTxIn(wire.NewTxIn(&wire.OutPoint{}, nil, nil))
+	wtx.AddTxOut(wire.NewTxOut(1000, []byte{0x00, 0x14}))
+	wtx.AddTxOut(wire.NewTxOut(2000, []byte{0x00, 0x20}))
+	var buf bytes.Buffer
+	wtx.Serialize(&buf)
+	return wtx, hex.EncodeToString(buf.Bytes())
+}
+
+func TestEsploraChain(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fee-estimates":
+			w.Write([]byte(`{"1": 20.5, "6": 10.0, "144": 1.5}`))
+		case "/blocks/tip/height":
+			w.Write([]byte(`105`))
+		case "/tx/confirmed/status":
+			w.Write([]byte(`{"confirmed": true, "block_height": 100, "block_hash": "abcd"}`))
+		case "/tx/pending/status":
+			w.Write([]byte(`{"confirmed": false}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	e := NewEsplora(server.URL, &chaincfg.RegressionNetParams)
+
+	rate, err := e.EstimateFeeRate(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate != 10000 {
+		t.Errorf("want 10000 sat/kvB, have %d", rate)
+	}
+
+	status, err := e.TxStatus("confirmed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Found || status.Confirmations != 6 || status.BlockHash != "abcd" {
+		t.Errorf("unexpected confirmed status %+v", status)
+	}
+
+	status, err = e.TxStatus("pending")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Found || status.Confirmations != 0 {
+		t.Errorf("unexpected pending status %+v", status)
+	}
+
+	status, err = e.TxStatus("unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Found {
+		t.Error("unknown transaction should not be found")
+	}
+}
+
+func TestEsploraPrevOut(t *testing.T) {
+	wtx, raw := prevTx()
+	txid := wtx.TxHash().String()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/tx/" + txid + "/hex":
+			w.Write([]byte(raw))
+		case "/tx/" + txid + "/outspend/0":
+			w.Write([]byte(`{"spent": true, "txid": "abcd", "vin": 0}`))
+		case "/tx/" + txid + "/outspend/1":
+			w.Write([]byte(`{"spent": false}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	e := NewEsplora(server.URL, &chaincfg.RegressionNetParams)
+
+	hash := wtx.TxHash()
+	if out, err := e.PrevOut(*wire.NewOutPoint(&hash, 1)); err != nil || out == nil || out.Value != 2000 {
+		t.Errorf("want unspent output of 2000, have %v %v", out, err)
+	}
+	if out, err := e.PrevOut(*wire.NewOutPoint(&hash, 0)); err != nil || out != nil {
+		t.Errorf("spent output should be nil, have %v %v", out, err)
+	}
+	if out, err := e.PrevOut(wire.OutPoint{}); err != nil || out != nil {
+		t.Errorf("unknown output should be nil, have %v %v", out, err)
+	}
+}
+
+// serveElectrum answers one request per connection with the result for its method
+func serveElectrum(t *testing.T, results map[string]interface{}) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			line, err := bufio.NewReader(conn).ReadBytes('\n')
+			if err == nil {
+				req := RpcCall{}
+				json.Unmarshal(line, &req)
+				res := map[string]interface{}{"id": req.Id, "jsonrpc": "2.0"}
+				if r, ok := results[req.Method]; ok {
+					res["result"] = r
+				} else {
+					res["error"] = map[string]interface{}{"code": 2, "message": "not found"}
+				}
+				b, _ := json.Marshal(res)
+				conn.Write(append(b, '\n'))
+			}
+			conn.Close()
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().String()
+}
+
+func TestElectrumChain(t *testing.T) {
+	server := serveElectrum(t, map[string]interface{}{
+		"blockchain.estimatefee":           0.0002,
+		"blockchain.transaction.broadcast": "txid",
+	})
+	e := NewElectrum(server, false, &chaincfg.RegressionNetParams)
+
+	rate, err := e.EstimateFeeRate(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate != 20000 {
+		t.Errorf("want 20000 sat/kvB, have %d", rate)
+	}
+
+	txid, err := e.Broadcast("00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txid != "txid" {
+		t.Errorf("want txid, have %s", txid)
+	}
+
+	status, err := e.TxStatus("unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Found {
+		t.Error("unknown transaction should not be found")
+	}
+}
+
+func TestElectrumPrevOut(t *testing.T) {
+	wtx, raw := prevTx()
+	server := serveElectrum(t, map[string]interface{}{
+		"blockchain.transaction.get":        raw,
+		"blockchain.scripthash.listunspent": []map[string]interface{}{{"tx_hash": wtx.TxHash().String(), "tx_pos": 1, "value": 2000}},
+	})
+	e := NewElectrum(server, false, &chaincfg.RegressionNetParams)
+
+	hash := wtx.TxHash()
+	if out, err := e.PrevOut(*wire.NewOutPoint(&hash, 1)); err != nil || out == nil || out.Value != 2000 {
+		t.Errorf("want unspent output of 2000, have %v %v", out, err)
+	}
+	if out, err := e.PrevOut(*wire.NewOutPoint(&hash, 0)); err != nil || out != nil {
+		t.Errorf("spent output should be nil, have %v %v", out, err)
+	}
+}
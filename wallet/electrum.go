@@ -0,0 +1,211 @@
+package wallet
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+// Electrum talks the electrum protocol, newline delimited json-rpc over tcp or tls
+//   a connection is made for each call, calls are infrequent and this avoids keepalive handling
+type Electrum struct {
+	server string
+	tls    bool
+	net    *chaincfg.Params
+	mu     sync.Mutex
+	id     int
+}
+
+func NewElectrum(server string, useTLS bool, net *chaincfg.Params) *Electrum {
+	return &Electrum{
+		server: server,
+		tls:    useTLS,
+		net:    net,
+	}
+}
+
+type electrumError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *electrumError) Error() string {
+	return e.Message
+}
+
+type electrumResponse struct {
+	Id     int             `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *electrumError  `json:"error"`
+}
+
+func (e *Electrum) call(method string, params []interface{}, result interface{}) error {
+	e.mu.Lock()
+	e.id++
+	id := e.id
+	e.mu.Unlock()
+
+	dialer := &net.Dialer{Timeout: time.Second * 10}
+	var conn net.Conn
+	var err error
+	if e.tls {
+		conn, err = tls.DialWithDialer(dialer, "tcp", e.server, &tls.Config{})
+	} else {
+		conn, err = dialer.Dial("tcp", e.server)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 30))
+
+	req, err := json.Marshal(&RpcCall{
+		Id:      int64(id),
+		Method:  method,
+		JsonRpc: "2.0",
+		Params:  params,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(append(req, '\n')); err != nil {
+		return err
+	}
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	res := electrumResponse{}
+	if err := json.Unmarshal(line, &res); err != nil {
+		return err
+	}
+	if res.Error != nil {
+		return res.Error
+	}
+	return json.Unmarshal(res.Result, result)
+}
+
+func (e *Electrum) Broadcast(rawtx string) (string, error) {
+	txid := ""
+	err := e.call("blockchain.transaction.broadcast", []interface{}{rawtx}, &txid)
+	return txid, err
+}
+
+// EstimateFeeRate, electrum returns BTC/kvbyte or -1 when it has no estimate
+func (e *Electrum) EstimateFeeRate(target uint) (uint64, error) {
+	var btc json.Number
+	if err := e.call("blockchain.estimatefee", []interface{}{target}, &btc); err != nil {
+		return 0, err
+	}
+	return satsPerKvb(btc)
+}
+
+type electrumTx struct {
+	Txid          string `json:"txid"`
+	Confirmations uint32 `json:"confirmations"`
+	BlockHash     string `json:"blockhash"`
+}
+
+// TxStatus needs a server that supports verbose transactions, such as ElectrumX
+func (e *Electrum) TxStatus(txid string) (*TxStatus, error) {
+	tx := electrumTx{}
+	err := e.call("blockchain.transaction.get", []interface{}{txid, true}, &tx)
+	if _, ok := err.(*electrumError); ok {
+		return &TxStatus{Txid: txid}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &TxStatus{
+		Txid:          txid,
+		Found:         true,
+		Confirmations: tx.Confirmations,
+		BlockHash:     tx.BlockHash,
+	}, nil
+}
+
+type electrumUtxo struct {
+	TxHash string `json:"tx_hash"`
+	TxPos  uint32 `json:"tx_pos"`
+	Height uint32 `json:"height"`
+	Value  Amount `json:"value"`
+}
+
+func (e *Electrum) AddressUtxos(address string) ([]UTXO, error) {
+	scripthash, err := e.scripthash(address)
+	if err != nil {
+		return nil, err
+	}
+
+	unspent := make([]electrumUtxo, 0)
+	if err := e.call("blockchain.scripthash.listunspent", []interface{}{scripthash}, &unspent); err != nil {
+		return nil, err
+	}
+
+	utxos := make([]UTXO, 0)
+	for _, u := range unspent {
+		h, err := chainhash.NewHashFromStr(u.TxHash)
+		if err != nil {
+			return nil, err
+		}
+		utxos = append(utxos, UTXO{u.Value, address, *wire.NewOutPoint(h, u.TxPos)})
+	}
+	return utxos, nil
+}
+
+// PrevOut is nil when the output is already spent, it must be in the unspent outputs of its script
+func (e *Electrum) PrevOut(op wire.OutPoint) (*wire.TxOut, error) {
+	raw := ""
+	err := e.call("blockchain.transaction.get", []interface{}{op.Hash.String()}, &raw)
+	if _, ok := err.(*electrumError); ok {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	out, err := rawTxOut(raw, op.Index)
+	if err != nil {
+		return nil, err
+	}
+
+	unspent := make([]electrumUtxo, 0)
+	if err := e.call("blockchain.scripthash.listunspent", []interface{}{scriptHash(out.PkScript)}, &unspent); err != nil {
+		return nil, err
+	}
+	for _, u := range unspent {
+		if u.TxHash == op.Hash.String() && u.TxPos == op.Index {
+			return out, nil
+		}
+	}
+	return nil, nil
+}
+
+// scripthash is the electrum address index, the reversed sha256 of the output script
+func (e *Electrum) scripthash(address string) (string, error) {
+	addr, err := btcutil.DecodeAddress(address, e.net)
+	if err != nil {
+		return "", err
+	}
+	pks, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		return "", err
+	}
+	return scriptHash(pks), nil
+}
+
+func scriptHash(pks []byte) string {
+	h := sha256.Sum256(pks)
+	return hex.EncodeToString(reverseBytes(h[:]))
+}
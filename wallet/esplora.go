@@ -0,0 +1,203 @@
+package wallet
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Esplora uses an Esplora compatible REST API such as blockstream.info or mempool.space
+type Esplora struct {
+	url    string
+	net    *chaincfg.Params
+	client *http.Client
+}
+
+func NewEsplora(url string, net *chaincfg.Params) *Esplora {
+	return &Esplora{
+		url:    strings.TrimRight(url, "/"),
+		net:    net,
+		client: &http.Client{Timeout: time.Second * 10},
+	}
+}
+
+func (e *Esplora) Broadcast(rawtx string) (string, error) {
+	res, err := e.client.Post(e.url+"/tx", "text/plain", strings.NewReader(rawtx))
+	if err != nil {
+		return "", err
+	}
+	body, err := readBody(res)
+	if err != nil {
+		return "", fmt.Errorf("esplora broadcast failed: %s", err.Error())
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// EstimateFeeRate uses the estimate for the largest target not above the one requested
+//   /fee-estimates is in sat/vbyte keyed by confirmation target
+func (e *Esplora) EstimateFeeRate(target uint) (uint64, error) {
+	estimates := make(map[string]float64)
+	if err := e.get("/fee-estimates", &estimates); err != nil {
+		return 0, err
+	}
+
+	targets := make([]int, 0)
+	for k := range estimates {
+		t, err := strconv.Atoi(k)
+		if err != nil {
+			continue
+		}
+		targets = append(targets, t)
+	}
+	if len(targets) == 0 {
+		return 0, nil
+	}
+	sort.Ints(targets)
+
+	best := targets[0]
+	for _, t := range targets {
+		if t <= int(target) {
+			best = t
+		}
+	}
+	return uint64(estimates[strconv.Itoa(best)] * 1000), nil
+}
+
+type esploraStatus struct {
+	Confirmed   bool   `json:"confirmed"`
+	BlockHeight uint32 `json:"block_height"`
+	BlockHash   string `json:"block_hash"`
+}
+
+func (e *Esplora) TxStatus(txid string) (*TxStatus, error) {
+	status := &TxStatus{Txid: txid}
+	es := esploraStatus{}
+	res, err := e.client.Get(e.url + "/tx/" + txid + "/status")
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return status, nil
+	}
+	body, err := readBody(res)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body, &es); err != nil {
+		return nil, err
+	}
+
+	status.Found = true
+	if !es.Confirmed {
+		return status, nil
+	}
+
+	tip := uint32(0)
+	if err := e.get("/blocks/tip/height", &tip); err != nil {
+		return nil, err
+	}
+	status.BlockHeight = es.BlockHeight
+	status.BlockHash = es.BlockHash
+	if tip >= es.BlockHeight {
+		status.Confirmations = tip - es.BlockHeight + 1
+	}
+	return status, nil
+}
+
+type esploraUtxo struct {
+	Txid  string `json:"txid"`
+	Vout  uint32 `json:"vout"`
+	Value Amount `json:"value"`
+}
+
+func (e *Esplora) AddressUtxos(address string) ([]UTXO, error) {
+	unspent := make([]esploraUtxo, 0)
+	if err := e.get("/address/"+address+"/utxo", &unspent); err != nil {
+		return nil, err
+	}
+
+	utxos := make([]UTXO, 0)
+	for _, u := range unspent {
+		h, err := chainhash.NewHashFromStr(u.Txid)
+		if err != nil {
+			return nil, err
+		}
+		utxos = append(utxos, UTXO{u.Value, address, *wire.NewOutPoint(h, u.Vout)})
+	}
+	return utxos, nil
+}
+
+type esploraOutspend struct {
+	Spent bool `json:"spent"`
+}
+
+// PrevOut is nil when the output is already spent, /tx/:txid/hex has every output
+func (e *Esplora) PrevOut(op wire.OutPoint) (*wire.TxOut, error) {
+	res, err := e.client.Get(fmt.Sprintf("%s/tx/%s/outspend/%d", e.url, op.Hash.String(), op.Index))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, nil
+	}
+	body, err := readBody(res)
+	if err != nil {
+		return nil, err
+	}
+	outspend := esploraOutspend{}
+	if err := json.Unmarshal(body, &outspend); err != nil {
+		return nil, err
+	}
+	if outspend.Spent {
+		return nil, nil
+	}
+
+	res, err = e.client.Get(e.url + "/tx/" + op.Hash.String() + "/hex")
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, nil
+	}
+	body, err = readBody(res)
+	if err != nil {
+		return nil, err
+	}
+	return rawTxOut(strings.TrimSpace(string(body)), op.Index)
+}
+
+func (e *Esplora) get(path string, result interface{}) error {
+	res, err := e.client.Get(e.url + path)
+	if err != nil {
+		return err
+	}
+	body, err := readBody(res)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, result)
+}
+
+func readBody(res *http.Response) ([]byte, error) {
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
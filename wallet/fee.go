@@ -0,0 +1,194 @@
+package wallet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+const (
+	FEE_LIGHTNING = "lightning"
+	FEE_BITCOIN   = "bitcoin"
+	FEE_CHAIN     = "chain"
+	FEE_STATIC    = "static"
+)
+
+// used when no estimate is available and no fallback is configured
+const DEFAULT_SATS_PER_VBYTE = 2
+
+// FeeEstimator provides the fee rate for funding and withdraw transactions
+type FeeEstimator interface {
+	// SatsPerVbyte is 0 when the source has no estimate
+	SatsPerVbyte() (uint64, error)
+}
+
+type FeeRatesRequest struct {
+	Style string `json:"style"`
+}
+
+func (r *FeeRatesRequest) Name() string {
+	return "feerates"
+}
+
+type FeeRatesPerKb struct {
+	Opening       uint64 `json:"opening"`
+	MinAcceptable uint64 `json:"min_acceptable"`
+	MaxAcceptable uint64 `json:"max_acceptable"`
+}
+
+type FeeRatesResult struct {
+	PerKb *FeeRatesPerKb `json:"perkb"`
+}
+
+// LightningFees uses lightningd's own opening estimate, the same rate fundchannel would use
+type LightningFees struct {
+	l Lightning
+}
+
+func NewLightningFees(l Lightning) *LightningFees {
+	return &LightningFees{l}
+}
+
+func (f *LightningFees) SatsPerVbyte() (uint64, error) {
+	result := FeeRatesResult{}
+	if err := f.l.Request(&FeeRatesRequest{Style: "perkb"}, &result); err != nil {
+		return 0, err
+	}
+	if result.PerKb == nil {
+		return 0, nil
+	}
+	return result.PerKb.Opening / 1000, nil
+}
+
+// BitcoinFees uses estimatesmartfee with a configurable target and mode, CONSERVATIVE or ECONOMICAL
+type BitcoinFees struct {
+	bitcoin *BitcoinWallet
+	target  uint
+	mode    string
+}
+
+func NewBitcoinFees(bitcoin *BitcoinWallet, target uint, mode string) *BitcoinFees {
+	return &BitcoinFees{bitcoin, target, mode}
+}
+
+func (f *BitcoinFees) SatsPerVbyte() (uint64, error) {
+	params := []interface{}{f.target}
+	if f.mode != "" {
+		params = append(params, f.mode)
+	}
+	fee := EstimateSmartFeeResult{}
+	result := makeResult(&fee)
+	if err := f.bitcoin.RpcPost("estimatesmartfee", params, &result); err != nil {
+		return 0, err
+	}
+	if result.Error != nil {
+		return 0, errors.New(result.Error.Message)
+	}
+	rate, err := satsPerKvb(fee.Feerate)
+	return rate / 1000, err
+}
+
+// ChainFees uses the chain backend's estimate
+type ChainFees struct {
+	chain  ChainBackend
+	target uint
+}
+
+func NewChainFees(chain ChainBackend, target uint) *ChainFees {
+	return &ChainFees{chain, target}
+}
+
+func (f *ChainFees) SatsPerVbyte() (uint64, error) {
+	rate, err := f.chain.EstimateFeeRate(f.target)
+	return rate / 1000, err
+}
+
+// StaticFees always uses the same rate
+type StaticFees uint64
+
+func (f StaticFees) SatsPerVbyte() (uint64, error) {
+	return uint64(f), nil
+}
+
+// FeePolicy falls back to a static rate when the estimator fails and limits the result
+//   to min and max, 0 for no limit
+type FeePolicy struct {
+	Estimator FeeEstimator
+	Fallback  uint64
+	Min       uint64
+	Max       uint64
+}
+
+// SatsPerVbyte always provides a usable rate, the error is the estimator's for logging
+func (p *FeePolicy) SatsPerVbyte() (uint64, error) {
+	var rate uint64
+	var err error
+	if p.Estimator != nil {
+		rate, err = p.Estimator.SatsPerVbyte()
+	}
+	if err != nil || rate == 0 {
+		rate = p.Fallback
+		if rate == 0 {
+			rate = DEFAULT_SATS_PER_VBYTE
+		}
+	}
+	if p.Min > 0 && rate < p.Min {
+		rate = p.Min
+	}
+	if p.Max > 0 && rate > p.Max {
+		rate = p.Max
+	}
+	return rate, err
+}
+
+type FeeConfig struct {
+	Source   string
+	Target   uint
+	Mode     string
+	Fallback uint64
+	Min      uint64
+	Max      uint64
+}
+
+// NewFeePolicy provides the estimator for the multi-fee-source option wrapped in the fallback and limits
+func NewFeePolicy(cfg *FeeConfig, chain ChainBackend, bitcoin *BitcoinWallet, l Lightning) (*FeePolicy, error) {
+	if cfg.Min > 0 && cfg.Max > 0 && cfg.Min > cfg.Max {
+		return nil, fmt.Errorf("minimum fee rate %d is above maximum %d", cfg.Min, cfg.Max)
+	}
+	policy := &FeePolicy{Fallback: cfg.Fallback, Min: cfg.Min, Max: cfg.Max}
+	switch cfg.Source {
+	case FEE_LIGHTNING:
+		policy.Estimator = NewLightningFees(l)
+	case FEE_BITCOIN:
+		if bitcoin == nil {
+			return nil, errors.New("bitcoin fee source requires bitcoind rpc access")
+		}
+		policy.Estimator = NewBitcoinFees(bitcoin, cfg.Target, cfg.Mode)
+	case "", FEE_CHAIN:
+		policy.Estimator = NewChainFees(chain, cfg.Target)
+	case FEE_STATIC:
+		if cfg.Fallback == 0 {
+			return nil, errors.New("static fee source requires multi-fee-fallback")
+		}
+		policy.Estimator = StaticFees(cfg.Fallback)
+	default:
+		return nil, fmt.Errorf("unknown fee source %s", cfg.Source)
+	}
+	return policy, nil
+}
+
+// satsPerKvb converts a BTC/kvbyte rate exactly, rounding down as a rate can be a fraction of a satoshi
+//   estimators give no rate or a negative one when they have no estimate, that is 0
+func satsPerKvb(btc json.Number) (uint64, error) {
+	if btc == "" || strings.HasPrefix(btc.String(), "-") {
+		return 0, nil
+	}
+	r, ok := new(big.Rat).SetString(btc.String())
+	if !ok {
+		return 0, fmt.Errorf("invalid fee rate %s", btc)
+	}
+	r.Mul(r, satPerBtc)
+	return new(big.Int).Quo(r.Num(), r.Denom()).Uint64(), nil
+}
@@ -0,0 +1,77 @@
+package wallet
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type testFees struct {
+	rate uint64
+	err  error
+}
+
+func (f *testFees) SatsPerVbyte() (uint64, error) {
+	return f.rate, f.err
+}
+
+func TestFeePolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		est      *testFees
+		fallback uint64
+		min, max uint64
+		want     uint64
+	}{
+		{"estimate", &testFees{rate: 12}, 3, 1, 0, 12},
+		{"no estimate", &testFees{}, 3, 1, 0, 3},
+		{"error", &testFees{rate: 12, err: errors.New("offline")}, 3, 1, 0, 3},
+		{"default", &testFees{}, 0, 0, 0, DEFAULT_SATS_PER_VBYTE},
+		{"min", &testFees{rate: 1}, 3, 5, 0, 5},
+		{"max", &testFees{rate: 500}, 3, 1, 100, 100},
+	}
+	for _, tt := range tests {
+		p := &FeePolicy{Estimator: tt.est, Fallback: tt.fallback, Min: tt.min, Max: tt.max}
+		rate, _ := p.SatsPerVbyte()
+		if rate != tt.want {
+			t.Errorf("%s: want %d, have %d", tt.name, tt.want, rate)
+		}
+	}
+
+	if _, err := NewFeePolicy(&FeeConfig{Source: FEE_CHAIN, Min: 10, Max: 5}, nil, nil, nil); err == nil {
+		t.Error("expected min above max to fail")
+	}
+	if _, err := NewFeePolicy(&FeeConfig{Source: FEE_STATIC}, nil, nil, nil); err == nil {
+		t.Error("expected static source without rate to fail")
+	}
+}
+
+func TestBitcoinFees(t *testing.T) {
+	var params []interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := struct {
+			Method string        `json:"method"`
+			Params []interface{} `json:"params"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&req)
+		params = req.Params
+		w.Write([]byte(`{"result": {"feerate": 0.00012}, "error": null}`))
+	}))
+	defer server.Close()
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	fees := NewBitcoinFees(&BitcoinWallet{rpchost: host, rpcport: port}, 6, "ECONOMICAL")
+	rate, err := fees.SatsPerVbyte()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate != 12 {
+		t.Errorf("want 12 sat/vbyte, have %d", rate)
+	}
+	if len(params) != 2 || params[0].(float64) != 6 || params[1].(string) != "ECONOMICAL" {
+		t.Errorf("unexpected estimatesmartfee params %v", params)
+	}
+}
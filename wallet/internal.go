@@ -7,7 +7,6 @@ import (
 	"errors"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
-	"log"
 	"os"
 
 	"github.com/btcsuite/btcd/chaincfg"
@@ -16,18 +15,18 @@ import (
 	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcutil"
 	"github.com/btcsuite/btcutil/hdkeychain"
-	"github.com/niftynei/glightning/glightning"
+	"github.com/rsbondi/multifund/logger"
 	"golang.org/x/crypto/hkdf"
 )
 
 type InternalWallet struct {
-	lightning *glightning.Lightning
+	lightning Lightning
 	master    *hdkeychain.ExtendedKey
 	net       *chaincfg.Params
 	dir       string
 }
 
-func NewInternalWallet(l *glightning.Lightning, net *chaincfg.Params, dir string) *InternalWallet {
+func NewInternalWallet(l Lightning, net *chaincfg.Params, dir string) *InternalWallet {
 	f, err := os.Open(dir + "/hsm_secret")
 	if err != nil {
 		panic(err)
@@ -64,18 +63,18 @@ type Outs struct {
 	Scriptpubkey []byte `db:"scriptpubkey"`
 }
 
-func (i *InternalWallet) Utxos(amt uint64, fee uint64) ([]UTXO, error) {
+func (i *InternalWallet) Utxos(amt Amount, fee Amount) ([]UTXO, error) {
 	dbpath := i.dir + "/lightningd.sqlite3"
 	db, err := sql.Open("sqlite3", dbpath)
 	defer db.Close()
 	if err != nil {
-		log.Printf("cannot open database: %s", err.Error())
+		logger.Errorf("cannot open database: %s", err.Error())
 	}
 
 	q := "SELECT prev_out_tx, prev_out_index, value, scriptpubkey FROM outputs WHERE spend_height IS NULL ORDER BY value"
 	rows, err := db.Query(fmt.Sprintf(q))
 	if err != nil {
-		log.Printf("cannot execute query: %s", err.Error())
+		logger.Errorf("cannot execute query: %s", err.Error())
 	}
 
 	defer rows.Close()
@@ -89,10 +88,10 @@ func (i *InternalWallet) Utxos(amt uint64, fee uint64) ([]UTXO, error) {
 		u := Outs{}
 		err = rows.Scan(&u.PrevOutTx, &u.PrevOutIndex, &u.Value, &u.Scriptpubkey)
 		if err != nil {
-			log.Printf("cannot read database row: %s", err.Error())
+			logger.Errorf("cannot read database row: %s", err.Error())
 		}
 		unspent = append(unspent, u)
-		sats := uint64(u.Value)
+		sats := Amount(u.Value)
 		if sats >= amt+fee && sats <= amt+fee+DUST_LIMIT {
 			txid := u.PrevOutTx
 			h, _ := chainhash.NewHash(txid)
@@ -103,7 +102,7 @@ func (i *InternalWallet) Utxos(amt uint64, fee uint64) ([]UTXO, error) {
 			// maybe best is not save address, and attach a func to UTXO to get address from scriptpubkey
 			_, addr, _, _ := txscript.ExtractPkScriptAddrs(u.Scriptpubkey, i.net)
 
-			utxos := []UTXO{UTXO{uint64(u.Value), addr[0].String(), *o}}
+			utxos := []UTXO{UTXO{Amount(u.Value), addr[0].String(), *o}}
 			return utxos, nil
 		}
 		if sats > amt+fee+DUST_LIMIT {
@@ -114,10 +113,10 @@ func (i *InternalWallet) Utxos(amt uint64, fee uint64) ([]UTXO, error) {
 
 	if len(candidates) == 0 {
 		// unspent is sorted so grabbing the largest first should give us the least input count to tx
-		sats := uint64(0)
+		sats := Amount(0)
 		for i := len(unspent) - 1; i >= 0; i-- {
 			u := unspent[i]
-			sats += uint64(u.Value)
+			sats += Amount(u.Value)
 			candidates = append(candidates, &unspent[i])
 			if sats > amt+fee+DUST_LIMIT {
 				break
@@ -133,18 +132,18 @@ func (i *InternalWallet) Utxos(amt uint64, fee uint64) ([]UTXO, error) {
 	for _, c := range candidates {
 		txid := c.PrevOutTx
 		if err != nil {
-			log.Printf("unable to decode txid %s\n", err)
+			logger.Errorf("unable to decode txid %s", err)
 
 		}
 		h, err := chainhash.NewHash(txid)
 		if err != nil {
-			log.Printf("unable to create hash from txid %s\n", err)
+			logger.Errorf("unable to create hash from txid %s", err)
 			return nil, err
 		}
 
 		o := wire.NewOutPoint(h, uint32(c.PrevOutIndex))
 		_, addr, _, _ := txscript.ExtractPkScriptAddrs(c.Scriptpubkey, i.net)
-		utxos = append(utxos, UTXO{uint64(c.Value), addr[0].String(), *o})
+		utxos = append(utxos, UTXO{Amount(c.Value), addr[0].String(), *o})
 	}
 
 	return utxos, nil
@@ -166,7 +165,7 @@ func (i *InternalWallet) Sign(tx *Transaction, utxos []UTXO) {
 	db, err := sql.Open("sqlite3", dbpath)
 	defer db.Close()
 	if err != nil {
-		log.Printf("cannot open database: %s", err.Error())
+		logger.Errorf("cannot open database: %s", err.Error())
 	}
 
 	for _, u := range utxos {
@@ -181,27 +180,25 @@ func (i *InternalWallet) Sign(tx *Transaction, utxos []UTXO) {
 			txhash, u.OutPoint.Index).Scan(&keyindex, &scriptpubkey)
 
 		if err != nil {
-			log.Printf("cannot read database row: %s", err.Error())
+			logger.Errorf("cannot read database row: %s", err.Error())
 		}
 		key, err := i.master.Child(keyindex)
 		if err != nil {
-			log.Printf("cannot derive key for signing: %s", err.Error())
+			logger.Errorf("cannot derive key for signing: %s", err.Error())
 		}
 		pk, _ := key.ECPrivKey()
 
 		// need to find input index, not in sequence if created elsewhere
+		//   and may include inputs from other parties when funding together
 		vin := -1
-	FindVin:
 		for o, in := range txToSign.TxIn {
-			for _, u := range utxos {
-				if u.OutPoint.String() == in.PreviousOutPoint.String() {
-					vin = o
-					break FindVin
-				}
+			if u.OutPoint.String() == in.PreviousOutPoint.String() {
+				vin = o
+				break
 			}
 		}
 		if vin == -1 {
-			log.Printf("cannot create find input to sign: %s", err.Error())
+			logger.Errorf("cannot find input to sign: %s", u.OutPoint.String())
 			return
 		}
 		if txscript.IsPayToScriptHash(scriptpubkey) {
@@ -210,16 +207,16 @@ func (i *InternalWallet) Sign(tx *Transaction, utxos []UTXO) {
 			txToSign.TxIn[vin].SignatureScript = append([]byte{0x16}, scriptpubkey...)
 		}
 
-		witSig, err := txscript.WitnessSignature(txToSign, txscript.NewTxSigHashes(txToSign), vin, int64(u.Amount), scriptpubkey, txscript.SigHashAll, pk, true)
+		witSig, err := txscript.WitnessSignature(txToSign, txscript.NewTxSigHashes(txToSign), vin, u.Amount.Int64(), scriptpubkey, txscript.SigHashAll, pk, true)
 		if err != nil {
-			log.Printf("cannot create sig script: %s", err.Error())
+			logger.Errorf("cannot create sig script: %s", err.Error())
 		}
 
 		txToSign.TxIn[vin].Witness = witSig
 
 		var txsig bytes.Buffer
 		if err != nil {
-			log.Printf("cannot sign: %s", err.Error())
+			logger.Errorf("cannot sign: %s", err.Error())
 		}
 		err = txToSign.Serialize(&txsig)
 
@@ -0,0 +1,535 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/psbt"
+)
+
+// MultisigUTXO is a P2WSH multisig input, the witness script is needed to build the
+// PSBT and to know how many signatures are required before it can be finalized
+type MultisigUTXO struct {
+	UTXO
+	WitnessScript []byte
+}
+
+// Required is the number of signatures needed to spend the input
+func (m *MultisigUTXO) Required() (int, error) {
+	_, required, err := txscript.CalcMultiSigStats(m.WitnessScript)
+	return required, err
+}
+
+// PkScript is the P2WSH output script being spent
+func (m *MultisigUTXO) PkScript(network *chaincfg.Params) ([]byte, error) {
+	h := sha256.Sum256(m.WitnessScript)
+	addr, err := btcutil.NewAddressWitnessScriptHash(h[:], network)
+	if err != nil {
+		return nil, err
+	}
+	return txscript.PayToAddrScript(addr)
+}
+
+// CreatePsbt builds an unsigned PSBT spending multisig inputs, each input carries the
+// witness utxo and witness script so signers can produce partial signatures
+func CreatePsbt(destinations []*TxRecipient, utxos []MultisigUTXO, network *chaincfg.Params) (*psbt.Packet, error) {
+	tx := wire.NewMsgTx(2)
+
+	for _, utxo := range utxos {
+		tx.AddTxIn(wire.NewTxIn(&utxo.OutPoint, nil, nil))
+	}
+
+	for _, destination := range destinations {
+		destinationAddress, err := btcutil.DecodeAddress(destination.Address, network)
+		if err != nil {
+			return nil, err
+		}
+		destinationPkScript, err := txscript.PayToAddrScript(destinationAddress)
+		if err != nil {
+			return nil, err
+		}
+		tx.AddTxOut(wire.NewTxOut(destination.Amount.Int64(), destinationPkScript))
+	}
+
+	p, err := psbt.NewFromUnsignedTx(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := psbt.NewUpdater(p)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, utxo := range utxos {
+		if _, err := utxo.Required(); err != nil {
+			return nil, fmt.Errorf("input %d is not a multisig script: %s", i, err.Error())
+		}
+		pks, err := utxo.PkScript(network)
+		if err != nil {
+			return nil, err
+		}
+		if err := u.AddInWitnessUtxo(wire.NewTxOut(utxo.Amount.Int64(), pks), i); err != nil {
+			return nil, err
+		}
+		if err := u.AddInWitnessScript(utxo.WitnessScript, i); err != nil {
+			return nil, err
+		}
+		if err := u.AddInSighashType(txscript.SigHashAll, i); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// CreateWalletPsbt builds an unsigned PSBT spending wallet utxos, the witness utxo is
+//   derived from the utxo address so other parties can verify the amounts
+func CreateWalletPsbt(destinations []*TxRecipient, utxos []UTXO, network *chaincfg.Params) (*psbt.Packet, error) {
+	tx, err := CreateTransaction(destinations, utxos, network)
+	if err != nil {
+		return nil, err
+	}
+	wtx := wire.NewMsgTx(2)
+	if err := wtx.Deserialize(bytes.NewReader(tx.Unsigned)); err != nil {
+		return nil, err
+	}
+
+	p, err := psbt.NewFromUnsignedTx(wtx)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := psbt.NewUpdater(p)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, utxo := range utxos {
+		addr, err := btcutil.DecodeAddress(utxo.Address, network)
+		if err != nil {
+			return nil, err
+		}
+		pks, err := txscript.PayToAddrScript(addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := u.AddInWitnessUtxo(wire.NewTxOut(utxo.Amount.Int64(), pks), i); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// InputTotal sums the outputs the PSBT spends, every input needs its witness or non witness utxo
+func InputTotal(p *psbt.Packet) (Amount, error) {
+	total := Amount(0)
+	for i, in := range p.Inputs {
+		var value int64
+		switch {
+		case in.WitnessUtxo != nil:
+			value = in.WitnessUtxo.Value
+		case in.NonWitnessUtxo != nil:
+			vout := p.UnsignedTx.TxIn[i].PreviousOutPoint.Index
+			if int(vout) >= len(in.NonWitnessUtxo.TxOut) {
+				return 0, fmt.Errorf("input %d spends an output its utxo does not have", i)
+			}
+			value = in.NonWitnessUtxo.TxOut[vout].Value
+		default:
+			return 0, fmt.Errorf("input %d has no utxo", i)
+		}
+		if value < 0 {
+			return 0, fmt.Errorf("input %d has a negative amount", i)
+		}
+		var err error
+		if total, err = total.Add(Amount(value)); err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+// DecodePsbt accepts a base64 or hex encoded PSBT
+func DecodePsbt(encoded string) (*psbt.Packet, error) {
+	encoded = strings.TrimSpace(encoded)
+	if raw, err := hex.DecodeString(encoded); err == nil {
+		return psbt.NewFromRawBytes(bytes.NewReader(raw), false)
+	}
+	return psbt.NewFromRawBytes(strings.NewReader(encoded), true)
+}
+
+// CombinePsbt merges the partial signatures from src into dst, both must be
+// for the same unsigned transaction
+func CombinePsbt(dst, src *psbt.Packet) error {
+	if dst.UnsignedTx.TxHash() != src.UnsignedTx.TxHash() {
+		return errors.New("PSBTs do not share the same unsigned transaction")
+	}
+	if len(dst.Inputs) != len(src.Inputs) {
+		return errors.New("PSBT input count mismatch")
+	}
+
+	for i := range src.Inputs {
+		in := &dst.Inputs[i]
+		if isFinal(in) {
+			continue
+		}
+		if isFinal(&src.Inputs[i]) {
+			if err := verifyFinal(dst, i, &src.Inputs[i]); err != nil {
+				return fmt.Errorf("input %d: %s", i, err.Error())
+			}
+			in.FinalScriptSig = src.Inputs[i].FinalScriptSig
+			in.FinalScriptWitness = src.Inputs[i].FinalScriptWitness
+			continue
+		}
+
+	AddSig:
+		for _, sig := range src.Inputs[i].PartialSigs {
+			for _, have := range in.PartialSigs {
+				if bytes.Equal(have.PubKey, sig.PubKey) {
+					continue AddSig
+				}
+			}
+			if err := verifyPartialSig(dst, i, sig); err != nil {
+				return fmt.Errorf("input %d: %s", i, err.Error())
+			}
+			in.PartialSigs = append(in.PartialSigs, sig)
+		}
+	}
+	return nil
+}
+
+// MissingSignatures returns how many signatures each input still needs to reach its threshold,
+//   only valid signatures from distinct keys of the witness script are counted
+func MissingSignatures(p *psbt.Packet) ([]int, error) {
+	missing := make([]int, len(p.Inputs))
+	for i, in := range p.Inputs {
+		if isFinal(&in) {
+			continue
+		}
+		_, required, err := txscript.CalcMultiSigStats(in.WitnessScript)
+		if err != nil {
+			return nil, fmt.Errorf("input %d: %s", i, err.Error())
+		}
+		valid := 0
+		seen := make(map[string]bool)
+		for _, sig := range in.PartialSigs {
+			if seen[string(sig.PubKey)] || verifyPartialSig(p, i, sig) != nil {
+				continue
+			}
+			seen[string(sig.PubKey)] = true
+			valid++
+		}
+		if valid < required {
+			missing[i] = required - valid
+		}
+	}
+	return missing, nil
+}
+
+// verifyPartialSig checks a signature for input i is from a key in its witness script and
+//   signs the witness sighash of the unsigned transaction, the witness utxo must be the
+//   P2WSH output of that script so the amount signed is the one spent
+func verifyPartialSig(p *psbt.Packet, i int, sig *psbt.PartialSig) error {
+	in := &p.Inputs[i]
+	if in.WitnessUtxo == nil || len(in.WitnessScript) == 0 {
+		return errors.New("no witness utxo and script to verify a signature")
+	}
+	h := sha256.Sum256(in.WitnessScript)
+	if !txscript.IsPayToWitnessScriptHash(in.WitnessUtxo.PkScript) || !bytes.Equal(in.WitnessUtxo.PkScript[2:], h[:]) {
+		return errors.New("witness utxo does not pay to the witness script")
+	}
+
+	pushes, err := txscript.PushedData(in.WitnessScript)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, push := range pushes {
+		found = found || bytes.Equal(push, sig.PubKey)
+	}
+	if !found {
+		return fmt.Errorf("key %x is not in the witness script", sig.PubKey)
+	}
+
+	if len(sig.Signature) == 0 {
+		return fmt.Errorf("empty signature for key %x", sig.PubKey)
+	}
+	hashType := txscript.SigHashType(sig.Signature[len(sig.Signature)-1])
+	if in.SighashType != 0 && hashType != in.SighashType {
+		return fmt.Errorf("signature for key %x has sighash type %d, want %d", sig.PubKey, hashType, in.SighashType)
+	}
+	signature, err := btcec.ParseDERSignature(sig.Signature[:len(sig.Signature)-1], btcec.S256())
+	if err != nil {
+		return err
+	}
+	pubkey, err := btcec.ParsePubKey(sig.PubKey, btcec.S256())
+	if err != nil {
+		return err
+	}
+	hash, err := txscript.CalcWitnessSigHash(in.WitnessScript, txscript.NewTxSigHashes(p.UnsignedTx), hashType, p.UnsignedTx, i, in.WitnessUtxo.Value)
+	if err != nil {
+		return err
+	}
+	if !signature.Verify(hash, pubkey) {
+		return fmt.Errorf("invalid signature for key %x", sig.PubKey)
+	}
+	return nil
+}
+
+// verifyFinal runs the final scripts of src through the script engine against the witness utxo of
+//   input i in p, so only scripts that spend it are accepted
+func verifyFinal(p *psbt.Packet, i int, src *psbt.PInput) error {
+	utxo := p.Inputs[i].WitnessUtxo
+	if utxo == nil {
+		return errors.New("no witness utxo to verify the final scripts")
+	}
+	tx := p.UnsignedTx.Copy()
+	tx.TxIn[i].SignatureScript = src.FinalScriptSig
+	if len(src.FinalScriptWitness) > 0 {
+		wit, err := readWitness(bytes.NewReader(src.FinalScriptWitness))
+		if err != nil {
+			return err
+		}
+		tx.TxIn[i].Witness = wit
+	}
+	vm, err := txscript.NewEngine(utxo.PkScript, tx, i, txscript.StandardVerifyFlags, nil, txscript.NewTxSigHashes(tx), utxo.Value)
+	if err == nil {
+		err = vm.Execute()
+	}
+	if err != nil {
+		return fmt.Errorf("final scripts do not spend the utxo: %s", err.Error())
+	}
+	return nil
+}
+
+// FinalizePsbt finalizes all inputs and extracts the network ready transaction
+func FinalizePsbt(p *psbt.Packet) (Transaction, error) {
+	if err := psbt.MaybeFinalizeAll(p); err != nil {
+		return Transaction{}, err
+	}
+	wtx, err := psbt.Extract(p)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	var signed bytes.Buffer
+	if err := wtx.Serialize(&signed); err != nil {
+		return Transaction{}, err
+	}
+	return Transaction{
+		TxId:   wtx.TxHash().String(),
+		Signed: signed.Bytes(),
+	}, nil
+}
+
+// AddSignedInputs copies the signatures for our utxos from a wallet signed transaction into
+//   the matching PSBT inputs as final scripts, inputs belonging to other parties are untouched
+func AddSignedInputs(p *psbt.Packet, signed []byte, utxos []UTXO) error {
+	wtx := wire.NewMsgTx(2)
+	if err := wtx.Deserialize(bytes.NewReader(signed)); err != nil {
+		return err
+	}
+
+	if unsignedHash(wtx) != p.UnsignedTx.TxHash() {
+		return errors.New("signed transaction does not match PSBT")
+	}
+
+	for _, u := range utxos {
+		vin := -1
+		for i, in := range wtx.TxIn {
+			if in.PreviousOutPoint == u.OutPoint {
+				vin = i
+				break
+			}
+		}
+		if vin == -1 {
+			return fmt.Errorf("input %s not found in PSBT", u.OutPoint.String())
+		}
+
+		in := wtx.TxIn[vin]
+		if len(in.Witness) == 0 && len(in.SignatureScript) == 0 {
+			return fmt.Errorf("input %s was not signed", u.OutPoint.String())
+		}
+		p.Inputs[vin].FinalScriptSig = in.SignatureScript
+		if len(in.Witness) > 0 {
+			var w bytes.Buffer
+			if err := writeWitness(&w, in.Witness); err != nil {
+				return err
+			}
+			p.Inputs[vin].FinalScriptWitness = w.Bytes()
+		}
+	}
+	return nil
+}
+
+// IsComplete is true once every input has its final scripts
+func IsComplete(p *psbt.Packet) bool {
+	for i := range p.Inputs {
+		if !isFinal(&p.Inputs[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// unsignedHash is the txid without any signatures, scriptSigs from wrapped segwit inputs change the txid
+func unsignedHash(tx *wire.MsgTx) chainhash.Hash {
+	stripped := tx.Copy()
+	for _, in := range stripped.TxIn {
+		in.SignatureScript = nil
+		in.Witness = nil
+	}
+	return stripped.TxHash()
+}
+
+func isFinal(in *psbt.PInput) bool {
+	return len(in.FinalScriptWitness) > 0 || len(in.FinalScriptSig) > 0
+}
+
+// readWitness parses a final script witness, the reverse of writeWitness
+func readWitness(r io.Reader) (wire.TxWitness, error) {
+	n, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(txscript.MaxStackSize) {
+		return nil, fmt.Errorf("witness has too many items %d", n)
+	}
+	wit := make(wire.TxWitness, 0, n)
+	for j := uint64(0); j < n; j++ {
+		item, err := wire.ReadVarBytes(r, 0, txscript.MaxScriptSize, "witness item")
+		if err != nil {
+			return nil, err
+		}
+		wit = append(wit, item)
+	}
+	return wit, nil
+}
+
+// writeWitness serializes a witness stack the way PSBT expects for final script witness
+func writeWitness(w io.Writer, wit wire.TxWitness) error {
+	if err := wire.WriteVarInt(w, 0, uint64(len(wit))); err != nil {
+		return err
+	}
+	for _, item := range wit {
+		if err := wire.WriteVarBytes(w, 0, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MergePsbt adds any inputs and outputs from update that are not already in base, this is
+//   how contributions from several dual funding peers are collected into one transaction
+func MergePsbt(base, update *psbt.Packet) (*psbt.Packet, error) {
+	tx := base.UnsignedTx.Copy()
+	inputs := append([]psbt.PInput{}, base.Inputs...)
+	outputs := append([]psbt.POutput{}, base.Outputs...)
+
+	have := make(map[wire.OutPoint]bool)
+	for _, in := range tx.TxIn {
+		have[in.PreviousOutPoint] = true
+	}
+	for i, in := range update.UnsignedTx.TxIn {
+		if have[in.PreviousOutPoint] {
+			continue
+		}
+		have[in.PreviousOutPoint] = true
+		tx.AddTxIn(wire.NewTxIn(&in.PreviousOutPoint, nil, nil))
+		inputs = append(inputs, update.Inputs[i])
+	}
+
+	// outputs can legitimately repeat so match them up one for one
+	used := make(map[int]bool)
+	for i, out := range update.UnsignedTx.TxOut {
+		found := false
+		for v, bout := range base.UnsignedTx.TxOut {
+			if !used[v] && bout.Value == out.Value && bytes.Equal(bout.PkScript, out.PkScript) {
+				used[v] = true
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		tx.AddTxOut(wire.NewTxOut(out.Value, out.PkScript))
+		outputs = append(outputs, update.Outputs[i])
+	}
+
+	merged, err := psbt.NewFromUnsignedTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	merged.Inputs = inputs
+	merged.Outputs = outputs
+	return merged, nil
+}
+
+// MergeWitnesses takes the first signature found for each input across several signed
+//   copies of the same transaction
+func MergeWitnesses(txs [][]byte) (Transaction, error) {
+	var merged *wire.MsgTx
+	for _, raw := range txs {
+		wtx := wire.NewMsgTx(2)
+		if err := wtx.Deserialize(bytes.NewReader(raw)); err != nil {
+			return Transaction{}, err
+		}
+		if merged == nil {
+			merged = wtx
+			continue
+		}
+		if unsignedHash(wtx) != unsignedHash(merged) {
+			return Transaction{}, errors.New("signed transactions do not match")
+		}
+		for i, in := range wtx.TxIn {
+			if len(merged.TxIn[i].Witness) == 0 {
+				merged.TxIn[i].Witness = in.Witness
+			}
+			if len(merged.TxIn[i].SignatureScript) == 0 {
+				merged.TxIn[i].SignatureScript = in.SignatureScript
+			}
+		}
+	}
+	if merged == nil {
+		return Transaction{}, errors.New("no signed transactions")
+	}
+
+	var signed bytes.Buffer
+	if err := merged.Serialize(&signed); err != nil {
+		return Transaction{}, err
+	}
+	return Transaction{
+		TxId:   merged.TxHash().String(),
+		Signed: signed.Bytes(),
+	}, nil
+}
+
+// AddPsbtOutputs appends outputs paying the recipients to the PSBT
+func AddPsbtOutputs(p *psbt.Packet, destinations []*TxRecipient, network *chaincfg.Params) error {
+	for _, destination := range destinations {
+		destinationAddress, err := btcutil.DecodeAddress(destination.Address, network)
+		if err != nil {
+			return err
+		}
+		destinationPkScript, err := txscript.PayToAddrScript(destinationAddress)
+		if err != nil {
+			return err
+		}
+		p.UnsignedTx.AddTxOut(wire.NewTxOut(destination.Amount.Int64(), destinationPkScript))
+		p.Outputs = append(p.Outputs, psbt.POutput{})
+	}
+	return nil
+}
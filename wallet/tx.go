@@ -3,12 +3,14 @@ package wallet
 import (
 	"bytes"
 	"encoding/hex"
-	"log"
+	"encoding/json"
+	"sort"
 
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcutil"
+	"github.com/rsbondi/multifund/logger"
 )
 
 type Transaction struct {
@@ -17,12 +19,38 @@ type Transaction struct {
 	Unsigned []byte
 }
 
+// Outputs is the funding output of one channel, Vout is its position in the request until
+//   the channels are completed and then its index in the transaction
 type Outputs struct {
+	Peer   string `json:"peer"`
 	Vout   uint16 `json:"vout"`
-	Amount int64  `json:"amount"`
+	Amount Amount `json:"amount"`
 	Script []byte `json:"script"`
 }
 
+// ChannelOutputs are the funding outputs of a batch, one per channel in request order
+type ChannelOutputs []*Outputs
+
+// UnmarshalJSON also reads outputs saved as an object keyed by peer
+func (c *ChannelOutputs) UnmarshalJSON(b []byte) error {
+	list := make([]*Outputs, 0)
+	if err := json.Unmarshal(b, &list); err == nil {
+		*c = list
+		return nil
+	}
+	byPeer := make(map[string]*Outputs)
+	if err := json.Unmarshal(b, &byPeer); err != nil {
+		return err
+	}
+	for peer, o := range byPeer {
+		o.Peer = peer
+		list = append(list, o)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Vout < list[j].Vout })
+	*c = list
+	return nil
+}
+
 func (t *Transaction) String() string {
 	if t.Signed != nil {
 		return hex.EncodeToString(t.Signed)
@@ -33,7 +61,7 @@ func (t *Transaction) String() string {
 
 type TxRecipient struct {
 	Address string
-	Amount  int64
+	Amount  Amount
 }
 
 func CreateTransaction(destinations []*TxRecipient, utxos []UTXO, network *chaincfg.Params) (Transaction, error) {
@@ -48,11 +76,11 @@ func CreateTransaction(destinations []*TxRecipient, utxos []UTXO, network *chain
 	for _, destination := range destinations {
 		destinationAddress, err := btcutil.DecodeAddress(destination.Address, network)
 		if err != nil {
-			log.Printf("unable to decode address: %s\n", err.Error())
+			logger.Warnf("unable to decode address: %s", err.Error())
 			return Transaction{}, err
 		}
 		destinationPkScript, _ := txscript.PayToAddrScript(destinationAddress)
-		tx.AddTxOut(wire.NewTxOut(destination.Amount, destinationPkScript))
+		tx.AddTxOut(wire.NewTxOut(destination.Amount.Int64(), destinationPkScript))
 	}
 
 	var unsignedTx bytes.Buffer
@@ -78,7 +106,7 @@ func OutputFeeSats(destinations []*TxRecipient, network *chaincfg.Params) uint64
 	for _, d := range destinations {
 		addr, err := btcutil.DecodeAddress(d.Address, network)
 		if err != nil {
-			log.Printf("unable to decode address: %s\n", err.Error())
+			logger.Warnf("unable to decode address: %s", err.Error())
 			return uint64(0)
 		}
 		pks, _ := txscript.PayToAddrScript(addr)
@@ -101,7 +129,7 @@ func InputFeeSats(utxos []UTXO, network *chaincfg.Params) uint64 {
 	for _, u := range utxos {
 		addr, err := btcutil.DecodeAddress(u.Address, network)
 		if err != nil {
-			log.Printf("unable to decode address: %s\n", err.Error())
+			logger.Warnf("unable to decode address: %s", err.Error())
 			return uint64(0)
 		}
 		pks, _ := txscript.PayToAddrScript(addr)
@@ -119,3 +147,59 @@ func InputFeeSats(utxos []UTXO, network *chaincfg.Params) uint64 {
 	}
 	return uint64(total)
 }
+
+// MultisigInputFeeSats estimates the vbytes of P2WSH multisig spends
+//   41 non witness bytes plus the witness, a dummy element, the signatures
+//   at up to 73 bytes each and the witness script with its length prefix
+func MultisigInputFeeSats(utxos []MultisigUTXO) uint64 {
+	total := uint64(0)
+	for _, u := range utxos {
+		required, err := u.Required()
+		if err != nil {
+			logger.Errorf("unable to read multisig script: %s", err.Error())
+			return uint64(0)
+		}
+		witness := uint64(1 + 1 + 73*required + 3 + len(u.WitnessScript))
+		total += 41 + (witness+3)/4
+	}
+	return total
+}
+
+// Change is what is left of in after out and fee, false when in does not cover them or only dust is left
+func Change(in, out, fee Amount) (Amount, bool) {
+	spent, err := out.Add(fee)
+	if err != nil {
+		return 0, false
+	}
+	change, err := in.Sub(spent)
+	if err != nil || change <= DUST_LIMIT {
+		return 0, false
+	}
+	return change, true
+}
+
+// TxFee is what the utxos pay above the outputs, 0 if the utxos do not cover the outputs
+//   or either total overflows
+func TxFee(wtx *wire.MsgTx, utxos []UTXO) Amount {
+	in, err := UtxoTotal(utxos)
+	if err != nil {
+		return 0
+	}
+	out := Amount(0)
+	for _, o := range wtx.TxOut {
+		if out, err = out.Add(Amount(o.Value)); err != nil {
+			return 0
+		}
+	}
+	fee, err := in.Sub(out)
+	if err != nil {
+		return 0
+	}
+	return fee
+}
+
+// TxVsize is the virtual size of a signed transaction, witness bytes count 1/4
+func TxVsize(wtx *wire.MsgTx) uint64 {
+	weight := wtx.SerializeSizeStripped()*3 + wtx.SerializeSize()
+	return uint64((weight + 3) / 4)
+}
@@ -3,6 +3,7 @@ package wallet
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 
 	"github.com/btcsuite/btcd/chaincfg"
@@ -61,3 +62,74 @@ func TestDeriveKey(t *testing.T) {
 	}
 
 }
+
+func TestChannelOutputsJSON(t *testing.T) {
+	list := ChannelOutputs{{Peer: "a", Vout: 0, Amount: 1}, {Peer: "a", Vout: 1, Amount: 2}}
+	b, err := json.Marshal(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := ChannelOutputs{}
+	if err := json.Unmarshal(b, &read); err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 2 || read[1].Amount != 2 {
+		t.Errorf("outputs for the same peer should both be kept, have %d", len(read))
+	}
+
+	legacy := []byte(`{"b": {"vout": 1, "amount": 2}, "a": {"vout": 0, "amount": 1}}`)
+	if err := json.Unmarshal(legacy, &read); err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 2 || read[0].Peer != "a" || read[1].Peer != "b" {
+		t.Errorf("outputs keyed by peer should be read in vout order, have %+v %+v", read[0], read[1])
+	}
+}
+
+func TestChange(t *testing.T) {
+	tests := []struct {
+		in, out, fee Amount
+		change       Amount
+		ok           bool
+	}{
+		{100000, 50000, 1000, 49000, true},
+		{100000, 99000, 1000, 0, false},      // nothing left
+		{100000, 99000, 500, 0, false},       // dust
+		{1000, 0, 2000, 0, false},            // fee above inputs would wrap
+		{100000, 99000, 2000, 0, false},      // fee recalculated above what is left
+		{100000, ^Amount(0), 2, 0, false},    // out plus fee overflows
+		{100000, 0, 100000 - 547, 547, true}, // just above dust
+	}
+	for _, tt := range tests {
+		change, ok := Change(tt.in, tt.out, tt.fee)
+		if change != tt.change || ok != tt.ok {
+			t.Errorf("%d - %d - %d: want %d %v, have %d %v", tt.in, tt.out, tt.fee, tt.change, tt.ok, change, ok)
+		}
+	}
+}
+
+func TestTxFee(t *testing.T) {
+	tests := []struct {
+		utxos []Amount
+		outs  []int64
+		fee   Amount
+	}{
+		{[]Amount{60000, 50000}, []int64{100000, 9000}, 1000},
+		{[]Amount{100000}, []int64{100001}, 0},                 // outputs above the inputs
+		{[]Amount{MAX_SATOSHI, MAX_SATOSHI}, []int64{1000}, 0}, // inputs overflow
+		{[]Amount{100000}, []int64{-1, 100000}, 0},             // a negative output would wrap the total
+	}
+	for _, tt := range tests {
+		utxos := make([]UTXO, 0)
+		for _, a := range tt.utxos {
+			utxos = append(utxos, UTXO{Amount: a})
+		}
+		wtx := wire.NewMsgTx(2)
+		for _, v := range tt.outs {
+			wtx.AddTxOut(wire.NewTxOut(v, nil))
+		}
+		if fee := TxFee(wtx, utxos); fee != tt.fee {
+			t.Errorf("%v - %v: want fee %d, have %d", tt.utxos, tt.outs, tt.fee, fee)
+		}
+	}
+}
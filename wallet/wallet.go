@@ -2,6 +2,7 @@ package wallet
 
 import (
 	"github.com/btcsuite/btcd/wire"
+	"github.com/niftynei/glightning/jrpc2"
 )
 
 const (
@@ -9,13 +10,13 @@ const (
 	WALLET_INTERNAL
 )
 
-const DUST_LIMIT = uint64(546)
+const DUST_LIMIT = Amount(546)
 
 type Wallet interface {
 
 	// Utxos will provide utxos(wire.OutPoint) for the wallet implementation based on the amount
 	// amt is the amount of the transaction used to determine what utxos to use to cover the amount plus fees
-	Utxos(amt uint64, fee uint64) ([]UTXO, error)
+	Utxos(amt Amount, fee Amount) ([]UTXO, error)
 
 	// ChangeAddress provides where to send the change
 	ChangeAddress() string
@@ -27,12 +28,30 @@ type Wallet interface {
 	Sign(tx *Transaction, utxos []UTXO)
 }
 
+// Lightning is the part of lightningd's rpc the wallets use, *glightning.Lightning in the plugin
+type Lightning interface {
+	NewAddr() (string, error)
+	Request(m jrpc2.Method, resp interface{}) error
+}
+
 type UTXO struct {
-	Amount  uint64
+	Amount  Amount
 	Address string
 	wire.OutPoint
 }
 
+// UtxoTotal totals the utxos, failing rather than wrapping around
+func UtxoTotal(utxos []UTXO) (Amount, error) {
+	total := Amount(0)
+	for _, u := range utxos {
+		var err error
+		if total, err = total.Add(u.Amount); err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
 func reverseBytes(b []byte) []byte {
 	newbytes := make([]byte, len(b))
 	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
@@ -40,7 +59,3 @@ func reverseBytes(b []byte) []byte {
 	}
 	return newbytes
 }
-
-func Satoshis(btc float64) uint64 {
-	return uint64(btc * float64(100000000))
-}
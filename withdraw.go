@@ -3,28 +3,44 @@ package main
 import (
 	"bytes"
 	"errors"
-	"log"
+	"fmt"
 
 	"github.com/btcsuite/btcd/wire"
 	"github.com/niftynei/glightning/jrpc2"
+	"github.com/rsbondi/multifund/funder"
+	"github.com/rsbondi/multifund/logger"
 	"github.com/rsbondi/multifund/wallet"
 )
 
 const WithdrawMultiDescription = `Withdraw funds to multiple addresses
-{channels} is an array of object{"id" string, "satoshi" int, "announce" bool}`
+{destinations} is an array of object{"destination" string, "satoshi" int or string as 100000sat, 1000msat or 0.01btc, "label" string, "feerate" string}
+the feerate is used when lightningd funds the withdraw, every destination must have the same or none`
 
 type MultiWithdrawRequest struct {
-	Destination string  `json:"destination"`
-	Satoshi     float64 `json:"satoshi"`
-	FeeRate     string  `json:"feerate,omitempty"`
+	Destination string        `json:"destination"`
+	Satoshi     wallet.Amount `json:"satoshi"`
+	FeeRate     string        `json:"feerate,omitempty"`
+	Label       string        `json:"label,omitempty"`
 }
 
 type MultiWithdraw struct {
 	Targets []MultiWithdrawRequest `json:"destinations"`
 }
 
+type WithdrawResult struct {
+	Tx    string `json:"tx"`
+	Txid  string `json:"txid"`
+	Trace string `json:"trace"` // on every log line of the call
+}
+
 func (m *MultiWithdraw) Call() (jrpc2.Result, error) {
-	return withdrawMulti(&m.Targets)
+	log := logger.NewTrace()
+	result, err := withdrawMulti(&m.Targets, nil, log)
+	if err != nil {
+		log.Warnf("withdraw_multi failed: %s", err.Error())
+		return nil, err
+	}
+	return result, nil
 }
 
 func (f *MultiWithdraw) Name() string {
@@ -35,53 +51,51 @@ func (f *MultiWithdraw) New() interface{} {
 	return &MultiWithdraw{}
 }
 
-func withdrawMulti(targets *[]MultiWithdrawRequest) (jrpc2.Result, error) {
-	var recipients = make([]*wallet.TxRecipient, 0)
-	outamt := uint64(0)
-	rate := fundr.Bitcoin.EstimateSmartFee(100)
-	bytesEstimate := uint64(160 + 70*len(*targets)) // crude size calc
-	feerate := rate.Result.(*wallet.EstimateSmartFeeResult).Feerate / 1000.0
-
-	var fee uint64
-	if feerate == 0.0 {
-		log.Println("unable to estimate fee rate, using default")
-		fee = 2 * bytesEstimate
-	} else {
-		fee = wallet.Satoshis(feerate) * bytesEstimate
+// withdrawMulti pays every target in one transaction, log carries the trace id of the command
+//   sending, if set, is called with the txid before the broadcast and an error stops it
+func withdrawMulti(targets *[]MultiWithdrawRequest, sending func(txid string) error, log *logger.Logger) (*WithdrawResult, error) {
+	log.Infof("withdraw to %d destinations", len(*targets))
+	if err := fundr.PreflightWithdraw(withdrawRecipients(targets)); err != nil {
+		return nil, err
 	}
+	if fundr.UseNative() && fundr.Capabilities.NativeWithdraw() {
+		return nativeWithdrawMulti(targets, sending, log)
+	}
+
+	recipients := withdrawRecipients(targets)
+	satsPerVbyte := fundr.SatsPerVbyte()
+	bytesEstimate := uint64(160 + 70*len(*targets)) // crude size calc
+	fee := wallet.Amount(satsPerVbyte * bytesEstimate)
 
-	recipamt := int64(0)
+	outamt := wallet.Amount(0)
 	for _, c := range *targets {
-		outamt += uint64(c.Satoshi)
+		var err error
+		if outamt, err = outamt.Add(c.Satoshi); err != nil {
+			return nil, err
+		}
 	}
 
 	internal := fundr.InternalWallet()
 	change := internal.ChangeAddress()
-	utxos, err := internal.Utxos(outamt, fee)
-	utxoamt := uint64(0)
-	for _, u := range utxos {
-		utxoamt += u.Amount
+	utxos, _ := internal.Utxos(outamt, fee)
+	utxoamt, err := wallet.UtxoTotal(utxos)
+	if err != nil {
+		return nil, err
 	}
 
-	if outamt > utxoamt+fee {
+	if outamt+fee > utxoamt {
 		return nil, errors.New("Insufficient funds, Need more coin")
 	}
 
-	for _, c := range *targets {
-		amt := int64(c.Satoshi) // difference in wire and glightning
-		recipamt += amt
-		recipients = append(recipients, &wallet.TxRecipient{Address: c.Destination, Amount: amt})
-	}
-
-	if utxoamt-fee > wallet.DUST_LIMIT { // no change if dust, save on tx fee
-		recipients = append(recipients, &wallet.TxRecipient{Address: change, Amount: int64(utxoamt-fee) - recipamt})
+	if amt, ok := wallet.Change(utxoamt, outamt, fee); ok { // no change if dust, save on tx fee
+		recipients = append(recipients, &wallet.TxRecipient{Address: change, Amount: amt})
 		vsize := wallet.InputFeeSats(utxos, fundr.BitcoinNet) + wallet.OutputFeeSats(recipients, fundr.BitcoinNet) + 11
-		if feerate == 0.0 {
-			fee = 2 * vsize
+		fee = wallet.Amount(satsPerVbyte * vsize)
+		if amt, ok = wallet.Change(utxoamt, outamt, fee); ok {
+			recipients[len(recipients)-1].Amount = amt
 		} else {
-			fee = wallet.Satoshis(feerate) * vsize
+			recipients = recipients[:len(recipients)-1] // the larger fee leaves only dust
 		}
-		recipients[len(recipients)-1].Amount = int64(utxoamt-fee) - recipamt
 	}
 	tx, err := wallet.CreateTransaction(recipients, utxos, fundr.BitcoinNet)
 	if err != nil {
@@ -93,17 +107,61 @@ func withdrawMulti(targets *[]MultiWithdrawRequest) (jrpc2.Result, error) {
 	r := bytes.NewReader(tx.Signed)
 	wtx.Deserialize(r)
 	tx.TxId = wtx.TxHash().String()
+	log.Debugf("signed %s spending %d inputs: %s", tx.TxId, len(utxos), tx.String())
 
-	txid, err := fundr.Bitcoin.SendTx(tx.String())
+	if sending != nil {
+		if err := sending(tx.TxId); err != nil {
+			return nil, err
+		}
+	}
+	txid, err := fundr.Broadcast(tx, utxoamt)
 	if err != nil {
 		return nil, err
 	}
+	log.Infof("broadcast %s paying %d destinations, fee %d sat", txid, len(*targets), wallet.TxFee(wtx, utxos))
+	fundr.RecordHistory(funder.HISTORY_WITHDRAW, tx.String(), utxos, nil, nil, withdrawLabels(targets), log)
 
-	return struct {
-		Tx   string `json:"tx"`
-		Txid string `json:"txid"`
-	}{
-		tx.String(),
-		txid,
-	}, nil
+	return &WithdrawResult{tx.String(), txid, log.Trace()}, nil
+}
+
+// withdrawRecipients are the outputs for the destinations, before change
+func withdrawRecipients(targets *[]MultiWithdrawRequest) []*wallet.TxRecipient {
+	recipients := make([]*wallet.TxRecipient, 0)
+	for _, c := range *targets {
+		recipients = append(recipients, &wallet.TxRecipient{Address: c.Destination, Amount: c.Satoshi})
+	}
+	return recipients
+}
+
+func nativeWithdrawMulti(targets *[]MultiWithdrawRequest, sending func(txid string) error, log *logger.Logger) (*WithdrawResult, error) {
+	log.Debugf("withdrawing with fundpsbt")
+	// fundpsbt takes one feerate for the whole transaction
+	feerate := ""
+	for _, c := range *targets {
+		if c.FeeRate == "" {
+			continue
+		}
+		if feerate != "" && c.FeeRate != feerate {
+			return nil, fmt.Errorf("destinations have different feerates %s and %s, one transaction has one feerate", feerate, c.FeeRate)
+		}
+		feerate = c.FeeRate
+	}
+	result, err := fundr.NativeWithdraw(withdrawRecipients(targets), feerate, sending, log)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("broadcast %s paying %d destinations", result.Txid, len(*targets))
+	fundr.RecordHistory(funder.HISTORY_WITHDRAW, result.Tx, nil, nil, nil, withdrawLabels(targets), log)
+	return &WithdrawResult{result.Tx, result.Txid, log.Trace()}, nil
+}
+
+// withdrawLabels are the destination labels by address
+func withdrawLabels(targets *[]MultiWithdrawRequest) map[string]string {
+	labels := make(map[string]string)
+	for _, t := range *targets {
+		if t.Label != "" {
+			labels[t.Destination] = t.Label
+		}
+	}
+	return labels
 }
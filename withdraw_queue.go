@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/niftynei/glightning/jrpc2"
+	"github.com/rsbondi/multifund/funder"
+	"github.com/rsbondi/multifund/logger"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+const WithdrawQueueDescription = `Queue a withdraw to be sent in a batch with other queued withdraws
+{destination} is the address, {satoshi} the amount and {label} an optional label
+the queue is sent with withdraw_multi when multi-queue-size requests are queued, the oldest request is
+multi-queue-interval old or the fee rate is at or below multi-queue-feerate`
+
+// held while the queue is being sent so requests are not removed mid batch
+var queueMu sync.Mutex
+
+var queuePolicy = &funder.QueuePolicy{}
+
+type WithdrawQueue struct {
+	Destination string        `json:"destination"`
+	Amount      wallet.Amount `json:"satoshi"`
+	Label       string        `json:"label,omitempty"`
+}
+
+func (m *WithdrawQueue) Call() (jrpc2.Result, error) {
+	addr, err := btcutil.DecodeAddress(m.Destination, fundr.BitcoinNet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination %s: %s", m.Destination, err.Error())
+	}
+	if !addr.IsForNet(fundr.BitcoinNet) {
+		return nil, fmt.Errorf("%s is not a %s address", m.Destination, fundr.BitcoinNet.Name)
+	}
+	if m.Amount <= wallet.DUST_LIMIT {
+		return nil, fmt.Errorf("amount must be above %d satoshi", wallet.DUST_LIMIT)
+	}
+	queue, err := fundr.WithdrawQueue()
+	if err != nil {
+		return nil, err
+	}
+	return queue.Add(m.Destination, m.Amount, m.Label)
+}
+
+func (m *WithdrawQueue) Name() string {
+	return "withdraw_queue"
+}
+
+func (m *WithdrawQueue) New() interface{} {
+	return &WithdrawQueue{}
+}
+
+type WithdrawQueueList struct {
+	Status string `json:"status,omitempty"`
+}
+
+func (m *WithdrawQueueList) Call() (jrpc2.Result, error) {
+	queue, err := fundr.WithdrawQueue()
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		Withdraws []*funder.QueuedWithdraw `json:"withdraws"`
+	}{queue.List(m.Status)}, nil
+}
+
+func (m *WithdrawQueueList) Name() string {
+	return "withdraw_queue_list"
+}
+
+func (m *WithdrawQueueList) New() interface{} {
+	return &WithdrawQueueList{}
+}
+
+type WithdrawQueueRemove struct {
+	Id string `json:"id"`
+}
+
+func (m *WithdrawQueueRemove) Call() (jrpc2.Result, error) {
+	queue, err := fundr.WithdrawQueue()
+	if err != nil {
+		return nil, err
+	}
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	if err := queue.Remove(m.Id); err != nil {
+		return nil, err
+	}
+	return struct {
+		Removed string `json:"removed"`
+	}{m.Id}, nil
+}
+
+func (m *WithdrawQueueRemove) Name() string {
+	return "withdraw_queue_remove"
+}
+
+func (m *WithdrawQueueRemove) New() interface{} {
+	return &WithdrawQueueRemove{}
+}
+
+// runWithdrawQueue checks the queue every interval and sends it when the policy is met
+func runWithdrawQueue(interval time.Duration) {
+	for range time.Tick(interval) {
+		flushWithdrawQueue()
+	}
+}
+
+func flushWithdrawQueue() {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	queue, err := fundr.WithdrawQueue()
+	if err != nil {
+		logger.Errorf("unable to load withdraw queue: %s", err.Error())
+		return
+	}
+	if !resolveSending(queue) {
+		return
+	}
+	pending := queue.List(funder.QUEUE_QUEUED)
+	if len(pending) == 0 {
+		return
+	}
+	rate, err := fundr.EstimateSatsPerVbyte()
+	if err != nil {
+		logger.Debugf("no fee estimate for the withdraw queue: %s", err.Error())
+	}
+	if !queuePolicy.Ready(pending, rate, time.Now()) {
+		return
+	}
+
+	targets := make([]MultiWithdrawRequest, 0)
+	ids := make([]string, 0)
+	for _, w := range pending {
+		targets = append(targets, MultiWithdrawRequest{Destination: w.Destination, Satoshi: w.Amount, Label: w.Label})
+		ids = append(ids, w.Id)
+	}
+
+	log := logger.NewTrace()
+	// a request failing its own checks fails alone, the rest stay queued for the next check
+	if failed := failedRequests(fundr.PreflightWithdraw(withdrawRecipients(&targets)), ids); len(failed) > 0 {
+		for id, err := range failed {
+			log.Warnf("queued withdraw %s failed: %s", id, err.Error())
+			if err := queue.Complete([]string{id}, "", err); err != nil {
+				log.Errorf("unable to update withdraw queue: %s", err.Error())
+			}
+		}
+		return
+	}
+
+	txid := ""
+	result, err := withdrawMulti(&targets, func(txid string) error {
+		return queue.Sending(ids, txid)
+	}, log)
+	if err != nil {
+		log.Warnf("queued withdraw of %d requests failed: %s", len(ids), err.Error())
+	} else {
+		txid = result.Txid
+		log.Infof("sent %d queued withdraws in %s", len(ids), txid)
+	}
+	if err := queue.Complete(ids, txid, err); err != nil {
+		log.Errorf("unable to update withdraw queue: %s", err.Error())
+	}
+}
+
+// failedRequests maps the requests with their own pre-flight problems to the error, problems of the
+//   whole batch such as the balance are left for withdrawMulti to fail every request with
+func failedRequests(err error, ids []string) map[string]error {
+	failed := make(map[string]error)
+	pe, ok := err.(*funder.PreflightError)
+	if !ok {
+		return failed
+	}
+	for _, p := range pe.Problems {
+		if p.Index >= 0 && p.Index < len(ids) {
+			failed[ids[p.Index]] = errors.New(p.Message)
+		}
+	}
+	return failed
+}
+
+// resolveSending looks up the transaction of requests left sending by a restart, found on chain
+//   they are sent, otherwise the broadcast never happened and they are queued again
+//   false while any can not be resolved, nothing more is sent until they are
+func resolveSending(queue *funder.WithdrawQueue) bool {
+	byTxid := make(map[string][]string)
+	for _, w := range queue.List(funder.QUEUE_SENDING) {
+		byTxid[w.Txid] = append(byTxid[w.Txid], w.Id)
+	}
+	resolved := true
+	for txid, ids := range byTxid {
+		status, err := fundr.Chain.TxStatus(txid)
+		if err != nil {
+			logger.Warnf("unable to get status of queued withdraw %s: %s", txid, err.Error())
+			resolved = false
+			continue
+		}
+		if status.Found {
+			logger.Infof("queued withdraws %v were sent in %s", ids, txid)
+			err = queue.Complete(ids, txid, nil)
+		} else {
+			logger.Warnf("queued withdraw %s was not broadcast, queueing %v again", txid, ids)
+			err = queue.Requeue(ids)
+		}
+		if err != nil {
+			logger.Errorf("unable to update withdraw queue: %s", err.Error())
+			resolved = false
+		}
+	}
+	return resolved
+}
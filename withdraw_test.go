@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/rsbondi/multifund/funder"
+	"github.com/rsbondi/multifund/wallet"
+)
+
+// withdrawRequest reads the destinations as lightningd passes them
+func withdrawRequest(t *testing.T, destinations string) *MultiWithdraw {
+	m := &MultiWithdraw{}
+	if err := json.Unmarshal([]byte(`{"destinations": `+destinations+`}`), m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestWithdrawMulti(t *testing.T) {
+	_, b := setup(t, []wallet.Amount{1000000})
+	req := withdrawRequest(t, fmt.Sprintf(`[{"destination": %q, "satoshi": "0.001btc", "label": "rent"}, {"destination": %q, "satoshi": 250000}]`,
+		fundingAddress("a"), fundingAddress("b")))
+
+	result, err := req.Call()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.broadcast) != 1 {
+		t.Fatalf("want 1 transaction broadcast, have %d", len(b.broadcast))
+	}
+	wtx := decodeHex(t, b.broadcast[0])
+	if txid := result.(*WithdrawResult).Txid; txid != wtx.TxHash().String() {
+		t.Errorf("want txid %s, have %s", wtx.TxHash(), txid)
+	}
+	if !pays(wtx, fundingAddress("a"), 100000) || !pays(wtx, fundingAddress("b"), 250000) {
+		t.Error("destinations should be paid")
+	}
+	if len(wtx.TxOut) != 3 || wtx.TxOut[2].Value < 600000 {
+		t.Errorf("want change back to the wallet, have %d outputs", len(wtx.TxOut))
+	}
+
+	history, _ := fundr.History().List(&funder.HistoryFilter{})
+	if len(history) != 1 || history[0].Type != funder.HISTORY_WITHDRAW || history[0].Outputs[0].Label != "rent" {
+		t.Errorf("want a labelled withdraw history entry, have %+v", history)
+	}
+}
+
+func TestWithdrawMultiFailure(t *testing.T) {
+	tests := []struct {
+		name         string
+		destinations string
+		prepare      func(b *fakeBitcoind)
+		want         string
+	}{
+		{"address", `[{"destination": "bcrt1qnotanaddress", "satoshi": 100000}]`, nil, "not a regtest address"},
+		{"dust", fmt.Sprintf(`[{"destination": %q, "satoshi": "500sat"}]`, fundingAddress("a")), nil, "dust limit"},
+		{"balance", fmt.Sprintf(`[{"destination": %q, "satoshi": "0.02btc"}]`, fundingAddress("a")), nil, "spendable"},
+		{"fee limit", fmt.Sprintf(`[{"destination": %q, "satoshi": 100000}]`, fundingAddress("a")), func(b *fakeBitcoind) {
+			fundr.Limits = &funder.BroadcastLimits{MaxFee: 100}
+		}, "above the limit of 100"},
+		{"broadcast", fmt.Sprintf(`[{"destination": %q, "satoshi": 100000}]`, fundingAddress("a")), func(b *fakeBitcoind) {
+			b.fail = errors.New("bitcoind unavailable")
+		}, "bitcoind unavailable"},
+	}
+	for _, tt := range tests {
+		_, b := setup(t, []wallet.Amount{1000000})
+		if tt.prepare != nil {
+			tt.prepare(b)
+		}
+		_, err := withdrawRequest(t, tt.destinations).Call()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: want error with %q, have %v", tt.name, tt.want, err)
+		}
+		if len(b.broadcast) > 0 {
+			t.Errorf("%s: nothing should be broadcast", tt.name)
+		}
+	}
+}
+
+func TestNativeWithdraw(t *testing.T) {
+	l, b := setupNative(t, []wallet.Amount{1000000})
+	req := withdrawRequest(t, fmt.Sprintf(`[{"destination": %q, "satoshi": 100000, "feerate": "slow"}]`, fundingAddress("a")))
+
+	result, err := req.Call()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.broadcast) != 1 {
+		t.Fatalf("want the signed transaction sent by the broadcaster, have %d", len(b.broadcast))
+	}
+	wtx := decodeHex(t, b.broadcast[0])
+	if txid := result.(*WithdrawResult).Txid; txid != wtx.TxHash().String() {
+		t.Errorf("want txid %s, have %s", wtx.TxHash(), txid)
+	}
+	if !pays(wtx, fundingAddress("a"), 100000) || !pays(wtx, fundingAddress("newaddr"), 1000000-100000-fee(t, wtx, 1000000)) {
+		t.Error("want the destination paid and the excess back to lightningd's wallet")
+	}
+	if l.unreserved > 0 {
+		t.Error("inputs of a sent transaction should stay reserved")
+	}
+
+	// lightningd can not take the transaction back, the inputs are released when it is not sent
+	l, b = setupNative(t, []wallet.Amount{1000000})
+	b.fail = errors.New("bitcoind unavailable")
+	if _, err := req.Call(); err == nil || l.reserved || l.unreserved != 1 {
+		t.Errorf("want an error and the inputs unreserved, have %v", err)
+	}
+
+	// fundpsbt takes one feerate, mixed ones are not silently dropped
+	l, b = setupNative(t, []wallet.Amount{1000000})
+	mixed := withdrawRequest(t, fmt.Sprintf(`[{"destination": %q, "satoshi": 100000, "feerate": "slow"}, {"destination": %q, "satoshi": 100000, "feerate": "urgent"}]`,
+		fundingAddress("a"), fundingAddress("b")))
+	if _, err := mixed.Call(); err == nil || !strings.Contains(err.Error(), "different feerates") || l.reserved {
+		t.Errorf("want mixed feerates rejected before funding, have %v", err)
+	}
+	nothingSent(t, "mixed feerates", b)
+}
+
+// TestNativeWithdrawGuard checks a transaction lightningd funds and signs is held to the limits
+func TestNativeWithdrawGuard(t *testing.T) {
+	l, b := setupNative(t, []wallet.Amount{1000000})
+	fundr.Limits = &funder.BroadcastLimits{MaxFee: 100}
+	req := withdrawRequest(t, fmt.Sprintf(`[{"destination": %q, "satoshi": 100000}]`, fundingAddress("a")))
+
+	_, err := req.Call()
+	if err == nil || !strings.Contains(err.Error(), "above the limit of 100") {
+		t.Errorf("want the fee limit to reject the withdraw, have %v", err)
+	}
+	if len(b.broadcast) > 0 || l.unreserved != 1 {
+		t.Errorf("nothing should be broadcast and the inputs unreserved, have %d broadcast", len(b.broadcast))
+	}
+}
+
+// fee is what the transaction leaves of in
+func fee(t *testing.T, wtx *wire.MsgTx, in wallet.Amount) wallet.Amount {
+	out := int64(0)
+	for _, o := range wtx.TxOut {
+		out += o.Value
+	}
+	return in - wallet.Amount(out)
+}
+
+// TestFlushWithdrawQueue checks a request failing its own checks fails alone and the rest are sent
+//   with their txid recorded before the broadcast
+func TestFlushWithdrawQueue(t *testing.T) {
+	_, b := setup(t, []wallet.Amount{1000000})
+	saved := queuePolicy
+	queuePolicy = &funder.QueuePolicy{Size: 1}
+	defer func() { queuePolicy = saved }()
+
+	queue, err := fundr.WithdrawQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	good1, _ := queue.Add(fundingAddress("a"), 100000, "")
+	bad, _ := queue.Add("bcrt1qnotanaddress", 100000, "") // queued before withdraw_queue checked addresses
+	good2, _ := queue.Add(fundingAddress("b"), 200000, "")
+
+	flushWithdrawQueue()
+	if len(b.broadcast) != 0 {
+		t.Fatal("nothing should be sent with a bad request")
+	}
+	if failed := queue.List(funder.QUEUE_FAILED); len(failed) != 1 || failed[0].Id != bad.Id {
+		t.Errorf("want only the bad request failed, have %+v", failed)
+	}
+	if queued := queue.List(funder.QUEUE_QUEUED); len(queued) != 2 {
+		t.Errorf("want the others still queued, have %+v", queued)
+	}
+
+	flushWithdrawQueue()
+	if len(b.broadcast) != 1 {
+		t.Fatalf("want the good requests sent, have %d broadcast", len(b.broadcast))
+	}
+	txid := decodeHex(t, b.broadcast[0]).TxHash().String()
+	for _, w := range queue.List(funder.QUEUE_SENT) {
+		if w.Txid != txid || (w.Id != good1.Id && w.Id != good2.Id) {
+			t.Errorf("unexpected sent %+v", w)
+		}
+	}
+	if len(queue.List(funder.QUEUE_SENT)) != 2 {
+		t.Errorf("want 2 sent, have %+v", queue.List(""))
+	}
+}
+
+// TestResolveSending checks requests left sending by a restart are looked up on chain, sent if found
+//   and queued again if the transaction never got out
+func TestResolveSending(t *testing.T) {
+	_, b := setup(t, []wallet.Amount{1000000})
+	queue, err := fundr.WithdrawQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent, _ := queue.Add(fundingAddress("a"), 100000, "")
+	lost, _ := queue.Add(fundingAddress("b"), 100000, "")
+
+	wtx := wire.NewMsgTx(2)
+	wtx.AddTxIn(wire.NewTxIn(&b.utxos[0].OutPoint, nil, nil))
+	wtx.AddTxOut(wire.NewTxOut(100000, b.script()))
+	b.broadcast = append(b.broadcast, rawTx(wtx))
+	queue.Sending([]string{sent.Id}, wtx.TxHash().String())
+	queue.Sending([]string{lost.Id}, "00"+wtx.TxHash().String()[2:])
+
+	if !resolveSending(queue) {
+		t.Fatal("want every request resolved")
+	}
+	if s := queue.List(funder.QUEUE_SENT); len(s) != 1 || s[0].Id != sent.Id || s[0].Txid != wtx.TxHash().String() {
+		t.Errorf("want the request found on chain sent, have %+v", s)
+	}
+	if q := queue.List(funder.QUEUE_QUEUED); len(q) != 1 || q[0].Id != lost.Id || q[0].Txid != "" {
+		t.Errorf("want the request never broadcast queued again, have %+v", q)
+	}
+}
+
+func TestWithdrawQueueAddress(t *testing.T) {
+	setup(t, []wallet.Amount{1000000})
+	req := &WithdrawQueue{Destination: "1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2", Amount: 100000}
+	if _, err := req.Call(); err == nil {
+		t.Errorf("want a mainnet address rejected, have %v", err)
+	}
+	queue, _ := fundr.WithdrawQueue()
+	if len(queue.List("")) != 0 {
+		t.Error("nothing should be queued")
+	}
+}